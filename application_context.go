@@ -18,30 +18,51 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
 type Config struct {
-	ServerAddress string `json:"server_address" binding:"required,ip|cidr" bson:"server_address"`
-	FlagRegex     string `json:"flag_regex" binding:"required,min=8" bson:"flag_regex"`
-	AuthRequired  bool   `json:"auth_required" bson:"auth_required"`
+	ServerAddress string    `json:"server_address" binding:"required,ip|cidr" bson:"server_address"`
+	FlagRegex     string    `json:"flag_regex" binding:"required,min=8" bson:"flag_regex"`
+	AuthRequired  bool      `json:"auth_required" bson:"auth_required"`
+	GameStart     time.Time `json:"game_start" bson:"game_start,omitempty"`
+	TickDuration  uint      `json:"tick_duration" binding:"required_with=GameStart" bson:"tick_duration,omitempty"`
+	// the additional networks of vulnboxes, the ServerAddress network is always a server network
+	ServerNetworks []ServerNetwork `json:"server_networks" binding:"dive" bson:"server_networks,omitempty"`
+	Retention      RetentionPolicy `json:"retention" bson:"retention"`
 }
 
 type ApplicationContext struct {
 	Storage                     Storage
-	Config                      Config
-	Accounts                    gin.Accounts
+	config                      Config
+	AuthController              *AuthController
+	AuditController             *AuditController
 	RulesManager                RulesManager
 	PcapImporter                *PcapImporter
 	ConnectionsController       ConnectionsController
 	ServicesController          *ServicesController
+	TeamsController             *TeamsController
+	TagsController              *TagsController
+	CommentsController          *CommentsController
 	ConnectionStreamsController ConnectionStreamsController
 	SearchController            *SearchController
-	StatisticsController        StatisticsController
+	statisticsController        StatisticsController
+	TLSKeysController           *TLSKeysController
+	DNSController               *DNSController
+	FilesController             *FilesController
+	ReplayController            *ReplayController
+	ClustersController          *ClustersController
+	RetentionController         *RetentionController
 	NotificationController      *NotificationController
 	IsConfigured                bool
 	Version                     string
+	mConfig                     sync.RWMutex // the config is read by the requests while it is updated
+	mUpdate                     sync.Mutex   // the config updates are applied one at a time
 }
 
 func CreateApplicationContext(storage Storage, version string) (*ApplicationContext, error) {
@@ -52,22 +73,16 @@ func CreateApplicationContext(storage Storage, version string) (*ApplicationCont
 		First(&configWrapper); err != nil {
 		return nil, err
 	}
-	var accountsWrapper struct {
-		Accounts gin.Accounts
-	}
-
-	if err := storage.Find(Settings).Filter(OrderedDocument{{"_id", "accounts"}}).
-		First(&accountsWrapper); err != nil {
+	authController, err := NewAuthController(storage)
+	if err != nil {
 		return nil, err
 	}
-	if accountsWrapper.Accounts == nil {
-		accountsWrapper.Accounts = make(gin.Accounts)
-	}
 
 	applicationContext := &ApplicationContext{
 		Storage:                storage,
-		Config:                 configWrapper.Config,
-		Accounts:               accountsWrapper.Accounts,
+		config:                 configWrapper.Config,
+		AuthController:         authController,
+		AuditController:        NewAuditController(storage),
 		Version:                version,
 	}
 
@@ -75,8 +90,60 @@ func CreateApplicationContext(storage Storage, version string) (*ApplicationCont
 }
 
 func (sm *ApplicationContext) SetConfig(config Config) {
-	sm.Config = config
+	sm.mUpdate.Lock()
+	defer sm.mUpdate.Unlock()
+
+	sm.mConfig.Lock()
+	sm.config = config
+	sm.mConfig.Unlock()
 	sm.Configure()
+	sm.saveConfig(config)
+}
+
+// UpdateConfig applies a new config to an already configured application, without restarting the services and
+// without interrupting the imports in progress
+func (sm *ApplicationContext) UpdateConfig(config Config) error {
+	sm.mUpdate.Lock()
+	defer sm.mUpdate.Unlock()
+
+	serverNetworks := NewServerNetworks(config)
+	if serverNetworks == nil {
+		return errors.New("invalid server networks")
+	}
+	if config.FlagRegex != sm.GetConfig().FlagRegex {
+		if err := sm.RulesManager.SetFlag(context.Background(), config.FlagRegex); err != nil {
+			return err
+		}
+		sm.ClustersController.SetIgnorePatterns(flagPatterns(config.FlagRegex))
+	}
+
+	gameClock := NewGameClock(config)
+	sm.PcapImporter.UpdateSettings(serverNetworks, gameClock)
+	sm.RetentionController.SetPolicy(config.Retention)
+	sm.mConfig.Lock()
+	sm.statisticsController = NewStatisticsController(sm.Storage, gameClock)
+	sm.config = config
+	sm.mConfig.Unlock()
+	sm.saveConfig(config)
+
+	return nil
+}
+
+func (sm *ApplicationContext) GetConfig() Config {
+	sm.mConfig.RLock()
+	defer sm.mConfig.RUnlock()
+	return sm.config
+}
+
+// GetStatisticsController returns a copy of the statistics controller of the current game clock
+func (sm *ApplicationContext) GetStatisticsController() *StatisticsController {
+	sm.mConfig.RLock()
+	statisticsController := sm.statisticsController
+	sm.mConfig.RUnlock()
+	return &statisticsController
+}
+
+func (sm *ApplicationContext) saveConfig(config Config) {
 	var upsertResults interface{}
 	if _, err := sm.Storage.Update(Settings).Upsert(&upsertResults).
 		Filter(OrderedDocument{{"_id", "config"}}).One(UnorderedDocument{"config": config}); err != nil {
@@ -85,11 +152,8 @@ func (sm *ApplicationContext) SetConfig(config Config) {
 }
 
 func (sm *ApplicationContext) SetAccounts(accounts gin.Accounts) {
-	sm.Accounts = accounts
-	var upsertResults interface{}
-	if _, err := sm.Storage.Update(Settings).Upsert(&upsertResults).
-		Filter(OrderedDocument{{"_id", "accounts"}}).One(UnorderedDocument{"accounts": accounts}); err != nil {
-		log.WithError(err).Error("failed to update accounts")
+	if err := sm.AuthController.SetAccounts(accounts); err != nil {
+		log.WithError(err).Error("failed to set accounts")
 	}
 }
 
@@ -101,24 +165,39 @@ func (sm *ApplicationContext) Configure() {
 	if sm.IsConfigured {
 		return
 	}
-	if sm.Config.ServerAddress == "" || sm.Config.FlagRegex == "" {
+	config := sm.GetConfig()
+	if config.ServerAddress == "" || config.FlagRegex == "" {
 		return
 	}
-	serverNet := ParseIPNet(sm.Config.ServerAddress)
-	if serverNet == nil {
+	serverNetworks := NewServerNetworks(config)
+	if serverNetworks == nil {
 		return
 	}
 
-	rulesManager, err := LoadRulesManager(sm.Storage, sm.Config.FlagRegex)
+	rulesManager, err := LoadRulesManager(sm.Storage, config.FlagRegex)
 	if err != nil {
 		log.WithError(err).Panic("failed to create a RulesManager")
 	}
 	sm.RulesManager = rulesManager
-	sm.PcapImporter = NewPcapImporter(sm.Storage, *serverNet, sm.RulesManager, sm.NotificationController)
+	sm.TLSKeysController = NewTLSKeysController(sm.Storage)
+	sm.DNSController = NewDNSController(sm.Storage)
+	sm.TeamsController = NewTeamsController(sm.Storage)
+	sm.ConnectionStreamsController = NewConnectionStreamsController(sm.Storage)
+	sm.ClustersController = NewClustersController(sm.Storage, sm.ConnectionStreamsController,
+		sm.NotificationController, flagPatterns(config.FlagRegex))
+	sm.PcapImporter = NewPcapImporter(sm.Storage, serverNetworks, sm.RulesManager, sm.TLSKeysController,
+		sm.TeamsController, sm.DNSController, sm.ClustersController, NewGameClock(config), sm.NotificationController)
 	sm.ServicesController = NewServicesController(sm.Storage)
 	sm.SearchController = NewSearchController(sm.Storage)
-	sm.ConnectionsController = NewConnectionsController(sm.Storage, sm.SearchController, sm.ServicesController)
-	sm.ConnectionStreamsController = NewConnectionStreamsController(sm.Storage)
-	sm.StatisticsController = NewStatisticsController(sm.Storage)
+	sm.TagsController = NewTagsController(sm.Storage)
+	sm.CommentsController = NewCommentsController(sm.Storage)
+	sm.ConnectionsController = NewConnectionsController(sm.Storage, sm.SearchController, sm.ServicesController,
+		sm.DNSController, sm.TeamsController, sm.TagsController, sm.CommentsController)
+	sm.mConfig.Lock()
+	sm.statisticsController = NewStatisticsController(sm.Storage, NewGameClock(config))
+	sm.mConfig.Unlock()
+	sm.FilesController = NewFilesController(sm.Storage)
+	sm.ReplayController = NewReplayController(sm.Storage, sm.ConnectionStreamsController)
+	sm.RetentionController = NewRetentionController(sm.Storage, sm.NotificationController, config.Retention)
 	sm.IsConfigured = true
 }
@@ -30,8 +30,8 @@ func TestCreateApplicationContext(t *testing.T) {
 	appContext, err := CreateApplicationContext(wrapper.Storage, "test")
 	assert.NoError(t, err)
 	assert.False(t, appContext.IsConfigured)
-	assert.Zero(t, appContext.Config)
-	assert.Len(t, appContext.Accounts, 0)
+	assert.Zero(t, appContext.GetConfig())
+	assert.False(t, appContext.AuthController.CheckPassword("username", "password"))
 	assert.Nil(t, appContext.PcapImporter)
 	assert.Nil(t, appContext.RulesManager)
 
@@ -49,8 +49,8 @@ func TestCreateApplicationContext(t *testing.T) {
 	}
 	appContext.SetConfig(config)
 	appContext.SetAccounts(accounts)
-	assert.Equal(t, appContext.Config, config)
-	assert.Equal(t, appContext.Accounts, accounts)
+	assert.Equal(t, appContext.GetConfig(), config)
+	assert.True(t, appContext.AuthController.CheckPassword("username", "password"))
 	assert.NotNil(t, appContext.PcapImporter)
 	assert.NotNil(t, appContext.RulesManager)
 	assert.True(t, appContext.IsConfigured)
@@ -65,8 +65,9 @@ func TestCreateApplicationContext(t *testing.T) {
 	checkAppContext.SetNotificationController(notificationController)
 	checkAppContext.Configure()
 	assert.True(t, checkAppContext.IsConfigured)
-	assert.Equal(t, checkAppContext.Config, config)
-	assert.Equal(t, checkAppContext.Accounts, accounts)
+	assert.Equal(t, checkAppContext.GetConfig(), config)
+	assert.False(t, checkAppContext.AuthController.CheckPassword("username", "password"))
+	assert.True(t, checkAppContext.AuthController.CheckPassword("username", "password2"))
 	assert.NotNil(t, checkAppContext.PcapImporter)
 	assert.NotNil(t, checkAppContext.RulesManager)
 	assert.Equal(t, notificationController, appContext.NotificationController)
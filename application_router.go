@@ -18,8 +18,11 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -31,6 +34,23 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const authRoleKey = "role"
+
+// routeRoles are the roles required by the routes which don't follow the rules of RoleRequiredMiddleware
+var routeRoles = map[string]string{
+	"GET /api/auth/keys":                RoleAdmin,
+	"GET /api/users":                    RoleAdmin,
+	"POST /api/auth/logout":             RoleViewer,
+	"POST /api/connections-bulk":        RoleAnalyst,
+	"POST /api/connections/:id/:action": RoleAnalyst,
+	"POST /api/rules":                   RoleAnalyst,
+	"PUT /api/rules/:id":                RoleAnalyst,
+	"POST /api/searches/perform":        RoleAnalyst,
+	"PUT /api/comments/:id":             RoleAnalyst,
+	"POST /api/tags/connections":        RoleAnalyst,
+	"PUT /api/tags":                     RoleAnalyst,
+}
+
 func CreateApplicationRouter(applicationContext *ApplicationContext,
 	notificationController *NotificationController, resourcesController *ResourcesController) *gin.Engine {
 	router := gin.New()
@@ -69,16 +89,202 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 		notificationController.Notify("setup", gin.H{})
 	})
 
-	router.GET("/ws", func(c *gin.Context) {
+	router.POST("/api/auth/login", SetupRequiredMiddleware(applicationContext), func(c *gin.Context) {
+		var credentials struct {
+			Username string `json:"username" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&credentials); err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		token, expiresAt, err := applicationContext.AuthController.Login(c, credentials.Username, credentials.Password)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, UnorderedDocument{"result": "error", "error": err.Error()})
+			return
+		}
+		success(c, gin.H{"token": token, "expires_at": expiresAt})
+	})
+
+	router.GET("/ws", AuthRequiredMiddleware(applicationContext), func(c *gin.Context) {
 		if err := notificationController.NotificationHandler(c.Writer, c.Request); err != nil {
 			serverError(c, err)
 		}
 	})
 
+	// audit saves who performed an action, with the values of the target before and after the action
+	audit := func(c *gin.Context, action, targetID string, before, after interface{}) {
+		if record, err := applicationContext.AuditController.Record(c, c.GetString(gin.AuthUserKey), action, targetID,
+			before, after); err == nil {
+			notificationController.Notify("audit.new", record)
+		}
+	}
+
 	api := router.Group("/api")
 	api.Use(SetupRequiredMiddleware(applicationContext))
 	api.Use(AuthRequiredMiddleware(applicationContext))
+	api.Use(RoleRequiredMiddleware())
 	{
+		api.POST("/auth/logout", func(c *gin.Context) {
+			token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+			if applicationContext.AuthController.Logout(c, token) {
+				success(c, gin.H{})
+			} else {
+				notFound(c, gin.H{})
+			}
+		})
+
+		api.GET("/auth/keys", func(c *gin.Context) {
+			success(c, applicationContext.AuthController.GetAPIKeys(c))
+		})
+
+		api.POST("/auth/keys", func(c *gin.Context) {
+			var apiKey APIKey
+			if err := c.ShouldBindJSON(&apiKey); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			apiKey, key, err := applicationContext.AuthController.CreateAPIKey(c, apiKey.Name, apiKey.Role)
+			if err != nil {
+				unprocessableEntity(c, err)
+				return
+			}
+			// the key can't be retrieved later
+			success(c, gin.H{"api_key": apiKey, "key": key})
+			audit(c, "auth.keys.new", apiKey.ID.Hex(), nil, apiKey)
+		})
+
+		api.DELETE("/auth/keys/:id", func(c *gin.Context) {
+			if id, err := RowIDFromHex(c.Param("id")); err != nil {
+				badRequest(c, err)
+			} else if applicationContext.AuthController.DeleteAPIKey(c, id) {
+				success(c, gin.H{"id": id})
+				audit(c, "auth.keys.delete", id.Hex(), nil, nil)
+			} else {
+				notFound(c, gin.H{"id": id})
+			}
+		})
+
+		api.GET("/users", func(c *gin.Context) {
+			success(c, applicationContext.AuthController.GetUsers())
+		})
+
+		api.POST("/users", func(c *gin.Context) {
+			var request struct {
+				Username string `json:"username" binding:"required,min=3"`
+				Password string `json:"password" binding:"required,min=8"`
+				Role     string `json:"role" binding:"required,oneof=viewer analyst admin"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if user, err := applicationContext.AuthController.AddUser(c, request.Username, request.Password,
+				request.Role); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, user)
+				notificationController.Notify("users.edit", user)
+				audit(c, "users.new", user.Username, nil, user)
+			}
+		})
+
+		api.PUT("/users/:username", func(c *gin.Context) {
+			var request struct {
+				Password string `json:"password" binding:"omitempty,min=8"`
+				Role     string `json:"role" binding:"omitempty,oneof=viewer analyst admin"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			username := c.Param("username")
+			before, _ := applicationContext.AuthController.GetUser(username)
+			if user, isPresent, err := applicationContext.AuthController.UpdateUser(c, username, request.Password,
+				request.Role); !isPresent {
+				notFound(c, gin.H{"username": username})
+			} else if err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				success(c, user)
+				notificationController.Notify("users.edit", user)
+				audit(c, "users.edit", username, before, user)
+			}
+		})
+
+		api.DELETE("/users/:username", func(c *gin.Context) {
+			username := c.Param("username")
+			before, _ := applicationContext.AuthController.GetUser(username)
+			if isPresent, err := applicationContext.AuthController.DeleteUser(c, username); !isPresent {
+				notFound(c, gin.H{"username": username})
+			} else if err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				response := gin.H{"username": username}
+				success(c, response)
+				notificationController.Notify("users.delete", response)
+				audit(c, "users.delete", username, before, nil)
+			}
+		})
+
+		api.GET("/settings", func(c *gin.Context) {
+			success(c, applicationContext.GetConfig())
+		})
+
+		api.PUT("/settings", func(c *gin.Context) {
+			var config Config
+			if err := c.ShouldBindJSON(&config); err != nil {
+				badRequest(c, err)
+				return
+			}
+			before := applicationContext.GetConfig()
+			if err := applicationContext.UpdateConfig(config); err != nil {
+				unprocessableEntity(c, err)
+				return
+			}
+
+			success(c, config)
+			notificationController.Notify("settings.edit", config)
+			audit(c, "settings.edit", "config", before, config)
+		})
+
+		api.GET("/retention/jobs", func(c *gin.Context) {
+			success(c, applicationContext.RetentionController.GetJobs())
+		})
+
+		api.GET("/retention/jobs/:id", func(c *gin.Context) {
+			jobID := c.Param("id")
+			if job, isPresent := applicationContext.RetentionController.GetJob(jobID); isPresent {
+				success(c, job)
+			} else {
+				notFound(c, gin.H{"job": jobID})
+			}
+		})
+
+		api.POST("/retention/jobs", func(c *gin.Context) {
+			job, err := applicationContext.RetentionController.ApplyPolicy()
+			if err != nil {
+				unprocessableEntity(c, err)
+				return
+			}
+			c.JSON(http.StatusAccepted, job)
+			audit(c, "retention.apply", job.ID, nil, applicationContext.GetConfig().Retention)
+		})
+
+		api.GET("/audit", func(c *gin.Context) {
+			var filter AuditFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, applicationContext.AuditController.GetAuditRecords(c, filter))
+		})
+
 		api.GET("/rules", func(c *gin.Context) {
 			success(c, applicationContext.RulesManager.GetRules())
 		})
@@ -97,6 +303,8 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				response := UnorderedDocument{"id": id}
 				success(c, response)
 				notificationController.Notify("rules.new", response)
+				rule.ID = id
+				audit(c, "rules.new", id.Hex(), nil, rule)
 			}
 		})
 
@@ -128,6 +336,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				return
 			}
 
+			before, _ := applicationContext.RulesManager.GetRule(id)
 			isPresent, err := applicationContext.RulesManager.UpdateRule(c, id, rule)
 			if err != nil {
 				badRequest(c, err)
@@ -136,6 +345,8 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			} else {
 				success(c, rule)
 				notificationController.Notify("rules.edit", rule)
+				rule.ID = id
+				audit(c, "rules.edit", id.Hex(), before, rule)
 			}
 		})
 
@@ -158,6 +369,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				response := gin.H{"session": sessionID}
 				c.JSON(http.StatusAccepted, response)
 				notificationController.Notify("pcap.upload", response)
+				audit(c, "pcap.upload", sessionID, nil, gin.H{"file": fileHeader.Filename, "flush_all": flushAll})
 			}
 		})
 
@@ -192,6 +404,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				response := gin.H{"session": sessionID}
 				c.JSON(http.StatusAccepted, response)
 				notificationController.Notify("pcap.file", response)
+				audit(c, "pcap.file", sessionID, nil, request)
 			}
 		})
 
@@ -223,12 +436,46 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
+		api.GET("/pcap/export", func(c *gin.Context) {
+			var filter ConnectionsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			var connections []Connection
+			if connectionIDs := c.QueryArray("connection_ids"); len(connectionIDs) > 0 {
+				for _, hex := range connectionIDs {
+					id, err := RowIDFromHex(hex)
+					if err != nil {
+						badRequest(c, err)
+						return
+					}
+					connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, id)
+					if !isPresent {
+						notFound(c, gin.H{"connection": id})
+						return
+					}
+					connections = append(connections, connection)
+				}
+			} else {
+				connections = applicationContext.ConnectionsController.GetConnections(c, filter)
+			}
+			if len(connections) == 0 {
+				notFound(c, gin.H{"connections": connections})
+				return
+			}
+
+			pcapAttachment(c, connections, fmt.Sprintf("connections-%d.pcap", time.Now().Unix()))
+		})
+
 		api.DELETE("/pcap/sessions/:id", func(c *gin.Context) {
 			sessionID := c.Param("id")
 			session := gin.H{"session": sessionID}
 			if cancelled := applicationContext.PcapImporter.CancelSession(sessionID); cancelled {
 				c.JSON(http.StatusAccepted, session)
 				notificationController.Notify("sessions.delete", session)
+				audit(c, "sessions.delete", sessionID, nil, nil)
 			} else {
 				notFound(c, session)
 			}
@@ -255,32 +502,212 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
+		api.GET("/connections/:id/files", func(c *gin.Context) {
+			if id, err := RowIDFromHex(c.Param("id")); err != nil {
+				badRequest(c, err)
+			} else {
+				success(c, applicationContext.FilesController.GetConnectionFiles(c, id))
+			}
+		})
+
+		api.GET("/connections/:id/comments", func(c *gin.Context) {
+			if id, err := RowIDFromHex(c.Param("id")); err != nil {
+				badRequest(c, err)
+			} else {
+				success(c, applicationContext.CommentsController.GetComments(c, id))
+			}
+		})
+
+		api.GET("/connections/:id/pcap", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, id); isPresent {
+				pcapAttachment(c, []Connection{connection}, id.Hex()+".pcap")
+			} else {
+				notFound(c, gin.H{"connection": id})
+			}
+		})
+
+		// the router doesn't allow to register /connections/bulk together with /connections/:id/:action
+		api.POST("/connections-bulk", func(c *gin.Context) {
+			var filter ConnectionsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+			var action BulkAction
+			if err := c.ShouldBindJSON(&action); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			affected, err := applicationContext.ConnectionsController.ApplyBulkAction(c, action, filter,
+				c.GetString(gin.AuthUserKey))
+			if err != nil {
+				unprocessableEntity(c, err)
+				return
+			}
+			// a single notification is sent for all the connections
+			response := gin.H{"action": action.Action, "affected": affected}
+			success(c, response)
+			notificationController.Notify("connections.bulk", response)
+			audit(c, "connections.bulk", "", nil, gin.H{"action": action, "filter": filter, "affected": affected})
+		})
+
+		api.DELETE("/connections", func(c *gin.Context) {
+			var filter ConnectionsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+			var request struct {
+				ConnectionIDs []string `form:"connection_ids" binding:"dive,hexadecimal,len=24"`
+			}
+			if err := c.ShouldBindQuery(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			selection, err := applicationContext.ConnectionsController.Selection(request.ConnectionIDs, filter)
+			if err != nil {
+				unprocessableEntity(c, err)
+				return
+			}
+			job, err := applicationContext.RetentionController.DeleteConnections(c, selection)
+			if err != nil {
+				unprocessableEntity(c, err)
+				return
+			}
+			c.JSON(http.StatusAccepted, job)
+			notificationController.Notify("connections.delete", job)
+			audit(c, "connections.delete", job.ID, nil, gin.H{"connection_ids": request.ConnectionIDs,
+				"filter": filter, "total": job.Total})
+		})
+
+		api.DELETE("/connections/:id", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, id)
+			if !isPresent {
+				notFound(c, gin.H{"connection": id})
+				return
+			}
+
+			job, err := applicationContext.RetentionController.DeleteConnections(c, byID(id))
+			if err != nil {
+				unprocessableEntity(c, err)
+				return
+			}
+			c.JSON(http.StatusAccepted, job)
+			notificationController.Notify("connections.delete", job)
+			audit(c, "connections.delete", id.Hex(), connectionState(connection), nil)
+		})
+
 		api.POST("/connections/:id/:action", func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
 				badRequest(c, err)
 				return
 			}
+			connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, id)
+			if !isPresent {
+				notFound(c, gin.H{"connection": id})
+				return
+			}
 
 			var result bool
+			updated := connection
 			switch action := c.Param("action"); action {
 			case "hide":
 				result = applicationContext.ConnectionsController.SetHidden(c, id, true)
+				updated.Hidden = true
 			case "show":
 				result = applicationContext.ConnectionsController.SetHidden(c, id, false)
+				updated.Hidden = false
 			case "mark":
 				result = applicationContext.ConnectionsController.SetMarked(c, id, true)
+				updated.Marked = true
 			case "unmark":
 				result = applicationContext.ConnectionsController.SetMarked(c, id, false)
+				updated.Marked = false
+			case "decrypt":
+				if err := applicationContext.TLSKeysController.DecryptConnection(c, connection); err != nil {
+					unprocessableEntity(c, err)
+					return
+				}
+				result = true
+			case "replay":
+				if connection.PayloadDropped {
+					gone(c, errPayloadDropped)
+					return
+				}
+				var options ReplayOptions
+				if err := c.ShouldBindJSON(&options); err != nil {
+					badRequest(c, err)
+					return
+				}
+				replay, err := applicationContext.ReplayController.ReplayConnection(c, connection, options,
+					flagPatterns(applicationContext.GetConfig().FlagRegex))
+				if err != nil {
+					unprocessableEntity(c, err)
+					return
+				}
+				success(c, replay)
+				response := gin.H{"connection_id": id, "replay_id": replay.Connection.ID, "equal": replay.Equal}
+				notificationController.Notify("connections.replay", response)
+				audit(c, "connections.replay", id.Hex(), nil, response)
+				return
 			case "comment":
-				var comment struct {
-					Comment string `json:"comment"`
+				var request struct {
+					Comment string `json:"comment" binding:"required"`
+					ReplyTo string `json:"reply_to" binding:"omitempty,hexadecimal,len=24"`
 				}
-				if err := c.ShouldBindJSON(&comment); err != nil {
+				if err := c.ShouldBindJSON(&request); err != nil {
 					badRequest(c, err)
 					return
 				}
-				result = applicationContext.ConnectionsController.SetComment(c, id, comment.Comment)
+				var replyTo *RowID
+				if request.ReplyTo != "" {
+					replyToID, _ := RowIDFromHex(request.ReplyTo)
+					replyTo = &replyToID
+				}
+				comment, err := applicationContext.CommentsController.AddComment(c, id, replyTo,
+					c.GetString(gin.AuthUserKey), request.Comment)
+				if err != nil {
+					unprocessableEntity(c, err)
+					return
+				}
+				success(c, comment)
+				notificationController.Notify("comments.new", comment)
+				audit(c, "comments.new", comment.ID.Hex(), nil, comment)
+				return
+			case "tag", "untag":
+				var request struct {
+					Tags []string `json:"tags" binding:"required,min=1"`
+				}
+				if err := c.ShouldBindJSON(&request); err != nil {
+					badRequest(c, err)
+					return
+				}
+				var err error
+				if action == "tag" {
+					_, err = applicationContext.TagsController.AddTags(c, []RowID{id}, request.Tags)
+				} else {
+					_, err = applicationContext.TagsController.RemoveTags(c, []RowID{id}, request.Tags)
+				}
+				if err != nil {
+					unprocessableEntity(c, err)
+					return
+				}
+				updated, _ = applicationContext.ConnectionsController.GetConnection(c, id)
+				result = true
 			default:
 				badRequest(c, errors.New("invalid action"))
 				return
@@ -290,11 +717,48 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				response := gin.H{"connection_id": c.Param("id"), "action": c.Param("action")}
 				success(c, response)
 				notificationController.Notify("connections.action", response)
+				audit(c, "connections."+c.Param("action"), id.Hex(), connectionState(connection),
+					connectionState(updated))
 			} else {
 				notFound(c, gin.H{"connection": id})
 			}
 		})
 
+		api.GET("/comments", func(c *gin.Context) {
+			var filter CommentsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, applicationContext.CommentsController.SearchComments(c, filter))
+		})
+
+		api.PUT("/comments/:id", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var request struct {
+				Text string `json:"text" binding:"required"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			before, _ := applicationContext.CommentsController.GetComment(c, id)
+			if comment, isPresent := applicationContext.CommentsController.EditComment(c, id,
+				c.GetString(gin.AuthUserKey), request.Text); isPresent {
+				success(c, comment)
+				notificationController.Notify("comments.edit", comment)
+				audit(c, "comments.edit", id.Hex(), gin.H{"text": before.Text}, gin.H{"text": comment.Text})
+			} else {
+				notFound(c, gin.H{"comment": id})
+			}
+		})
+
 		api.GET("/searches", func(c *gin.Context) {
 			success(c, applicationContext.SearchController.GetPerformedSearches())
 		})
@@ -334,6 +798,27 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			success(c, applicationContext.SearchController.PerformSearch(c, options))
 		})
 
+		// the router doesn't allow to register /streams/diff together with /streams/:id
+		api.GET("/streams-diff", func(c *gin.Context) {
+			var options DiffOptions
+			if err := c.ShouldBindQuery(&options); err != nil {
+				badRequest(c, err)
+				return
+			}
+			for _, id := range []string{options.A, options.B} {
+				if rowID, err := RowIDFromHex(id); err == nil && !hasPayload(c, applicationContext, rowID) {
+					return
+				}
+			}
+
+			if diff, found := applicationContext.ConnectionStreamsController.DiffConnections(c, options,
+				flagPatterns(applicationContext.GetConfig().FlagRegex)); !found {
+				notFound(c, gin.H{"a": options.A, "b": options.B})
+			} else {
+				success(c, diff)
+			}
+		})
+
 		api.GET("/streams/:id", func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
@@ -346,6 +831,9 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				return
 			}
 
+			if !hasPayload(c, applicationContext, id) {
+				return
+			}
 			if messages, found := applicationContext.ConnectionStreamsController.GetConnectionMessages(c, id, format); !found {
 				notFound(c, gin.H{"connection": id})
 			} else {
@@ -353,6 +841,29 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
+		api.GET("/streams/:id/summary", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			var format GetMessageFormat
+			if err := c.ShouldBindQuery(&format); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if !hasPayload(c, applicationContext, id) {
+				return
+			}
+			if summary, found := applicationContext.ConnectionStreamsController.GetConnectionMessagesSummary(c, id,
+				format); !found {
+				notFound(c, gin.H{"connection": id})
+			} else {
+				success(c, summary)
+			}
+		})
+
 		api.GET("/streams/:id/download", func(c *gin.Context) {
 			id, err := RowIDFromHex(c.Param("id"))
 			if err != nil {
@@ -364,6 +875,40 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				badRequest(c, err)
 				return
 			}
+			if !hasPayload(c, applicationContext, id) {
+				return
+			}
+
+			if format.Format == "raw" {
+				payload, found := applicationContext.ConnectionStreamsController.GetConnectionPayload(c, id, format)
+				if !found {
+					notFound(c, gin.H{"connection": id})
+					return
+				}
+				fileName := id.Hex() + ".bin"
+				if format.Type == "only_client" || format.Type == "only_server" {
+					fileName = fmt.Sprintf("%s-%s.bin", id.Hex(), format.Type)
+				}
+				c.Header("Content-Type", "application/octet-stream")
+				c.Header("Content-Disposition", mime.FormatMediaType("attachment",
+					map[string]string{"filename": fileName}))
+				// ServeContent handles the Range requests
+				http.ServeContent(c.Writer, c.Request, fileName, time.Time{}, payload)
+				return
+			}
+
+			if _, isExploit := exploitExporters[format.Type]; isExploit {
+				format.FlagRegex = applicationContext.GetConfig().FlagRegex
+				script, found, err := applicationContext.ConnectionStreamsController.ExportExploit(c, id, format)
+				if !found {
+					notFound(c, gin.H{"connection": id})
+				} else if err != nil {
+					unprocessableEntity(c, err)
+				} else {
+					c.String(http.StatusOK, script)
+				}
+				return
+			}
 
 			if blob, found := applicationContext.ConnectionStreamsController.DownloadConnectionMessages(c, id, format); !found {
 				notFound(c, gin.H{"connection": id})
@@ -372,6 +917,56 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 			}
 		})
 
+		api.GET("/clusters", func(c *gin.Context) {
+			var filter ClustersFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, applicationContext.ClustersController.GetClusters(c, filter))
+		})
+
+		api.GET("/clusters/:id", func(c *gin.Context) {
+			if id, err := RowIDFromHex(c.Param("id")); err != nil {
+				badRequest(c, err)
+			} else if cluster, isPresent := applicationContext.ClustersController.GetCluster(c, id); isPresent {
+				success(c, cluster)
+			} else {
+				notFound(c, gin.H{"cluster": id})
+			}
+		})
+
+		api.GET("/files", func(c *gin.Context) {
+			var filter FilesFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, applicationContext.FilesController.GetFiles(c, filter))
+		})
+
+		api.GET("/files/:id/download", func(c *gin.Context) {
+			id, err := RowIDFromHex(c.Param("id"))
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if file, isPresent := applicationContext.FilesController.GetFile(c, id); isPresent {
+				fileName := file.Name
+				if fileName == "" {
+					fileName = file.SHA256[:16]
+				}
+				c.Header("Content-Disposition", mime.FormatMediaType("attachment",
+					map[string]string{"filename": filepath.Base(fileName)}))
+				c.Data(http.StatusOK, file.MIMEType, file.Content)
+			} else {
+				notFound(c, gin.H{"file": id})
+			}
+		})
+
 		api.GET("/services", func(c *gin.Context) {
 			success(c, applicationContext.ServicesController.GetServices())
 		})
@@ -382,9 +977,14 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				badRequest(c, err)
 				return
 			}
+			var before interface{}
+			if previous, isPresent := applicationContext.ServicesController.GetServices()[service.Port]; isPresent {
+				before = previous
+			}
 			if err := applicationContext.ServicesController.SetService(c, service); err == nil {
 				success(c, service)
 				notificationController.Notify("services.edit", service)
+				audit(c, "services.edit", fmt.Sprint(service.Port), before, service)
 			} else {
 				unprocessableEntity(c, err)
 			}
@@ -396,14 +996,227 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				badRequest(c, err)
 				return
 			}
+			var before interface{}
+			if previous, isPresent := applicationContext.ServicesController.GetServices()[service.Port]; isPresent {
+				before = previous
+			}
 			if err := applicationContext.ServicesController.DeleteService(c, service); err == nil {
 				success(c, service)
 				notificationController.Notify("services.edit", service)
+				audit(c, "services.delete", fmt.Sprint(service.Port), before, nil)
+			} else {
+				unprocessableEntity(c, err)
+			}
+		})
+
+		api.GET("/teams", func(c *gin.Context) {
+			success(c, applicationContext.TeamsController.GetTeams())
+		})
+
+		api.PUT("/teams", func(c *gin.Context) {
+			var team Team
+			if err := c.ShouldBindJSON(&team); err != nil {
+				badRequest(c, err)
+				return
+			}
+			var before interface{}
+			if previous, isPresent := applicationContext.TeamsController.GetTeams()[team.ID]; isPresent {
+				before = previous
+			}
+			if err := applicationContext.TeamsController.SetTeam(c, team); err == nil {
+				success(c, team)
+				notificationController.Notify("teams.edit", team)
+				audit(c, "teams.edit", fmt.Sprint(team.ID), before, team)
+			} else {
+				unprocessableEntity(c, err)
+			}
+		})
+
+		api.DELETE("/teams", func(c *gin.Context) {
+			var team Team
+			if err := c.ShouldBindJSON(&team); err != nil {
+				badRequest(c, err)
+				return
+			}
+			var before interface{}
+			if previous, isPresent := applicationContext.TeamsController.GetTeams()[team.ID]; isPresent {
+				before = previous
+			}
+			if err := applicationContext.TeamsController.DeleteTeam(c, team); err == nil {
+				success(c, team)
+				notificationController.Notify("teams.edit", team)
+				audit(c, "teams.delete", fmt.Sprint(team.ID), before, nil)
+			} else {
+				unprocessableEntity(c, err)
+			}
+		})
+
+		api.GET("/tags", func(c *gin.Context) {
+			success(c, applicationContext.TagsController.GetTags())
+		})
+
+		api.GET("/tags/counts", func(c *gin.Context) {
+			success(c, applicationContext.TagsController.CountConnections(c))
+		})
+
+		api.PUT("/tags", func(c *gin.Context) {
+			var tag Tag
+			if err := c.ShouldBindJSON(&tag); err != nil {
+				badRequest(c, err)
+				return
+			}
+			var before interface{}
+			if previous, isPresent := applicationContext.TagsController.GetTags()[tag.Name]; isPresent {
+				before = previous
+			}
+			if err := applicationContext.TagsController.SetTag(c, tag); err == nil {
+				success(c, tag)
+				notificationController.Notify("tags.edit", tag)
+				audit(c, "tags.edit", tag.Name, before, tag)
 			} else {
 				unprocessableEntity(c, err)
 			}
 		})
 
+		api.DELETE("/tags", func(c *gin.Context) {
+			var tag Tag
+			if err := c.ShouldBindJSON(&tag); err != nil {
+				badRequest(c, err)
+				return
+			}
+			var before interface{}
+			if previous, isPresent := applicationContext.TagsController.GetTags()[tag.Name]; isPresent {
+				before = previous
+			}
+			if err := applicationContext.TagsController.DeleteTag(c, tag); err == nil {
+				success(c, tag)
+				notificationController.Notify("tags.edit", tag)
+				audit(c, "tags.delete", tag.Name, before, nil)
+			} else {
+				unprocessableEntity(c, err)
+			}
+		})
+
+		api.POST("/tags/connections", func(c *gin.Context) {
+			var request struct {
+				ConnectionIDs []string `json:"connection_ids" binding:"required,min=1,dive,hexadecimal,len=24"`
+				Add           []string `json:"add"`
+				Remove        []string `json:"remove"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+			ids := make([]RowID, len(request.ConnectionIDs))
+			for i, hex := range request.ConnectionIDs {
+				ids[i], _ = RowIDFromHex(hex)
+			}
+
+			var added, removed int64
+			var err error
+			if len(request.Add) > 0 {
+				if added, err = applicationContext.TagsController.AddTags(c, ids, request.Add); err != nil {
+					unprocessableEntity(c, err)
+					return
+				}
+			}
+			if len(request.Remove) > 0 {
+				if removed, err = applicationContext.TagsController.RemoveTags(c, ids, request.Remove); err != nil {
+					unprocessableEntity(c, err)
+					return
+				}
+			}
+
+			response := gin.H{"connection_ids": request.ConnectionIDs, "add": request.Add, "remove": request.Remove,
+				"added": added, "removed": removed}
+			success(c, response)
+			notificationController.Notify("connections.tags", response)
+			audit(c, "connections.tags", "", nil, request)
+		})
+
+		api.GET("/tls/keys", func(c *gin.Context) {
+			success(c, gin.H{
+				"key_log_secrets": applicationContext.TLSKeysController.KeyLogSize(),
+				"server_keys":     applicationContext.TLSKeysController.GetServerKeys(),
+			})
+		})
+
+		api.POST("/tls/keylog", func(c *gin.Context) {
+			fileHeader, err := c.FormFile("file")
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			file, err := fileHeader.Open()
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+			content, err := ioutil.ReadAll(file)
+			_ = file.Close()
+			if err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			if added, err := applicationContext.TLSKeysController.AddKeyLog(c, content); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				response := gin.H{"added_secrets": added}
+				success(c, response)
+				notificationController.Notify("tls.keylog", response)
+				audit(c, "tls.keylog", fileHeader.Filename, nil, response)
+			}
+		})
+
+		api.PUT("/tls/server_keys", func(c *gin.Context) {
+			var serverKey TLSServerKey
+			if err := c.ShouldBindJSON(&serverKey); err != nil {
+				badRequest(c, err)
+				return
+			}
+			if err := applicationContext.TLSKeysController.SetServerKey(c, serverKey); err != nil {
+				unprocessableEntity(c, err)
+			} else {
+				response := gin.H{"service_port": serverKey.ServicePort}
+				success(c, response)
+				notificationController.Notify("tls.server_keys.edit", response)
+				audit(c, "tls.server_keys.edit", fmt.Sprint(serverKey.ServicePort), nil, response)
+			}
+		})
+
+		api.DELETE("/tls/server_keys", func(c *gin.Context) {
+			var request struct {
+				ServicePort uint16 `json:"service_port" binding:"required"`
+			}
+			if err := c.ShouldBindJSON(&request); err != nil {
+				badRequest(c, err)
+				return
+			}
+			response := gin.H{"service_port": request.ServicePort}
+			if applicationContext.TLSKeysController.DeleteServerKey(c, request.ServicePort) {
+				success(c, response)
+				notificationController.Notify("tls.server_keys.edit", response)
+				audit(c, "tls.server_keys.delete", fmt.Sprint(request.ServicePort), nil, nil)
+			} else {
+				notFound(c, response)
+			}
+		})
+
+		api.GET("/dns/queries", func(c *gin.Context) {
+			var filter DNSQueriesFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, applicationContext.DNSController.GetDNSQueries(c, filter))
+		})
+
+		api.GET("/dns/records", func(c *gin.Context) {
+			success(c, applicationContext.DNSController.GetPassiveDNSRecords(c, c.Query("hostname")))
+		})
+
 		api.GET("/statistics", func(c *gin.Context) {
 			var filter StatisticsFilter
 			if err := c.ShouldBindQuery(&filter); err != nil {
@@ -411,7 +1224,7 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				return
 			}
 
-			success(c, applicationContext.StatisticsController.GetStatistics(c, filter))
+			success(c, applicationContext.GetStatisticsController().GetStatistics(c, filter))
 		})
 
 		api.GET("/statistics/totals", func(c *gin.Context) {
@@ -421,7 +1234,17 @@ func CreateApplicationRouter(applicationContext *ApplicationContext,
 				return
 			}
 
-			success(c, applicationContext.StatisticsController.GetTotalStatistics(c, filter))
+			success(c, applicationContext.GetStatisticsController().GetTotalStatistics(c, filter))
+		})
+
+		api.GET("/statistics/rounds", func(c *gin.Context) {
+			var filter StatisticsFilter
+			if err := c.ShouldBindQuery(&filter); err != nil {
+				badRequest(c, err)
+				return
+			}
+
+			success(c, applicationContext.GetStatisticsController().GetRoundStatistics(c, filter))
 		})
 
 		api.GET("/resources/system", func(c *gin.Context) {
@@ -451,13 +1274,60 @@ func SetupRequiredMiddleware(applicationContext *ApplicationContext) gin.Handler
 
 func AuthRequiredMiddleware(applicationContext *ApplicationContext) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !applicationContext.Config.AuthRequired {
+		if !applicationContext.GetConfig().AuthRequired {
+			c.Set(authRoleKey, RoleAdmin)
+			c.Next()
+			return
+		}
+
+		if name, role, authenticated := applicationContext.AuthController.Authenticate(c, c.Request); authenticated {
+			c.Set(gin.AuthUserKey, name)
+			c.Set(authRoleKey, role)
 			c.Next()
 			return
 		}
+		// the basic authentication is still requested to allow the login from the browser
+		c.Header("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+// RoleRequiredMiddleware checks the role set by AuthRequiredMiddleware. The routes which only read data require
+// the viewer role and the ones which modify data require the admin role, except the ones in routeRoles
+func RoleRequiredMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requiredRole, isPresent := routeRoles[c.Request.Method+" "+c.FullPath()]
+		if !isPresent {
+			requiredRole = RoleAdmin
+			if c.Request.Method == http.MethodGet {
+				requiredRole = RoleViewer
+			}
+		}
+
+		if HasRole(c.GetString(authRoleKey), requiredRole) {
+			c.Next()
+		} else {
+			c.AbortWithStatusJSON(http.StatusForbidden, UnorderedDocument{"result": "error",
+				"error": fmt.Sprintf("the %s role is required", requiredRole)})
+		}
+	}
+}
+
+// connectionState returns the properties of a connection which can be changed by the users
+func connectionState(connection Connection) gin.H {
+	return gin.H{"hidden": connection.Hidden, "marked": connection.Marked, "comment": connection.Comment,
+		"tags": connection.Tags}
+}
 
-		gin.BasicAuth(applicationContext.Accounts)(c)
+func pcapAttachment(c *gin.Context, connections []Connection, fileName string) {
+	var buffer bytes.Buffer
+	if err := ExportConnectionsPcap(connections, &buffer); err != nil {
+		unprocessableEntity(c, err)
+		return
 	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	c.Data(http.StatusOK, "application/vnd.tcpdump.pcap", buffer.Bytes())
 }
 
 func success(c *gin.Context, obj interface{}) {
@@ -493,6 +1363,24 @@ func notFound(c *gin.Context, obj interface{}) {
 	c.JSON(http.StatusNotFound, obj)
 }
 
+func gone(c *gin.Context, err error) {
+	c.JSON(http.StatusGone, UnorderedDocument{"result": "error", "error": err.Error()})
+}
+
+// hasPayload responds with an error if the connection doesn't exist, or its payload was dropped by the retention
+func hasPayload(c *gin.Context, applicationContext *ApplicationContext, id RowID) bool {
+	connection, isPresent := applicationContext.ConnectionsController.GetConnection(c, id)
+	if !isPresent {
+		notFound(c, gin.H{"connection": id})
+		return false
+	}
+	if connection.PayloadDropped {
+		gone(c, errPayloadDropped)
+		return false
+	}
+	return true
+}
+
 func serverError(c *gin.Context, err error) {
 	c.JSON(http.StatusInternalServerError, UnorderedDocument{"result": "error", "error": err.Error()})
 }
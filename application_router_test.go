@@ -49,11 +49,120 @@ func TestAuthRequired(t *testing.T) {
 	toolkit := NewRouterTestToolkit(t, true)
 
 	assert.Equal(t, http.StatusOK, toolkit.MakeRequest("GET", "/api/rules", nil).Code)
-	config := toolkit.appContext.Config
+	config := toolkit.appContext.GetConfig()
 	config.AuthRequired = true
 	toolkit.appContext.SetConfig(config)
 	toolkit.appContext.SetAccounts(gin.Accounts{"username": "password"})
 	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeRequest("GET", "/api/rules", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeRequest("GET", "/ws", nil).Code)
+
+	// login
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeRequest("POST", "/api/auth/login",
+		gin.H{"username": "username", "password": "invalid"}).Code)
+	w := toolkit.MakeRequest("POST", "/api/auth/login", gin.H{"username": "username", "password": "password"})
+	var login struct{ Token string }
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("GET", "/api/rules", nil, login.Token).Code)
+
+	// api keys
+	w = toolkit.MakeAuthenticatedRequest("POST", "/api/auth/keys", gin.H{"name": "pcap_feeder"}, login.Token)
+	var apiKey struct{ Key string }
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &apiKey))
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("GET", "/api/rules", nil, apiKey.Key).Code)
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeAuthenticatedRequest("GET", "/api/rules", nil,
+		apiKey.Key+"0").Code)
+
+	// logout
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("POST", "/api/auth/logout", nil,
+		login.Token).Code)
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeAuthenticatedRequest("GET", "/api/rules", nil,
+		login.Token).Code)
+
+	toolkit.wrapper.Destroy(t)
+}
+
+func TestUsersApi(t *testing.T) {
+	toolkit := NewRouterTestToolkit(t, true)
+	config := toolkit.appContext.GetConfig()
+	config.AuthRequired = true
+	toolkit.appContext.SetConfig(config)
+	toolkit.appContext.SetAccounts(gin.Accounts{"admin": "password"})
+	login := func(username, password string) string {
+		w := toolkit.MakeRequest("POST", "/api/auth/login", gin.H{"username": username, "password": password})
+		var login struct{ Token string }
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+		return login.Token
+	}
+	adminToken := login("admin", "password")
+
+	assert.Equal(t, http.StatusBadRequest, toolkit.MakeAuthenticatedRequest("POST", "/api/users",
+		gin.H{"username": "guest", "password": "password", "role": "guest"}, adminToken).Code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("POST", "/api/users",
+		gin.H{"username": "guest", "password": "password", "role": RoleViewer}, adminToken).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, toolkit.MakeAuthenticatedRequest("POST", "/api/users",
+		gin.H{"username": "guest", "password": "password", "role": RoleViewer}, adminToken).Code)
+	assert.Len(t, toolkit.appContext.AuthController.GetUsers(), 2)
+
+	// viewers can only browse
+	guestToken := login("guest", "password")
+	rule := Rule{Name: "guestRule", Color: "#fff"}
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("GET", "/api/rules", nil, guestToken).Code)
+	assert.Equal(t, http.StatusForbidden, toolkit.MakeAuthenticatedRequest("POST", "/api/rules", rule,
+		guestToken).Code)
+	assert.Equal(t, http.StatusForbidden, toolkit.MakeAuthenticatedRequest("GET", "/api/users", nil,
+		guestToken).Code)
+
+	// analysts can add rules, but can't change the settings
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("PUT", "/api/users/guest",
+		gin.H{"role": RoleAnalyst}, adminToken).Code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("POST", "/api/rules", rule, guestToken).Code)
+	assert.Equal(t, http.StatusForbidden, toolkit.MakeAuthenticatedRequest("PUT", "/api/settings", config,
+		guestToken).Code)
+
+	// changing the password closes the sessions
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("PUT", "/api/users/guest",
+		gin.H{"password": "password2"}, adminToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, toolkit.MakeAuthenticatedRequest("GET", "/api/rules", nil,
+		guestToken).Code)
+	assert.True(t, toolkit.appContext.AuthController.CheckPassword("guest", "password2"))
+	// the verified password is cached, the wrong ones are still rejected
+	assert.True(t, toolkit.appContext.AuthController.CheckPassword("guest", "password2"))
+	assert.False(t, toolkit.appContext.AuthController.CheckPassword("guest", "password"))
+	assert.False(t, toolkit.appContext.AuthController.CheckPassword("unknown", "password2"))
+
+	// the last admin can't be removed
+	assert.Equal(t, http.StatusUnprocessableEntity, toolkit.MakeAuthenticatedRequest("DELETE", "/api/users/admin",
+		nil, adminToken).Code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("DELETE", "/api/users/guest", nil,
+		adminToken).Code)
+	assert.Equal(t, http.StatusNotFound, toolkit.MakeAuthenticatedRequest("DELETE", "/api/users/guest", nil,
+		adminToken).Code)
+
+	toolkit.wrapper.Destroy(t)
+}
+
+func TestSettingsApi(t *testing.T) {
+	toolkit := NewRouterTestToolkit(t, true)
+
+	w := toolkit.MakeRequest("GET", "/api/settings", nil)
+	var config Config
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &config))
+	assert.Equal(t, "FLAG{test}", config.FlagRegex)
+
+	assert.Equal(t, http.StatusBadRequest, toolkit.MakeRequest("PUT", "/api/settings",
+		Config{ServerAddress: "1.2.3.4", FlagRegex: "short"}).Code)
+	config.FlagRegex = "FLAG{[a-z]+}"
+	config.ServerNetworks = []ServerNetwork{{Name: "services", Address: "10.10.0.0/16", Ports: []uint16{8080}}}
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequest("PUT", "/api/settings", config).Code)
+	assert.Equal(t, config, toolkit.appContext.GetConfig())
+
+	// the default flag rules are updated with the new regex
+	for _, rule := range toolkit.appContext.RulesManager.GetRules() {
+		assert.Equal(t, "/FLAG{[a-z]+}/", rule.Patterns[0].Regex)
+	}
 
 	toolkit.wrapper.Destroy(t)
 }
@@ -114,6 +223,159 @@ func TestRulesApi(t *testing.T) {
 	toolkit.wrapper.Destroy(t)
 }
 
+func TestAuditApi(t *testing.T) {
+	toolkit := NewRouterTestToolkit(t, true)
+	config := toolkit.appContext.GetConfig()
+	config.AuthRequired = true
+	toolkit.appContext.SetConfig(config)
+	toolkit.appContext.SetAccounts(gin.Accounts{"admin": "password"})
+	w := toolkit.MakeRequest("POST", "/api/auth/login", gin.H{"username": "admin", "password": "password"})
+	var login struct{ Token string }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+
+	w = toolkit.MakeAuthenticatedRequest("POST", "/api/rules", Rule{Name: "testRule", Color: "#fff"}, login.Token)
+	var testRuleID struct{ ID string }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &testRuleID))
+	assert.Equal(t, http.StatusOK, toolkit.MakeAuthenticatedRequest("PUT", "/api/rules/"+testRuleID.ID,
+		Rule{Name: "testRule", Color: "#ddd"}, login.Token).Code)
+
+	w = toolkit.MakeAuthenticatedRequest("GET", "/api/audit?action=rules.edit", nil, login.Token)
+	var records []AuditRecord
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "admin", records[0].User)
+	assert.Equal(t, testRuleID.ID, records[0].TargetID)
+	assert.Equal(t, "#fff", records[0].Before["color"])
+	assert.Equal(t, "#ddd", records[0].After["color"])
+
+	w = toolkit.MakeAuthenticatedRequest("GET", "/api/audit?user=admin", nil, login.Token)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &records))
+	assert.Len(t, records, 2)
+
+	toolkit.wrapper.Destroy(t)
+}
+
+func TestDeleteConnectionsApi(t *testing.T) {
+	toolkit := NewRouterTestToolkit(t, true)
+	connections := []interface{}{
+		Connection{ID: NewRowID(), DestinationPort: 80},
+		Connection{ID: NewRowID(), DestinationPort: 80},
+		Connection{ID: NewRowID(), DestinationPort: 22},
+	}
+	_, err := toolkit.wrapper.Storage.Insert(Connections).Context(toolkit.wrapper.Context).Many(connections)
+	require.NoError(t, err)
+	countConnections := func() int64 {
+		count, err := toolkit.wrapper.Storage.Find(Connections).Context(toolkit.wrapper.Context).Count()
+		require.NoError(t, err)
+		return count
+	}
+
+	// a search without results deletes nothing, even with other filters
+	emptySearch := PerformedSearch{ID: NewRowID()}
+	toolkit.appContext.SearchController.performedSearches = []PerformedSearch{emptySearch}
+	assert.Equal(t, http.StatusUnprocessableEntity, toolkit.MakeRequest("DELETE",
+		"/api/connections?service_port=80&performed_search="+emptySearch.ID.Hex(), nil).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, toolkit.MakeRequest("DELETE",
+		"/api/connections?performed_search="+NewRowID().Hex(), nil).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, toolkit.MakeRequest("DELETE", "/api/connections", nil).Code)
+	assert.Equal(t, int64(3), countConnections())
+
+	w := toolkit.MakeRequest("DELETE", "/api/connections?service_port=80", nil)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var job RetentionJob
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, int64(2), job.Total)
+	job, isPresent := toolkit.appContext.RetentionController.GetJob(job.ID)
+	require.True(t, isPresent)
+	<-job.completed
+	assert.Equal(t, int64(1), countConnections())
+
+	assert.Equal(t, http.StatusNotFound, toolkit.MakeRequest("DELETE",
+		"/api/connections/"+connections[0].(Connection).ID.Hex(), nil).Code)
+
+	toolkit.wrapper.Destroy(t)
+}
+
+func TestBulkConnectionsApi(t *testing.T) {
+	toolkit := NewRouterTestToolkit(t, true)
+	connections := []interface{}{
+		Connection{ID: NewRowID(), DestinationPort: 80},
+		Connection{ID: NewRowID(), DestinationPort: 22},
+	}
+	_, err := toolkit.wrapper.Storage.Insert(Connections).Context(toolkit.wrapper.Context).Many(connections)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusBadRequest, toolkit.MakeRequest("POST", "/api/connections-bulk",
+		gin.H{"action": "invalid"}).Code)
+	w := toolkit.MakeRequest("POST", "/api/connections-bulk?service_port=80", gin.H{"action": "mark"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Affected int64 `json:"affected"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, int64(1), response.Affected)
+	// the path doesn't conflict with the actions on the single connections
+	assert.Equal(t, http.StatusBadRequest, toolkit.MakeRequest("POST", "/api/connections/bulk/mark", nil).Code)
+
+	toolkit.wrapper.Destroy(t)
+}
+
+func TestDownloadConnectionPayloadApi(t *testing.T) {
+	toolkit := NewRouterTestToolkit(t, true)
+	connectionID := insertTestConnectionStreams(t, toolkit.wrapper)
+	url := "/api/streams/" + connectionID.Hex() + "/download?format=raw"
+
+	w := toolkit.MakeRequest("GET", url, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ab12c3def456", w.Body.String())
+
+	// the range crosses the boundary between the documents of the client
+	w = httptest.NewRecorder()
+	request, err := http.NewRequest("GET", url+"&type=only_client", nil)
+	require.NoError(t, err)
+	request.Header.Set("Range", "bytes=1-4")
+	toolkit.router.ServeHTTP(w, request)
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 1-4/6", w.Header().Get("Content-Range"))
+	assert.Equal(t, "bcde", w.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, toolkit.MakeRequest("GET",
+		"/api/streams/"+NewRowID().Hex()+"/download?format=raw", nil).Code)
+
+	// the payloads dropped by the retention policy are gone
+	_, err = toolkit.wrapper.Storage.Update(Connections).Context(toolkit.wrapper.Context).Filter(byID(connectionID)).
+		One(UnorderedDocument{"payload_dropped": true})
+	require.NoError(t, err)
+	for _, path := range []string{"/download?format=raw", "/download", "", "/summary"} {
+		assert.Equal(t, http.StatusGone, toolkit.MakeRequest("GET", "/api/streams/"+connectionID.Hex()+path,
+			nil).Code, path)
+	}
+	assert.Equal(t, http.StatusGone, toolkit.MakeRequest("POST", "/api/connections/"+connectionID.Hex()+"/replay",
+		gin.H{"host": "127.0.0.1", "port": 8080}).Code)
+
+	toolkit.wrapper.Destroy(t)
+}
+
+func TestDiffConnectionsApi(t *testing.T) {
+	toolkit := NewRouterTestToolkit(t, true)
+	a, b := insertTestConnectionStreams(t, toolkit.wrapper), insertTestConnectionStreams(t, toolkit.wrapper)
+	url := "/api/streams-diff?a=" + a.Hex() + "&b="
+
+	assert.Equal(t, http.StatusBadRequest, toolkit.MakeRequest("GET", "/api/streams-diff?a="+a.Hex(), nil).Code)
+	assert.Equal(t, http.StatusNotFound, toolkit.MakeRequest("GET", url+NewRowID().Hex(), nil).Code)
+	assert.Equal(t, http.StatusOK, toolkit.MakeRequest("GET", url+b.Hex(), nil).Code)
+	// the path doesn't conflict with the messages of the single connections
+	assert.Equal(t, http.StatusBadRequest, toolkit.MakeRequest("GET", "/api/streams/diff", nil).Code)
+
+	_, err := toolkit.wrapper.Storage.Update(Connections).Context(toolkit.wrapper.Context).Filter(byID(b)).
+		One(UnorderedDocument{"payload_dropped": true})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGone, toolkit.MakeRequest("GET", url+b.Hex(), nil).Code)
+
+	toolkit.wrapper.Destroy(t)
+}
+
 func TestPcapImporterApi(t *testing.T) {
 	toolkit := NewRouterTestToolkit(t, true)
 
@@ -192,6 +454,11 @@ func NewRouterTestToolkit(t *testing.T, withSetup bool) *RouterTestToolkit {
 }
 
 func (rtt *RouterTestToolkit) MakeRequest(method string, url string, body interface{}) *httptest.ResponseRecorder {
+	return rtt.MakeAuthenticatedRequest(method, url, body, "")
+}
+
+func (rtt *RouterTestToolkit) MakeAuthenticatedRequest(method string, url string, body interface{},
+	token string) *httptest.ResponseRecorder {
 	var r io.Reader
 
 	if body != nil {
@@ -203,6 +470,9 @@ func (rtt *RouterTestToolkit) MakeRequest(method string, url string, body interf
 	w := httptest.NewRecorder()
 	req, err := http.NewRequest(method, url, r)
 	require.NoError(rtt.t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 	rtt.router.ServeHTTP(w, req)
 
 	return w
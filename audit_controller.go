@@ -0,0 +1,133 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// AuditRecord is an action performed by a user or by an api key. Before and After are the values of the target,
+// with the same fields returned by the api, before and after the action
+type AuditRecord struct {
+	ID        RowID             `json:"id" bson:"_id"`
+	User      string            `json:"user" bson:"user"`
+	Action    string            `json:"action" bson:"action"`
+	TargetID  string            `json:"target_id" bson:"target_id"`
+	Before    UnorderedDocument `json:"before" bson:"before,omitempty"`
+	After     UnorderedDocument `json:"after" bson:"after,omitempty"`
+	Timestamp time.Time         `json:"timestamp" bson:"timestamp"`
+}
+
+type AuditFilter struct {
+	User      string    `form:"user"`
+	Action    string    `form:"action"`
+	TargetID  string    `form:"target_id"`
+	RangeFrom time.Time `form:"range_from"`
+	RangeTo   time.Time `form:"range_to"`
+	Limit     int64     `form:"limit"`
+}
+
+type AuditController struct {
+	storage Storage
+}
+
+func NewAuditController(storage Storage) *AuditController {
+	return &AuditController{
+		storage: storage,
+	}
+}
+
+func (ac *AuditController) Record(c context.Context, user, action, targetID string,
+	before, after interface{}) (AuditRecord, error) {
+	record := AuditRecord{
+		ID:        NewRowID(),
+		User:      user,
+		Action:    action,
+		TargetID:  targetID,
+		Before:    auditDocument(before),
+		After:     auditDocument(after),
+		Timestamp: time.Now(),
+	}
+	if _, err := ac.storage.Insert(AuditLog).Context(c).One(record); err != nil {
+		log.WithError(err).WithField("record", record).Error("failed to insert audit record")
+		return AuditRecord{}, err
+	}
+
+	return record, nil
+}
+
+func (ac *AuditController) GetAuditRecords(c context.Context, filter AuditFilter) []AuditRecord {
+	var records []AuditRecord
+	query := ac.storage.Find(AuditLog).Context(c).Sort("_id", false)
+	if filter.User != "" {
+		query = query.Filter(OrderedDocument{{"user", filter.User}})
+	}
+	if filter.Action != "" {
+		query = query.Filter(OrderedDocument{{"action", filter.Action}})
+	}
+	if filter.TargetID != "" {
+		query = query.Filter(OrderedDocument{{"target_id", filter.TargetID}})
+	}
+	timestampRange := UnorderedDocument{}
+	if !filter.RangeFrom.IsZero() {
+		timestampRange["$gte"] = filter.RangeFrom
+	}
+	if !filter.RangeTo.IsZero() {
+		timestampRange["$lte"] = filter.RangeTo
+	}
+	if len(timestampRange) > 0 {
+		query = query.Filter(OrderedDocument{{"timestamp", timestampRange}})
+	}
+	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
+		query = query.Limit(filter.Limit)
+	} else {
+		query = query.Limit(DefaultQueryLimit)
+	}
+
+	if err := query.All(&records); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get audit records")
+	}
+
+	if records == nil {
+		return []AuditRecord{}
+	}
+	return records
+}
+
+// auditDocument converts a value to a document with the fields of its json representation
+func auditDocument(value interface{}) UnorderedDocument {
+	if value == nil {
+		return nil
+	}
+
+	buffer, err := json.Marshal(value)
+	if err != nil {
+		log.WithError(err).WithField("value", value).Error("failed to marshal audit value")
+		return nil
+	}
+	var document UnorderedDocument
+	if err := json.Unmarshal(buffer, &document); err != nil {
+		log.WithError(err).WithField("value", value).Error("failed to unmarshal audit value")
+		return nil
+	}
+
+	return document
+}
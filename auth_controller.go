@@ -0,0 +1,496 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionTokenDuration = 24 * time.Hour
+	secretBytes          = 32
+	apiKeyPrefix         = "caronte_"
+)
+
+const (
+	RoleViewer  = "viewer"
+	RoleAnalyst = "analyst"
+	RoleAdmin   = "admin"
+)
+
+// roleLevels sorts the roles by privileges, each role can do everything the lower roles can do
+var roleLevels = map[string]int{RoleViewer: 1, RoleAnalyst: 2, RoleAdmin: 3}
+
+// User is an account of the analyzer. A viewer can only browse the data, an analyst can also mark and comment
+// connections, perform searches and add rules, while an admin can also import pcaps, change the settings, manage
+// the users and delete data
+type User struct {
+	Username     string    `json:"username" bson:"_id"`
+	PasswordHash string    `json:"-" bson:"password_hash"`
+	Role         string    `json:"role" bson:"role"`
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+}
+
+// SessionToken is issued at login. Only the hash of the token is saved
+type SessionToken struct {
+	ID        string    `bson:"_id"`
+	Username  string    `bson:"username"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// APIKey is a long-lived credential for scripts. Only the hash of the key is saved, the key is returned once
+// when it is created. The keys without a role, like the ones created before the roles, have the admin role
+type APIKey struct {
+	ID         RowID     `json:"id" bson:"_id"`
+	Name       string    `json:"name" binding:"min=3" bson:"name"`
+	Role       string    `json:"role" binding:"omitempty,oneof=viewer analyst admin" bson:"role,omitempty"`
+	KeyHash    string    `json:"-" bson:"key_hash"`
+	CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at" bson:"last_used_at,omitempty"`
+}
+
+type AuthController struct {
+	storage  Storage
+	users    map[string]User
+	verified map[string][]byte // the HMACs of the passwords already checked, to not run bcrypt at each request
+	// the key of the HMACs of the verified passwords, random for each process
+	verifiedKey []byte
+	// compared with the passwords of the unknown users, which take as long as the ones of the known users
+	dummyHash []byte
+	mutex     sync.Mutex
+}
+
+func NewAuthController(storage Storage) (*AuthController, error) {
+	var users []User
+	if err := storage.Find(Users).All(&users); err != nil {
+		return nil, err
+	}
+
+	verifiedKey := make([]byte, secretBytes)
+	if _, err := rand.Read(verifiedKey); err != nil {
+		return nil, err
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	authController := &AuthController{
+		storage:     storage,
+		users:       make(map[string]User, len(users)),
+		verified:    make(map[string][]byte),
+		verifiedKey: verifiedKey,
+		dummyHash:   dummyHash,
+	}
+	for _, user := range users {
+		authController.users[user.Username] = user
+	}
+	if len(users) == 0 {
+		if err := authController.migrateAccounts(); err != nil {
+			return nil, err
+		}
+	}
+
+	return authController, nil
+}
+
+// migrateAccounts converts the accounts saved in the settings by the previous versions, with plaintext or hashed
+// passwords, to admin users
+func (ac *AuthController) migrateAccounts() error {
+	var accountsWrapper struct {
+		Accounts       gin.Accounts      `bson:"accounts"`
+		PasswordHashes map[string]string `bson:"password_hashes"`
+	}
+	if err := ac.storage.Find(Settings).Filter(OrderedDocument{{"_id", "accounts"}}).
+		First(&accountsWrapper); err != nil {
+		return err
+	}
+	if len(accountsWrapper.Accounts) == 0 && len(accountsWrapper.PasswordHashes) == 0 {
+		return nil
+	}
+
+	for username, hash := range accountsWrapper.PasswordHashes {
+		if err := ac.saveUser(context.Background(), User{
+			Username:     username,
+			PasswordHash: hash,
+			Role:         RoleAdmin,
+			CreatedAt:    time.Now(),
+		}); err != nil {
+			return err
+		}
+	}
+	if accountsWrapper.PasswordHashes == nil {
+		if err := ac.SetAccounts(accountsWrapper.Accounts); err != nil {
+			return err
+		}
+	}
+
+	return ac.storage.Delete(Settings).Filter(OrderedDocument{{"_id", "accounts"}}).One()
+}
+
+// SetAccounts adds the accounts as admin users, or replaces the passwords of the users which already exist
+func (ac *AuthController) SetAccounts(accounts gin.Accounts) error {
+	for username, password := range accounts {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+
+		ac.mutex.Lock()
+		user, isPresent := ac.users[username]
+		if !isPresent {
+			user = User{Username: username, CreatedAt: time.Now()}
+		}
+		user.PasswordHash = string(hash)
+		user.Role = RoleAdmin
+		err = ac.saveUser(context.Background(), user)
+		ac.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ac *AuthController) GetUsers() []User {
+	ac.mutex.Lock()
+	users := make([]User, 0, len(ac.users))
+	for _, user := range ac.users {
+		users = append(users, user)
+	}
+	ac.mutex.Unlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+func (ac *AuthController) GetUser(username string) (User, bool) {
+	ac.mutex.Lock()
+	user, isPresent := ac.users[username]
+	ac.mutex.Unlock()
+	return user, isPresent
+}
+
+func (ac *AuthController) AddUser(c context.Context, username, password, role string) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if _, isPresent := ac.users[username]; isPresent {
+		return User{}, errors.New("user already exists")
+	}
+	user := User{
+		Username:     username,
+		PasswordHash: string(hash),
+		Role:         role,
+		CreatedAt:    time.Now(),
+	}
+	if _, err := ac.storage.Insert(Users).Context(c).One(user); err != nil {
+		log.WithError(err).WithField("username", username).Error("failed to insert user")
+		return User{}, err
+	}
+	ac.users[username] = user
+
+	return user, nil
+}
+
+// UpdateUser changes the password and the role of a user. Empty values are not changed. When the password is
+// changed, the sessions of the user are closed
+func (ac *AuthController) UpdateUser(c context.Context, username, password, role string) (User, bool, error) {
+	var hash []byte
+	if password != "" {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return User{}, false, err
+		}
+	}
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	user, isPresent := ac.users[username]
+	if !isPresent {
+		return User{}, false, nil
+	}
+	if role != "" && role != RoleAdmin && ac.isLastAdmin(username) {
+		return User{}, true, errors.New("at least an admin is required")
+	}
+
+	if hash != nil {
+		user.PasswordHash = string(hash)
+	}
+	if role != "" {
+		user.Role = role
+	}
+	if err := ac.saveUser(c, user); err != nil {
+		log.WithError(err).WithField("username", username).Error("failed to update user")
+		return User{}, true, err
+	}
+	if hash != nil {
+		delete(ac.verified, username)
+		ac.deleteSessionTokens(c, username)
+	}
+
+	return user, true, nil
+}
+
+// DeleteUser removes a user and closes its sessions. The last admin can't be removed
+func (ac *AuthController) DeleteUser(c context.Context, username string) (bool, error) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if _, isPresent := ac.users[username]; !isPresent {
+		return false, nil
+	}
+	if ac.isLastAdmin(username) {
+		return true, errors.New("at least an admin is required")
+	}
+
+	if err := ac.storage.Delete(Users).Context(c).Filter(OrderedDocument{{"_id", username}}).One(); err != nil {
+		log.WithError(err).WithField("username", username).Error("failed to delete user")
+		return true, err
+	}
+	delete(ac.users, username)
+	delete(ac.verified, username)
+	ac.deleteSessionTokens(c, username)
+
+	return true, nil
+}
+
+func (ac *AuthController) CheckPassword(username, password string) bool {
+	mac := hmac.New(sha256.New, ac.verifiedKey)
+	mac.Write([]byte(password))
+	passwordMAC := mac.Sum(nil)
+	ac.mutex.Lock()
+	user, isPresent := ac.users[username]
+	verifiedMAC, isVerified := ac.verified[username]
+	ac.mutex.Unlock()
+	if !isPresent {
+		_ = bcrypt.CompareHashAndPassword(ac.dummyHash, []byte(password))
+		return false
+	}
+	if isVerified && hmac.Equal(verifiedMAC, passwordMAC) {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return false
+	}
+	ac.mutex.Lock()
+	ac.verified[username] = passwordMAC
+	ac.mutex.Unlock()
+	return true
+}
+
+// Login returns a new session token if the credentials are valid
+func (ac *AuthController) Login(c context.Context, username, password string) (string, time.Time, error) {
+	if !ac.CheckPassword(username, password) {
+		return "", time.Time{}, errors.New("invalid username or password")
+	}
+
+	token, err := randomSecret("")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// the expired tokens are removed at each login
+	if err := ac.storage.Delete(AuthTokens).Context(c).Filter(OrderedDocument{{"expires_at",
+		UnorderedDocument{"$lt": time.Now()}}}).Many(); err != nil {
+		log.WithError(err).Error("failed to delete expired session tokens")
+	}
+
+	sessionToken := SessionToken{
+		ID:        secretHash(token),
+		Username:  username,
+		ExpiresAt: time.Now().Add(sessionTokenDuration),
+	}
+	if _, err := ac.storage.Insert(AuthTokens).Context(c).One(sessionToken); err != nil {
+		log.WithError(err).Error("failed to insert session token")
+		return "", time.Time{}, err
+	}
+
+	return token, sessionToken.ExpiresAt, nil
+}
+
+func (ac *AuthController) Logout(c context.Context, token string) bool {
+	return ac.storage.Delete(AuthTokens).Context(c).Filter(OrderedDocument{{"_id", secretHash(token)}}).One() == nil
+}
+
+func (ac *AuthController) CreateAPIKey(c context.Context, name, role string) (APIKey, string, error) {
+	key, err := randomSecret(apiKeyPrefix)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	apiKey := APIKey{
+		ID:        NewRowID(),
+		Name:      name,
+		Role:      role,
+		KeyHash:   secretHash(key),
+		CreatedAt: time.Now(),
+	}
+	if _, err := ac.storage.Insert(APIKeys).Context(c).One(apiKey); err != nil {
+		log.WithError(err).WithField("name", name).Error("failed to insert api key")
+		return APIKey{}, "", err
+	}
+
+	return apiKey, key, nil
+}
+
+func (ac *AuthController) GetAPIKeys(c context.Context) []APIKey {
+	var apiKeys []APIKey
+	if err := ac.storage.Find(APIKeys).Context(c).Sort("_id", true).All(&apiKeys); err != nil {
+		log.WithError(err).Panic("failed to get api keys")
+	}
+
+	if apiKeys == nil {
+		return []APIKey{}
+	}
+	return apiKeys
+}
+
+func (ac *AuthController) DeleteAPIKey(c context.Context, id RowID) bool {
+	return ac.storage.Delete(APIKeys).Context(c).Filter(byID(id)).One() == nil
+}
+
+// Authenticate checks the credentials of a request, and returns the name and the role of the user or of the api
+// key. The credentials can be a session token or an api key in the bearer authorization, or the basic
+// authorization. Since the browsers can't set headers to websockets, the token can also be passed as query
+// parameter to them
+func (ac *AuthController) Authenticate(c context.Context, request *http.Request) (string, string, bool) {
+	authorization := request.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return ac.authenticateSecret(c, strings.TrimPrefix(authorization, "Bearer "))
+	}
+	if username, password, hasBasicAuth := request.BasicAuth(); hasBasicAuth {
+		if !ac.CheckPassword(username, password) {
+			return "", "", false
+		}
+		return ac.userRole(username)
+	}
+	if token := request.URL.Query().Get("token"); token != "" && websocket.IsWebSocketUpgrade(request) {
+		return ac.authenticateSecret(c, token)
+	}
+
+	return "", "", false
+}
+
+func (ac *AuthController) authenticateSecret(c context.Context, secret string) (string, string, bool) {
+	if strings.HasPrefix(secret, apiKeyPrefix) {
+		var apiKey APIKey
+		if err := ac.storage.Find(APIKeys).Context(c).Filter(OrderedDocument{{"key_hash", secretHash(secret)}}).
+			First(&apiKey); err != nil {
+			log.WithError(err).Error("failed to get api key")
+			return "", "", false
+		}
+		if apiKey.ID.IsZero() {
+			return "", "", false
+		}
+		if _, err := ac.storage.Update(APIKeys).Context(c).Filter(byID(apiKey.ID)).
+			One(UnorderedDocument{"last_used_at": time.Now()}); err != nil {
+			log.WithError(err).WithField("id", apiKey.ID).Error("failed to update api key")
+		}
+		if apiKey.Role == "" {
+			return apiKey.Name, RoleAdmin, true
+		}
+		return apiKey.Name, apiKey.Role, true
+	}
+
+	var sessionToken SessionToken
+	if err := ac.storage.Find(AuthTokens).Context(c).Filter(OrderedDocument{{"_id", secretHash(secret)}}).
+		First(&sessionToken); err != nil {
+		log.WithError(err).Error("failed to get session token")
+		return "", "", false
+	}
+	if sessionToken.ID == "" || sessionToken.ExpiresAt.Before(time.Now()) {
+		return "", "", false
+	}
+
+	return ac.userRole(sessionToken.Username)
+}
+
+// userRole returns the current role of a user, so the changes of the role apply to the open sessions too
+func (ac *AuthController) userRole(username string) (string, string, bool) {
+	ac.mutex.Lock()
+	user, isPresent := ac.users[username]
+	ac.mutex.Unlock()
+	return username, user.Role, isPresent
+}
+
+// saveUser must be called with the mutex locked, except during the initialization
+func (ac *AuthController) saveUser(c context.Context, user User) error {
+	var upsertResults interface{}
+	if _, err := ac.storage.Update(Users).Context(c).Upsert(&upsertResults).
+		Filter(OrderedDocument{{"_id", user.Username}}).One(user); err != nil {
+		return err
+	}
+	ac.users[user.Username] = user
+	return nil
+}
+
+func (ac *AuthController) isLastAdmin(username string) bool {
+	if ac.users[username].Role != RoleAdmin {
+		return false
+	}
+	for _, user := range ac.users {
+		if user.Role == RoleAdmin && user.Username != username {
+			return false
+		}
+	}
+	return true
+}
+
+func (ac *AuthController) deleteSessionTokens(c context.Context, username string) {
+	// an error is returned also when the user has no sessions
+	_ = ac.storage.Delete(AuthTokens).Context(c).Filter(OrderedDocument{{"username", username}}).Many()
+}
+
+// HasRole returns true if a role has at least the privileges of the required role
+func HasRole(role, requiredRole string) bool {
+	return roleLevels[role] >= roleLevels[requiredRole]
+}
+
+func randomSecret(prefix string) (string, error) {
+	secret := make([]byte, secretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(secret), nil
+}
+
+func secretHash(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
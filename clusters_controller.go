@@ -0,0 +1,457 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"math/bits"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusteringInterval         = 10 * time.Second
+	clusteringBatchSize        = 500
+	maxFingerprintMessages     = 64
+	maxFingerprintPayload      = 64 * 1024
+	maxFingerprintTokens       = 512
+	clusterSimilarityThreshold = 0.75
+	novelConnectionDistance    = 0.5
+	novelDetectionQueueSize    = 1024
+)
+
+var fingerprintTokenPattern = regexp.MustCompile(`[A-Za-z_]+|[0-9]+|[^\sA-Za-z0-9_]`)
+
+// ConnectionFingerprint describes the structure of a connection, ignoring the parts which change between
+// the executions of the same exploit
+type ConnectionFingerprint struct {
+	Directions string   `json:"directions" bson:"directions"` // c or s for each group of messages of the same side
+	Sizes      []int    `json:"sizes" bson:"sizes"`           // the magnitude of the size of each group of messages
+	Tokens     []string `json:"tokens" bson:"tokens"`         // the normalized pairs of tokens sent by the client
+	Rules      []RowID  `json:"rules" bson:"rules"`
+}
+
+type Cluster struct {
+	ID                       RowID                 `json:"id" bson:"_id"`
+	ServicePort              uint16                `json:"service_port" bson:"service_port"`
+	Fingerprint              ConnectionFingerprint `json:"fingerprint" bson:"fingerprint"`
+	RepresentativeConnection RowID                 `json:"representative_connection" bson:"representative_connection"`
+	ConnectionsCount         int                   `json:"connections_count" bson:"connections_count"`
+	FirstSeen                time.Time             `json:"first_seen" bson:"first_seen"`
+	LastSeen                 time.Time             `json:"last_seen" bson:"last_seen"`
+}
+
+type ClustersFilter struct {
+	ServicePort uint16 `form:"service_port"`
+	MinCount    int    `form:"min_count"`
+	Limit       int64  `form:"limit"`
+}
+
+type ClustersController struct {
+	storage                     Storage
+	connectionStreamsController ConnectionStreamsController
+	notificationController      *NotificationController
+	ignorePatterns              []*regexp.Regexp
+	clusters                    map[uint16][]*Cluster // the clusters of each service, loaded at the first run
+	mClusters                   sync.Mutex
+	completedConnections        chan Connection
+}
+
+func NewClustersController(storage Storage, connectionStreamsController ConnectionStreamsController,
+	notificationController *NotificationController, ignorePatterns []*regexp.Regexp) *ClustersController {
+	clustersController := &ClustersController{
+		storage:                     storage,
+		connectionStreamsController: connectionStreamsController,
+		notificationController:      notificationController,
+		ignorePatterns:              append(append([]*regexp.Regexp{}, tokenPatterns...), ignorePatterns...),
+		completedConnections:        make(chan Connection, novelDetectionQueueSize),
+	}
+
+	go clustersController.clusteringService()
+
+	return clustersController
+}
+
+// SetIgnorePatterns changes the patterns, in addition to the random tokens, which are ignored by the fingerprints
+func (cc *ClustersController) SetIgnorePatterns(ignorePatterns []*regexp.Regexp) {
+	cc.mClusters.Lock()
+	cc.ignorePatterns = append(append([]*regexp.Regexp{}, tokenPatterns...), ignorePatterns...)
+	cc.mClusters.Unlock()
+}
+
+func (cc *ClustersController) GetClusters(c context.Context, filter ClustersFilter) []Cluster {
+	var clusters []Cluster
+	query := cc.storage.Find(Clusters).Context(c).Sort("first_seen", false)
+	if filter.ServicePort > 0 {
+		query = query.Filter(OrderedDocument{{"service_port", filter.ServicePort}})
+	}
+	if filter.MinCount > 0 {
+		query = query.Filter(OrderedDocument{{"connections_count", UnorderedDocument{"$gte": filter.MinCount}}})
+	}
+	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
+		query = query.Limit(filter.Limit)
+	} else {
+		query = query.Limit(DefaultQueryLimit)
+	}
+
+	if err := query.All(&clusters); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get clusters")
+	}
+
+	if clusters == nil {
+		return []Cluster{}
+	}
+	return clusters
+}
+
+func (cc *ClustersController) GetCluster(c context.Context, id RowID) (Cluster, bool) {
+	var cluster Cluster
+	if err := cc.storage.Find(Clusters).Context(c).Filter(byID(id)).First(&cluster); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to get cluster")
+	}
+
+	return cluster, !cluster.ID.IsZero()
+}
+
+// ClusterConnections assigns a cluster to the connections which don't have one yet, and returns the number of
+// connections assigned. The connections just completed are left to DetectNovelConnection
+func (cc *ClustersController) ClusterConnections(c context.Context) int {
+	var connections []Connection
+	if err := cc.storage.Find(Connections).Context(c).Filter(OrderedDocument{
+		{"cluster_id", UnorderedDocument{"$exists": false}},
+		{"replay_of", UnorderedDocument{"$exists": false}},
+		{"processed_at", UnorderedDocument{"$lt": time.Now().Add(-clusteringInterval)}},
+	}).Sort("_id", true).Limit(clusteringBatchSize).All(&connections); err != nil {
+		log.WithError(err).Error("failed to get the connections to cluster")
+		return 0
+	}
+
+	for _, connection := range connections {
+		if !cc.clusterConnection(c, connection) {
+			return 0
+		}
+	}
+
+	return len(connections)
+}
+
+// DetectNovelConnection queues a connection just completed, which is assigned to a cluster and marked as novel
+// when it is too distant from all the known clusters of its service. It doesn't block the caller: when the queue
+// is full the connection is clustered later by ClusterConnections
+func (cc *ClustersController) DetectNovelConnection(_ context.Context, connection Connection) {
+	select {
+	case cc.completedConnections <- connection:
+	default:
+		log.WithField("connection_id", connection.ID).Debug("novel connections queue is full")
+	}
+}
+
+func (cc *ClustersController) loadClusters(c context.Context) bool {
+	cc.mClusters.Lock()
+	loaded := cc.clusters != nil
+	cc.mClusters.Unlock()
+	if loaded {
+		return true
+	}
+
+	var result []*Cluster
+	if err := cc.storage.Find(Clusters).Context(c).All(&result); err != nil {
+		log.WithError(err).Error("failed to load clusters")
+		return false
+	}
+	clusters := make(map[uint16][]*Cluster)
+	for _, cluster := range result {
+		clusters[cluster.ServicePort] = append(clusters[cluster.ServicePort], cluster)
+	}
+
+	cc.mClusters.Lock()
+	if cc.clusters == nil {
+		cc.clusters = clusters
+	}
+	cc.mClusters.Unlock()
+	return true
+}
+
+// clusterConnection assigns a cluster to a connection, and notifies it if it is novel. The first connections of a
+// service are never novel, since there is nothing to compare them with. The lock is held only while the clusters
+// in memory are compared and updated, not while the storage is read or written
+func (cc *ClustersController) clusterConnection(c context.Context, connection Connection) bool {
+	cc.mClusters.Lock()
+	ignorePatterns := cc.ignorePatterns
+	cc.mClusters.Unlock()
+	fingerprint := cc.computeFingerprint(c, connection, ignorePatterns)
+	if !cc.loadClusters(c) {
+		return false
+	}
+
+	cc.mClusters.Lock()
+	knownService := len(cc.clusters[connection.DestinationPort]) > 0
+	cluster, similarity, isNew := cc.assignCluster(connection, fingerprint)
+	cc.mClusters.Unlock()
+
+	var err error
+	if isNew {
+		_, err = cc.storage.Insert(Clusters).Context(c).One(cluster)
+	} else {
+		_, err = cc.storage.Update(Clusters).Context(c).Filter(byID(cluster.ID)).OneComplex(UnorderedDocument{
+			"$inc": UnorderedDocument{"connections_count": 1},
+			"$min": UnorderedDocument{"first_seen": connection.StartedAt},
+			"$max": UnorderedDocument{"last_seen": connection.StartedAt},
+		})
+	}
+	if err != nil {
+		log.WithError(err).WithField("cluster_id", cluster.ID).Error("failed to save cluster")
+		// the clusters in memory are reloaded from the storage, to not keep the changes which were not saved
+		cc.mClusters.Lock()
+		cc.clusters = nil
+		cc.mClusters.Unlock()
+		return false
+	}
+
+	distance := 1 - similarity
+	novel := knownService && distance > novelConnectionDistance
+	update := UnorderedDocument{"cluster_id": cluster.ID}
+	if novel {
+		update["novel"] = true
+	}
+	if _, err := cc.storage.Update(Connections).Context(c).Filter(byID(connection.ID)).One(update); err != nil {
+		log.WithError(err).WithField("connection_id", connection.ID).Error("failed to set the connection cluster")
+		return false
+	}
+
+	if novel {
+		connection.ClusterID = &cluster.ID
+		connection.Novel = true
+		cc.notificationController.Notify("connections.novel", gin.H{
+			"connection": connection,
+			"cluster_id": cluster.ID,
+			"distance":   distance,
+		})
+	}
+
+	return true
+}
+
+// clusteringService clusters the connections just completed, and periodically the ones which were not clustered.
+// Both are done by this goroutine, so that the same connection is not clustered twice
+func (cc *ClustersController) clusteringService() {
+	ticker := time.NewTicker(clusteringInterval)
+	for {
+		select {
+		case connection := <-cc.completedConnections:
+			cc.clusterConnection(context.Background(), connection)
+		case <-ticker.C:
+			// the connections are processed in batches, until the last batch is not full
+			for {
+				if cc.ClusterConnections(context.Background()) < clusteringBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// assignCluster finds the most similar cluster of the same service, or creates a new one, and updates it in memory.
+// It returns a copy of the cluster to save, the similarity with the closest cluster which existed before, and if the
+// cluster is new. It must be called with the lock held
+func (cc *ClustersController) assignCluster(connection Connection, fingerprint ConnectionFingerprint) (Cluster,
+	float64, bool) {
+	bestCluster, similarity := cc.closestCluster(connection.DestinationPort, fingerprint)
+	if similarity < clusterSimilarityThreshold {
+		cluster := &Cluster{
+			ID:                       NewRowID(),
+			ServicePort:              connection.DestinationPort,
+			Fingerprint:              fingerprint,
+			RepresentativeConnection: connection.ID,
+			ConnectionsCount:         1,
+			FirstSeen:                connection.StartedAt,
+			LastSeen:                 connection.StartedAt,
+		}
+		cc.clusters[cluster.ServicePort] = append(cc.clusters[cluster.ServicePort], cluster)
+		return *cluster, similarity, true
+	}
+
+	bestCluster.ConnectionsCount++
+	if connection.StartedAt.Before(bestCluster.FirstSeen) {
+		bestCluster.FirstSeen = connection.StartedAt
+	}
+	if connection.StartedAt.After(bestCluster.LastSeen) {
+		bestCluster.LastSeen = connection.StartedAt
+	}
+	return *bestCluster, similarity, false
+}
+
+// closestCluster returns the most similar cluster of a service with its similarity, which is 0 if there are none
+func (cc *ClustersController) closestCluster(port uint16, fingerprint ConnectionFingerprint) (*Cluster, float64) {
+	var bestCluster *Cluster
+	var bestSimilarity float64
+	for _, cluster := range cc.clusters[port] {
+		similarity := fingerprintSimilarity(cluster.Fingerprint, fingerprint)
+		if bestCluster == nil || similarity > bestSimilarity {
+			bestCluster, bestSimilarity = cluster, similarity
+		}
+	}
+
+	return bestCluster, bestSimilarity
+}
+
+func (cc *ClustersController) computeFingerprint(c context.Context, connection Connection,
+	ignorePatterns []*regexp.Regexp) ConnectionFingerprint {
+	var directions strings.Builder
+	var sizes []int
+	var clientPayload []byte
+	var size int
+	lastFromClient, hasLastSide := false, false
+
+	cursor := cc.connectionStreamsController.newMessagesCursor(c, connection.ID, isDecrypted(connection), true)
+	for side := cursor.nextSide(); side != nil; side = cursor.nextSide() {
+		if !hasLastSide || side.fromClient != lastFromClient {
+			if hasLastSide {
+				sizes = append(sizes, bits.Len(uint(size)))
+			}
+			if len(sizes) >= maxFingerprintMessages {
+				size = 0
+				break
+			}
+			if side.fromClient {
+				directions.WriteByte('c')
+			} else {
+				directions.WriteByte('s')
+			}
+			size = 0
+		}
+		payload := blockPayload(side.stream, side.blocksIndex)
+		size += len(payload)
+		if side.fromClient && len(clientPayload) < maxFingerprintPayload {
+			clientPayload = append(clientPayload, payload...)
+		}
+
+		lastFromClient, hasLastSide = side.fromClient, true
+		cursor.advance(side)
+	}
+	if size > 0 {
+		sizes = append(sizes, bits.Len(uint(size)))
+	}
+	if len(clientPayload) > maxFingerprintPayload {
+		clientPayload = clientPayload[:maxFingerprintPayload]
+	}
+
+	rules := append([]RowID{}, connection.MatchedRules...)
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Hex() < rules[j].Hex()
+	})
+
+	return ConnectionFingerprint{
+		Directions: directions.String(),
+		Sizes:      sizes,
+		Tokens:     fingerprintTokens(clientPayload, ignorePatterns),
+		Rules:      rules,
+	}
+}
+
+// fingerprintTokens returns the pairs of consecutive tokens of a payload, with the numbers and the parts which
+// look like flags or random tokens replaced by placeholders
+func fingerprintTokens(payload []byte, ignorePatterns []*regexp.Regexp) []string {
+	message := &Message{Content: string(payload)}
+	ranges := ignoredRanges(message, ignorePatterns, false)
+	normalized := maskRanges(message.Content, 0, len(message.Content), ranges)
+
+	var tokens []string
+	for _, token := range fingerprintTokenPattern.FindAllString(normalized, -1) {
+		if token == maskedKey {
+			token = "<token>"
+		} else if token[0] >= '0' && token[0] <= '9' {
+			token = "<num>"
+		}
+		tokens = append(tokens, token)
+	}
+
+	pairs := make(map[string]bool)
+	for i := 1; i < len(tokens) && len(pairs) < maxFingerprintTokens; i++ {
+		pairs[tokens[i-1]+" "+tokens[i]] = true
+	}
+	if len(tokens) == 1 {
+		pairs[tokens[0]] = true
+	}
+
+	result := make([]string, 0, len(pairs))
+	for pair := range pairs {
+		result = append(result, pair)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// fingerprintSimilarity returns a value between 0 and 1 which is 1 when the fingerprints are the same
+func fingerprintSimilarity(a, b ConnectionFingerprint) float64 {
+	aSizes, bSizes := make([]string, len(a.Sizes)), make([]string, len(b.Sizes))
+	for i, size := range a.Sizes {
+		aSizes[i] = string(rune('0' + size))
+	}
+	for i, size := range b.Sizes {
+		bSizes[i] = string(rune('0' + size))
+	}
+	aRules, bRules := make([]string, len(a.Rules)), make([]string, len(b.Rules))
+	for i, rule := range a.Rules {
+		aRules[i] = rule.Hex()
+	}
+	for i, rule := range b.Rules {
+		bRules[i] = rule.Hex()
+	}
+
+	return 0.2*sequenceSimilarity(strings.Split(a.Directions, ""), strings.Split(b.Directions, "")) +
+		0.15*sequenceSimilarity(aSizes, bSizes) +
+		0.5*jaccardSimilarity(a.Tokens, b.Tokens) +
+		0.15*jaccardSimilarity(aRules, bRules)
+}
+
+// sequenceSimilarity is the ratio of the elements in common in the longest common subsequence
+func sequenceSimilarity(a, b []string) float64 {
+	if len(a)+len(b) == 0 {
+		return 1
+	}
+	var common int
+	for _, operation := range diffKeys(a, b) {
+		if operation.kind == DiffChunkEqual {
+			common++
+		}
+	}
+	return 2 * float64(common) / float64(len(a)+len(b))
+}
+
+func jaccardSimilarity(a, b []string) float64 {
+	if len(a)+len(b) == 0 {
+		return 1
+	}
+	elements := make(map[string]bool, len(a))
+	for _, element := range a {
+		elements[element] = true
+	}
+	var intersection int
+	for _, element := range b {
+		if elements[element] {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
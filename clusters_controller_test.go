@@ -0,0 +1,63 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+)
+
+func TestFingerprintSimilarity(t *testing.T) {
+	patterns := append([]*regexp.Regexp{regexp.MustCompile(`FLAG\{\w+\}`)}, tokenPatterns...)
+	firstTokens := fingerprintTokens([]byte("GET /note?id=1337&token=5f4dcc3b5aa765d61d8327deb882cf99 HTTP/1.1\r\n"+
+		"Host: 10.10.1.1\r\n\r\n"), patterns)
+	secondTokens := fingerprintTokens([]byte("GET /note?id=42&token=e99a18c428cb38d5f260853678922e03 HTTP/1.1\r\n"+
+		"Host: 10.10.7.1\r\n\r\n"), patterns)
+	assert.Equal(t, firstTokens, secondTokens)
+	assert.Contains(t, firstTokens, "id =")
+	assert.Contains(t, firstTokens, "= <num>")
+	assert.Contains(t, firstTokens, "= <token>")
+
+	rule := NewRowID()
+	first := ConnectionFingerprint{Directions: "cs", Sizes: []int{7, 9}, Tokens: firstTokens, Rules: []RowID{rule}}
+	second := ConnectionFingerprint{Directions: "cs", Sizes: []int{7, 10}, Tokens: secondTokens, Rules: []RowID{rule}}
+	assert.Equal(t, 1.0, fingerprintSimilarity(first, first))
+	assert.GreaterOrEqual(t, fingerprintSimilarity(first, second), clusterSimilarityThreshold)
+
+	third := ConnectionFingerprint{Directions: "scscsc", Sizes: []int{4, 3, 4, 3, 4, 6},
+		Tokens: fingerprintTokens([]byte("1\nadmin\n3\n"), patterns)}
+	assert.Less(t, fingerprintSimilarity(first, third), clusterSimilarityThreshold)
+
+	assert.Equal(t, 1.0, jaccardSimilarity(nil, nil))
+	assert.Equal(t, 0.5, jaccardSimilarity([]string{"a", "b"}, []string{"a", "b", "c", "d"}))
+	assert.Equal(t, 0.5, sequenceSimilarity([]string{"c", "s"}, []string{"s", "c"}))
+}
+
+func TestDetectNovelConnectionDoesNotBlock(t *testing.T) {
+	controller := &ClustersController{completedConnections: make(chan Connection, 1)}
+	first, second := Connection{ID: NewRowID()}, Connection{ID: NewRowID()}
+
+	// the connections which don't fit in the queue are left to the periodic clustering
+	controller.DetectNovelConnection(context.Background(), first)
+	controller.DetectNovelConnection(context.Background(), second)
+	require.Len(t, controller.completedConnections, 1)
+	assert.Equal(t, first.ID, (<-controller.completedConnections).ID)
+}
@@ -0,0 +1,245 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Comment is a message left by a user on a connection. Comments can reply to other comments of the same
+// connection, and when a comment is edited the previous versions are kept in History
+type Comment struct {
+	ID           RowID             `json:"id" bson:"_id"`
+	ConnectionID RowID             `json:"connection_id" bson:"connection_id"`
+	ReplyTo      *RowID            `json:"reply_to,omitempty" bson:"reply_to,omitempty"`
+	Author       string            `json:"author" bson:"author"`
+	Text         string            `json:"text" bson:"text"`
+	CreatedAt    time.Time         `json:"created_at" bson:"created_at"`
+	EditedBy     string            `json:"edited_by,omitempty" bson:"edited_by,omitempty"`
+	EditedAt     time.Time         `json:"edited_at" bson:"edited_at,omitempty"`
+	History      []CommentRevision `json:"history" bson:"history,omitempty"`
+}
+
+// CommentRevision is a previous version of a comment, with who wrote it and when
+type CommentRevision struct {
+	Text      string    `json:"text" bson:"text"`
+	Author    string    `json:"author" bson:"author"`
+	WrittenAt time.Time `json:"written_at" bson:"written_at"`
+}
+
+type CommentsFilter struct {
+	Text         string `form:"text"`
+	Author       string `form:"author"`
+	ConnectionID string `form:"connection_id" binding:"omitempty,hexadecimal,len=24"`
+	Limit        int64  `form:"limit"`
+}
+
+type CommentsController struct {
+	storage Storage
+}
+
+func NewCommentsController(storage Storage) *CommentsController {
+	commentsController := &CommentsController{
+		storage: storage,
+	}
+	commentsController.migrateComments()
+
+	return commentsController
+}
+
+// migrateComments converts the single comments saved on the connections by the previous versions to comments
+func (cc *CommentsController) migrateComments() {
+	var comments []Comment
+	if err := cc.storage.Find(Comments).Limit(1).All(&comments); err != nil {
+		log.WithError(err).Panic("failed to retrieve comments")
+	}
+	if len(comments) > 0 {
+		return
+	}
+
+	var connections []Connection
+	if err := cc.storage.Find(Connections).Filter(OrderedDocument{{"comment", UnorderedDocument{"$exists": true}}}).
+		Projection(OrderedDocument{{"_id", 1}, {"comment", 1}, {"processed_at", 1}}).All(&connections); err != nil {
+		log.WithError(err).Panic("failed to retrieve commented connections")
+	}
+	for _, connection := range connections {
+		if connection.Comment == "" {
+			continue
+		}
+		comment := Comment{
+			ID:           NewRowID(),
+			ConnectionID: connection.ID,
+			Text:         connection.Comment,
+			CreatedAt:    connection.ProcessedAt,
+		}
+		if _, err := cc.storage.Insert(Comments).One(comment); err != nil {
+			log.WithError(err).WithField("connection", connection.ID).Error("failed to migrate comment")
+		}
+	}
+}
+
+// AddComment saves a new comment, and sets it as the last comment of the connection
+func (cc *CommentsController) AddComment(c context.Context, connectionID RowID, replyTo *RowID,
+	author, text string) (Comment, error) {
+	if replyTo != nil {
+		if repliedComment, isPresent := cc.GetComment(c, *replyTo); !isPresent ||
+			repliedComment.ConnectionID != connectionID {
+			return Comment{}, errors.New("the replied comment is not on the same connection")
+		}
+	}
+
+	comment := Comment{
+		ID:           NewRowID(),
+		ConnectionID: connectionID,
+		ReplyTo:      replyTo,
+		Author:       author,
+		Text:         text,
+		CreatedAt:    time.Now(),
+	}
+	if _, err := cc.storage.Insert(Comments).Context(c).One(comment); err != nil {
+		log.WithError(err).WithField("comment", comment).Error("failed to insert comment")
+		return Comment{}, err
+	}
+	cc.setLastComment(c, connectionID)
+
+	return comment, nil
+}
+
+// addComments adds the same comment to all the selected connections, and returns the number of connections
+func (cc *CommentsController) addComments(c context.Context, selection OrderedDocument,
+	author, text string) (int64, error) {
+	var connections []Connection
+	if err := cc.storage.Find(Connections).Context(c).Filter(selection).Projection(OrderedDocument{{"_id", 1}}).
+		All(&connections); err != nil {
+		return 0, err
+	}
+	if len(connections) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]RowID, len(connections))
+	comments := make([]interface{}, len(connections))
+	createdAt := time.Now()
+	for i, connection := range connections {
+		ids[i] = connection.ID
+		comments[i] = Comment{
+			ID:           NewRowID(),
+			ConnectionID: connection.ID,
+			Author:       author,
+			Text:         text,
+			CreatedAt:    createdAt,
+		}
+	}
+	if _, err := cc.storage.Insert(Comments).Context(c).Many(comments); err != nil {
+		return 0, err
+	}
+	if _, err := cc.storage.Update(Connections).Context(c).Filter(OrderedDocument{{"_id",
+		UnorderedDocument{"$in": ids}}}).Many(UnorderedDocument{"comment": text}); err != nil {
+		return 0, err
+	}
+
+	return int64(len(connections)), nil
+}
+
+func (cc *CommentsController) GetComment(c context.Context, id RowID) (Comment, bool) {
+	var comment Comment
+	if err := cc.storage.Find(Comments).Context(c).Filter(byID(id)).First(&comment); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to get comment")
+	}
+
+	return comment, !comment.ID.IsZero()
+}
+
+// GetComments returns the comments of a connection from the oldest
+func (cc *CommentsController) GetComments(c context.Context, connectionID RowID) []Comment {
+	return cc.SearchComments(c, CommentsFilter{ConnectionID: connectionID.Hex(), Limit: MaxQueryLimit})
+}
+
+// EditComment replaces the text of a comment, and saves the previous text in the history
+func (cc *CommentsController) EditComment(c context.Context, id RowID, editor, text string) (Comment, bool) {
+	comment, isPresent := cc.GetComment(c, id)
+	if !isPresent {
+		return Comment{}, false
+	}
+
+	revision := CommentRevision{Text: comment.Text, Author: comment.Author, WrittenAt: comment.CreatedAt}
+	if !comment.EditedAt.IsZero() {
+		revision.Author, revision.WrittenAt = comment.EditedBy, comment.EditedAt
+	}
+	comment.History = append(comment.History, revision)
+	comment.Text = text
+	comment.EditedBy = editor
+	comment.EditedAt = time.Now()
+	if _, err := cc.storage.Update(Comments).Context(c).Filter(byID(id)).One(comment); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to update comment")
+	}
+	cc.setLastComment(c, comment.ConnectionID)
+
+	return comment, true
+}
+
+// SearchComments returns the comments which match the filter, from the oldest. Text is searched case-insensitive
+func (cc *CommentsController) SearchComments(c context.Context, filter CommentsFilter) []Comment {
+	var comments []Comment
+	query := cc.storage.Find(Comments).Context(c).Sort("_id", true)
+	if filter.Text != "" {
+		query = query.Filter(OrderedDocument{{"text", UnorderedDocument{
+			"$regex": regexp.QuoteMeta(filter.Text), "$options": "i"}}})
+	}
+	if filter.Author != "" {
+		query = query.Filter(OrderedDocument{{"author", filter.Author}})
+	}
+	if filter.ConnectionID != "" {
+		connectionID, _ := RowIDFromHex(filter.ConnectionID)
+		query = query.Filter(OrderedDocument{{"connection_id", connectionID}})
+	}
+	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
+		query = query.Limit(filter.Limit)
+	} else {
+		query = query.Limit(DefaultQueryLimit)
+	}
+
+	if err := query.All(&comments); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get comments")
+	}
+
+	if comments == nil {
+		return []Comment{}
+	}
+	return comments
+}
+
+// setLastComment copies the text of the last comment of a connection in the connection, to show it in the list
+func (cc *CommentsController) setLastComment(c context.Context, connectionID RowID) {
+	var comment Comment
+	if err := cc.storage.Find(Comments).Context(c).Filter(OrderedDocument{{"connection_id", connectionID}}).
+		Sort("_id", false).First(&comment); err != nil {
+		log.WithError(err).WithField("connection", connectionID).Error("failed to get last comment")
+		return
+	}
+
+	if _, err := cc.storage.Update(Connections).Context(c).Filter(byID(connectionID)).
+		One(UnorderedDocument{"comment": comment.Text}); err != nil {
+		log.WithError(err).WithField("connection", connectionID).Error("failed to update connection comment")
+	}
+}
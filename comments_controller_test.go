@@ -0,0 +1,67 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCommentsThread(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(Comments)
+
+	// the comments of the previous versions are migrated
+	legacy := Connection{ID: NewRowID(), Comment: "legacy comment"}
+	other := Connection{ID: NewRowID()}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many([]interface{}{legacy, other})
+	require.NoError(t, err)
+	controller := NewCommentsController(wrapper.Storage)
+	comments := controller.GetComments(wrapper.Context, legacy.ID)
+	require.Len(t, comments, 1)
+	assert.Equal(t, "legacy comment", comments[0].Text)
+
+	reply, err := controller.AddComment(wrapper.Context, legacy.ID, &comments[0].ID, "alice", "exploit for the login")
+	require.NoError(t, err)
+	_, err = controller.AddComment(wrapper.Context, other.ID, &comments[0].ID, "bob", "wrong thread")
+	assert.Error(t, err)
+
+	edited, isPresent := controller.EditComment(wrapper.Context, reply.ID, "bob", "exploit for the register")
+	require.True(t, isPresent)
+	assert.Equal(t, "bob", edited.EditedBy)
+	require.Len(t, edited.History, 1)
+	assert.Equal(t, "exploit for the login", edited.History[0].Text)
+	assert.Equal(t, "alice", edited.History[0].Author)
+	assert.WithinDuration(t, reply.CreatedAt, edited.History[0].WrittenAt, time.Millisecond)
+
+	comments = controller.SearchComments(wrapper.Context, CommentsFilter{Text: "REGISTER"})
+	require.Len(t, comments, 1)
+	assert.Equal(t, reply.ID, comments[0].ID)
+	assert.Len(t, controller.SearchComments(wrapper.Context, CommentsFilter{Author: "alice"}), 1)
+
+	// the connection shows the last comment
+	var connection Connection
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Filter(byID(legacy.ID)).
+		First(&connection))
+	assert.Equal(t, "exploit for the register", connection.Comment)
+
+	wrapper.Destroy(t)
+}
@@ -18,14 +18,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"github.com/eciavatta/caronte/parsers"
 	"github.com/flier/gohs/hyperscan"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
 	log "github.com/sirupsen/logrus"
 	"hash/fnv"
-	"net"
 	"sync"
 	"time"
 )
@@ -35,22 +37,40 @@ const initialScannersCapacity = 1024
 
 type BiDirectionalStreamFactory struct {
 	storage        Storage
-	serverNet      net.IPNet
+	serverNetworks *ServerNetworks
 	connections    map[StreamFlow]ConnectionHandler
 	mConnections   sync.Mutex
 	rulesManager   RulesManager
 	rulesDatabase  RulesDatabase
 	mRulesDatabase sync.Mutex
 	scanners       []Scanner
+	tlsKeys        TLSKeyProvider
+	flowsSessions  map[StreamFlow]flowSessions
+	mFlowsSessions sync.Mutex
+	teams          TeamResolver
+	novelDetector  NovelConnectionsDetector
+	gameClock      GameClock
+	mSettings      sync.Mutex
 }
 
 type StreamFlow [4]gopacket.Endpoint
 
+// flowSessions are the importing sessions which read the packets of a connection not completed yet
+type flowSessions struct {
+	sessions []string
+	lastSeen time.Time
+}
+
 type Scanner struct {
 	scratch *hyperscan.Scratch
 	version RowID
 }
 
+// NovelConnectionsDetector is notified of each completed connection, after its streams are stored
+type NovelConnectionsDetector interface {
+	DetectNovelConnection(c context.Context, connection Connection)
+}
+
 type ConnectionHandler interface {
 	Complete(handler *StreamHandler)
 	Storage() Storage
@@ -65,17 +85,24 @@ type connectionHandlerImpl struct {
 	otherStream    *StreamHandler
 }
 
-func NewBiDirectionalStreamFactory(storage Storage, serverNet net.IPNet,
-	rulesManager RulesManager) *BiDirectionalStreamFactory {
+func NewBiDirectionalStreamFactory(storage Storage, serverNetworks *ServerNetworks, rulesManager RulesManager,
+	tlsKeys TLSKeyProvider, teams TeamResolver, novelDetector NovelConnectionsDetector,
+	gameClock GameClock) *BiDirectionalStreamFactory {
 
 	factory := &BiDirectionalStreamFactory{
 		storage:        storage,
-		serverNet:      serverNet,
+		serverNetworks: serverNetworks,
 		connections:    make(map[StreamFlow]ConnectionHandler, initialConnectionsCapacity),
 		mConnections:   sync.Mutex{},
 		rulesManager:   rulesManager,
 		mRulesDatabase: sync.Mutex{},
 		scanners:       make([]Scanner, 0, initialScannersCapacity),
+		tlsKeys:        tlsKeys,
+		flowsSessions:  make(map[StreamFlow]flowSessions, initialConnectionsCapacity),
+		mFlowsSessions: sync.Mutex{},
+		teams:          teams,
+		novelDetector:  novelDetector,
+		gameClock:      gameClock,
 	}
 
 	go factory.updateRulesDatabaseService()
@@ -147,13 +174,105 @@ func (factory *BiDirectionalStreamFactory) releaseScanner(scanner Scanner) {
 	factory.scanners = append(factory.scanners, scanner)
 }
 
+// TrackSession records that a packet of the connection identified by flow (from client to server) has been read
+// from the pcap of an importing session
+func (factory *BiDirectionalStreamFactory) TrackSession(flow StreamFlow, sessionID string, seen time.Time) {
+	factory.mFlowsSessions.Lock()
+	defer factory.mFlowsSessions.Unlock()
+
+	tracked := factory.flowsSessions[flow]
+	if seen.After(tracked.lastSeen) {
+		tracked.lastSeen = seen
+	}
+	for _, session := range tracked.sessions {
+		if session == sessionID {
+			factory.flowsSessions[flow] = tracked
+			return
+		}
+	}
+	tracked.sessions = append(tracked.sessions, sessionID)
+	factory.flowsSessions[flow] = tracked
+}
+
+func (factory *BiDirectionalStreamFactory) takeSessions(flow StreamFlow) []string {
+	factory.mFlowsSessions.Lock()
+	defer factory.mFlowsSessions.Unlock()
+
+	tracked := factory.flowsSessions[flow]
+	delete(factory.flowsSessions, flow)
+	return tracked.sessions
+}
+
+// ReleaseSession forgets the connections tracked by an importing session whose connections are all completed.
+// The connections which never complete, such as the ones of which only one side was captured, are not taken
+func (factory *BiDirectionalStreamFactory) ReleaseSession(sessionID string) {
+	factory.mFlowsSessions.Lock()
+	defer factory.mFlowsSessions.Unlock()
+
+	for flow, tracked := range factory.flowsSessions {
+		sessions := tracked.sessions[:0]
+		for _, session := range tracked.sessions {
+			if session != sessionID {
+				sessions = append(sessions, session)
+			}
+		}
+		if len(sessions) == 0 {
+			delete(factory.flowsSessions, flow)
+		} else {
+			tracked.sessions = sessions
+			factory.flowsSessions[flow] = tracked
+		}
+	}
+}
+
+// ExpireSessions forgets the connections tracked without packets after olderThan, like the assembler flush does
+// with the connections idle for too long. It returns the number of the forgotten connections
+func (factory *BiDirectionalStreamFactory) ExpireSessions(olderThan time.Time) int {
+	factory.mFlowsSessions.Lock()
+	defer factory.mFlowsSessions.Unlock()
+
+	expired := 0
+	for flow, tracked := range factory.flowsSessions {
+		if tracked.lastSeen.Before(olderThan) {
+			delete(factory.flowsSessions, flow)
+			expired++
+		}
+	}
+	return expired
+}
+
+// UpdateSettings changes the server networks and the game clock used for the new connections
+func (factory *BiDirectionalStreamFactory) UpdateSettings(serverNetworks *ServerNetworks, gameClock GameClock) {
+	factory.mSettings.Lock()
+	factory.serverNetworks = serverNetworks
+	factory.gameClock = gameClock
+	factory.mSettings.Unlock()
+}
+
+// isServerFlow returns true if the flow is from the server to the client. The direction chosen when the packets
+// of the flow were tracked is preferred to keep the connection consistent with its importing session
+func (factory *BiDirectionalStreamFactory) isServerFlow(flow StreamFlow) bool {
+	factory.mFlowsSessions.Lock()
+	_, isClientFlow := factory.flowsSessions[flow]
+	_, isServerFlow := factory.flowsSessions[StreamFlow{flow[1], flow[0], flow[3], flow[2]}]
+	factory.mFlowsSessions.Unlock()
+	if isClientFlow != isServerFlow {
+		return isServerFlow
+	}
+
+	factory.mSettings.Lock()
+	serverNetworks := factory.serverNetworks
+	factory.mSettings.Unlock()
+	return !serverNetworks.IsDstServer(flow, nil, nil)
+}
+
 func (factory *BiDirectionalStreamFactory) New(netFlow, transportFlow gopacket.Flow) tcpassembly.Stream {
 	flow := StreamFlow{netFlow.Src(), netFlow.Dst(), transportFlow.Src(), transportFlow.Dst()}
 	invertedFlow := StreamFlow{netFlow.Dst(), netFlow.Src(), transportFlow.Dst(), transportFlow.Src()}
 
 	factory.mConnections.Lock()
 	connection, isPresent := factory.connections[invertedFlow]
-	isServer := factory.serverNet.Contains(netFlow.Src().Raw())
+	isServer := factory.isServerFlow(flow)
 	if isPresent {
 		delete(factory.connections, invertedFlow)
 	} else {
@@ -210,21 +329,39 @@ func (ch *connectionHandlerImpl) Complete(handler *StreamHandler) {
 	}
 
 	connectionID := CustomRowID(ch.connectionFlow.Hash(), startedAt)
+	ch.factory.mSettings.Lock()
+	gameClock := ch.factory.gameClock
+	ch.factory.mSettings.Unlock()
 	connection := Connection{
-		ID:              connectionID,
-		SourceIP:        ch.connectionFlow[0].String(),
-		DestinationIP:   ch.connectionFlow[1].String(),
-		SourcePort:      binary.BigEndian.Uint16(ch.connectionFlow[2].Raw()),
-		DestinationPort: binary.BigEndian.Uint16(ch.connectionFlow[3].Raw()),
-		StartedAt:       startedAt,
-		ClosedAt:        closedAt,
-		ClientBytes:     client.streamLength,
-		ServerBytes:     server.streamLength,
-		ClientDocuments: len(client.documentsIDs),
-		ServerDocuments: len(server.documentsIDs),
-		ProcessedAt:     time.Now(),
-	}
-	ch.factory.rulesManager.FillWithMatchedRules(&connection, client.patternMatches, server.patternMatches)
+		ID:                connectionID,
+		SourceIP:          ch.connectionFlow[0].String(),
+		DestinationIP:     ch.connectionFlow[1].String(),
+		SourcePort:        binary.BigEndian.Uint16(ch.connectionFlow[2].Raw()),
+		DestinationPort:   binary.BigEndian.Uint16(ch.connectionFlow[3].Raw()),
+		StartedAt:         startedAt,
+		ClosedAt:          closedAt,
+		ClientBytes:       client.streamLength,
+		ServerBytes:       server.streamLength,
+		ClientDocuments:   len(client.documentsIDs),
+		ServerDocuments:   len(server.documentsIDs),
+		ProcessedAt:       time.Now(),
+		TLS:               extractTLSInfo(client.firstBytes, server.firstBytes),
+		ImportingSessions: ch.factory.takeSessions(ch.connectionFlow),
+		Round:             gameClock.Round(startedAt),
+	}
+	if ch.factory.teams != nil {
+		assignTeams(ch.factory.teams, &connection)
+	}
+	// rules are matched on the plaintext when the connection can be decrypted
+	clientMatches, serverMatches := client.patternMatches, server.patternMatches
+	clientPlaintext, serverPlaintext, decrypted := ch.decryptTLS(connection, client, server)
+	if decrypted {
+		connection.TLS.Decrypted = true
+		connection.TLS.DecryptedClientBytes = plaintextLength(clientPlaintext)
+		connection.TLS.DecryptedServerBytes = plaintextLength(serverPlaintext)
+		clientMatches, serverMatches = ch.scanPlaintext(clientPlaintext), ch.scanPlaintext(serverPlaintext)
+	}
+	ch.factory.rulesManager.FillWithMatchedRules(&connection, clientMatches, serverMatches)
 
 	_, err := ch.Storage().Insert(Connections).One(connection)
 	if err != nil {
@@ -244,9 +381,144 @@ func (ch *connectionHandlerImpl) Complete(handler *StreamHandler) {
 		}
 	}
 
+	if decrypted {
+		storeDecryptedStream(ch.Storage(), connectionID, true, clientPlaintext, clientMatches)
+		storeDecryptedStream(ch.Storage(), connectionID, false, serverPlaintext, serverMatches)
+	}
+
+	// encrypted payloads are not carved, the magic bytes would match randomly
+	if connection.TLS == nil || decrypted {
+		files := CarveFiles(ch.streamPayload(client, clientPlaintext, decrypted), true)
+		files = append(files, CarveFiles(ch.streamPayload(server, serverPlaintext, decrypted), false)...)
+		storeExtractedFiles(ch.Storage(), connectionID, files)
+	}
+
+	if ch.factory.novelDetector != nil {
+		ch.factory.novelDetector.DetectNovelConnection(context.Background(), connection)
+	}
+
 	ch.UpdateStatistics(connection)
 }
 
+func (ch *connectionHandlerImpl) decryptTLS(connection Connection, client, server *StreamHandler) (
+	[]TLSPlaintextBlock, []TLSPlaintextBlock, bool) {
+	if connection.TLS == nil || ch.factory.tlsKeys == nil ||
+		!hasTLSKeys(ch.factory.tlsKeys, connection.DestinationPort, client.firstBytes) {
+		return nil, nil, false
+	}
+
+	loadStream := func(handler *StreamHandler) TLSStream {
+		return loadTLSStream(context.Background(), ch.Storage(),
+			OrderedDocument{{"_id", UnorderedDocument{"$in": handler.documentsIDs}}})
+	}
+	clientPlaintext, serverPlaintext, err := DecryptTLSConnection(ch.factory.tlsKeys, connection.DestinationPort,
+		loadStream(client), loadStream(server))
+	if err != nil {
+		log.WithError(err).WithField("connection", connection).Warn("failed to decrypt a tls connection")
+		return nil, nil, false
+	}
+
+	return clientPlaintext, serverPlaintext, true
+}
+
+// streamPayload returns the whole payload of one side of the connection, or nil if it is too big to be carved
+func (ch *connectionHandlerImpl) streamPayload(handler *StreamHandler, plaintext []TLSPlaintextBlock,
+	decrypted bool) []byte {
+	if handler.streamLength == 0 || handler.streamLength > maxCarvedStreamSize {
+		return nil
+	}
+	if !decrypted {
+		// the documents are carved from memory, without reading them back from the database
+		return handler.payload()
+	}
+
+	var payload []byte
+	for _, block := range plaintext {
+		payload = append(payload, block.Payload...)
+	}
+	return payload
+}
+
+func (ch *connectionHandlerImpl) scanPlaintext(blocks []TLSPlaintextBlock) map[uint][]PatternSlice {
+	patternMatches := make(map[uint][]PatternSlice, ch.PatternsDatabaseSize())
+	scanner := ch.factory.takeScanner()
+	defer ch.factory.releaseScanner(scanner)
+
+	stream, err := ch.PatternsDatabase().Open(0, scanner.scratch,
+		func(id uint, from uint64, to uint64, _ uint, _ interface{}) error {
+			addPatternMatch(patternMatches, id, from, to)
+			return nil
+		}, nil)
+	if err != nil {
+		log.WithError(err).Error("failed to create a stream")
+		return patternMatches
+	}
+	for _, block := range blocks {
+		if err := stream.Scan(block.Payload); err != nil {
+			log.WithError(err).Error("failed to scan decrypted buffer")
+		}
+	}
+	if err := stream.Close(); err != nil {
+		log.WithError(err).Error("failed to close pattern stream")
+	}
+
+	return patternMatches
+}
+
+// extractTLSInfo parses the handshake of a TLS connection from the first bytes of the two streams.
+// Returns nil if the client doesn't start the connection with a ClientHello.
+func extractTLSInfo(clientBytes, serverBytes []byte) *TLSInfo {
+	clientHandshake, ok := parsers.ParseTLSHandshake(clientBytes)
+	if !ok || clientHandshake.ClientHello == nil {
+		return nil
+	}
+	clientHello := clientHandshake.ClientHello
+
+	clientVersion := clientHello.Version
+	for _, version := range clientHello.SupportedVersions {
+		if version > clientVersion && version <= tls.VersionTLS13 {
+			clientVersion = version
+		}
+	}
+	cipherSuites := make([]string, len(clientHello.CipherSuites))
+	for i, cipherSuite := range clientHello.CipherSuites {
+		cipherSuites[i] = tls.CipherSuiteName(cipherSuite)
+	}
+
+	ja3 := clientHello.JA3()
+	info := TLSInfo{
+		ClientVersion: parsers.TLSVersionName(clientVersion),
+		ServerName:    clientHello.ServerName,
+		ALPN:          clientHello.ALPN,
+		CipherSuites:  cipherSuites,
+		JA3:           ja3,
+		JA3Hash:       parsers.TLSFingerprintHash(ja3),
+	}
+
+	serverHandshake, ok := parsers.ParseTLSHandshake(serverBytes)
+	if ok && serverHandshake.ServerHello != nil {
+		serverHello := serverHandshake.ServerHello
+		version := serverHello.Version
+		if serverHello.SupportedVersion != 0 {
+			version = serverHello.SupportedVersion
+		}
+		ja3s := serverHello.JA3S()
+
+		info.Version = parsers.TLSVersionName(version)
+		info.NegotiatedProtocol = serverHello.ALPN
+		info.CipherSuite = tls.CipherSuiteName(serverHello.CipherSuite)
+		info.JA3S = ja3s
+		info.JA3SHash = parsers.TLSFingerprintHash(ja3s)
+	}
+	// certificates are encrypted in TLS 1.3
+	if ok && len(serverHandshake.Certificates) > 0 {
+		info.CertificateSubject = serverHandshake.Certificates[0].Subject
+		info.CertificateIssuer = serverHandshake.Certificates[0].Issuer
+	}
+
+	return &info
+}
+
 func (ch *connectionHandlerImpl) UpdateStatistics(connection Connection) {
 	rangeStart := connection.StartedAt.Unix() / 60 // group statistic records by minutes
 	duration := connection.ClosedAt.Sub(connection.StartedAt)
@@ -268,12 +540,28 @@ func (ch *connectionHandlerImpl) UpdateStatistics(connection Connection) {
 		updateDocument[fmt.Sprintf("matched_rules.%s", ruleID.Hex())] = 1
 	}
 
+	// the statistics of the teams are grouped by the team which started the connection
+	if connection.SourceTeamID > 0 {
+		updateDocument[fmt.Sprintf("connections_per_team.%d", connection.SourceTeamID)] = 1
+		for _, ruleID := range connection.MatchedRules {
+			updateDocument[fmt.Sprintf("matched_rules_per_team.%d.%s", connection.SourceTeamID, ruleID.Hex())] = 1
+		}
+	}
+
 	var results interface{}
 	if _, err := ch.Storage().Update(Statistics).Upsert(&results).
 		Filter(OrderedDocument{{"_id", time.Unix(rangeStart*60, 0)}}).
 		OneComplex(UnorderedDocument{"$inc": updateDocument}); err != nil {
 		log.WithError(err).WithField("connection", connection).Error("failed to update connection statistics")
 	}
+
+	if connection.Round > 0 {
+		if _, err := ch.Storage().Update(RoundStatistics).Upsert(&results).
+			Filter(OrderedDocument{{"_id", connection.Round}}).
+			OneComplex(UnorderedDocument{"$inc": updateDocument}); err != nil {
+			log.WithError(err).WithField("connection", connection).Error("failed to update round statistics")
+		}
+	}
 }
 
 func (ch *connectionHandlerImpl) Storage() Storage {
@@ -18,7 +18,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
 	"github.com/flier/gohs/hyperscan"
 	"github.com/google/gopacket"
@@ -26,6 +32,7 @@ import (
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"math/big"
 	"math/rand"
 	"net"
 	"testing"
@@ -34,7 +41,7 @@ import (
 
 func TestTakeReleaseScanners(t *testing.T) {
 	wrapper := NewTestStorageWrapper(t)
-	serverNet := ParseIPNet(testDstIP)
+	serverNetworks := NewServerNetworks(Config{ServerAddress: testDstIP})
 	ruleManager := TestRulesManager{
 		databaseUpdated: make(chan RulesDatabase),
 	}
@@ -42,7 +49,7 @@ func TestTakeReleaseScanners(t *testing.T) {
 	database, err := hyperscan.NewStreamDatabase(hyperscan.NewPattern("/nope/", 0))
 	require.NoError(t, err)
 
-	factory := NewBiDirectionalStreamFactory(wrapper.Storage, *serverNet, &ruleManager)
+	factory := NewBiDirectionalStreamFactory(wrapper.Storage, serverNetworks, &ruleManager, nil, nil, nil, GameClock{})
 	version := NewRowID()
 	ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version}
 	time.Sleep(10 * time.Millisecond)
@@ -105,7 +112,8 @@ func TestConnectionFactory(t *testing.T) {
 	database, err := hyperscan.NewStreamDatabase(hyperscan.NewPattern("/nope/", 0))
 	require.NoError(t, err)
 
-	factory := NewBiDirectionalStreamFactory(wrapper.Storage, *ParseIPNet(testDstIP), &ruleManager)
+	factory := NewBiDirectionalStreamFactory(wrapper.Storage, NewServerNetworks(Config{ServerAddress: testDstIP}),
+		&ruleManager, nil, nil, nil, GameClock{})
 	version := NewRowID()
 	ruleManager.DatabaseUpdateChannel() <- RulesDatabase{database, 0, version}
 	time.Sleep(10 * time.Millisecond)
@@ -187,6 +195,94 @@ func TestConnectionFactory(t *testing.T) {
 	wrapper.Destroy(t)
 }
 
+func TestTrackSessions(t *testing.T) {
+	factory := &BiDirectionalStreamFactory{flowsSessions: make(map[StreamFlow]flowSessions)}
+	flow := func(port int) StreamFlow {
+		return StreamFlow{layers.NewIPEndpoint(net.ParseIP(testSrcIP)), layers.NewIPEndpoint(net.ParseIP(testDstIP)),
+			layers.NewTCPPortEndpoint(layers.TCPPort(port)), layers.NewTCPPortEndpoint(dstPort)}
+	}
+	start := time.Now()
+
+	factory.TrackSession(flow(1), "first", start)
+	factory.TrackSession(flow(1), "first", start.Add(time.Second))
+	factory.TrackSession(flow(1), "second", start.Add(2*time.Second))
+	factory.TrackSession(flow(2), "first", start)
+	factory.TrackSession(flow(3), "second", start.Add(time.Hour))
+	factory.TrackSession(flow(4), "first", start.Add(time.Hour))
+
+	assert.Equal(t, []string{"first", "second"}, factory.takeSessions(flow(1)))
+	assert.Empty(t, factory.takeSessions(flow(1)))
+
+	// the connections of the first session which are never completed are forgotten with the session
+	factory.ReleaseSession("first")
+	assert.Len(t, factory.flowsSessions, 1)
+	assert.Equal(t, []string{"second"}, factory.flowsSessions[flow(3)].sessions)
+
+	factory.TrackSession(flow(2), "third", start)
+	assert.Equal(t, 1, factory.ExpireSessions(start.Add(time.Minute)))
+	assert.Equal(t, 1, factory.ExpireSessions(start.Add(2*time.Hour)))
+	assert.Empty(t, factory.flowsSessions)
+}
+
+func TestExtractTLSInfo(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.New(rand.NewSource(0)))
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "caronte.test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.New(rand.NewSource(0)), &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	client := &recordingConn{Conn: clientConn}
+	server := &recordingConn{Conn: serverConn}
+	go func() {
+		_ = tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+			NextProtos:   []string{"h2"},
+		}).Handshake()
+	}()
+	_ = tls.Client(client, &tls.Config{
+		ServerName:         "caronte.test",
+		NextProtos:         []string{"h2", "http/1.1"},
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	}).Handshake()
+	_ = clientConn.Close()
+
+	info := extractTLSInfo(client.written.Bytes(), server.written.Bytes())
+	require.NotNil(t, info)
+	assert.Equal(t, "TLS 1.2", info.ClientVersion)
+	assert.Equal(t, "TLS 1.2", info.Version)
+	assert.Equal(t, "caronte.test", info.ServerName)
+	assert.Equal(t, []string{"h2", "http/1.1"}, info.ALPN)
+	assert.Equal(t, "h2", info.NegotiatedProtocol)
+	assert.Contains(t, info.CipherSuites, info.CipherSuite)
+	assert.Equal(t, "CN=caronte.test", info.CertificateSubject)
+	assert.Equal(t, "CN=caronte.test", info.CertificateIssuer)
+	assert.Regexp(t, "^771,[0-9-]+,[0-9-]+,[0-9-]+,[0-9-]*$", info.JA3)
+	assert.Len(t, info.JA3Hash, 32)
+	assert.Regexp(t, "^771,[0-9]+,[0-9-]+$", info.JA3S)
+	assert.Len(t, info.JA3SHash, 32)
+
+	assert.Nil(t, extractTLSInfo([]byte("GET / HTTP/1.1\r\n\r\n"), nil))
+}
+
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+	indexes []int
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.indexes = append(c.indexes, c.written.Len())
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
 type TestRulesManager struct {
 	databaseUpdated chan RulesDatabase
 }
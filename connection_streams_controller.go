@@ -20,9 +20,11 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/eciavatta/caronte/parsers"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"strings"
 	"time"
 )
@@ -44,6 +46,8 @@ type ConnectionStream struct {
 	BlocksTimestamps []time.Time             `bson:"blocks_timestamps"`
 	BlocksLoss       []bool                  `bson:"blocks_loss"`
 	PatternMatches   map[uint][]PatternSlice `bson:"pattern_matches"`
+	Decrypted        bool                    `bson:"decrypted,omitempty"`
+	PayloadSize      int                     `bson:"payload_size,omitempty"` // set when the payload is not loaded
 }
 
 type PatternSlice [2]uint64
@@ -54,6 +58,8 @@ type Message struct {
 	Metadata               parsers.Metadata `json:"metadata"`
 	IsMetadataContinuation bool             `json:"is_metadata_continuation"`
 	Index                  int              `json:"index"`
+	Number                 int              `json:"number"`
+	Offset                 uint64           `json:"offset"`
 	Timestamp              time.Time        `json:"timestamp"`
 	IsRetransmitted        bool             `json:"is_retransmitted"`
 	RegexMatches           []RegexSlice     `json:"regex_matches"`
@@ -65,12 +71,36 @@ type RegexSlice struct {
 }
 
 type GetMessageFormat struct {
-	Format string `form:"format"`
+	Format    string `form:"format"`
+	Encrypted bool   `form:"encrypted"`
+	From      int    `form:"from" binding:"min=0"`
+	FromByte  uint64 `form:"from_byte"`
+	Limit     int    `form:"limit" binding:"min=0"`
+}
+
+type MessagesSummary struct {
+	MessagesCount       int           `json:"messages_count"`
+	ClientMessagesCount int           `json:"client_messages_count"`
+	ServerMessagesCount int           `json:"server_messages_count"`
+	ClientBytes         uint64        `json:"client_bytes"`
+	ServerBytes         uint64        `json:"server_bytes"`
+	Messages            []MessageSize `json:"messages"`
+}
+
+type MessageSize struct {
+	FromClient bool      `json:"from_client"`
+	Size       int       `json:"size"`
+	Timestamp  time.Time `json:"timestamp"`
 }
 
 type DownloadMessageFormat struct {
-	Format string `form:"format"`
-	Type   string `form:"type"`
+	Format         string `form:"format"`
+	Type           string `form:"type"`
+	Encrypted      bool   `form:"encrypted"`
+	ServerBytes    int    `form:"server_bytes" binding:"min=0"` // the last bytes of the server data to wait for
+	ExtractFlags   bool   `form:"extract_flags"`
+	ParametricHost bool   `form:"parametric_host"` // the target host is read from the arguments of the script
+	FlagRegex      string `form:"-"`
 }
 
 type ConnectionStreamsController struct {
@@ -83,6 +113,10 @@ func NewConnectionStreamsController(storage Storage) ConnectionStreamsController
 	}
 }
 
+// GetConnectionMessages returns the messages of a connection, starting from the message with the number From and with
+// the offset of at least FromByte bytes from the start of the connection. If Limit is set, at most Limit messages are
+// returned. The metadata are parsed only for the groups of messages that are returned, and the last group of a page
+// is parsed only up to its last returned message.
 func (csc ConnectionStreamsController) GetConnectionMessages(c context.Context, connectionID RowID,
 	format GetMessageFormat) ([]*Message, bool) {
 	connection := csc.getConnection(c, connectionID)
@@ -90,119 +124,115 @@ func (csc ConnectionStreamsController) GetConnectionMessages(c context.Context,
 		return nil, false
 	}
 
-	messages := make([]*Message, 0, initialMessagesSize)
-	var clientIndex, serverIndex uint64
-
-	var clientBlocksIndex, serverBlocksIndex int
-	var clientDocumentIndex, serverDocumentIndex int
-	clientStream := csc.getConnectionStream(c, connectionID, true, clientDocumentIndex)
-	serverStream := csc.getConnectionStream(c, connectionID, false, serverDocumentIndex)
-
-	hasClientBlocks := func() bool {
-		return clientBlocksIndex < len(clientStream.BlocksIndexes)
+	decrypted := isDecrypted(connection) && !format.Encrypted
+	var cursor *messagesCursor
+	if format.From > 0 || format.FromByte > 0 {
+		cursor = csc.skipMessages(c, connectionID, decrypted, format.From, format.FromByte)
+	} else {
+		cursor = csc.newMessagesCursor(c, connectionID, decrypted, true)
 	}
-	hasServerBlocks := func() bool {
-		return serverBlocksIndex < len(serverStream.BlocksIndexes)
+
+	isInWindow := func(messages []*Message) bool {
+		return cursor.number >= format.From && cursor.offset >= format.FromByte &&
+			(format.Limit <= 0 || len(messages) < format.Limit)
 	}
 
-	var message *Message
+	capacity := initialMessagesSize
+	if format.Limit > 0 && format.Limit < capacity {
+		capacity = format.Limit
+	}
+	messages := make([]*Message, 0, capacity)
+	// the metadata are parsed on all the consecutive blocks of the same side
 	messagesBuffer := make([]*Message, 0, 16)
 	contentChunkBuffer := new(bytes.Buffer)
-	var lastContentSlice []byte
-	var sideChanged, lastClient, lastServer bool
-	for !clientStream.ID.IsZero() || !serverStream.ID.IsZero() {
-		if hasClientBlocks() && (!hasServerBlocks() || // next payload is from client
-			clientStream.BlocksTimestamps[clientBlocksIndex].UnixNano() <=
-				serverStream.BlocksTimestamps[serverBlocksIndex].UnixNano()) {
-			start := clientStream.BlocksIndexes[clientBlocksIndex]
-			end := 0
-			if clientBlocksIndex < len(clientStream.BlocksIndexes)-1 {
-				end = clientStream.BlocksIndexes[clientBlocksIndex+1]
-			} else {
-				end = len(clientStream.Payload)
-			}
-			size := uint64(end - start)
-
-			message = &Message{
-				FromClient:      true,
-				Content:         DecodeBytes(clientStream.Payload[start:end], format.Format),
-				Index:           start,
-				Timestamp:       clientStream.BlocksTimestamps[clientBlocksIndex],
-				IsRetransmitted: clientStream.BlocksLoss[clientBlocksIndex],
-				RegexMatches:    findMatchesBetween(clientStream.PatternMatches, clientIndex, clientIndex+size),
-			}
-			clientIndex += size
-			clientBlocksIndex++
-
-			lastContentSlice = clientStream.Payload[start:end]
-			sideChanged, lastClient, lastServer = lastServer, true, false
-		} else { // next payload is from server
-			start := serverStream.BlocksIndexes[serverBlocksIndex]
-			end := 0
-			if serverBlocksIndex < len(serverStream.BlocksIndexes)-1 {
-				end = serverStream.BlocksIndexes[serverBlocksIndex+1]
-			} else {
-				end = len(serverStream.Payload)
-			}
-			size := uint64(end - start)
-
-			message = &Message{
-				FromClient:      false,
-				Content:         DecodeBytes(serverStream.Payload[start:end], format.Format),
-				Index:           start,
-				Timestamp:       serverStream.BlocksTimestamps[serverBlocksIndex],
-				IsRetransmitted: serverStream.BlocksLoss[serverBlocksIndex],
-				RegexMatches:    findMatchesBetween(serverStream.PatternMatches, serverIndex, serverIndex+size),
-			}
-			serverIndex += size
-			serverBlocksIndex++
-
-			lastContentSlice = serverStream.Payload[start:end]
-			sideChanged, lastClient, lastServer = lastClient, false, true
-		}
-
-		if !hasClientBlocks() {
-			clientDocumentIndex++
-			clientBlocksIndex = 0
-			clientIndex = 0
-			clientStream = csc.getConnectionStream(c, connectionID, true, clientDocumentIndex)
-		}
-		if !hasServerBlocks() {
-			serverDocumentIndex++
-			serverBlocksIndex = 0
-			serverIndex = 0
-			serverStream = csc.getConnectionStream(c, connectionID, false, serverDocumentIndex)
-		}
-
-		updateMetadata := func() {
+	var isContinuation bool
+	updateMetadata := func() {
+		if len(messagesBuffer) > 0 {
 			metadata := parsers.Parse(contentChunkBuffer.Bytes())
-			var isMetadataContinuation bool
+			isMetadataContinuation := isContinuation
 			for _, elem := range messagesBuffer {
 				elem.Metadata = metadata
 				elem.IsMetadataContinuation = metadata != nil && isMetadataContinuation
 				isMetadataContinuation = true
 			}
-
-			messagesBuffer = messagesBuffer[:0]
-			contentChunkBuffer.Reset()
 		}
 
-		if sideChanged {
+		messagesBuffer = messagesBuffer[:0]
+		contentChunkBuffer.Reset()
+		isContinuation = false
+	}
+
+	var lastFromClient, hasLastSide bool
+	for side := cursor.nextSide(); side != nil; side = cursor.nextSide() {
+		// the page is full, the metadata of the last group are parsed only on the blocks already read
+		if format.Limit > 0 && len(messages) >= format.Limit {
+			break
+		}
+		if hasLastSide && side.fromClient != lastFromClient {
 			updateMetadata()
 		}
-		messagesBuffer = append(messagesBuffer, message)
-		contentChunkBuffer.Write(lastContentSlice)
 
-		if clientStream.ID.IsZero() && serverStream.ID.IsZero() {
-			updateMetadata()
+		start := side.stream.BlocksIndexes[side.blocksIndex]
+		payload := blockPayload(side.stream, side.blocksIndex)
+		if isInWindow(messages) {
+			message := &Message{
+				FromClient:      side.fromClient,
+				Content:         DecodeBytes(payload, format.Format),
+				Index:           start,
+				Number:          cursor.number,
+				Offset:          cursor.offset,
+				Timestamp:       side.stream.BlocksTimestamps[side.blocksIndex],
+				IsRetransmitted: side.stream.BlocksLoss[side.blocksIndex],
+				RegexMatches: findMatchesBetween(side.stream.PatternMatches, uint64(start),
+					uint64(start+len(payload))),
+			}
+			messages = append(messages, message)
+			messagesBuffer = append(messagesBuffer, message)
+		} else if len(messagesBuffer) == 0 {
+			isContinuation = true // the group of messages started before the first returned message
 		}
+		contentChunkBuffer.Write(payload)
 
-		messages = append(messages, message)
+		lastFromClient, hasLastSide = side.fromClient, true
+		cursor.advance(side)
 	}
+	updateMetadata()
 
 	return messages, true
 }
 
+// GetConnectionMessagesSummary returns the number and the size of the messages of a connection, without loading
+// the payloads
+func (csc ConnectionStreamsController) GetConnectionMessagesSummary(c context.Context, connectionID RowID,
+	format GetMessageFormat) (MessagesSummary, bool) {
+	connection := csc.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return MessagesSummary{}, false
+	}
+
+	summary := MessagesSummary{Messages: make([]MessageSize, 0, initialMessagesSize)}
+	cursor := csc.newMessagesCursor(c, connectionID, isDecrypted(connection) && !format.Encrypted, false)
+	for side := cursor.nextSide(); side != nil; side = cursor.nextSide() {
+		size := blockSize(side.stream, side.blocksIndex)
+		if side.fromClient {
+			summary.ClientMessagesCount++
+			summary.ClientBytes += uint64(size)
+		} else {
+			summary.ServerMessagesCount++
+			summary.ServerBytes += uint64(size)
+		}
+		summary.Messages = append(summary.Messages, MessageSize{
+			FromClient: side.fromClient,
+			Size:       size,
+			Timestamp:  side.stream.BlocksTimestamps[side.blocksIndex],
+		})
+		cursor.advance(side)
+	}
+	summary.MessagesCount = cursor.number
+
+	return summary, true
+}
+
 func (csc ConnectionStreamsController) DownloadConnectionMessages(c context.Context, connectionID RowID,
 	format DownloadMessageFormat) (string, bool) {
 	connection := csc.getConnection(c, connectionID)
@@ -213,16 +243,17 @@ func (csc ConnectionStreamsController) DownloadConnectionMessages(c context.Cont
 	var sb strings.Builder
 	includeClient, includeServer := format.Type != "only_server", format.Type != "only_client"
 	isPwntools := format.Type == "pwntools"
+	decrypted := isDecrypted(connection) && !format.Encrypted
 
 	var clientBlocksIndex, serverBlocksIndex int
 	var clientDocumentIndex, serverDocumentIndex int
 	var clientStream ConnectionStream
 	if includeClient {
-		clientStream = csc.getConnectionStream(c, connectionID, true, clientDocumentIndex)
+		clientStream = csc.getConnectionStream(c, connectionID, true, decrypted, clientDocumentIndex)
 	}
 	var serverStream ConnectionStream
 	if includeServer {
-		serverStream = csc.getConnectionStream(c, connectionID, false, serverDocumentIndex)
+		serverStream = csc.getConnectionStream(c, connectionID, false, decrypted, serverDocumentIndex)
 	}
 
 	hasClientBlocks := func() bool {
@@ -241,6 +272,16 @@ func (csc ConnectionStreamsController) DownloadConnectionMessages(c context.Cont
 	}
 
 	lastIsClient, lastIsServer := true, true
+	// in pwntools mode the blocks of the same side are grouped, to find the prompts of interactive sessions
+	var pwntoolsChunk [][]byte
+	flushPwntoolsChunk := func() string {
+		if len(pwntoolsChunk) == 0 {
+			return ""
+		}
+		code := decodePwntoolsChunk(pwntoolsChunk, lastIsClient, format.Format)
+		pwntoolsChunk = pwntoolsChunk[:0]
+		return code
+	}
 	for !clientStream.ID.IsZero() || !serverStream.ID.IsZero() {
 		if hasClientBlocks() && (!hasServerBlocks() || // next payload is from client
 			clientStream.BlocksTimestamps[clientBlocksIndex].UnixNano() <=
@@ -254,12 +295,13 @@ func (csc ConnectionStreamsController) DownloadConnectionMessages(c context.Cont
 			}
 
 			if !lastIsClient {
+				sb.WriteString(flushPwntoolsChunk())
 				sb.WriteString("\n")
 			}
 			lastIsClient = true
 			lastIsServer = false
 			if isPwntools {
-				sb.WriteString(decodePwntools(clientStream.Payload[start:end], true, format.Format))
+				pwntoolsChunk = append(pwntoolsChunk, clientStream.Payload[start:end])
 			} else {
 				sb.WriteString(DecodeBytes(clientStream.Payload[start:end], format.Format))
 			}
@@ -274,12 +316,13 @@ func (csc ConnectionStreamsController) DownloadConnectionMessages(c context.Cont
 			}
 
 			if !lastIsServer {
+				sb.WriteString(flushPwntoolsChunk())
 				sb.WriteString("\n")
 			}
 			lastIsClient = false
 			lastIsServer = true
 			if isPwntools {
-				sb.WriteString(decodePwntools(serverStream.Payload[start:end], false, format.Format))
+				pwntoolsChunk = append(pwntoolsChunk, serverStream.Payload[start:end])
 			} else {
 				sb.WriteString(DecodeBytes(serverStream.Payload[start:end], format.Format))
 			}
@@ -289,18 +332,50 @@ func (csc ConnectionStreamsController) DownloadConnectionMessages(c context.Cont
 		if includeClient && !hasClientBlocks() {
 			clientDocumentIndex++
 			clientBlocksIndex = 0
-			clientStream = csc.getConnectionStream(c, connectionID, true, clientDocumentIndex)
+			clientStream = csc.getConnectionStream(c, connectionID, true, decrypted, clientDocumentIndex)
 		}
 		if includeServer && !hasServerBlocks() {
 			serverDocumentIndex++
 			serverBlocksIndex = 0
-			serverStream = csc.getConnectionStream(c, connectionID, false, serverDocumentIndex)
+			serverStream = csc.getConnectionStream(c, connectionID, false, decrypted, serverDocumentIndex)
 		}
 	}
+	sb.WriteString(flushPwntoolsChunk())
 
 	return sb.String(), true
 }
 
+// GetConnectionPayload returns a reader of the raw bytes exchanged in a connection. If both sides are included, the
+// blocks of the two sides are ordered by time. The documents are loaded only when they are read.
+func (csc ConnectionStreamsController) GetConnectionPayload(c context.Context, connectionID RowID,
+	format DownloadMessageFormat) (io.ReadSeeker, bool) {
+	connection := csc.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return nil, false
+	}
+
+	reader := &connectionPayloadReader{
+		c:             c,
+		csc:           csc,
+		connectionID:  connectionID,
+		includeClient: format.Type != "only_server",
+		includeServer: format.Type != "only_client",
+		decrypted:     isDecrypted(connection) && !format.Encrypted,
+	}
+	clientBytes, serverBytes := connection.ClientBytes, connection.ServerBytes
+	if reader.decrypted {
+		clientBytes, serverBytes = connection.TLS.DecryptedClientBytes, connection.TLS.DecryptedServerBytes
+	}
+	if reader.includeClient {
+		reader.size += int64(clientBytes)
+	}
+	if reader.includeServer {
+		reader.size += int64(serverBytes)
+	}
+
+	return reader, true
+}
+
 func (csc ConnectionStreamsController) getConnection(c context.Context, connectionID RowID) Connection {
 	var connection Connection
 	if err := csc.storage.Find(Connections).Context(c).Filter(OrderedDocument{{"_id", connectionID}}).
@@ -311,18 +386,267 @@ func (csc ConnectionStreamsController) getConnection(c context.Context, connecti
 }
 
 func (csc ConnectionStreamsController) getConnectionStream(c context.Context, connectionID RowID, fromClient bool,
-	documentIndex int) ConnectionStream {
+	decrypted bool, documentIndex int) ConnectionStream {
 	var result ConnectionStream
 	if err := csc.storage.Find(ConnectionStreams).Filter(OrderedDocument{
 		{"connection_id", connectionID},
 		{"from_client", fromClient},
 		{"document_index", documentIndex},
-	}).Context(c).First(&result); err != nil {
+		{"decrypted", decryptedFilter(decrypted)},
+	}).Projection(OrderedDocument{{"payload_string", 0}}).Context(c).First(&result); err != nil {
 		log.WithError(err).WithField("connection_id", connectionID).Panic("failed to get a ConnectionStream")
 	}
 	return result
 }
 
+// getConnectionStreamBlocks returns a ConnectionStream with only the blocks, without the payload
+func (csc ConnectionStreamsController) getConnectionStreamBlocks(c context.Context, connectionID RowID,
+	fromClient bool, decrypted bool, documentIndex int) ConnectionStream {
+	var result ConnectionStream
+	if err := csc.storage.Find(ConnectionStreams).Filter(OrderedDocument{
+		{"connection_id", connectionID},
+		{"from_client", fromClient},
+		{"document_index", documentIndex},
+		{"decrypted", decryptedFilter(decrypted)},
+	}).Projection(OrderedDocument{
+		{"blocks_indexes", 1},
+		{"blocks_timestamps", 1},
+		{"blocks_loss", 1},
+		{"payload_size", UnorderedDocument{"$binarySize": "$payload"}},
+	}).Context(c).First(&result); err != nil {
+		log.WithError(err).WithField("connection_id", connectionID).Panic("failed to get the blocks of a ConnectionStream")
+	}
+	return result
+}
+
+// skipMessages returns a cursor placed at the start of the group of consecutive messages of the same side which
+// contains the first message after from and fromByte. The documents are read without the payload.
+func (csc ConnectionStreamsController) skipMessages(c context.Context, connectionID RowID, decrypted bool,
+	from int, fromByte uint64) *messagesCursor {
+	cursor := csc.newMessagesCursor(c, connectionID, decrypted, false)
+	groupStart := *cursor
+	var lastFromClient, hasLastSide bool
+	for side := cursor.nextSide(); side != nil; side = cursor.nextSide() {
+		if !hasLastSide || side.fromClient != lastFromClient {
+			groupStart = *cursor
+		}
+		if cursor.number >= from && cursor.offset >= fromByte {
+			break
+		}
+
+		lastFromClient, hasLastSide = side.fromClient, true
+		cursor.advance(side)
+	}
+	if cursor.nextSide() == nil {
+		return cursor
+	}
+
+	groupStart.withPayload = true
+	groupStart.load(&groupStart.client)
+	groupStart.load(&groupStart.server)
+	return &groupStart
+}
+
+// messagesCursor iterates the blocks of the two sides of a connection ordered by time
+type messagesCursor struct {
+	c            context.Context
+	csc          ConnectionStreamsController
+	connectionID RowID
+	decrypted    bool
+	withPayload  bool
+	client       streamSide
+	server       streamSide
+	number       int    // the number of the next message
+	offset       uint64 // the offset of the next message from the start of the connection
+}
+
+type streamSide struct {
+	fromClient    bool
+	documentIndex int
+	blocksIndex   int
+	stream        ConnectionStream
+}
+
+func (csc ConnectionStreamsController) newMessagesCursor(c context.Context, connectionID RowID, decrypted bool,
+	withPayload bool) *messagesCursor {
+	cursor := &messagesCursor{
+		c:            c,
+		csc:          csc,
+		connectionID: connectionID,
+		decrypted:    decrypted,
+		withPayload:  withPayload,
+		client:       streamSide{fromClient: true},
+		server:       streamSide{fromClient: false},
+	}
+	cursor.load(&cursor.client)
+	cursor.load(&cursor.server)
+	return cursor
+}
+
+func (mc *messagesCursor) load(side *streamSide) {
+	if mc.withPayload {
+		side.stream = mc.csc.getConnectionStream(mc.c, mc.connectionID, side.fromClient, mc.decrypted,
+			side.documentIndex)
+	} else {
+		side.stream = mc.csc.getConnectionStreamBlocks(mc.c, mc.connectionID, side.fromClient, mc.decrypted,
+			side.documentIndex)
+	}
+}
+
+// nextSide returns the side of the next block, or nil if there are no more blocks
+func (mc *messagesCursor) nextSide() *streamSide {
+	hasClientBlocks := mc.client.blocksIndex < len(mc.client.stream.BlocksIndexes)
+	hasServerBlocks := mc.server.blocksIndex < len(mc.server.stream.BlocksIndexes)
+	if hasClientBlocks && (!hasServerBlocks || // next payload is from client
+		mc.client.stream.BlocksTimestamps[mc.client.blocksIndex].UnixNano() <=
+			mc.server.stream.BlocksTimestamps[mc.server.blocksIndex].UnixNano()) {
+		return &mc.client
+	} else if hasServerBlocks {
+		return &mc.server
+	}
+	return nil
+}
+
+// advance moves the cursor after the current block of side, loading the next document if necessary
+func (mc *messagesCursor) advance(side *streamSide) {
+	mc.number++
+	mc.offset += uint64(blockSize(side.stream, side.blocksIndex))
+	if side.blocksIndex++; side.blocksIndex >= len(side.stream.BlocksIndexes) {
+		side.documentIndex++
+		side.blocksIndex = 0
+		mc.load(side)
+	}
+}
+
+type connectionPayloadReader struct {
+	c                   context.Context
+	csc                 ConnectionStreamsController
+	connectionID        RowID
+	includeClient       bool
+	includeServer       bool
+	decrypted           bool
+	size                int64
+	position            int64 // the position requested by Seek
+	offset              int64 // the position of the first byte of pending
+	pending             []byte
+	loaded              bool
+	clientStream        ConnectionStream
+	serverStream        ConnectionStream
+	clientDocumentIndex int
+	serverDocumentIndex int
+	clientBlocksIndex   int
+	serverBlocksIndex   int
+}
+
+func (r *connectionPayloadReader) Read(p []byte) (int, error) {
+	if !r.loaded || r.position < r.offset { // the documents can be read only forward
+		r.reset()
+	}
+	for r.offset+int64(len(r.pending)) <= r.position {
+		r.offset += int64(len(r.pending))
+		block, ok := r.nextBlock()
+		if !ok {
+			r.pending = nil
+			return 0, io.EOF
+		}
+		r.pending = block
+	}
+
+	n := copy(p, r.pending[r.position-r.offset:])
+	r.position += int64(n)
+	return n, nil
+}
+
+func (r *connectionPayloadReader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = r.position + offset
+	case io.SeekEnd:
+		position = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if position < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.position = position
+	return position, nil
+}
+
+func (r *connectionPayloadReader) reset() {
+	r.offset, r.pending, r.loaded = 0, nil, true
+	r.clientDocumentIndex, r.serverDocumentIndex, r.clientBlocksIndex, r.serverBlocksIndex = 0, 0, 0, 0
+	if r.includeClient {
+		r.clientStream = r.csc.getConnectionStream(r.c, r.connectionID, true, r.decrypted, 0)
+	}
+	if r.includeServer {
+		r.serverStream = r.csc.getConnectionStream(r.c, r.connectionID, false, r.decrypted, 0)
+	}
+}
+
+func (r *connectionPayloadReader) nextBlock() ([]byte, bool) {
+	hasClientBlocks := r.clientBlocksIndex < len(r.clientStream.BlocksIndexes)
+	hasServerBlocks := r.serverBlocksIndex < len(r.serverStream.BlocksIndexes)
+	if !hasClientBlocks && !hasServerBlocks {
+		return nil, false
+	}
+
+	var block []byte
+	if hasClientBlocks && (!hasServerBlocks || // next payload is from client
+		r.clientStream.BlocksTimestamps[r.clientBlocksIndex].UnixNano() <=
+			r.serverStream.BlocksTimestamps[r.serverBlocksIndex].UnixNano()) {
+		block = blockPayload(r.clientStream, r.clientBlocksIndex)
+		if r.clientBlocksIndex++; r.clientBlocksIndex >= len(r.clientStream.BlocksIndexes) {
+			r.clientDocumentIndex++
+			r.clientBlocksIndex = 0
+			r.clientStream = r.csc.getConnectionStream(r.c, r.connectionID, true, r.decrypted, r.clientDocumentIndex)
+		}
+	} else { // next payload is from server
+		block = blockPayload(r.serverStream, r.serverBlocksIndex)
+		if r.serverBlocksIndex++; r.serverBlocksIndex >= len(r.serverStream.BlocksIndexes) {
+			r.serverDocumentIndex++
+			r.serverBlocksIndex = 0
+			r.serverStream = r.csc.getConnectionStream(r.c, r.connectionID, false, r.decrypted, r.serverDocumentIndex)
+		}
+	}
+
+	return block, true
+}
+
+func blockPayload(stream ConnectionStream, blockIndex int) []byte {
+	if blockIndex < len(stream.BlocksIndexes)-1 {
+		return stream.Payload[stream.BlocksIndexes[blockIndex]:stream.BlocksIndexes[blockIndex+1]]
+	}
+	return stream.Payload[stream.BlocksIndexes[blockIndex]:]
+}
+
+func blockSize(stream ConnectionStream, blockIndex int) int {
+	if blockIndex < len(stream.BlocksIndexes)-1 {
+		return stream.BlocksIndexes[blockIndex+1] - stream.BlocksIndexes[blockIndex]
+	}
+	payloadSize := len(stream.Payload)
+	if stream.Payload == nil {
+		payloadSize = stream.PayloadSize
+	}
+	return payloadSize - stream.BlocksIndexes[blockIndex]
+}
+
+func isDecrypted(connection Connection) bool {
+	return connection.TLS != nil && connection.TLS.Decrypted
+}
+
+// decryptedFilter selects the plaintext or the ciphertext documents, which don't have the decrypted field
+func decryptedFilter(decrypted bool) interface{} {
+	if decrypted {
+		return true
+	}
+	return UnorderedDocument{"$ne": true}
+}
+
 func findMatchesBetween(patternMatches map[uint][]PatternSlice, from, to uint64) []RegexSlice {
 	regexSlices := make([]RegexSlice, 0, initialRegexSlicesCount)
 	for _, slices := range patternMatches {
@@ -350,26 +674,47 @@ func findMatchesBetween(patternMatches map[uint][]PatternSlice, from, to uint64)
 	return regexSlices
 }
 
+func decodePwntoolsChunk(blocks [][]byte, isClient bool, format string) string {
+	var sb strings.Builder
+	chunk := bytes.Join(blocks, nil)
+	if metadata, isLineMenu := parsers.Parse(chunk).(parsers.LineMenuMetadata); isLineMenu {
+		if isClient && metadata.Prompt == "" && len(metadata.Lines) > 0 && !bytes.ContainsRune(chunk, '\r') {
+			for _, line := range metadata.Lines {
+				sb.WriteString(fmt.Sprintf("p.sendline(%s)\n", pwntoolsBytes([]byte(line), format)))
+			}
+			return sb.String()
+		} else if delimiter := metadata.Delimiter(); !isClient && delimiter != "" {
+			return fmt.Sprintf("p.recvuntil(%s)\n", pwntoolsBytes([]byte(delimiter), format))
+		}
+	}
+
+	for _, block := range blocks {
+		sb.WriteString(decodePwntools(block, isClient, format))
+	}
+	return sb.String()
+}
+
 func decodePwntools(payload []byte, isClient bool, format string) string {
 	if !isClient && len(payload) > pwntoolsMaxServerBytes {
 		payload = payload[len(payload)-pwntoolsMaxServerBytes:]
 	}
 
-	var content string
+	if isClient {
+		return fmt.Sprintf("p.send(%s)\n", pwntoolsBytes(payload, format))
+	}
+
+	return fmt.Sprintf("p.recvuntil(%s)\n", pwntoolsBytes(payload, format))
+}
+
+func pwntoolsBytes(payload []byte, format string) string {
 	switch format {
 	case "hex":
-		content = fmt.Sprintf("bytes.fromhex('%s')", DecodeBytes(payload, format))
+		return fmt.Sprintf("bytes.fromhex('%s')", DecodeBytes(payload, format))
 	case "base32":
-		content = fmt.Sprintf("base64.b32decode('%s')", DecodeBytes(payload, format))
+		return fmt.Sprintf("base64.b32decode('%s')", DecodeBytes(payload, format))
 	case "base64":
-		content = fmt.Sprintf("base64.b64decode('%s')", DecodeBytes(payload, format))
+		return fmt.Sprintf("base64.b64decode('%s')", DecodeBytes(payload, format))
 	default:
-		content = fmt.Sprintf("'%s'", strings.Replace(DecodeBytes(payload, "ascii"), "'", "\\'", -1))
+		return fmt.Sprintf("'%s'", strings.Replace(DecodeBytes(payload, "ascii"), "'", "\\'", -1))
 	}
-
-	if isClient {
-		return fmt.Sprintf("p.send(%s)\n", content)
-	}
-
-	return fmt.Sprintf("p.recvuntil(%s)\n", content)
 }
@@ -0,0 +1,263 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetConnectionPayload(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	connectionID := insertTestConnectionStreams(t, wrapper)
+	controller := NewConnectionStreamsController(wrapper.Storage)
+
+	_, found := controller.GetConnectionPayload(wrapper.Context, NewRowID(), DownloadMessageFormat{})
+	assert.False(t, found)
+
+	reader, found := controller.GetConnectionPayload(wrapper.Context, connectionID, DownloadMessageFormat{})
+	require.True(t, found)
+	payload, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "ab12c3def456", string(payload))
+
+	reader, found = controller.GetConnectionPayload(wrapper.Context, connectionID,
+		DownloadMessageFormat{Type: "only_client"})
+	require.True(t, found)
+	// the read crosses the boundary between the documents of the client
+	position, err := reader.Seek(2, io.SeekStart)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), position)
+	buffer := make([]byte, 3)
+	_, err = io.ReadFull(reader, buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "cde", string(buffer))
+
+	position, err = reader.Seek(-3, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), position)
+	payload, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "def", string(payload))
+
+	// the documents are loaded again to read backwards
+	position, err = reader.Seek(-5, io.SeekCurrent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), position)
+	buffer = make([]byte, 2)
+	_, err = io.ReadFull(reader, buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "bc", string(buffer))
+
+	_, err = reader.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	n, err := reader.Read(buffer)
+	assert.Zero(t, n)
+	assert.Equal(t, io.EOF, err)
+	_, err = reader.Seek(-1, io.SeekStart)
+	assert.Error(t, err)
+	_, err = reader.Seek(0, 3)
+	assert.Error(t, err)
+
+	reader, found = controller.GetConnectionPayload(wrapper.Context, connectionID,
+		DownloadMessageFormat{Type: "only_server"})
+	require.True(t, found)
+	payload, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "123456", string(payload))
+
+	wrapper.Destroy(t)
+}
+
+func TestGetConnectionMessagesPages(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	connectionID := insertTestConnectionStreams(t, wrapper)
+	controller := NewConnectionStreamsController(wrapper.Storage)
+
+	_, found := controller.GetConnectionMessages(wrapper.Context, NewRowID(), GetMessageFormat{})
+	assert.False(t, found)
+
+	type page struct {
+		contents []string
+		numbers  []int
+		offsets  []uint64
+		indexes  []int
+	}
+	getPage := func(format GetMessageFormat) page {
+		messages, found := controller.GetConnectionMessages(wrapper.Context, connectionID, format)
+		require.True(t, found)
+		var result page
+		for _, message := range messages {
+			result.contents = append(result.contents, message.Content)
+			result.numbers = append(result.numbers, message.Number)
+			result.offsets = append(result.offsets, message.Offset)
+			result.indexes = append(result.indexes, message.Index)
+		}
+		return result
+	}
+
+	assert.Equal(t, page{[]string{"ab", "12", "c", "3", "def", "456"}, []int{0, 1, 2, 3, 4, 5},
+		[]uint64{0, 2, 4, 5, 6, 9}, []int{0, 0, 2, 2, 0, 0}}, getPage(GetMessageFormat{}))
+	assert.Equal(t, page{[]string{"ab", "12"}, []int{0, 1}, []uint64{0, 2}, []int{0, 0}},
+		getPage(GetMessageFormat{Limit: 2}))
+	assert.Equal(t, page{[]string{"c", "3"}, []int{2, 3}, []uint64{4, 5}, []int{2, 2}},
+		getPage(GetMessageFormat{From: 2, Limit: 2}))
+	// the cursor skips the first documents of both sides, the last page is shorter than the limit
+	assert.Equal(t, page{[]string{"def", "456"}, []int{4, 5}, []uint64{6, 9}, []int{0, 0}},
+		getPage(GetMessageFormat{From: 4, Limit: 3}))
+	assert.Equal(t, page{[]string{"3", "def"}, []int{3, 4}, []uint64{5, 6}, []int{2, 0}},
+		getPage(GetMessageFormat{FromByte: 5, Limit: 2}))
+	assert.Equal(t, page{[]string{"456"}, []int{5}, []uint64{9}, []int{0}},
+		getPage(GetMessageFormat{FromByte: 7}))
+	assert.Equal(t, page{}, getPage(GetMessageFormat{From: 6}))
+
+	wrapper.Destroy(t)
+}
+
+func TestGetConnectionMessagesStopsAtLimit(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	controller := NewConnectionStreamsController(wrapper.Storage)
+
+	connection := Connection{ID: NewRowID(), ClientBytes: 3, ClientDocuments: 3}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(connection)
+	require.NoError(t, err)
+	now := time.Now()
+	// the last document can't be decoded, it must not be read to return the first page
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many([]interface{}{
+		testConnectionStream(connection.ID, true, 0, []time.Time{now, now}, "a", "b"),
+		testConnectionStream(connection.ID, true, 1, []time.Time{now}, "c"),
+		UnorderedDocument{"_id": NewRowID(), "connection_id": connection.ID, "from_client": true,
+			"document_index": 2, "blocks_indexes": "invalid"},
+	})
+	require.NoError(t, err)
+
+	messages, found := controller.GetConnectionMessages(wrapper.Context, connection.ID, GetMessageFormat{Limit: 1})
+	require.True(t, found)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "a", messages[0].Content)
+
+	wrapper.Destroy(t)
+}
+
+func TestGetConnectionMessagesSummary(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	connectionID := insertTestConnectionStreams(t, wrapper)
+	controller := NewConnectionStreamsController(wrapper.Storage)
+
+	_, found := controller.GetConnectionMessagesSummary(wrapper.Context, NewRowID(), GetMessageFormat{})
+	assert.False(t, found)
+
+	summary, found := controller.GetConnectionMessagesSummary(wrapper.Context, connectionID, GetMessageFormat{})
+	require.True(t, found)
+	assert.Equal(t, 6, summary.MessagesCount)
+	assert.Equal(t, 3, summary.ClientMessagesCount)
+	assert.Equal(t, 3, summary.ServerMessagesCount)
+	assert.Equal(t, uint64(6), summary.ClientBytes)
+	assert.Equal(t, uint64(6), summary.ServerBytes)
+	// the size of the last block of each document is computed from the size of the payload, which is not loaded
+	require.Len(t, summary.Messages, 6)
+	for i, size := range []int{2, 2, 1, 1, 3, 3} {
+		assert.Equal(t, i%2 == 0, summary.Messages[i].FromClient)
+		assert.Equal(t, size, summary.Messages[i].Size)
+		assert.Equal(t, int64(1600000000+i), summary.Messages[i].Timestamp.Unix())
+	}
+
+	wrapper.Destroy(t)
+}
+
+// insertTestConnectionStreams saves a connection with two documents for each side. The blocks of the two sides
+// are interleaved, the whole payload is "ab12c3def456"
+func insertTestConnectionStreams(t *testing.T, wrapper *TestStorageWrapper) RowID {
+	connection := Connection{ID: NewRowID(), ClientBytes: 6, ServerBytes: 6, ClientDocuments: 2, ServerDocuments: 2}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(connection)
+	require.NoError(t, err)
+
+	start := time.Unix(1600000000, 0).UTC()
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	streams := []interface{}{
+		testConnectionStream(connection.ID, true, 0, []time.Time{at(0), at(2)}, "ab", "c"),
+		testConnectionStream(connection.ID, true, 1, []time.Time{at(4)}, "def"),
+		testConnectionStream(connection.ID, false, 0, []time.Time{at(1), at(3)}, "12", "3"),
+		testConnectionStream(connection.ID, false, 1, []time.Time{at(5)}, "456"),
+	}
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many(streams)
+	require.NoError(t, err)
+
+	return connection.ID
+}
+
+func testConnectionStream(connectionID RowID, fromClient bool, documentIndex int, timestamps []time.Time,
+	blocks ...string) ConnectionStream {
+	stream := ConnectionStream{
+		ID:               NewRowID(),
+		ConnectionID:     connectionID,
+		FromClient:       fromClient,
+		DocumentIndex:    documentIndex,
+		BlocksTimestamps: timestamps,
+		BlocksLoss:       make([]bool, len(blocks)),
+		PatternMatches:   map[uint][]PatternSlice{},
+	}
+	for _, block := range blocks {
+		stream.BlocksIndexes = append(stream.BlocksIndexes, len(stream.Payload))
+		stream.Payload = append(stream.Payload, block...)
+	}
+	stream.PayloadString = string(stream.Payload)
+	return stream
+}
+
+func TestDecodePwntoolsChunk(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   []string
+		isClient bool
+		format   string
+		want     string
+	}{
+		{"lines sent by the client", []string{"1\n", "flag\n"}, true, "", "p.sendline('1')\np.sendline('flag')\n"},
+		{"lines with carriage return", []string{"1\r\n"}, true, "", "p.send('1\\r\\n')\n"},
+		{"prompt of the server", []string{"1. Add\n", "> "}, false, "", "p.recvuntil('> ')\n"},
+		{"last line of the server", []string{"Welcome\n"}, false, "", "p.recvuntil('Welcome')\n"},
+		{"quotes", []string{"it's\n"}, true, "", "p.sendline('it\\'s')\n"},
+		{"hex", []string{"ab\n"}, true, "hex", "p.sendline(bytes.fromhex('6162'))\n"},
+		{"base64", []string{"ab\x00"}, true, "base64", "p.send(base64.b64decode('YWIA'))\n"},
+		{"binary blocks", []string{"\x00\x01", "\x02"}, false, "", "p.recvuntil('\\x00\\x01')\np.recvuntil('\\x02')\n"},
+	}
+
+	for _, test := range tests {
+		blocks := make([][]byte, len(test.blocks))
+		for i, block := range test.blocks {
+			blocks[i] = []byte(block)
+		}
+		assert.Equal(t, test.want, decodePwntoolsChunk(blocks, test.isClient, test.format), test.name)
+	}
+}
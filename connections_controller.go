@@ -19,8 +19,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"strings"
 	"time"
 )
 
@@ -28,23 +30,56 @@ const DefaultQueryLimit = 50
 const MaxQueryLimit = 200
 
 type Connection struct {
-	ID              RowID     `json:"id" bson:"_id"`
-	SourceIP        string    `json:"ip_src" bson:"ip_src"`
-	DestinationIP   string    `json:"ip_dst" bson:"ip_dst"`
-	SourcePort      uint16    `json:"port_src" bson:"port_src"`
-	DestinationPort uint16    `json:"port_dst" bson:"port_dst"`
-	StartedAt       time.Time `json:"started_at" bson:"started_at"`
-	ClosedAt        time.Time `json:"closed_at" bson:"closed_at"`
-	ClientBytes     int       `json:"client_bytes" bson:"client_bytes"`
-	ServerBytes     int       `json:"server_bytes" bson:"server_bytes"`
-	ClientDocuments int       `json:"client_documents" bson:"client_documents"`
-	ServerDocuments int       `json:"server_documents" bson:"server_documents"`
-	ProcessedAt     time.Time `json:"processed_at" bson:"processed_at"`
-	MatchedRules    []RowID   `json:"matched_rules" bson:"matched_rules"`
-	Hidden          bool      `json:"hidden" bson:"hidden,omitempty"`
-	Marked          bool      `json:"marked" bson:"marked,omitempty"`
-	Comment         string    `json:"comment" bson:"comment,omitempty"`
-	Service         Service   `json:"service" bson:"-"`
+	ID                   RowID     `json:"id" bson:"_id"`
+	SourceIP             string    `json:"ip_src" bson:"ip_src"`
+	DestinationIP        string    `json:"ip_dst" bson:"ip_dst"`
+	SourcePort           uint16    `json:"port_src" bson:"port_src"`
+	DestinationPort      uint16    `json:"port_dst" bson:"port_dst"`
+	StartedAt            time.Time `json:"started_at" bson:"started_at"`
+	ClosedAt             time.Time `json:"closed_at" bson:"closed_at"`
+	ClientBytes          int       `json:"client_bytes" bson:"client_bytes"`
+	ServerBytes          int       `json:"server_bytes" bson:"server_bytes"`
+	ClientDocuments      int       `json:"client_documents" bson:"client_documents"`
+	ServerDocuments      int       `json:"server_documents" bson:"server_documents"`
+	ProcessedAt          time.Time `json:"processed_at" bson:"processed_at"`
+	MatchedRules         []RowID   `json:"matched_rules" bson:"matched_rules"`
+	Hidden               bool      `json:"hidden" bson:"hidden,omitempty"`
+	Marked               bool      `json:"marked" bson:"marked,omitempty"`
+	Comment              string    `json:"comment" bson:"comment,omitempty"`
+	Tags                 []string  `json:"tags" bson:"tags,omitempty"`
+	TLS                  *TLSInfo  `json:"tls" bson:"tls,omitempty"`
+	Service              Service   `json:"service" bson:"-"`
+	SourceHostnames      []string  `json:"src_hostnames" bson:"-" binding:"omitempty"`
+	DestinationHostnames []string  `json:"dst_hostnames" bson:"-" binding:"omitempty"`
+	ImportingSessions    []string  `json:"importing_sessions" bson:"importing_sessions,omitempty"`
+	ReplayOf             *RowID    `json:"replay_of,omitempty" bson:"replay_of,omitempty"`
+	ClusterID            *RowID    `json:"cluster_id,omitempty" bson:"cluster_id,omitempty"`
+	Novel                bool      `json:"novel" bson:"novel,omitempty"`
+	SourceTeamID         uint16    `json:"src_team_id" bson:"src_team_id,omitempty"`
+	DestinationTeamID    uint16    `json:"dst_team_id" bson:"dst_team_id,omitempty"`
+	SourceTeam           *Team     `json:"src_team" bson:"-"`
+	DestinationTeam      *Team     `json:"dst_team" bson:"-"`
+	Round                int       `json:"round" bson:"round,omitempty"`
+	PayloadDropped       bool      `json:"payload_dropped" bson:"payload_dropped,omitempty"`
+}
+
+type TLSInfo struct {
+	ClientVersion        string   `json:"client_version" bson:"client_version"`
+	Version              string   `json:"version" bson:"version,omitempty"`
+	ServerName           string   `json:"server_name" bson:"server_name,omitempty"`
+	ALPN                 []string `json:"alpn" bson:"alpn,omitempty"`
+	NegotiatedProtocol   string   `json:"negotiated_protocol" bson:"negotiated_protocol,omitempty"`
+	CipherSuites         []string `json:"cipher_suites" bson:"cipher_suites"`
+	CipherSuite          string   `json:"cipher_suite" bson:"cipher_suite,omitempty"`
+	CertificateSubject   string   `json:"certificate_subject" bson:"certificate_subject,omitempty"`
+	CertificateIssuer    string   `json:"certificate_issuer" bson:"certificate_issuer,omitempty"`
+	JA3                  string   `json:"ja3" bson:"ja3"`
+	JA3Hash              string   `json:"ja3_hash" bson:"ja3_hash"`
+	JA3S                 string   `json:"ja3s" bson:"ja3s,omitempty"`
+	JA3SHash             string   `json:"ja3s_hash" bson:"ja3s_hash,omitempty"`
+	Decrypted            bool     `json:"decrypted" bson:"decrypted,omitempty"`
+	DecryptedClientBytes int      `json:"decrypted_client_bytes" bson:"decrypted_client_bytes,omitempty"`
+	DecryptedServerBytes int      `json:"decrypted_server_bytes" bson:"decrypted_server_bytes,omitempty"`
 }
 
 type ConnectionsFilter struct {
@@ -63,78 +98,171 @@ type ConnectionsFilter struct {
 	ClosedBefore    int64    `form:"closed_before" binding:"omitempty,gtefield=ClosedAfter"`
 	Hidden          bool     `form:"hidden"`
 	Marked          bool     `form:"marked"`
+	Tags            []string `form:"tags"`
 	MatchedRules    []string `form:"matched_rules" binding:"dive,hexadecimal,len=24"`
 	PerformedSearch string   `form:"performed_search" binding:"omitempty,hexadecimal,len=24"`
+	TLS             bool     `form:"tls"`
+	TLSServerName   string   `form:"tls_server_name"`
+	TLSVersion      string   `form:"tls_version"`
+	TLSALPN         string   `form:"tls_alpn"`
+	JA3Hash         string   `form:"ja3_hash" binding:"omitempty,hexadecimal,len=32"`
+	JA3SHash        string   `form:"ja3s_hash" binding:"omitempty,hexadecimal,len=32"`
+	ClusterID       string   `form:"cluster_id" binding:"omitempty,hexadecimal,len=24"`
+	Novel           bool     `form:"novel"`
+	ClientTeam      uint16   `form:"client_team"`
+	ServerTeam      uint16   `form:"server_team"`
+	MinRound        int      `form:"min_round"`
+	MaxRound        int      `form:"max_round" binding:"omitempty,gtefield=MinRound"`
 	Limit           int64    `form:"limit"`
 }
 
+// BulkAction is an action applied at once to the connections with the given ids or, if no ids are given, to all
+// the connections which match a filter
+type BulkAction struct {
+	Action        string   `json:"action" binding:"required,oneof=hide show mark unmark tag untag comment"`
+	ConnectionIDs []string `json:"connection_ids" binding:"dive,hexadecimal,len=24"`
+	Tags          []string `json:"tags"`
+	Comment       string   `json:"comment"`
+}
+
 type ConnectionsController struct {
 	storage            Storage
 	searchController   *SearchController
 	servicesController *ServicesController
+	dnsController      *DNSController
+	teamsController    *TeamsController
+	tagsController     *TagsController
+	commentsController *CommentsController
 }
 
 func NewConnectionsController(storage Storage, searchesController *SearchController,
-	servicesController *ServicesController) ConnectionsController {
+	servicesController *ServicesController, dnsController *DNSController, teamsController *TeamsController,
+	tagsController *TagsController, commentsController *CommentsController) ConnectionsController {
 	return ConnectionsController{
 		storage:            storage,
 		searchController:   searchesController,
 		servicesController: servicesController,
+		dnsController:      dnsController,
+		teamsController:    teamsController,
+		tagsController:     tagsController,
+		commentsController: commentsController,
 	}
 }
 
 func (cc ConnectionsController) GetConnections(c context.Context, filter ConnectionsFilter) []Connection {
 	var connections []Connection
-	query := cc.storage.Find(Connections).Context(c)
+	query := cc.storage.Find(Connections).Context(c).Filter(cc.filterDocument(filter))
+	to, _ := RowIDFromHex(filter.To)
+	if to.IsZero() {
+		query = query.Sort("_id", false)
+	}
+	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
+		query = query.Limit(filter.Limit)
+	} else {
+		query = query.Limit(DefaultQueryLimit)
+	}
+
+	if err := query.All(&connections); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get connections")
+	}
+
+	if connections == nil {
+		return []Connection{}
+	}
+
+	services := cc.servicesController.GetServices()
+	addresses := make([]string, 0, 2*len(connections))
+	for i, connection := range connections {
+		if service, isPresent := services[connection.DestinationPort]; isPresent {
+			connections[i].Service = service
+		}
+		addresses = append(addresses, connection.SourceIP, connection.DestinationIP)
+	}
+	if cc.dnsController != nil {
+		hostnames := cc.dnsController.GetHostnames(c, addresses)
+		for i, connection := range connections {
+			connections[i].SourceHostnames = hostnames[connection.SourceIP]
+			connections[i].DestinationHostnames = hostnames[connection.DestinationIP]
+		}
+	}
+
+	if cc.teamsController != nil {
+		teams := cc.teamsController.GetTeams()
+		// connections imported before the definition of their teams are resolved now
+		resolveTeam := func(id uint16, address string) *Team {
+			if team, isPresent := teams[id]; isPresent {
+				return &team
+			}
+			if team, found := cc.teamsController.ResolveTeam(address); found {
+				return &team
+			}
+			return nil
+		}
+		for i, connection := range connections {
+			connections[i].SourceTeam = resolveTeam(connection.SourceTeamID, connection.SourceIP)
+			connections[i].DestinationTeam = resolveTeam(connection.DestinationTeamID, connection.DestinationIP)
+		}
+	}
+
+	if !to.IsZero() {
+		connections = reverseConnections(connections)
+	}
 
+	return connections
+}
+
+// filterDocument returns the conditions of a filter on the connections, without the limit
+func (cc ConnectionsController) filterDocument(filter ConnectionsFilter) OrderedDocument {
+	document := OrderedDocument{}
 	from, _ := RowIDFromHex(filter.From)
 	if !from.IsZero() {
-		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$lte": from}}})
+		document = append(document, Entry{"_id", UnorderedDocument{"$lte": from}})
 	}
 	to, _ := RowIDFromHex(filter.To)
 	if !to.IsZero() {
-		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$gte": to}}})
-	} else {
-		query = query.Sort("_id", false)
+		document = append(document, Entry{"_id", UnorderedDocument{"$gte": to}})
 	}
 	if filter.ServicePort > 0 {
-		query = query.Filter(OrderedDocument{{"port_dst", filter.ServicePort}})
+		document = append(document, Entry{"port_dst", filter.ServicePort})
 	}
 	if len(filter.ClientAddress) > 0 {
-		query = query.Filter(OrderedDocument{{"ip_src", filter.ClientAddress}})
+		document = append(document, Entry{"ip_src", filter.ClientAddress})
 	}
 	if filter.ClientPort > 0 {
-		query = query.Filter(OrderedDocument{{"port_src", filter.ClientPort}})
+		document = append(document, Entry{"port_src", filter.ClientPort})
 	}
 	if filter.MinDuration > 0 {
-		query = query.Filter(OrderedDocument{{"$where", fmt.Sprintf("this.closed_at - this.started_at >= %v", filter.MinDuration)}})
+		document = append(document, Entry{"$where", fmt.Sprintf("this.closed_at - this.started_at >= %v", filter.MinDuration)})
 	}
 	if filter.MaxDuration > 0 {
-		query = query.Filter(OrderedDocument{{"$where", fmt.Sprintf("this.closed_at - this.started_at <= %v", filter.MaxDuration)}})
+		document = append(document, Entry{"$where", fmt.Sprintf("this.closed_at - this.started_at <= %v", filter.MaxDuration)})
 	}
 	if filter.MinBytes > 0 {
-		query = query.Filter(OrderedDocument{{"$where", fmt.Sprintf("this.client_bytes + this.server_bytes >= %v", filter.MinBytes)}})
+		document = append(document, Entry{"$where", fmt.Sprintf("this.client_bytes + this.server_bytes >= %v", filter.MinBytes)})
 	}
 	if filter.MaxBytes > 0 {
-		query = query.Filter(OrderedDocument{{"$where", fmt.Sprintf("this.client_bytes + this.server_bytes <= %v", filter.MaxBytes)}})
+		document = append(document, Entry{"$where", fmt.Sprintf("this.client_bytes + this.server_bytes <= %v", filter.MaxBytes)})
 	}
 	if filter.StartedAfter > 0 {
-		query = query.Filter(OrderedDocument{{"started_at", UnorderedDocument{"$gt": time.Unix(filter.StartedAfter, 0)}}})
+		document = append(document, Entry{"started_at", UnorderedDocument{"$gt": time.Unix(filter.StartedAfter, 0)}})
 	}
 	if filter.StartedBefore > 0 {
-		query = query.Filter(OrderedDocument{{"started_at", UnorderedDocument{"$lt": time.Unix(filter.StartedBefore, 0)}}})
+		document = append(document, Entry{"started_at", UnorderedDocument{"$lt": time.Unix(filter.StartedBefore, 0)}})
 	}
 	if filter.ClosedAfter > 0 {
-		query = query.Filter(OrderedDocument{{"closed_at", UnorderedDocument{"$gt": time.Unix(filter.ClosedAfter, 0)}}})
+		document = append(document, Entry{"closed_at", UnorderedDocument{"$gt": time.Unix(filter.ClosedAfter, 0)}})
 	}
 	if filter.ClosedBefore > 0 {
-		query = query.Filter(OrderedDocument{{"closed_at", UnorderedDocument{"$lt": time.Unix(filter.ClosedBefore, 0)}}})
+		document = append(document, Entry{"closed_at", UnorderedDocument{"$lt": time.Unix(filter.ClosedBefore, 0)}})
 	}
 	if filter.Hidden {
-		query = query.Filter(OrderedDocument{{"hidden", true}})
+		document = append(document, Entry{"hidden", true})
 	}
 	if filter.Marked {
-		query = query.Filter(OrderedDocument{{"marked", true}})
+		document = append(document, Entry{"marked", true})
+	}
+	if len(filter.Tags) > 0 {
+		document = append(document, Entry{"tags", UnorderedDocument{"$all": filter.Tags}})
 	}
 	if filter.MatchedRules != nil && len(filter.MatchedRules) > 0 {
 		matchedRules := make([]RowID, len(filter.MatchedRules))
@@ -146,41 +274,56 @@ func (cc ConnectionsController) GetConnections(c context.Context, filter Connect
 			}
 		}
 
-		query = query.Filter(OrderedDocument{{"matched_rules", UnorderedDocument{"$all": matchedRules}}})
+		document = append(document, Entry{"matched_rules", UnorderedDocument{"$all": matchedRules}})
 	}
 	performedSearchID, _ := RowIDFromHex(filter.PerformedSearch)
 	if !performedSearchID.IsZero() {
 		performedSearch := cc.searchController.GetPerformedSearch(performedSearchID)
-		if !performedSearch.ID.IsZero() && len(performedSearch.AffectedConnections) > 0 {
-			query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$in": performedSearch.AffectedConnections}}})
+		if len(performedSearch.AffectedConnections) == 0 {
+			// an unknown search or a search without results selects no connections, not all the other ones
+			return OrderedDocument{{"_id", UnorderedDocument{"$in": []RowID{}}}}
 		}
+		document = append(document, Entry{"_id", UnorderedDocument{"$in": performedSearch.AffectedConnections}})
 	}
-	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
-		query = query.Limit(filter.Limit)
-	} else {
-		query = query.Limit(DefaultQueryLimit)
+	if filter.TLS {
+		document = append(document, Entry{"tls", UnorderedDocument{"$exists": true}})
 	}
-
-	if err := query.All(&connections); err != nil {
-		log.WithError(err).WithField("filter", filter).Panic("failed to get connections")
+	if filter.TLSServerName != "" {
+		document = append(document, Entry{"tls.server_name", filter.TLSServerName})
 	}
-
-	if connections == nil {
-		return []Connection{}
+	if filter.TLSVersion != "" {
+		document = append(document, Entry{"tls.version", filter.TLSVersion})
 	}
-
-	services := cc.servicesController.GetServices()
-	for i, connection := range connections {
-		if service, isPresent := services[connection.DestinationPort]; isPresent {
-			connections[i].Service = service
-		}
+	if filter.TLSALPN != "" {
+		document = append(document, Entry{"tls.alpn", filter.TLSALPN})
 	}
-
-	if !to.IsZero() {
-		connections = reverseConnections(connections)
+	if filter.JA3Hash != "" {
+		document = append(document, Entry{"tls.ja3_hash", strings.ToLower(filter.JA3Hash)})
+	}
+	if filter.JA3SHash != "" {
+		document = append(document, Entry{"tls.ja3s_hash", strings.ToLower(filter.JA3SHash)})
+	}
+	clusterID, _ := RowIDFromHex(filter.ClusterID)
+	if !clusterID.IsZero() {
+		document = append(document, Entry{"cluster_id", clusterID})
+	}
+	if filter.Novel {
+		document = append(document, Entry{"novel", true})
+	}
+	if filter.ClientTeam > 0 {
+		document = append(document, Entry{"src_team_id", filter.ClientTeam})
+	}
+	if filter.ServerTeam > 0 {
+		document = append(document, Entry{"dst_team_id", filter.ServerTeam})
+	}
+	if filter.MinRound > 0 {
+		document = append(document, Entry{"round", UnorderedDocument{"$gte": filter.MinRound}})
+	}
+	if filter.MaxRound > 0 {
+		document = append(document, Entry{"round", UnorderedDocument{"$lte": filter.MaxRound}})
 	}
 
-	return connections
+	return document
 }
 
 func (cc ConnectionsController) GetConnection(c context.Context, id RowID) (Connection, bool) {
@@ -204,6 +347,60 @@ func (cc ConnectionsController) SetComment(c context.Context, id RowID, comment
 	return cc.setProperty(c, id, "comment", comment)
 }
 
+// ApplyBulkAction applies an action to many connections with a single update, and returns the number of the
+// connections changed. The limit of the filter is ignored
+func (cc ConnectionsController) ApplyBulkAction(c context.Context, action BulkAction, filter ConnectionsFilter,
+	author string) (int64, error) {
+	selection, err := cc.Selection(action.ConnectionIDs, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	switch action.Action {
+	case "hide", "show":
+		return cc.storage.Update(Connections).Context(c).Filter(selection).
+			Many(UnorderedDocument{"hidden": action.Action == "hide"})
+	case "mark", "unmark":
+		return cc.storage.Update(Connections).Context(c).Filter(selection).
+			Many(UnorderedDocument{"marked": action.Action == "mark"})
+	case "tag", "untag":
+		if len(action.Tags) == 0 {
+			return 0, errors.New("specify the tags")
+		}
+		if action.Action == "tag" {
+			return cc.tagsController.addTags(c, selection, action.Tags)
+		}
+		return cc.tagsController.removeTags(c, selection, action.Tags)
+	case "comment":
+		if action.Comment == "" {
+			return 0, errors.New("specify the comment")
+		}
+		return cc.commentsController.addComments(c, selection, author, action.Comment)
+	default:
+		return 0, errors.New("invalid action")
+	}
+}
+
+// Selection returns the query which selects the connections with the given ids or, if there are no ids, the
+// connections which match the filter. The limit of the filter is ignored
+func (cc ConnectionsController) Selection(connectionIDs []string, filter ConnectionsFilter) (OrderedDocument, error) {
+	var selection OrderedDocument
+	if len(connectionIDs) > 0 {
+		ids := make([]RowID, len(connectionIDs))
+		for i, hex := range connectionIDs {
+			ids[i], _ = RowIDFromHex(hex)
+		}
+		selection = OrderedDocument{{"_id", UnorderedDocument{"$in": ids}}}
+	} else {
+		selection = cc.filterDocument(filter)
+	}
+	if len(selection) == 0 {
+		return nil, errors.New("specify the connection ids or a filter")
+	}
+
+	return selection, nil
+}
+
 func (cc ConnectionsController) setProperty(c context.Context, id RowID, propertyName string, propertyValue interface{}) bool {
 	updated, err := cc.storage.Update(Connections).Context(c).Filter(byID(id)).
 		One(UnorderedDocument{propertyName: propertyValue})
@@ -0,0 +1,101 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestApplyBulkAction(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(Comments)
+	wrapper.AddCollection(Tags)
+
+	connections := []interface{}{
+		Connection{ID: NewRowID(), DestinationPort: 80},
+		Connection{ID: NewRowID(), DestinationPort: 80},
+		Connection{ID: NewRowID(), DestinationPort: 80},
+		Connection{ID: NewRowID(), DestinationPort: 22},
+	}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).Many(connections)
+	require.NoError(t, err)
+
+	tagsController := NewTagsController(wrapper.Storage)
+	require.NoError(t, tagsController.SetTag(wrapper.Context, Tag{Name: "checker", Color: "#0f0"}))
+	controller := NewConnectionsController(wrapper.Storage, nil, nil, nil, nil, tagsController,
+		NewCommentsController(wrapper.Storage))
+	checkerFilter := ConnectionsFilter{ServicePort: 80}
+
+	_, err = controller.ApplyBulkAction(wrapper.Context, BulkAction{Action: "hide"}, ConnectionsFilter{}, "")
+	assert.Error(t, err)
+	_, err = controller.ApplyBulkAction(wrapper.Context, BulkAction{Action: "tag"}, checkerFilter, "")
+	assert.Error(t, err)
+
+	affected, err := controller.ApplyBulkAction(wrapper.Context, BulkAction{Action: "hide"}, checkerFilter, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), affected)
+	affected, err = controller.ApplyBulkAction(wrapper.Context, BulkAction{Action: "tag", Tags: []string{"checker"}},
+		checkerFilter, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), affected)
+	affected, err = controller.ApplyBulkAction(wrapper.Context, BulkAction{Action: "comment", Comment: "checker",
+		ConnectionIDs: []string{connections[0].(Connection).ID.Hex()}}, ConnectionsFilter{}, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), affected)
+
+	// a search without results selects no connections
+	emptySearch := PerformedSearch{ID: NewRowID()}
+	controller.searchController = &SearchController{performedSearches: []PerformedSearch{emptySearch}}
+	affected, err = controller.ApplyBulkAction(wrapper.Context, BulkAction{Action: "show"},
+		ConnectionsFilter{ServicePort: 80, PerformedSearch: emptySearch.ID.Hex()}, "")
+	require.NoError(t, err)
+	assert.Zero(t, affected)
+
+	var result []Connection
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Sort("_id", true).All(&result))
+	for i, connection := range result[:3] {
+		assert.True(t, connection.Hidden)
+		assert.Equal(t, []string{"checker"}, connection.Tags)
+		assert.Equal(t, i == 0, connection.Comment == "checker")
+	}
+	assert.False(t, result[3].Hidden)
+	assert.Empty(t, result[3].Tags)
+	assert.Len(t, controller.commentsController.SearchComments(wrapper.Context, CommentsFilter{Author: "alice"}), 1)
+
+	wrapper.Destroy(t)
+}
+
+func TestFilterDocumentPerformedSearch(t *testing.T) {
+	affected := []RowID{NewRowID(), NewRowID()}
+	search := PerformedSearch{ID: NewRowID(), AffectedConnections: affected}
+	emptySearch := PerformedSearch{ID: NewRowID()}
+	controller := ConnectionsController{searchController: &SearchController{
+		performedSearches: []PerformedSearch{search, emptySearch},
+	}}
+	nothing := OrderedDocument{{"_id", UnorderedDocument{"$in": []RowID{}}}}
+
+	assert.Equal(t, OrderedDocument{{"port_dst", uint16(80)}, {"_id", UnorderedDocument{"$in": affected}}},
+		controller.filterDocument(ConnectionsFilter{ServicePort: 80, PerformedSearch: search.ID.Hex()}))
+	assert.Equal(t, nothing, controller.filterDocument(ConnectionsFilter{ServicePort: 80,
+		PerformedSearch: emptySearch.ID.Hex()}))
+	assert.Equal(t, nothing, controller.filterDocument(ConnectionsFilter{ServicePort: 80,
+		PerformedSearch: NewRowID().Hex()}))
+}
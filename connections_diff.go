@@ -0,0 +1,444 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxDiffCells is the maximum size of the table used to compute the longest common subsequence. Beyond it, the
+// different parts of two sequences are reported as a whole
+const maxDiffCells = 4 * 1024 * 1024
+
+const maskedKey = "\x00"
+
+const (
+	DiffChunkEqual   = "equal"
+	DiffChunkIgnored = "ignored"
+	DiffChunkRemoved = "removed"
+	DiffChunkAdded   = "added"
+)
+
+var tokenPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`),
+	regexp.MustCompile(`[0-9a-fA-F]{16,}`),
+}
+
+var randomTokenPattern = regexp.MustCompile(`[A-Za-z0-9+/_\-]{20,}={0,2}`)
+
+type DiffOptions struct {
+	A         string `form:"a" binding:"required,hexadecimal,len=24"`
+	B         string `form:"b" binding:"required,hexadecimal,len=24"`
+	Mode      string `form:"mode" binding:"omitempty,oneof=bytes lines"`
+	Format    string `form:"format"`
+	Encrypted bool   `form:"encrypted"`
+	Rules     bool   `form:"rules"` // ignore also the parts matched by the rules
+}
+
+type ConnectionsDiff struct {
+	A     RowID          `json:"a"`
+	B     RowID          `json:"b"`
+	Pairs []MessagesDiff `json:"pairs"`
+}
+
+// MessagesDiff is the diff of a message of the first connection with a message of the second connection. If a
+// message has not a counterpart, only one of A and B is set
+type MessagesDiff struct {
+	FromClient bool        `json:"from_client"`
+	A          *int        `json:"a"`
+	B          *int        `json:"b"`
+	Equal      bool        `json:"equal"`
+	Chunks     []DiffChunk `json:"chunks"`
+}
+
+type DiffChunk struct {
+	Type    string `json:"type"`
+	Content string `json:"content,omitempty"`
+	A       string `json:"a,omitempty"`
+	B       string `json:"b,omitempty"`
+}
+
+type diffOperation struct {
+	kind   string
+	aIndex int
+	bIndex int
+}
+
+// diffUnit is a piece of a message compared with the key, which has the ignored parts replaced
+type diffUnit struct {
+	key  string
+	text string
+}
+
+// DiffConnections lines up the messages of two connections and returns the diff of each pair. The parts which look
+// like flags or random tokens, and the ones matched by ignorePatterns, are not considered differences.
+func (csc ConnectionStreamsController) DiffConnections(c context.Context, options DiffOptions,
+	ignorePatterns []*regexp.Regexp) (ConnectionsDiff, bool) {
+	aID, _ := RowIDFromHex(options.A)
+	bID, _ := RowIDFromHex(options.B)
+	// the messages are compared in their original form and encoded only at the end
+	aMessages, aFound := csc.GetConnectionMessages(c, aID, GetMessageFormat{Encrypted: options.Encrypted})
+	bMessages, bFound := csc.GetConnectionMessages(c, bID, GetMessageFormat{Encrypted: options.Encrypted})
+	if !aFound || !bFound {
+		return ConnectionsDiff{}, false
+	}
+
+	patterns := append(append([]*regexp.Regexp{}, tokenPatterns...), ignorePatterns...)
+	aRanges := make([][][2]int, len(aMessages))
+	aKeys := make([]string, len(aMessages))
+	for i, message := range aMessages {
+		aRanges[i] = ignoredRanges(message, patterns, options.Rules)
+		aKeys[i] = messageKey(message, aRanges[i])
+	}
+	bRanges := make([][][2]int, len(bMessages))
+	bKeys := make([]string, len(bMessages))
+	for i, message := range bMessages {
+		bRanges[i] = ignoredRanges(message, patterns, options.Rules)
+		bKeys[i] = messageKey(message, bRanges[i])
+	}
+
+	diff := ConnectionsDiff{A: aID, B: bID, Pairs: make([]MessagesDiff, 0, len(aMessages))}
+	appendPair := func(aIndex, bIndex int) {
+		aNumber, bNumber := aIndex, bIndex
+		pair := MessagesDiff{}
+		var aUnits, bUnits []diffUnit
+		if aIndex >= 0 {
+			pair.A, pair.FromClient = &aNumber, aMessages[aIndex].FromClient
+			aUnits = diffUnits(aMessages[aIndex].Content, aRanges[aIndex], options.Mode)
+		}
+		if bIndex >= 0 {
+			pair.B, pair.FromClient = &bNumber, bMessages[bIndex].FromClient
+			bUnits = diffUnits(bMessages[bIndex].Content, bRanges[bIndex], options.Mode)
+		}
+		pair.Chunks, pair.Equal = diffChunks(aUnits, bUnits, options.Format)
+		diff.Pairs = append(diff.Pairs, pair)
+	}
+
+	// the messages of the same side between two equal messages are paired in order
+	var aPending, bPending []int
+	flushPending := func() {
+		var aClient, aServer, bClient, bServer []int
+		for _, i := range aPending {
+			if aMessages[i].FromClient {
+				aClient = append(aClient, i)
+			} else {
+				aServer = append(aServer, i)
+			}
+		}
+		for _, i := range bPending {
+			if bMessages[i].FromClient {
+				bClient = append(bClient, i)
+			} else {
+				bServer = append(bServer, i)
+			}
+		}
+
+		var pairs [][2]int
+		for _, sides := range [][2][]int{{aClient, bClient}, {aServer, bServer}} {
+			for i := 0; i < len(sides[0]) || i < len(sides[1]); i++ {
+				pair := [2]int{-1, -1}
+				if i < len(sides[0]) {
+					pair[0] = sides[0][i]
+				}
+				if i < len(sides[1]) {
+					pair[1] = sides[1][i]
+				}
+				pairs = append(pairs, pair)
+			}
+		}
+		// the pairs are ordered by the position of the first message of the pair
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return pairPosition(pairs[i], aPending, bPending) < pairPosition(pairs[j], aPending, bPending)
+		})
+		for _, pair := range pairs {
+			appendPair(pair[0], pair[1])
+		}
+		aPending, bPending = aPending[:0], bPending[:0]
+	}
+
+	for _, operation := range diffKeys(aKeys, bKeys) {
+		switch operation.kind {
+		case DiffChunkEqual:
+			flushPending()
+			appendPair(operation.aIndex, operation.bIndex)
+		case DiffChunkRemoved:
+			aPending = append(aPending, operation.aIndex)
+		case DiffChunkAdded:
+			bPending = append(bPending, operation.bIndex)
+		}
+	}
+	flushPending()
+
+	return diff, true
+}
+
+// flagPatterns returns the patterns of the flags to ignore when comparing connections, if the flag regex is
+// compatible with the go syntax
+func flagPatterns(flagRegex string) []*regexp.Regexp {
+	if pattern, err := regexp.Compile(flagRegex); err == nil {
+		return []*regexp.Regexp{pattern}
+	}
+	return nil
+}
+
+// pairPosition returns the relative position of the first message of a pair among the pending messages
+func pairPosition(pair [2]int, aPending, bPending []int) int {
+	position := len(aPending) + len(bPending)
+	for i, index := range aPending {
+		if index == pair[0] && i < position {
+			position = i
+		}
+	}
+	for i, index := range bPending {
+		if index == pair[1] && i < position {
+			position = i
+		}
+	}
+	return position
+}
+
+// ignoredRanges returns the sorted ranges of the content of a message which look like flags or random tokens
+func ignoredRanges(message *Message, patterns []*regexp.Regexp, withRules bool) [][2]int {
+	var ranges [][2]int
+	for _, pattern := range patterns {
+		for _, match := range pattern.FindAllStringIndex(message.Content, -1) {
+			ranges = append(ranges, [2]int{match[0], match[1]})
+		}
+	}
+	for _, match := range randomTokenPattern.FindAllStringIndex(message.Content, -1) {
+		token := message.Content[match[0]:match[1]]
+		if strings.ContainsAny(token, "0123456789") && strings.IndexFunc(token, isLetter) >= 0 {
+			ranges = append(ranges, [2]int{match[0], match[1]})
+		}
+	}
+	if withRules {
+		for _, slice := range message.RegexMatches {
+			ranges = append(ranges, [2]int{int(slice.From), int(slice.To)})
+		}
+	}
+
+	// merge the overlapping ranges
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+	merged := make([][2]int, 0, len(ranges))
+	for _, r := range ranges {
+		if r[0] >= r[1] || r[1] > len(message.Content) {
+			continue
+		}
+		if last := len(merged) - 1; last >= 0 && r[0] <= merged[last][1] {
+			if r[1] > merged[last][1] {
+				merged[last][1] = r[1]
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+func isLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func messageKey(message *Message, ranges [][2]int) string {
+	side := "s"
+	if message.FromClient {
+		side = "c"
+	}
+	return side + maskRanges(message.Content, 0, len(message.Content), ranges)
+}
+
+// maskRanges returns the content between start and end with the ignored ranges replaced by maskedKey
+func maskRanges(content string, start, end int, ranges [][2]int) string {
+	var sb strings.Builder
+	position := start
+	for _, r := range ranges {
+		if r[1] <= position || r[0] >= end {
+			continue
+		}
+		if r[0] > position {
+			sb.WriteString(content[position:r[0]])
+		}
+		sb.WriteString(maskedKey)
+		position = r[1]
+	}
+	if position < end {
+		sb.WriteString(content[position:end])
+	}
+	return sb.String()
+}
+
+// diffUnits splits a content in lines or in bytes. In bytes mode each ignored range is a single unit
+func diffUnits(content string, ranges [][2]int, mode string) []diffUnit {
+	var units []diffUnit
+	if mode == "bytes" {
+		units = make([]diffUnit, 0, len(content))
+		nextRange := 0
+		for i := 0; i < len(content); {
+			if nextRange < len(ranges) && ranges[nextRange][0] == i {
+				units = append(units, diffUnit{key: maskedKey, text: content[i:ranges[nextRange][1]]})
+				i = ranges[nextRange][1]
+				nextRange++
+				continue
+			}
+			units = append(units, diffUnit{key: content[i : i+1], text: content[i : i+1]})
+			i++
+		}
+		return units
+	}
+
+	for start := 0; start < len(content); {
+		end := strings.IndexByte(content[start:], '\n') + start + 1
+		if end == start { // no more new lines
+			end = len(content)
+		}
+		units = append(units, diffUnit{key: maskRanges(content, start, end, ranges), text: content[start:end]})
+		start = end
+	}
+	return units
+}
+
+// diffChunks compares the units of two messages and groups the consecutive units of the same type in chunks
+func diffChunks(aUnits, bUnits []diffUnit, format string) ([]DiffChunk, bool) {
+	aKeys := make([]string, len(aUnits))
+	for i, unit := range aUnits {
+		aKeys[i] = unit.key
+	}
+	bKeys := make([]string, len(bUnits))
+	for i, unit := range bUnits {
+		bKeys[i] = unit.key
+	}
+
+	chunks := make([]DiffChunk, 0)
+	var chunkType string
+	var aBuilder, bBuilder strings.Builder
+	flushChunk := func() {
+		if chunkType == "" {
+			return
+		}
+		chunk := DiffChunk{Type: chunkType}
+		if chunkType == DiffChunkEqual {
+			chunk.Content = DecodeBytes([]byte(aBuilder.String()), format)
+		} else {
+			chunk.A = DecodeBytes([]byte(aBuilder.String()), format)
+			chunk.B = DecodeBytes([]byte(bBuilder.String()), format)
+		}
+		chunks = append(chunks, chunk)
+		aBuilder.Reset()
+		bBuilder.Reset()
+	}
+
+	isEqual := true
+	for _, operation := range diffKeys(aKeys, bKeys) {
+		kind := operation.kind
+		if kind == DiffChunkEqual && aUnits[operation.aIndex].text != bUnits[operation.bIndex].text {
+			kind = DiffChunkIgnored
+		} else if kind != DiffChunkEqual {
+			isEqual = false
+		}
+		if kind != chunkType {
+			flushChunk()
+			chunkType = kind
+		}
+		if operation.aIndex >= 0 {
+			aBuilder.WriteString(aUnits[operation.aIndex].text)
+		}
+		if operation.bIndex >= 0 {
+			bBuilder.WriteString(bUnits[operation.bIndex].text)
+		}
+	}
+	flushChunk()
+
+	return chunks, isEqual
+}
+
+// diffKeys computes the longest common subsequence of two sequences of keys and returns the operations which
+// transform the first sequence in the second one. The common prefix and suffix are skipped, and if the remaining
+// parts are too big they are replaced as a whole.
+func diffKeys(a, b []string) []diffOperation {
+	operations := make([]diffOperation, 0, len(a)+len(b))
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		operations = append(operations, diffOperation{DiffChunkEqual, prefix, prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	aMiddle, bMiddle := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	removeAll := func(from, to int) {
+		for i := from; i < to; i++ {
+			operations = append(operations, diffOperation{DiffChunkRemoved, prefix + i, -1})
+		}
+	}
+	addAll := func(from, to int) {
+		for j := from; j < to; j++ {
+			operations = append(operations, diffOperation{DiffChunkAdded, -1, prefix + j})
+		}
+	}
+
+	if (len(aMiddle)+1)*(len(bMiddle)+1) > maxDiffCells {
+		removeAll(0, len(aMiddle))
+		addAll(0, len(bMiddle))
+	} else {
+		// lengths[i][j] is the length of the longest common subsequence of aMiddle[i:] and bMiddle[j:]
+		lengths := make([][]int32, len(aMiddle)+1)
+		for i := range lengths {
+			lengths[i] = make([]int32, len(bMiddle)+1)
+		}
+		for i := len(aMiddle) - 1; i >= 0; i-- {
+			for j := len(bMiddle) - 1; j >= 0; j-- {
+				if aMiddle[i] == bMiddle[j] {
+					lengths[i][j] = lengths[i+1][j+1] + 1
+				} else if lengths[i+1][j] >= lengths[i][j+1] {
+					lengths[i][j] = lengths[i+1][j]
+				} else {
+					lengths[i][j] = lengths[i][j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(aMiddle) && j < len(bMiddle) {
+			if aMiddle[i] == bMiddle[j] {
+				operations = append(operations, diffOperation{DiffChunkEqual, prefix + i, prefix + j})
+				i++
+				j++
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				removeAll(i, i+1)
+				i++
+			} else {
+				addAll(j, j+1)
+				j++
+			}
+		}
+		removeAll(i, len(aMiddle))
+		addAll(j, len(bMiddle))
+	}
+
+	for k := suffix; k > 0; k-- {
+		operations = append(operations, diffOperation{DiffChunkEqual, len(a) - k, len(b) - k})
+	}
+	return operations
+}
@@ -0,0 +1,71 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+)
+
+func TestDiffMessages(t *testing.T) {
+	flagRegex := regexp.MustCompile(`FLAG\{[a-z0-9_]+\}`)
+	patterns := append([]*regexp.Regexp{flagRegex}, tokenPatterns...)
+
+	a := &Message{FromClient: false, Content: "user: admin\nflag: FLAG{first_flag}\nsession: 5f4dcc3b5aa765d61d8327deb882cf99\n"}
+	b := &Message{FromClient: false, Content: "user: admin\nflag: FLAG{second_flag}\nsession: e99a18c428cb38d5f260853678922e03\n"}
+	aRanges, bRanges := ignoredRanges(a, patterns, false), ignoredRanges(b, patterns, false)
+	assert.Len(t, aRanges, 2)
+	assert.Equal(t, messageKey(a, aRanges), messageKey(b, bRanges))
+
+	chunks, isEqual := diffChunks(diffUnits(a.Content, aRanges, "lines"), diffUnits(b.Content, bRanges, "lines"), "")
+	assert.True(t, isEqual)
+	assert.Equal(t, []DiffChunk{
+		{Type: DiffChunkEqual, Content: "user: admin\n"},
+		{Type: DiffChunkIgnored, A: "flag: FLAG{first_flag}\nsession: 5f4dcc3b5aa765d61d8327deb882cf99\n",
+			B: "flag: FLAG{second_flag}\nsession: e99a18c428cb38d5f260853678922e03\n"},
+	}, chunks)
+
+	a = &Message{FromClient: true, Content: "GET /?q=1 HTTP/1.1"}
+	b = &Message{FromClient: true, Content: "GET /?q=1' OR 1=1 HTTP/1.1"}
+	chunks, isEqual = diffChunks(diffUnits(a.Content, nil, "bytes"), diffUnits(b.Content, nil, "bytes"), "")
+	assert.False(t, isEqual)
+	assert.Equal(t, []DiffChunk{
+		{Type: DiffChunkEqual, Content: "GET /?q=1"},
+		{Type: DiffChunkAdded, B: "' OR 1=1"},
+		{Type: DiffChunkEqual, Content: " HTTP/1.1"},
+	}, chunks)
+
+	// the matches of the rules are ignored only if requested
+	a.RegexMatches = []RegexSlice{{From: 8, To: 9}}
+	assert.Empty(t, ignoredRanges(a, patterns, false))
+	assert.Equal(t, [][2]int{{8, 9}}, ignoredRanges(a, patterns, true))
+}
+
+func TestDiffKeys(t *testing.T) {
+	operations := diffKeys([]string{"a", "b", "c", "d"}, []string{"a", "c", "e", "d"})
+	assert.Equal(t, []diffOperation{
+		{DiffChunkEqual, 0, 0},
+		{DiffChunkRemoved, 1, -1},
+		{DiffChunkEqual, 2, 1},
+		{DiffChunkAdded, -1, 2},
+		{DiffChunkEqual, 3, 3},
+	}, operations)
+
+	assert.Equal(t, []diffOperation{{DiffChunkAdded, -1, 0}}, diffKeys(nil, []string{"a"}))
+}
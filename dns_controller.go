@@ -0,0 +1,201 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/eciavatta/caronte/parsers"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SuspiciousLabelLength is the length of the labels of domain names which are probably used to exfiltrate data
+const SuspiciousLabelLength = 32
+
+type PassiveDNSRecord struct {
+	IP        string    `json:"ip" bson:"_id"`
+	Hostnames []string  `json:"hostnames" bson:"hostnames"`
+	FirstSeen time.Time `json:"first_seen" bson:"first_seen"`
+	LastSeen  time.Time `json:"last_seen" bson:"last_seen"`
+}
+
+type DNSQuery struct {
+	ID            string    `json:"id" bson:"_id"`
+	Name          string    `json:"name" bson:"name"`
+	Type          string    `json:"type" bson:"type"`
+	ClientIP      string    `json:"client_ip" bson:"client_ip"`
+	ServerIP      string    `json:"server_ip" bson:"server_ip"`
+	TransactionID uint16    `json:"transaction_id" bson:"transaction_id"`
+	Timestamp     time.Time `json:"timestamp" bson:"timestamp"`
+	LongestLabel  int       `json:"longest_label" bson:"longest_label"`
+	ResponseCode  string    `json:"response_code" bson:"response_code,omitempty"`
+	Answers       []string  `json:"answers" bson:"answers,omitempty"`
+}
+
+type DNSQueriesFilter struct {
+	Name           string `form:"name"`
+	ClientAddress  string `form:"client_address" binding:"omitempty,ip"`
+	ResponseCode   string `form:"response_code"`
+	MinLabelLength int    `form:"min_label_length"`
+	Suspicious     bool   `form:"suspicious"`
+	Limit          int64  `form:"limit"`
+}
+
+type DNSController struct {
+	storage Storage
+}
+
+func NewDNSController(storage Storage) *DNSController {
+	return &DNSController{
+		storage: storage,
+	}
+}
+
+// ProcessDNSMessage saves the query of a DNS message and, for the responses, associates the addresses in the
+// answers to the domain names requested, following the CNAME records.
+func (dc *DNSController) ProcessDNSMessage(message parsers.DNSMessage, srcIP, dstIP string, timestamp time.Time) {
+	clientIP, serverIP := srcIP, dstIP
+	if message.IsResponse {
+		clientIP, serverIP = dstIP, srcIP
+	}
+
+	question := message.Questions[0]
+	query := UnorderedDocument{
+		"name":           question.Name,
+		"type":           question.Type,
+		"client_ip":      clientIP,
+		"server_ip":      serverIP,
+		"transaction_id": message.ID,
+		"timestamp":      timestamp,
+		"longest_label":  parsers.LongestDNSLabel(question.Name),
+	}
+	update := UnorderedDocument{"$setOnInsert": query}
+	if message.IsResponse {
+		answers := make([]string, 0, len(message.Answers))
+		for _, answer := range message.Answers {
+			answers = append(answers, fmt.Sprintf("%s %s %s", answer.Name, answer.Type, answer.Data))
+		}
+		update["$set"] = UnorderedDocument{"response_code": message.ResponseCode, "answers": answers}
+	}
+
+	var upsertResults interface{}
+	queryID := fmt.Sprintf("%s-%s-%d-%s", clientIP, serverIP, message.ID, question.Name)
+	if _, err := dc.storage.Update(DNSQueries).Upsert(&upsertResults).Filter(OrderedDocument{{"_id", queryID}}).
+		OneComplex(update); err != nil {
+		log.WithError(err).WithField("query", query).Error("failed to save dns query")
+	}
+
+	if !message.IsResponse {
+		return
+	}
+	aliases := make(map[string][]string) // canonical name -> names
+	for _, q := range message.Questions {
+		aliases[q.Name] = []string{q.Name}
+	}
+	for _, answer := range message.Answers {
+		if answer.Type == "CNAME" {
+			aliases[answer.Data] = append(aliases[answer.Data], aliases[answer.Name]...)
+			aliases[answer.Data] = append(aliases[answer.Data], answer.Data)
+		}
+	}
+	for _, answer := range message.Answers {
+		if answer.Type != "A" && answer.Type != "AAAA" {
+			continue
+		}
+		hostnames := append([]string{answer.Name}, aliases[answer.Name]...)
+		recordUpdate := UnorderedDocument{
+			"$addToSet": UnorderedDocument{"hostnames": UnorderedDocument{"$each": hostnames}},
+			"$min":      UnorderedDocument{"first_seen": timestamp},
+			"$max":      UnorderedDocument{"last_seen": timestamp},
+		}
+		if _, err := dc.storage.Update(PassiveDNS).Upsert(&upsertResults).
+			Filter(OrderedDocument{{"_id", answer.Data}}).OneComplex(recordUpdate); err != nil {
+			log.WithError(err).WithField("ip", answer.Data).Error("failed to update passive dns")
+		}
+	}
+}
+
+// GetHostnames returns the names resolved to the given addresses
+func (dc *DNSController) GetHostnames(c context.Context, ips []string) map[string][]string {
+	var records []PassiveDNSRecord
+	if err := dc.storage.Find(PassiveDNS).Context(c).Filter(OrderedDocument{{"_id", UnorderedDocument{"$in": ips}}}).
+		All(&records); err != nil {
+		log.WithError(err).Panic("failed to get passive dns records")
+	}
+
+	hostnames := make(map[string][]string, len(records))
+	for _, record := range records {
+		hostnames[record.IP] = record.Hostnames
+	}
+	return hostnames
+}
+
+func (dc *DNSController) GetPassiveDNSRecords(c context.Context, hostname string) []PassiveDNSRecord {
+	var records []PassiveDNSRecord
+	query := dc.storage.Find(PassiveDNS).Context(c).Sort("last_seen", false).Limit(MaxQueryLimit)
+	if hostname != "" {
+		query = query.Filter(OrderedDocument{{"hostnames", hostname}})
+	}
+	if err := query.All(&records); err != nil {
+		log.WithError(err).Panic("failed to get passive dns records")
+	}
+
+	if records == nil {
+		return []PassiveDNSRecord{}
+	}
+	return records
+}
+
+func (dc *DNSController) GetDNSQueries(c context.Context, filter DNSQueriesFilter) []DNSQuery {
+	var queries []DNSQuery
+	query := dc.storage.Find(DNSQueries).Context(c).Sort("timestamp", false)
+	if filter.Name != "" {
+		query = query.Filter(OrderedDocument{{"name", UnorderedDocument{
+			"$regex": regexp.QuoteMeta(filter.Name), "$options": "i"}}})
+	}
+	if filter.ClientAddress != "" {
+		query = query.Filter(OrderedDocument{{"client_ip", filter.ClientAddress}})
+	}
+	if filter.ResponseCode != "" {
+		query = query.Filter(OrderedDocument{{"response_code", strings.ToUpper(filter.ResponseCode)}})
+	}
+	minLabelLength := filter.MinLabelLength
+	if filter.Suspicious && minLabelLength < SuspiciousLabelLength {
+		minLabelLength = SuspiciousLabelLength
+	}
+	if minLabelLength > 0 {
+		query = query.Filter(OrderedDocument{{"longest_label", UnorderedDocument{"$gte": minLabelLength}}})
+	}
+	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
+		query = query.Limit(filter.Limit)
+	} else {
+		query = query.Limit(DefaultQueryLimit)
+	}
+
+	if err := query.All(&queries); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get dns queries")
+	}
+
+	if queries == nil {
+		return []DNSQuery{}
+	}
+	return queries
+}
@@ -0,0 +1,103 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/eciavatta/caronte/parsers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessDNSMessage(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(DNSQueries)
+	wrapper.AddCollection(PassiveDNS)
+	controller := NewDNSController(wrapper.Storage)
+
+	start := time.Unix(1600000000, 0).UTC()
+	question := []parsers.DNSQuestion{{Name: "www.ctf", Type: "A"}}
+	controller.ProcessDNSMessage(parsers.DNSMessage{ID: 1, Questions: question}, "10.0.0.1", "10.0.0.53", start)
+	controller.ProcessDNSMessage(parsers.DNSMessage{ID: 1, IsResponse: true, ResponseCode: "NOERROR",
+		Questions: question, Answers: []parsers.DNSRecord{
+			{Name: "www.ctf", Type: "CNAME", Data: "web.ctf"},
+			{Name: "web.ctf", Type: "A", Data: "10.60.1.1"},
+		}}, "10.0.0.53", "10.0.0.1", start.Add(time.Second))
+
+	// the query and its response are saved in the same document
+	queries := controller.GetDNSQueries(wrapper.Context, DNSQueriesFilter{})
+	require.Len(t, queries, 1)
+	assert.Equal(t, "10.0.0.1-10.0.0.53-1-www.ctf", queries[0].ID)
+	assert.Equal(t, "10.0.0.1", queries[0].ClientIP)
+	assert.Equal(t, "10.0.0.53", queries[0].ServerIP)
+	assert.True(t, start.Equal(queries[0].Timestamp))
+	assert.Equal(t, 3, queries[0].LongestLabel)
+	assert.Equal(t, "NOERROR", queries[0].ResponseCode)
+	assert.Equal(t, []string{"www.ctf CNAME web.ctf", "web.ctf A 10.60.1.1"}, queries[0].Answers)
+
+	// the address is associated to the canonical name and to its aliases
+	assert.Equal(t, map[string][]string{"10.60.1.1": {"web.ctf", "www.ctf"}},
+		controller.GetHostnames(wrapper.Context, []string{"10.60.1.1", "10.60.2.1"}))
+
+	controller.ProcessDNSMessage(parsers.DNSMessage{ID: 2, IsResponse: true, ResponseCode: "NOERROR",
+		Questions: []parsers.DNSQuestion{{Name: "flag.ctf", Type: "A"}},
+		Answers:   []parsers.DNSRecord{{Name: "flag.ctf", Type: "A", Data: "10.60.1.1"}},
+	}, "10.0.0.53", "10.0.0.1", start.Add(time.Minute))
+	records := controller.GetPassiveDNSRecords(wrapper.Context, "flag.ctf")
+	require.Len(t, records, 1)
+	assert.Equal(t, []string{"web.ctf", "www.ctf", "flag.ctf"}, records[0].Hostnames)
+	assert.True(t, start.Add(time.Second).Equal(records[0].FirstSeen))
+	assert.True(t, start.Add(time.Minute).Equal(records[0].LastSeen))
+	assert.Empty(t, controller.GetPassiveDNSRecords(wrapper.Context, "unknown.ctf"))
+
+	wrapper.Destroy(t)
+}
+
+func TestGetDNSQueries(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(DNSQueries)
+	controller := NewDNSController(wrapper.Storage)
+
+	exfiltration := strings.Repeat("a", SuspiciousLabelLength) + ".exfil.ctf"
+	start := time.Unix(1600000000, 0).UTC()
+	for i, name := range []string{"www.ctf", "abcdefghij.ctf", exfiltration} {
+		controller.ProcessDNSMessage(parsers.DNSMessage{ID: uint16(i), Questions: []parsers.DNSQuestion{
+			{Name: name, Type: "A"}}}, "10.0.0.1", "10.0.0.53", start.Add(time.Duration(i)*time.Second))
+	}
+
+	names := func(filter DNSQueriesFilter) []string {
+		queries := controller.GetDNSQueries(wrapper.Context, filter)
+		names := make([]string, len(queries))
+		for i, query := range queries {
+			names[i] = query.Name
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{exfiltration, "abcdefghij.ctf", "www.ctf"}, names(DNSQueriesFilter{}))
+	assert.Equal(t, []string{exfiltration}, names(DNSQueriesFilter{Suspicious: true}))
+	assert.Equal(t, []string{exfiltration, "abcdefghij.ctf"}, names(DNSQueriesFilter{MinLabelLength: 10}))
+	// the suspicious filter raises the minimum length of the labels, but doesn't lower it
+	assert.Equal(t, []string{exfiltration}, names(DNSQueriesFilter{MinLabelLength: 10, Suspicious: true}))
+	assert.Empty(t, names(DNSQueriesFilter{MinLabelLength: SuspiciousLabelLength + 1, Suspicious: true}))
+	assert.Equal(t, []string{"www.ctf"}, names(DNSQueriesFilter{Name: "WWW", MinLabelLength: 3, Limit: 1}))
+
+	wrapper.Destroy(t)
+}
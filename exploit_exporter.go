@@ -0,0 +1,374 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// excludedRequestHeaders are set by the requests library, or by the session in the case of the cookies
+var excludedRequestHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Cookie":            true,
+}
+
+type exploitExporter func(connection Connection, chunks []exploitChunk, format DownloadMessageFormat) (string, error)
+
+var exploitExporters = map[string]exploitExporter{
+	"python_socket":   exportPythonSocket,
+	"python_requests": exportPythonRequests,
+	"go":              exportGoConn,
+}
+
+// exploitChunk contains the consecutive blocks of the same side of a connection
+type exploitChunk struct {
+	fromClient bool
+	blocks     [][]byte
+}
+
+// ExportExploit returns a script which repeats the client messages of a connection. The type of the script is one
+// of the exploitExporters.
+func (csc ConnectionStreamsController) ExportExploit(c context.Context, connectionID RowID,
+	format DownloadMessageFormat) (string, bool, error) {
+	exporter, isPresent := exploitExporters[format.Type]
+	if !isPresent {
+		return "", false, errors.New("invalid exploit type")
+	}
+	connection := csc.getConnection(c, connectionID)
+	if connection.ID.IsZero() {
+		return "", false, nil
+	}
+
+	var chunks []exploitChunk
+	cursor := csc.newMessagesCursor(c, connectionID, isDecrypted(connection) && !format.Encrypted, true)
+	for side := cursor.nextSide(); side != nil; side = cursor.nextSide() {
+		if len(chunks) == 0 || chunks[len(chunks)-1].fromClient != side.fromClient {
+			chunks = append(chunks, exploitChunk{fromClient: side.fromClient})
+		}
+		chunk := &chunks[len(chunks)-1]
+		chunk.blocks = append(chunk.blocks, blockPayload(side.stream, side.blocksIndex))
+		cursor.advance(side)
+	}
+
+	script, err := exporter(connection, chunks, format)
+	return script, true, err
+}
+
+func exportPythonSocket(connection Connection, chunks []exploitChunk, format DownloadMessageFormat) (string, error) {
+	var sb strings.Builder
+	if connection.TLS != nil {
+		sb.WriteString("import re\nimport socket\nimport ssl\nimport sys\n\n")
+	} else {
+		sb.WriteString("import re\nimport socket\nimport sys\n\n")
+	}
+	writePythonTarget(&sb, connection, format)
+	sb.WriteString(`
+
+def recvuntil(s, delimiter):
+    data = b''
+    while not data.endswith(delimiter):
+        chunk = s.recv(4096)
+        if not chunk:
+            break
+        data += chunk
+    return data
+
+
+`)
+	if connection.TLS != nil {
+		sb.WriteString("context = ssl.create_default_context()\ncontext.check_hostname = False\n" +
+			"context.verify_mode = ssl.CERT_NONE\n")
+		sb.WriteString("s = context.wrap_socket(socket.create_connection((HOST, PORT), timeout=10), " +
+			"server_hostname=HOST)\n")
+	} else {
+		sb.WriteString("s = socket.create_connection((HOST, PORT), timeout=10)\n")
+	}
+	sb.WriteString("data = b''\n")
+	for _, chunk := range chunks {
+		if chunk.fromClient {
+			for _, block := range chunk.blocks {
+				sb.WriteString(fmt.Sprintf("s.sendall(%s)\n", pythonBytes(block)))
+			}
+		} else {
+			delimiter := serverDelimiter(chunk, format.ServerBytes)
+			sb.WriteString(fmt.Sprintf("data += recvuntil(s, %s)\n", pythonBytes(delimiter)))
+		}
+	}
+	sb.WriteString("s.close()\n\n")
+	writePythonOutput(&sb, format)
+
+	return sb.String(), nil
+}
+
+func exportPythonRequests(connection Connection, chunks []exploitChunk, format DownloadMessageFormat) (string, error) {
+	var clientPayload, serverPayload []byte
+	for _, chunk := range chunks {
+		for _, block := range chunk.blocks {
+			if chunk.fromClient {
+				clientPayload = append(clientPayload, block...)
+			} else {
+				serverPayload = append(serverPayload, block...)
+			}
+		}
+	}
+
+	var requests []*http.Request
+	var bodies [][]byte
+	reader := bufio.NewReader(bytes.NewReader(clientPayload))
+	for {
+		request, err := http.ReadRequest(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if len(requests) == 0 {
+				return "", errors.New("the connection doesn't contain http requests")
+			}
+			break // the last request is truncated
+		}
+		body, _ := ioutil.ReadAll(request.Body)
+		_ = request.Body.Close()
+		requests = append(requests, request)
+		bodies = append(bodies, body)
+	}
+	if len(requests) == 0 {
+		return "", errors.New("the connection doesn't contain http requests")
+	}
+
+	// the cookies set by the server are handled by the session
+	setCookies := make(map[string]bool)
+	reader = bufio.NewReader(bytes.NewReader(serverPayload))
+	for _, request := range requests {
+		response, err := http.ReadResponse(reader, request)
+		if err != nil {
+			break
+		}
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		_ = response.Body.Close()
+		for _, cookie := range response.Cookies() {
+			setCookies[cookie.Name] = true
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("import re\nimport sys\n\nimport requests\n\n")
+	writePythonTarget(&sb, connection, format)
+	scheme, verify := "http", ""
+	if connection.TLS != nil {
+		scheme, verify = "https", ", verify=False"
+	}
+	sb.WriteString(fmt.Sprintf("BASE_URL = '%s://%%s:%%d' %% (HOST, PORT)\n\n", scheme))
+	sb.WriteString("s = requests.Session()\n")
+	sb.WriteString("data = b''\n")
+
+	for i, request := range requests {
+		for _, cookie := range request.Cookies() {
+			if !setCookies[cookie.Name] {
+				sb.WriteString(fmt.Sprintf("s.cookies.set(%s, %s)\n", pythonString(cookie.Name),
+					pythonString(cookie.Value)))
+				setCookies[cookie.Name] = true
+			}
+		}
+
+		var headers []string
+		for name, values := range request.Header {
+			if excludedRequestHeaders[name] {
+				continue
+			}
+			headers = append(headers, fmt.Sprintf("%s: %s", pythonString(name),
+				pythonString(strings.Join(values, ", "))))
+		}
+		sort.Strings(headers)
+
+		uri := request.RequestURI
+		if request.URL.IsAbs() {
+			uri = request.URL.RequestURI()
+		}
+		sb.WriteString(fmt.Sprintf("r = s.request(%s, BASE_URL + %s", pythonString(request.Method),
+			pythonString(uri)))
+		if len(headers) > 0 {
+			sb.WriteString(fmt.Sprintf(", headers={%s}", strings.Join(headers, ", ")))
+		}
+		if len(bodies[i]) > 0 {
+			sb.WriteString(fmt.Sprintf(", data=%s", pythonBytes(bodies[i])))
+		}
+		sb.WriteString(fmt.Sprintf(", allow_redirects=False%s)\n", verify))
+		sb.WriteString("data += r.content\n")
+	}
+	sb.WriteString("\n")
+	writePythonOutput(&sb, format)
+
+	return sb.String(), nil
+}
+
+func exportGoConn(connection Connection, chunks []exploitChunk, format DownloadMessageFormat) (string, error) {
+	imports := []string{"bytes", "net", "time"}
+	if format.ExtractFlags {
+		// the flag regex is matched by hyperscan, which supports constructs unknown to the regexp package
+		if _, err := regexp.Compile(format.FlagRegex); err != nil {
+			return "", fmt.Errorf("the flag regex is not supported by go: %v", err)
+		}
+		imports = append(imports, "fmt", "regexp")
+	}
+	if format.ParametricHost || !format.ExtractFlags {
+		imports = append(imports, "os")
+	}
+	if connection.TLS != nil {
+		imports = append(imports, "crypto/tls")
+	}
+	sort.Strings(imports)
+
+	var sb strings.Builder
+	sb.WriteString("package main\n\nimport (\n")
+	for _, name := range imports {
+		sb.WriteString(fmt.Sprintf("\t%s\n", strconv.Quote(name)))
+	}
+	sb.WriteString(")\n\n")
+	if format.ExtractFlags {
+		sb.WriteString(fmt.Sprintf("var flagRegex = regexp.MustCompile(%s)\n\n", strconv.Quote(format.FlagRegex)))
+	}
+	sb.WriteString(`func recvUntil(conn net.Conn, delimiter []byte) []byte {
+	var data []byte
+	buffer := make([]byte, 4096)
+	for !bytes.HasSuffix(data, delimiter) {
+		n, err := conn.Read(buffer)
+		data = append(data, buffer[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	return data
+}
+
+func main() {
+`)
+	sb.WriteString(fmt.Sprintf("\thost := %s\n", strconv.Quote(connection.DestinationIP)))
+	if format.ParametricHost {
+		sb.WriteString("\tif len(os.Args) > 1 {\n\t\thost = os.Args[1]\n\t}\n")
+	}
+	address := fmt.Sprintf("net.JoinHostPort(host, %s)", strconv.Quote(strconv.Itoa(int(connection.DestinationPort))))
+	if connection.TLS != nil {
+		sb.WriteString(fmt.Sprintf("\tconn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, \"tcp\", "+
+			"%s, &tls.Config{InsecureSkipVerify: true})\n", address))
+	} else {
+		sb.WriteString(fmt.Sprintf("\tconn, err := net.DialTimeout(\"tcp\", %s, 10*time.Second)\n", address))
+	}
+	sb.WriteString("\tif err != nil {\n\t\tpanic(err)\n\t}\n\tdefer conn.Close()\n\n")
+
+	sb.WriteString("\tvar data []byte\n")
+	for _, chunk := range chunks {
+		if chunk.fromClient {
+			for _, block := range chunk.blocks {
+				sb.WriteString(fmt.Sprintf("\t_, _ = conn.Write([]byte(%s))\n", strconv.Quote(string(block))))
+			}
+		} else {
+			delimiter := serverDelimiter(chunk, format.ServerBytes)
+			sb.WriteString(fmt.Sprintf("\tdata = append(data, recvUntil(conn, []byte(%s))...)\n",
+				strconv.Quote(string(delimiter))))
+		}
+	}
+
+	sb.WriteString("\n")
+	if format.ExtractFlags {
+		sb.WriteString("\tfor _, flag := range flagRegex.FindAll(data, -1) {\n\t\tfmt.Println(string(flag))\n\t}\n")
+	} else {
+		sb.WriteString("\t_, _ = os.Stdout.Write(data)\n")
+	}
+	sb.WriteString("}\n")
+
+	return sb.String(), nil
+}
+
+func writePythonTarget(sb *strings.Builder, connection Connection, format DownloadMessageFormat) {
+	if format.ParametricHost {
+		sb.WriteString(fmt.Sprintf("HOST = sys.argv[1] if len(sys.argv) > 1 else %s\n",
+			pythonString(connection.DestinationIP)))
+	} else {
+		sb.WriteString(fmt.Sprintf("HOST = %s\n", pythonString(connection.DestinationIP)))
+	}
+	sb.WriteString(fmt.Sprintf("PORT = %d\n", connection.DestinationPort))
+	if format.ExtractFlags {
+		sb.WriteString(fmt.Sprintf("FLAG_REGEX = re.compile(%s)\n", pythonBytes([]byte(format.FlagRegex))))
+	}
+}
+
+func writePythonOutput(sb *strings.Builder, format DownloadMessageFormat) {
+	if format.ExtractFlags {
+		sb.WriteString("for flag in FLAG_REGEX.findall(data):\n    print(flag.decode())\n")
+	} else {
+		sb.WriteString("sys.stdout.buffer.write(data)\n")
+	}
+}
+
+// serverDelimiter returns the last bytes of a server chunk, which the scripts wait for before continuing
+func serverDelimiter(chunk exploitChunk, serverBytes int) []byte {
+	if serverBytes <= 0 {
+		serverBytes = pwntoolsMaxServerBytes
+	}
+	payload := bytes.Join(chunk.blocks, nil)
+	if len(payload) > serverBytes {
+		return payload[len(payload)-serverBytes:]
+	}
+	return payload
+}
+
+func pythonBytes(payload []byte) string {
+	return "b" + pythonLiteral(payload)
+}
+
+func pythonString(value string) string {
+	return pythonLiteral([]byte(value))
+}
+
+// pythonLiteral returns a quoted literal with the non printable characters escaped
+func pythonLiteral(payload []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for _, b := range payload {
+		switch {
+		case b == '\\' || b == '\'':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b == '\n':
+			sb.WriteString("\\n")
+		case b == '\r':
+			sb.WriteString("\\r")
+		case b == '\t':
+			sb.WriteString("\\t")
+		case b >= 0x20 && b < 0x7f:
+			sb.WriteByte(b)
+		default:
+			sb.WriteString(fmt.Sprintf("\\x%02x", b))
+		}
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
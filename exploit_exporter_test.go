@@ -0,0 +1,89 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestExportSocketExploits(t *testing.T) {
+	connection := Connection{DestinationIP: "10.10.10.1", DestinationPort: 1337}
+	chunks := []exploitChunk{
+		{fromClient: false, blocks: [][]byte{[]byte("Welcome to the vault\n"), []byte("> ")}},
+		{fromClient: true, blocks: [][]byte{[]byte("get 'flag'\n")}},
+		{fromClient: false, blocks: [][]byte{[]byte("FLAG{abc}\n\x00> ")}},
+	}
+	format := DownloadMessageFormat{ServerBytes: 3, ExtractFlags: true, ParametricHost: true, FlagRegex: `FLAG\{\w+\}`}
+
+	script, err := exportPythonSocket(connection, chunks, format)
+	require.NoError(t, err)
+	assert.Contains(t, script, "HOST = sys.argv[1] if len(sys.argv) > 1 else '10.10.10.1'\nPORT = 1337\n")
+	assert.Contains(t, script, "FLAG_REGEX = re.compile(b'FLAG\\\\{\\\\w+\\\\}')\n")
+	assert.Contains(t, script, "data += recvuntil(s, b'\\n> ')\ns.sendall(b'get \\'flag\\'\\n')\n"+
+		"data += recvuntil(s, b'\\x00> ')\n")
+	assert.Contains(t, script, "for flag in FLAG_REGEX.findall(data):\n")
+
+	format = DownloadMessageFormat{}
+	script, err = exportGoConn(connection, chunks, format)
+	require.NoError(t, err)
+	assert.Contains(t, script, "\t\"os\"\n")
+	assert.NotContains(t, script, "regexp")
+	assert.Contains(t, script, "\thost := \"10.10.10.1\"\n\tconn, err := net.DialTimeout(\"tcp\", "+
+		"net.JoinHostPort(host, \"1337\"), 10*time.Second)\n")
+	assert.Contains(t, script, "recvUntil(conn, []byte(\"come to the vault\\n> \"))")
+	assert.Contains(t, script, "\t_, _ = conn.Write([]byte(\"get 'flag'\\n\"))\n")
+	assert.Contains(t, script, "\t_, _ = os.Stdout.Write(data)\n")
+
+	format = DownloadMessageFormat{ExtractFlags: true, FlagRegex: `FLAG\{\w+\}`}
+	script, err = exportGoConn(connection, chunks, format)
+	require.NoError(t, err)
+	assert.Contains(t, script, "var flagRegex = regexp.MustCompile(\"FLAG\\\\{\\\\w+\\\\}\")\n")
+	format.FlagRegex = `FLAG\{(?=\w+\})`
+	_, err = exportGoConn(connection, chunks, format)
+	assert.Error(t, err)
+}
+
+func TestExportPythonRequestsExploit(t *testing.T) {
+	connection := Connection{DestinationIP: "10.10.10.1", DestinationPort: 8080}
+	chunks := []exploitChunk{
+		{fromClient: true, blocks: [][]byte{[]byte("POST /login HTTP/1.1\r\nHost: 10.10.10.1:8080\r\n" +
+			"Content-Type: application/x-www-form-urlencoded\r\nCookie: lang=en\r\nContent-Length: 17\r\n\r\n" +
+			"user=admin&pass=x")}},
+		{fromClient: false, blocks: [][]byte{[]byte("HTTP/1.1 302 Found\r\nSet-Cookie: session=abc\r\n" +
+			"Location: /notes\r\nContent-Length: 0\r\n\r\n")}},
+		{fromClient: true, blocks: [][]byte{[]byte("GET /notes?id=1 HTTP/1.1\r\nHost: 10.10.10.1:8080\r\n" +
+			"Cookie: lang=en; session=abc\r\n\r\n")}},
+		{fromClient: false, blocks: [][]byte{[]byte("HTTP/1.1 200 OK\r\nContent-Length: 9\r\n\r\nFLAG{abc}")}},
+	}
+
+	script, err := exportPythonRequests(connection, chunks, DownloadMessageFormat{})
+	require.NoError(t, err)
+	assert.Contains(t, script, "BASE_URL = 'http://%s:%d' % (HOST, PORT)\n")
+	// only the cookies not set by the server are added to the session
+	assert.Contains(t, script, "s.cookies.set('lang', 'en')\nr = s.request('POST', BASE_URL + '/login', "+
+		"headers={'Content-Type': 'application/x-www-form-urlencoded'}, data=b'user=admin&pass=x', "+
+		"allow_redirects=False)\n")
+	assert.Contains(t, script, "r = s.request('GET', BASE_URL + '/notes?id=1', allow_redirects=False)\n")
+	assert.NotContains(t, script, "session")
+
+	_, err = exportPythonRequests(connection, []exploitChunk{{fromClient: true,
+		blocks: [][]byte{[]byte("not http\r\n\r\n")}}}, DownloadMessageFormat{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,373 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// MaxCarvedFileSize is the maximum size of an extracted file, which must fit in a single document
+const MaxCarvedFileSize = 8 * 1024 * 1024
+
+// maxCarvedStreamSize is the maximum size of the streams which are searched for files
+const maxCarvedStreamSize = 64 * 1024 * 1024
+
+const (
+	FileSourceHTTPRequest  = "http-request"
+	FileSourceHTTPResponse = "http-response"
+	FileSourceMultipart    = "multipart"
+	FileSourceRaw          = "raw"
+)
+
+// maxGzipAttempts is the maximum number of gzip signatures of a stream which are decompressed to find the files
+const maxGzipAttempts = 8
+
+type fileSignature struct {
+	magic []byte
+	// trailer is searched after the magic bytes, for the formats which end with a known sequence
+	trailer []byte
+	// length returns the size of the file which starts at the beginning of data, or -1 if it isn't a valid file.
+	// trailerEnd is the position in data after the first trailer, or -1 if there is no trailer in data
+	length func(data []byte, trailerEnd int) int
+	// maxAttempts limits the files of a stream which are checked, for the formats which are expensive to check
+	maxAttempts int
+}
+
+var fileSignatures = []fileSignature{
+	{[]byte("\x89PNG\r\n\x1a\n"), []byte("IEND\xaeB`\x82"), trailerLength, 0},
+	{[]byte("\xff\xd8\xff"), []byte("\xff\xd9"), trailerLength, 0},
+	{[]byte("GIF87a"), []byte("\x00\x3b"), trailerLength, 0},
+	{[]byte("GIF89a"), []byte("\x00\x3b"), trailerLength, 0},
+	{[]byte("%PDF-"), []byte("%%EOF"), trailerLength, 0},
+	{[]byte("PK\x03\x04"), []byte("PK\x05\x06"), zipLength, 0}, // the end of central directory record
+	{[]byte("\x1f\x8b\x08"), nil, gzipLength, maxGzipAttempts},
+	{[]byte("\x7fELF"), nil, elfLength, 0},
+}
+
+// patternFinder returns the occurrences of a pattern in a payload. The positions of the searches must not decrease,
+// so that the payload is scanned once even when the same occurrence is requested many times
+type patternFinder struct {
+	pattern  []byte
+	found    int // the last occurrence found, or -1 if there are no more occurrences
+	searched bool
+}
+
+func (pf *patternFinder) index(payload []byte, position int) int {
+	if pf.searched && (pf.found < 0 || pf.found >= position) {
+		return pf.found
+	}
+
+	pf.searched = true
+	if index := bytes.Index(payload[position:], pf.pattern); index >= 0 {
+		pf.found = position + index
+	} else {
+		pf.found = -1
+	}
+	return pf.found
+}
+
+// CarveFiles extracts the files contained in one side of a connection. If the stream contains HTTP messages the
+// files are searched in the decoded bodies, otherwise the stream is searched for the magic bytes of known formats.
+func CarveFiles(payload []byte, fromClient bool) []ExtractedFile {
+	if files, isHTTP := carveHTTPFiles(payload, fromClient); isHTTP {
+		return files
+	}
+
+	var files []ExtractedFile
+	for _, file := range carveRawFiles(payload) {
+		file.FromClient = fromClient
+		files = append(files, file)
+	}
+	return files
+}
+
+func carveHTTPFiles(payload []byte, fromClient bool) ([]ExtractedFile, bool) {
+	reader := bytes.NewReader(payload)
+	bufferedReader := bufio.NewReader(reader)
+	offset := func() int {
+		return len(payload) - reader.Len() - bufferedReader.Buffered()
+	}
+
+	var files []ExtractedFile
+	var messagesCount int
+	for offset() < len(payload) {
+		index := offset()
+		var header http.Header
+		var body io.ReadCloser
+		var isUpload bool
+		source := FileSourceHTTPResponse
+		if fromClient {
+			request, err := http.ReadRequest(bufferedReader)
+			if err != nil {
+				break
+			}
+			header, body, isUpload = request.Header, request.Body, request.Method == http.MethodPut
+			source = FileSourceHTTPRequest
+		} else {
+			response, err := http.ReadResponse(bufferedReader, nil)
+			if err != nil {
+				break
+			}
+			header, body = response.Header, response.Body
+		}
+		messagesCount++
+
+		content, err := ioutil.ReadAll(io.LimitReader(body, MaxCarvedFileSize+1))
+		_ = body.Close()
+		if err != nil {
+			break
+		}
+		content = decodeHTTPBody(content, header.Get("Content-Encoding"))
+		if len(content) == 0 || len(content) > MaxCarvedFileSize {
+			continue
+		}
+
+		contentType := header.Get("Content-Type")
+		if mediaType, params, err := mime.ParseMediaType(contentType); err == nil &&
+			mediaType == "multipart/form-data" && params["boundary"] != "" {
+			files = append(files, carveMultipartFiles(content, params["boundary"], index, fromClient)...)
+			continue
+		}
+
+		name := dispositionFileName(header.Get("Content-Disposition"))
+		mimeType := detectMIMEType(content, contentType)
+		if name != "" || isUpload || !strings.HasPrefix(mimeType, "text/") {
+			files = append(files, ExtractedFile{
+				FromClient: fromClient,
+				Index:      index,
+				Name:       name,
+				Source:     source,
+				MIMEType:   mimeType,
+				Content:    content,
+			})
+		}
+	}
+
+	return files, messagesCount > 0
+}
+
+func carveMultipartFiles(body []byte, boundary string, index int, fromClient bool) []ExtractedFile {
+	var files []ExtractedFile
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(part, MaxCarvedFileSize+1))
+		if err != nil {
+			break
+		}
+		if len(content) == 0 || len(content) > MaxCarvedFileSize {
+			continue
+		}
+
+		files = append(files, ExtractedFile{
+			FromClient: fromClient,
+			Index:      index,
+			Name:       part.FileName(),
+			Source:     FileSourceMultipart,
+			MIMEType:   detectMIMEType(content, part.Header.Get("Content-Type")),
+			Content:    content,
+		})
+	}
+
+	return files
+}
+
+// carveRawFiles searches the files by their magic bytes. The magic bytes and the trailers are searched once in the
+// payload, and each file can't be bigger than MaxCarvedFileSize, so the false matches don't rescan the payload
+func carveRawFiles(payload []byte) []ExtractedFile {
+	magics := make([]patternFinder, len(fileSignatures))
+	trailers := make([]patternFinder, len(fileSignatures))
+	attempts := make([]int, len(fileSignatures))
+	for i, signature := range fileSignatures {
+		magics[i].pattern, trailers[i].pattern = signature.magic, signature.trailer
+	}
+
+	var files []ExtractedFile
+	for position := 0; position < len(payload); {
+		// the first signature found after the position
+		start, i := -1, -1
+		for j := range fileSignatures {
+			if index := magics[j].index(payload, position); index >= 0 && (start < 0 || index < start) {
+				start, i = index, j
+			}
+		}
+		if start < 0 {
+			break
+		}
+		position = start + 1
+
+		signature := fileSignatures[i]
+		if signature.maxAttempts > 0 {
+			if attempts[i] >= signature.maxAttempts {
+				continue
+			}
+			attempts[i]++
+		}
+		end := start + MaxCarvedFileSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		trailerEnd := -1
+		if signature.trailer != nil {
+			index := trailers[i].index(payload, start+len(signature.magic))
+			if index >= 0 && index+len(signature.trailer) <= end {
+				trailerEnd = index + len(signature.trailer) - start
+			}
+		}
+
+		length := signature.length(payload[start:end], trailerEnd)
+		if length <= 0 {
+			continue
+		}
+		content := payload[start : start+length]
+		files = append(files, ExtractedFile{
+			Index:    start,
+			Source:   FileSourceRaw,
+			MIMEType: detectMIMEType(content, ""),
+			Content:  content,
+		})
+		position = start + length
+	}
+
+	return files
+}
+
+func trailerLength(_ []byte, trailerEnd int) int {
+	return trailerEnd
+}
+
+func zipLength(data []byte, trailerEnd int) int {
+	// the end of central directory record is 22 bytes long, and ends with the length of the comment
+	if trailerEnd < 0 || trailerEnd+18 > len(data) {
+		return -1
+	}
+	length := trailerEnd + 18 + int(binary.LittleEndian.Uint16(data[trailerEnd+16:trailerEnd+18]))
+	if length > len(data) {
+		return -1
+	}
+	return length
+}
+
+func gzipLength(data []byte, _ int) int {
+	reader := bytes.NewReader(data)
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return -1
+	}
+	gzipReader.Multistream(false)
+	const maxDecompressedSize = 4 * MaxCarvedFileSize
+	if n, err := io.Copy(ioutil.Discard, io.LimitReader(gzipReader, maxDecompressedSize)); err != nil ||
+		n == maxDecompressedSize {
+		return -1
+	}
+	return len(data) - reader.Len()
+}
+
+func elfLength(data []byte, _ int) int {
+	if len(data) < 64 {
+		return -1
+	}
+	var byteOrder binary.ByteOrder
+	switch data[5] {
+	case 1:
+		byteOrder = binary.LittleEndian
+	case 2:
+		byteOrder = binary.BigEndian
+	default:
+		return -1
+	}
+
+	// the section headers table is at the end of the file
+	var sectionsOffset, sectionSize, sectionsCount int
+	switch data[4] {
+	case 1:
+		sectionsOffset = int(byteOrder.Uint32(data[32:36]))
+		sectionSize, sectionsCount = int(byteOrder.Uint16(data[46:48])), int(byteOrder.Uint16(data[48:50]))
+	case 2:
+		sectionsOffset = int(byteOrder.Uint64(data[40:48]))
+		sectionSize, sectionsCount = int(byteOrder.Uint16(data[58:60])), int(byteOrder.Uint16(data[60:62]))
+	default:
+		return -1
+	}
+
+	length := sectionsOffset + sectionSize*sectionsCount
+	if sectionsOffset <= 0 || length > len(data) {
+		return -1
+	}
+	return length
+}
+
+func decodeHTTPBody(body []byte, contentEncoding string) []byte {
+	var reader io.ReadCloser
+	var err error
+	switch strings.ToLower(contentEncoding) {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate": // should be zlib, but some servers send raw deflate data
+		if reader, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return body
+	}
+	if err != nil {
+		return body
+	}
+
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, MaxCarvedFileSize+1))
+	_ = reader.Close()
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// detectMIMEType sniffs the type of the content, falling back to the declared type if the content is unknown
+func detectMIMEType(content []byte, declaredType string) string {
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	if mimeType == "application/octet-stream" && declaredType != "" {
+		if mediaType, _, err := mime.ParseMediaType(declaredType); err == nil {
+			return mediaType
+		}
+	}
+	return mimeType
+}
+
+func dispositionFileName(contentDisposition string) string {
+	if _, params, err := mime.ParseMediaType(contentDisposition); err == nil {
+		return params["filename"]
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"testing"
+)
+
+func TestCarveHTTPFiles(t *testing.T) {
+	var encodedImage bytes.Buffer
+	require.NoError(t, png.Encode(&encodedImage, testImage()))
+	var compressedImage bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressedImage)
+	_, err := gzipWriter.Write(encodedImage.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	htmlResponse := "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 13\r\n\r\n<html></html>"
+	imageResponse := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Encoding: gzip\r\n"+
+		"Content-Length: %d\r\n\r\n%s", compressedImage.Len(), compressedImage.String())
+	files := CarveFiles([]byte(htmlResponse+imageResponse), false)
+	require.Len(t, files, 1)
+	assert.Equal(t, len(htmlResponse), files[0].Index)
+	assert.Equal(t, FileSourceHTTPResponse, files[0].Source)
+	assert.Equal(t, "image/png", files[0].MIMEType)
+	assert.Equal(t, encodedImage.Bytes(), files[0].Content)
+	assert.False(t, files[0].FromClient)
+
+	var body bytes.Buffer
+	multipartWriter := multipart.NewWriter(&body)
+	require.NoError(t, multipartWriter.WriteField("submit", "upload"))
+	fileWriter, err := multipartWriter.CreateFormFile("file", "shell.php")
+	require.NoError(t, err)
+	_, err = fileWriter.Write([]byte("<?php system($_GET['cmd']); ?>"))
+	require.NoError(t, err)
+	require.NoError(t, multipartWriter.Close())
+
+	uploadRequest := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: %s\r\n"+
+		"Content-Length: %d\r\n\r\n%s", multipartWriter.FormDataContentType(), body.Len(), body.String())
+	files = CarveFiles([]byte(uploadRequest), true)
+	require.Len(t, files, 1)
+	assert.Equal(t, 0, files[0].Index)
+	assert.Equal(t, "shell.php", files[0].Name)
+	assert.Equal(t, FileSourceMultipart, files[0].Source)
+	assert.Equal(t, "text/plain", files[0].MIMEType)
+	assert.Equal(t, "<?php system($_GET['cmd']); ?>", string(files[0].Content))
+	assert.True(t, files[0].FromClient)
+}
+
+func TestCarveRawFiles(t *testing.T) {
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	fileWriter, err := zipWriter.Create("flag.txt")
+	require.NoError(t, err)
+	_, err = fileWriter.Write([]byte("FLAG{this_is_a_test}"))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.SetComment("comment"))
+	require.NoError(t, zipWriter.Close())
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, err = gzipWriter.Write(bytes.Repeat([]byte("caronte"), 100))
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	var encodedImage bytes.Buffer
+	require.NoError(t, png.Encode(&encodedImage, testImage()))
+
+	prefix := []byte("> send file\n")
+	separator := []byte("\nPK\x03\x04 not a zip\n")
+	payload := bytes.Join([][]byte{prefix, archive.Bytes(), separator, compressed.Bytes(), encodedImage.Bytes(),
+		[]byte("\n> exit\n")}, nil)
+
+	files := CarveFiles(payload, false)
+	require.Len(t, files, 3)
+	assert.Equal(t, len(prefix), files[0].Index)
+	assert.Equal(t, "application/zip", files[0].MIMEType)
+	assert.Equal(t, archive.Bytes(), files[0].Content)
+	assert.Equal(t, len(prefix)+archive.Len()+len(separator), files[1].Index)
+	assert.Equal(t, "application/x-gzip", files[1].MIMEType)
+	assert.Equal(t, compressed.Bytes(), files[1].Content)
+	assert.Equal(t, "image/png", files[2].MIMEType)
+	assert.Equal(t, encodedImage.Bytes(), files[2].Content)
+	for _, file := range files {
+		assert.Equal(t, FileSourceRaw, file.Source)
+		assert.False(t, file.FromClient)
+	}
+
+	assert.Empty(t, CarveFiles([]byte("\xff\xd8\xff truncated jpeg"), true))
+}
+
+func TestCarveRawFilesFalseSignatures(t *testing.T) {
+	var encodedImage bytes.Buffer
+	require.NoError(t, png.Encode(&encodedImage, testImage()))
+
+	// without the limits each false signature would rescan the rest of the stream
+	falseSignatures := bytes.Repeat([]byte("\xff\xd8\xff\x1f\x8b\x08PK\x03\x04"), 100000)
+	payload := bytes.Join([][]byte{falseSignatures, encodedImage.Bytes(), []byte("PK\x05\x06")}, nil)
+	files := carveRawFiles(payload)
+	require.Len(t, files, 1)
+	assert.Equal(t, len(falseSignatures), files[0].Index)
+	assert.Equal(t, encodedImage.Bytes(), files[0].Content)
+
+	// the trailers too far from the signatures are ignored
+	tooBig := append(append([]byte("\xff\xd8\xff"), make([]byte, MaxCarvedFileSize)...), "\xff\xd9"...)
+	assert.Empty(t, carveRawFiles(tooBig))
+}
+
+func testImage() image.Image {
+	img := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	return img
+}
@@ -0,0 +1,172 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type ExtractedFile struct {
+	ID           RowID     `json:"id" bson:"_id"`
+	ConnectionID RowID     `json:"connection_id" bson:"connection_id"`
+	FromClient   bool      `json:"from_client" bson:"from_client"`
+	Index        int       `json:"index" bson:"index"`
+	Name         string    `json:"name" bson:"name,omitempty"`
+	Source       string    `json:"source" bson:"source"`
+	MIMEType     string    `json:"mime_type" bson:"mime_type"`
+	Size         int       `json:"size" bson:"size"`
+	SHA256       string    `json:"sha256" bson:"sha256"`
+	ExtractedAt  time.Time `json:"extracted_at" bson:"extracted_at"`
+	Content      []byte    `json:"-" bson:"-"`
+}
+
+// FileContent is saved once for each different file, identified by its sha256
+type FileContent struct {
+	SHA256  string `bson:"_id"`
+	Content []byte `bson:"content"`
+}
+
+type FilesFilter struct {
+	From     string `form:"from" binding:"omitempty,hexadecimal,len=24"`
+	Name     string `form:"name"`
+	MIMEType string `form:"mime_type"`
+	Source   string `form:"source" binding:"omitempty,oneof=http-request http-response multipart raw"`
+	SHA256   string `form:"sha256" binding:"omitempty,hexadecimal,len=64"`
+	Limit    int64  `form:"limit"`
+}
+
+type FilesController struct {
+	storage Storage
+}
+
+func NewFilesController(storage Storage) *FilesController {
+	return &FilesController{
+		storage: storage,
+	}
+}
+
+func (fc *FilesController) GetFiles(c context.Context, filter FilesFilter) []ExtractedFile {
+	var files []ExtractedFile
+	query := fc.storage.Find(Files).Context(c).Sort("_id", false)
+
+	from, _ := RowIDFromHex(filter.From)
+	if !from.IsZero() {
+		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$lt": from}}})
+	}
+	if filter.Name != "" {
+		query = query.Filter(OrderedDocument{{"name", UnorderedDocument{
+			"$regex": regexp.QuoteMeta(filter.Name), "$options": "i"}}})
+	}
+	if filter.MIMEType != "" {
+		query = query.Filter(OrderedDocument{{"mime_type", UnorderedDocument{
+			"$regex": "^" + regexp.QuoteMeta(strings.ToLower(filter.MIMEType))}}})
+	}
+	if filter.Source != "" {
+		query = query.Filter(OrderedDocument{{"source", filter.Source}})
+	}
+	if filter.SHA256 != "" {
+		query = query.Filter(OrderedDocument{{"sha256", strings.ToLower(filter.SHA256)}})
+	}
+	if filter.Limit > 0 && filter.Limit <= MaxQueryLimit {
+		query = query.Limit(filter.Limit)
+	} else {
+		query = query.Limit(DefaultQueryLimit)
+	}
+
+	if err := query.All(&files); err != nil {
+		log.WithError(err).WithField("filter", filter).Panic("failed to get files")
+	}
+
+	if files == nil {
+		return []ExtractedFile{}
+	}
+	return files
+}
+
+func (fc *FilesController) GetConnectionFiles(c context.Context, connectionID RowID) []ExtractedFile {
+	var files []ExtractedFile
+	if err := fc.storage.Find(Files).Context(c).Filter(OrderedDocument{{"connection_id", connectionID}}).
+		Sort("_id", true).All(&files); err != nil {
+		log.WithError(err).WithField("connection_id", connectionID).Panic("failed to get connection files")
+	}
+
+	if files == nil {
+		return []ExtractedFile{}
+	}
+	return files
+}
+
+// GetFile returns the file with its content
+func (fc *FilesController) GetFile(c context.Context, id RowID) (ExtractedFile, bool) {
+	var file ExtractedFile
+	if err := fc.storage.Find(Files).Context(c).Filter(byID(id)).First(&file); err != nil {
+		log.WithError(err).WithField("id", id).Panic("failed to get file")
+	}
+	if file.ID.IsZero() {
+		return file, false
+	}
+
+	var content FileContent
+	if err := fc.storage.Find(FileContents).Context(c).Filter(OrderedDocument{{"_id", file.SHA256}}).
+		First(&content); err != nil {
+		log.WithError(err).WithField("sha256", file.SHA256).Panic("failed to get file content")
+	}
+	file.Content = content.Content
+
+	return file, true
+}
+
+// storeExtractedFiles saves the files carved from a connection. The files with the same content are saved once
+func storeExtractedFiles(storage Storage, connectionID RowID, files []ExtractedFile) {
+	if len(files) == 0 {
+		return
+	}
+
+	documents := make([]interface{}, 0, len(files))
+	extractedAt := time.Now()
+	for _, file := range files {
+		hash := sha256.Sum256(file.Content)
+		file.ID = NewRowID()
+		file.ConnectionID = connectionID
+		file.Size = len(file.Content)
+		file.SHA256 = hex.EncodeToString(hash[:])
+		file.ExtractedAt = extractedAt
+
+		var upsertResults interface{}
+		if _, err := storage.Update(FileContents).Upsert(&upsertResults).
+			Filter(OrderedDocument{{"_id", file.SHA256}}).
+			OneComplex(UnorderedDocument{"$setOnInsert": UnorderedDocument{"content": file.Content}}); err != nil {
+			log.WithError(err).WithField("sha256", file.SHA256).Error("failed to save file content")
+			continue
+		}
+		documents = append(documents, file)
+	}
+
+	if len(documents) == 0 {
+		return
+	}
+	if _, err := storage.Insert(Files).StopOnFail(false).Many(documents); err != nil {
+		log.WithError(err).WithField("connection_id", connectionID).Error("failed to insert extracted files")
+	}
+}
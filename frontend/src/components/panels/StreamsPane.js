@@ -31,6 +31,9 @@ import "./StreamsPane.scss";
 const reactStringReplace = require("react-string-replace");
 const classNames = require("classnames");
 
+// metadata types which are rendered using the content of all the messages of the same chunk
+const reconstructedMetadataTypes = ["http-request", "http-response"];
+
 class StreamsPane extends Component {
 
     state = {
@@ -220,7 +223,8 @@ class StreamsPane extends Component {
         };
         const content = this.state.messages || [];
 
-        let payload = content.filter((c) => !this.state.tryParse || (this.state.tryParse && !c["is_metadata_continuation"]))
+        let payload = content.filter((c) => !this.state.tryParse || !c["is_metadata_continuation"] ||
+            !reconstructedMetadataTypes.includes(c.metadata.type))
             .map((c, i) =>
             <div key={`content-${i}`}
                  className={classNames("connection-message", c["from_client"] ? "from-client" : "from-server")}>
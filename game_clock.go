@@ -0,0 +1,57 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "time"
+
+// GameClock divides the time of an attack-defense competition in rounds (or ticks) of the same duration. The
+// first round is the number 1, and 0 means that the game is not configured or not started yet
+type GameClock struct {
+	StartedAt    time.Time
+	TickDuration time.Duration
+}
+
+func NewGameClock(config Config) GameClock {
+	return GameClock{
+		StartedAt:    config.GameStart,
+		TickDuration: time.Duration(config.TickDuration) * time.Second,
+	}
+}
+
+func (gc GameClock) IsConfigured() bool {
+	return !gc.StartedAt.IsZero() && gc.TickDuration > 0
+}
+
+// Round returns the round which contains the time t
+func (gc GameClock) Round(t time.Time) int {
+	if !gc.IsConfigured() || t.Before(gc.StartedAt) {
+		return 0
+	}
+
+	return int(t.Sub(gc.StartedAt)/gc.TickDuration) + 1
+}
+
+// RoundRange returns the start and the end of a round
+func (gc GameClock) RoundRange(round int) (time.Time, time.Time) {
+	if !gc.IsConfigured() || round < 1 {
+		return time.Time{}, time.Time{}
+	}
+
+	start := gc.StartedAt.Add(time.Duration(round-1) * gc.TickDuration)
+	return start, start.Add(gc.TickDuration)
+}
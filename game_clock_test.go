@@ -0,0 +1,42 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGameClock(t *testing.T) {
+	startedAt := time.Date(2020, 11, 1, 9, 0, 0, 0, time.UTC)
+	gameClock := NewGameClock(Config{GameStart: startedAt, TickDuration: 120})
+
+	assert.Equal(t, 0, gameClock.Round(startedAt.Add(-time.Second)))
+	assert.Equal(t, 1, gameClock.Round(startedAt))
+	assert.Equal(t, 1, gameClock.Round(startedAt.Add(119*time.Second)))
+	assert.Equal(t, 42, gameClock.Round(startedAt.Add(41*2*time.Minute)))
+
+	start, end := gameClock.RoundRange(42)
+	assert.Equal(t, startedAt.Add(82*time.Minute), start)
+	assert.Equal(t, startedAt.Add(84*time.Minute), end)
+
+	assert.Equal(t, 0, NewGameClock(Config{}).Round(startedAt))
+	start, _ = NewGameClock(Config{}).RoundRange(1)
+	assert.True(t, start.IsZero())
+}
@@ -0,0 +1,206 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strings"
+)
+
+var dnsOpCodes = map[layers.DNSOpCode]string{
+	layers.DNSOpCodeQuery:  "QUERY",
+	layers.DNSOpCodeIQuery: "IQUERY",
+	layers.DNSOpCodeStatus: "STATUS",
+	layers.DNSOpCodeNotify: "NOTIFY",
+	layers.DNSOpCodeUpdate: "UPDATE",
+}
+
+var dnsResponseCodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+}
+
+type DNSMetadata struct {
+	BasicMetadata
+	Messages []DNSMessage `json:"messages"`
+}
+
+type DNSMessage struct {
+	ID           uint16        `json:"id"`
+	IsResponse   bool          `json:"is_response"`
+	OpCode       string        `json:"op_code"`
+	ResponseCode string        `json:"response_code" binding:"omitempty"`
+	Questions    []DNSQuestion `json:"questions"`
+	Answers      []DNSRecord   `json:"answers" binding:"omitempty"`
+}
+
+type DNSQuestion struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type DNSRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// DNSParser parses DNS over TCP, where each message is prefixed by its length
+type DNSParser struct {
+}
+
+func (p DNSParser) TryParse(content []byte) Metadata {
+	var messages []DNSMessage
+	for len(content) > 0 {
+		if len(content) < 2 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(content[0:2]))
+		if length == 0 || 2+length > len(content) {
+			return nil
+		}
+		message, ok := ParseDNSMessage(content[2 : 2+length])
+		if !ok {
+			return nil
+		}
+		messages = append(messages, message)
+		content = content[2+length:]
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return DNSMetadata{
+		BasicMetadata: BasicMetadata{"dns"},
+		Messages:      messages,
+	}
+}
+
+// decodeDNS decodes a DNS message. gopacket panics on some truncated messages instead of returning an error, and
+// the messages come from the traffic, so the panics are recovered. gopacket can also read past the length of the
+// payload, up to its capacity, so the capacity is limited to the length
+func decodeDNS(payload []byte) (dns *layers.DNS, ok bool) {
+	defer func() {
+		if recover() != nil {
+			dns, ok = nil, false
+		}
+	}()
+
+	dns = &layers.DNS{}
+	return dns, dns.DecodeFromBytes(payload[:len(payload):len(payload)], gopacket.NilDecodeFeedback) == nil
+}
+
+// ParseDNSMessage parses a single DNS message, like the payload of an UDP packet
+func ParseDNSMessage(payload []byte) (DNSMessage, bool) {
+	dns, ok := decodeDNS(payload)
+	if !ok {
+		return DNSMessage{}, false
+	}
+	opCode, isPresent := dnsOpCodes[dns.OpCode]
+	if !isPresent || len(dns.Questions) == 0 {
+		return DNSMessage{}, false
+	}
+
+	message := DNSMessage{
+		ID:         dns.ID,
+		IsResponse: dns.QR,
+		OpCode:     opCode,
+		Questions:  make([]DNSQuestion, 0, len(dns.Questions)),
+	}
+	if dns.QR {
+		if message.ResponseCode, isPresent = dnsResponseCodes[dns.ResponseCode]; !isPresent {
+			message.ResponseCode = dns.ResponseCode.String()
+		}
+	}
+	for _, question := range dns.Questions {
+		if !isDNSName(question.Name) {
+			return DNSMessage{}, false
+		}
+		message.Questions = append(message.Questions, DNSQuestion{
+			Name: string(question.Name),
+			Type: question.Type.String(),
+		})
+	}
+	for _, answer := range dns.Answers {
+		message.Answers = append(message.Answers, DNSRecord{
+			Name: string(answer.Name),
+			Type: answer.Type.String(),
+			TTL:  answer.TTL,
+			Data: dnsRecordData(answer),
+		})
+	}
+
+	return message, true
+}
+
+func dnsRecordData(record layers.DNSResourceRecord) string {
+	switch record.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return record.IP.String()
+	case layers.DNSTypeNS:
+		return string(record.NS)
+	case layers.DNSTypeCNAME:
+		return string(record.CNAME)
+	case layers.DNSTypePTR:
+		return string(record.PTR)
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%d %s", record.MX.Preference, record.MX.Name)
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", record.SRV.Priority, record.SRV.Weight, record.SRV.Port, record.SRV.Name)
+	case layers.DNSTypeSOA:
+		return fmt.Sprintf("%s %s %d", record.SOA.MName, record.SOA.RName, record.SOA.Serial)
+	case layers.DNSTypeTXT:
+		txts := make([]string, len(record.TXTs))
+		for i, txt := range record.TXTs {
+			txts[i] = string(txt)
+		}
+		return strings.Join(txts, " ")
+	default:
+		return hex.EncodeToString(record.Data)
+	}
+}
+
+func isDNSName(name []byte) bool {
+	for _, c := range name {
+		if c <= 0x20 || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// LongestDNSLabel returns the length of the longest label of a domain name. Long labels are used to exfiltrate
+// data through DNS queries.
+func LongestDNSLabel(name string) int {
+	var longest int
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > longest {
+			longest = len(label)
+		}
+	}
+	return longest
+}
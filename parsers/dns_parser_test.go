@@ -0,0 +1,70 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// a query of the A record of www.example.com
+const dnsQuery = "12340100000100000000000003777777076578616d706c6503636f6d0000010001"
+
+func TestParseDNSMessage(t *testing.T) {
+	message, ok := ParseDNSMessage(decodeHex(t, dnsQuery))
+	require.True(t, ok)
+	assert.Equal(t, uint16(0x1234), message.ID)
+	assert.False(t, message.IsResponse)
+	assert.Equal(t, "QUERY", message.OpCode)
+	assert.Equal(t, []DNSQuestion{{Name: "www.example.com", Type: "A"}}, message.Questions)
+
+	invalid := []string{
+		"",
+		"1234",
+		"12340100000100000000000003777777",   // truncated question name
+		"1234010000010000000000000377777700", // truncated question type and class
+		dnsQuery[:len(dnsQuery)-2],
+		"12348180000100010000000003777777076578616d706c6503636f6d0000010001c00c0001000100000e100004",
+		"ffffffffffffffffffffffffffffffffffffffffffffffff",
+		"474554202f20485454502f312e310d0a", // GET / HTTP/1.1
+	}
+	for _, payload := range invalid {
+		_, ok := ParseDNSMessage(decodeHex(t, payload))
+		assert.False(t, ok, payload)
+	}
+}
+
+func TestDNSParser(t *testing.T) {
+	query := decodeHex(t, dnsQuery)
+	content := append([]byte{0, byte(len(query))}, query...)
+	metadata := DNSParser{}.TryParse(append(content, content...))
+	require.NotNil(t, metadata)
+	assert.Len(t, metadata.(DNSMetadata).Messages, 2)
+
+	assert.Nil(t, DNSParser{}.TryParse(content[:len(content)-1]))
+	assert.Nil(t, DNSParser{}.TryParse(append([]byte{0, 17}, decodeHex(t, "1234010000010000000000000377777700")...)))
+	assert.Nil(t, DNSParser{}.TryParse([]byte{0, 0}))
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
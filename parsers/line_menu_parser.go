@@ -0,0 +1,63 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"strings"
+)
+
+// LineMenuMetadata describes a chunk of an interactive netcat-style session. A chunk sent by the server is usually
+// the output of the program followed by a prompt which is not terminated by a newline, while a chunk sent by the
+// client contains the lines typed by the user.
+type LineMenuMetadata struct {
+	BasicMetadata
+	Lines  []string `json:"lines"`
+	Prompt string   `json:"prompt" binding:"omitempty"`
+}
+
+type LineMenuParser struct {
+}
+
+func (p LineMenuParser) TryParse(content []byte) Metadata {
+	text := string(content)
+	if !isPrintableText(text) {
+		return nil
+	}
+
+	lines := strings.Split(text, "\n")
+	prompt := lines[len(lines)-1]
+	lines = lines[:len(lines)-1]
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	return LineMenuMetadata{
+		BasicMetadata: BasicMetadata{"line-menu"},
+		Lines:         lines,
+		Prompt:        prompt,
+	}
+}
+
+// Delimiter returns the text that must be received before sending the next input: the prompt if present,
+// otherwise the last line printed.
+func (m LineMenuMetadata) Delimiter() string {
+	if m.Prompt != "" || len(m.Lines) == 0 {
+		return m.Prompt
+	}
+	return m.Lines[len(m.Lines)-1]
+}
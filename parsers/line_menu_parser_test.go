@@ -0,0 +1,58 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLineMenuParser(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		want      Metadata
+		delimiter string
+	}{
+		{"output with prompt", "1. Add note\r\n2. Exit\r\n> ", LineMenuMetadata{
+			BasicMetadata: BasicMetadata{"line-menu"},
+			Lines:         []string{"1. Add note", "2. Exit"},
+			Prompt:        "> ",
+		}, "> "},
+		{"input", "1\n", LineMenuMetadata{
+			BasicMetadata: BasicMetadata{"line-menu"},
+			Lines:         []string{"1"},
+		}, "1"},
+		{"only prompt", "Name: ", LineMenuMetadata{
+			BasicMetadata: BasicMetadata{"line-menu"},
+			Lines:         []string{},
+			Prompt:        "Name: ",
+		}, "Name: "},
+		{"binary", "\x00\x01\n", nil, ""},
+		{"invalid utf8", "\xff\n", nil, ""},
+		{"empty", "", nil, ""},
+	}
+
+	for _, test := range tests {
+		metadata := LineMenuParser{}.TryParse([]byte(test.content))
+		assert.Equal(t, test.want, metadata, test.name)
+		if menu, ok := metadata.(LineMenuMetadata); ok {
+			assert.Equal(t, test.delimiter, menu.Delimiter(), test.name)
+		}
+	}
+}
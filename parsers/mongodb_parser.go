@@ -0,0 +1,234 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	mongoDBHeaderSize     = 16
+	mongoDBMaxMessageSize = 48 * 1000 * 1000
+	mongoDBOpReply        = 1
+	mongoDBOpQuery        = 2004
+	mongoDBOpMsg          = 2013
+	mongoDBChecksumFlag   = 1
+)
+
+type MongoDBMetadata struct {
+	BasicMetadata
+	Messages []MongoDBMessage `json:"messages"`
+}
+
+type MongoDBMessage struct {
+	RequestID  int32                        `json:"request_id"`
+	ResponseTo int32                        `json:"response_to"`
+	OpCode     string                       `json:"op_code"`
+	Command    string                       `json:"command" binding:"omitempty"`
+	Database   string                       `json:"database" binding:"omitempty"`
+	Collection string                       `json:"collection" binding:"omitempty"`
+	Body       json.RawMessage              `json:"body" binding:"omitempty"`
+	Documents  map[string][]json.RawMessage `json:"documents" binding:"omitempty"`
+}
+
+type MongoDBParser struct {
+}
+
+func (p MongoDBParser) TryParse(content []byte) Metadata {
+	var messages []MongoDBMessage
+	for len(content) > 0 {
+		if len(content) < mongoDBHeaderSize {
+			return nil
+		}
+		length := int(binary.LittleEndian.Uint32(content[0:4]))
+		if length < mongoDBHeaderSize || length > mongoDBMaxMessageSize || length > len(content) {
+			return nil
+		}
+		message := MongoDBMessage{
+			RequestID:  int32(binary.LittleEndian.Uint32(content[4:8])),
+			ResponseTo: int32(binary.LittleEndian.Uint32(content[8:12])),
+		}
+
+		var ok bool
+		body := content[mongoDBHeaderSize:length]
+		switch binary.LittleEndian.Uint32(content[12:16]) {
+		case mongoDBOpMsg:
+			message.OpCode = "OP_MSG"
+			ok = parseMongoDBOpMsg(body, &message)
+		case mongoDBOpQuery:
+			message.OpCode = "OP_QUERY"
+			ok = parseMongoDBOpQuery(body, &message)
+		case mongoDBOpReply:
+			message.OpCode = "OP_REPLY"
+			ok = parseMongoDBOpReply(body, &message)
+		}
+		if !ok {
+			return nil
+		}
+
+		messages = append(messages, message)
+		content = content[length:]
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return MongoDBMetadata{
+		BasicMetadata: BasicMetadata{"mongodb"},
+		Messages:      messages,
+	}
+}
+
+func parseMongoDBOpMsg(body []byte, message *MongoDBMessage) bool {
+	if len(body) < 4 {
+		return false
+	}
+	flags := binary.LittleEndian.Uint32(body[0:4])
+	body = body[4:]
+	if flags&mongoDBChecksumFlag != 0 {
+		if len(body) < 4 {
+			return false
+		}
+		body = body[:len(body)-4]
+	}
+
+	for len(body) > 0 {
+		kind := body[0]
+		body = body[1:]
+		switch kind {
+		case 0:
+			document, rest, ok := readBSONDocument(body)
+			if !ok {
+				return false
+			}
+			message.Body = extendedJSON(document)
+			if elements, err := document.Elements(); err == nil && len(elements) > 0 && message.ResponseTo == 0 {
+				message.Command = elements[0].Key()
+			}
+			if database, ok := document.Lookup("$db").StringValueOK(); ok {
+				message.Database = database
+			}
+			body = rest
+		case 1:
+			if len(body) < 4 {
+				return false
+			}
+			size := int(binary.LittleEndian.Uint32(body[0:4]))
+			if size < 5 || size > len(body) {
+				return false
+			}
+			identifier, sequence, ok := readCString(body[4:size])
+			if !ok {
+				return false
+			}
+			documents, ok := readBSONDocuments(sequence)
+			if !ok {
+				return false
+			}
+			if message.Documents == nil {
+				message.Documents = make(map[string][]json.RawMessage)
+			}
+			message.Documents[identifier] = documents
+			body = body[size:]
+		default:
+			return false
+		}
+	}
+
+	return message.Body != nil
+}
+
+func parseMongoDBOpQuery(body []byte, message *MongoDBMessage) bool {
+	if len(body) < 4 {
+		return false
+	}
+	collection, rest, ok := readCString(body[4:])
+	if !ok || len(rest) < 8 {
+		return false
+	}
+	message.Collection = collection
+	document, rest, ok := readBSONDocument(rest[8:])
+	if !ok {
+		return false
+	}
+	message.Body = extendedJSON(document)
+	if elements, err := document.Elements(); err == nil && len(elements) > 0 {
+		message.Command = elements[0].Key()
+	}
+	if len(rest) > 0 { // returnFieldsSelector
+		selector, ok := readBSONDocuments(rest)
+		if !ok {
+			return false
+		}
+		message.Documents = map[string][]json.RawMessage{"return_fields_selector": selector}
+	}
+
+	return true
+}
+
+func parseMongoDBOpReply(body []byte, message *MongoDBMessage) bool {
+	if len(body) < 20 {
+		return false
+	}
+	documents, ok := readBSONDocuments(body[20:])
+	if !ok || len(documents) != int(binary.LittleEndian.Uint32(body[16:20])) {
+		return false
+	}
+	message.Documents = map[string][]json.RawMessage{"documents": documents}
+
+	return true
+}
+
+func readBSONDocument(buffer []byte) (bson.Raw, []byte, bool) {
+	if len(buffer) < 5 {
+		return nil, nil, false
+	}
+	size := int(binary.LittleEndian.Uint32(buffer[0:4]))
+	if size < 5 || size > len(buffer) {
+		return nil, nil, false
+	}
+	document := bson.Raw(buffer[:size])
+	if document.Validate() != nil {
+		return nil, nil, false
+	}
+
+	return document, buffer[size:], true
+}
+
+func readBSONDocuments(buffer []byte) ([]json.RawMessage, bool) {
+	documents := make([]json.RawMessage, 0)
+	for len(buffer) > 0 {
+		document, rest, ok := readBSONDocument(buffer)
+		if !ok {
+			return nil, false
+		}
+		documents = append(documents, extendedJSON(document))
+		buffer = rest
+	}
+
+	return documents, true
+}
+
+func extendedJSON(document bson.Raw) json.RawMessage {
+	if buffer, err := bson.MarshalExtJSON(document, false, false); err == nil {
+		return buffer
+	}
+	return json.RawMessage("null")
+}
@@ -0,0 +1,84 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+func TestMongoDBParser(t *testing.T) {
+	command, err := bson.Marshal(bson.D{{Key: "find", Value: "flags"}, {Key: "$db", Value: "ctf"}})
+	require.NoError(t, err)
+	opMsg := mongoDBTestMessage(mongoDBOpMsg, concat([]byte{0, 0, 0, 0, 0}, command))
+	opQuery := mongoDBTestMessage(mongoDBOpQuery, concat([]byte{0, 0, 0, 0}, []byte("ctf.$cmd\x00"),
+		make([]byte, 8), command))
+	reply := mongoDBTestMessage(mongoDBOpReply, concat(make([]byte, 16), []byte{1, 0, 0, 0}, command))
+
+	tests := []struct {
+		name    string
+		content []byte
+		check   func(metadata MongoDBMetadata)
+	}{
+		{"op msg", opMsg, func(metadata MongoDBMetadata) {
+			require.Len(t, metadata.Messages, 1)
+			assert.Equal(t, "OP_MSG", metadata.Messages[0].OpCode)
+			assert.Equal(t, "find", metadata.Messages[0].Command)
+			assert.Equal(t, "ctf", metadata.Messages[0].Database)
+		}},
+		{"op query", opQuery, func(metadata MongoDBMetadata) {
+			assert.Equal(t, "ctf.$cmd", metadata.Messages[0].Collection)
+		}},
+		{"op reply", reply, func(metadata MongoDBMetadata) {
+			assert.Len(t, metadata.Messages[0].Documents["documents"], 1)
+		}},
+		{"truncated header", opMsg[:10], nil},
+		{"truncated message", opMsg[:len(opMsg)-1], nil},
+		{"length shorter than the header", mongoDBTestMessage(mongoDBOpMsg, nil)[:12], nil},
+		{"huge length", []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0xdd, 0x07, 0, 0}, nil},
+		{"invalid document", mongoDBTestMessage(mongoDBOpMsg, concat([]byte{0, 0, 0, 0, 0},
+			[]byte{0x0f, 0, 0, 0, 0x02, 'a', 0, 0xff, 0xff, 0xff, 0x7f, 0, 0, 0, 0})), nil},
+		{"document longer than the message", mongoDBTestMessage(mongoDBOpMsg, concat([]byte{0, 0, 0, 0, 0},
+			command[:len(command)-1])), nil},
+		{"sequence longer than the message", mongoDBTestMessage(mongoDBOpMsg, concat([]byte{0, 0, 0, 0, 0},
+			command, []byte{1, 0xff, 0xff, 0, 0})), nil},
+		{"reply with wrong documents count", mongoDBTestMessage(mongoDBOpReply, concat(make([]byte, 16),
+			[]byte{0xff, 0xff, 0xff, 0xff}, command)), nil},
+		{"unknown op code", mongoDBTestMessage(2010, command), nil},
+	}
+
+	for _, test := range tests {
+		metadata := MongoDBParser{}.TryParse(test.content)
+		if test.check == nil {
+			assert.Nil(t, metadata, test.name)
+		} else if assert.IsType(t, MongoDBMetadata{}, metadata, test.name) {
+			test.check(metadata.(MongoDBMetadata))
+		}
+	}
+}
+
+func mongoDBTestMessage(opCode uint32, body []byte) []byte {
+	header := make([]byte, mongoDBHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(mongoDBHeaderSize+len(body)))
+	binary.LittleEndian.PutUint32(header[4:8], 1)
+	binary.LittleEndian.PutUint32(header[12:16], opCode)
+	return append(header, body...)
+}
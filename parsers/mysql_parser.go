@@ -0,0 +1,336 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"encoding/binary"
+)
+
+const (
+	mysqlHeaderSize                 = 4
+	mysqlClientProtocol41           = 0x00000200
+	mysqlClientConnectWithDB        = 0x00000008
+	mysqlClientSecureConn           = 0x00008000
+	mysqlClientPluginAuthLenencData = 0x00200000
+)
+
+var mysqlCommands = map[byte]string{
+	0x01: "COM_QUIT",
+	0x02: "COM_INIT_DB",
+	0x03: "COM_QUERY",
+	0x04: "COM_FIELD_LIST",
+	0x05: "COM_CREATE_DB",
+	0x06: "COM_DROP_DB",
+	0x08: "COM_SHUTDOWN",
+	0x09: "COM_STATISTICS",
+	0x0d: "COM_DEBUG",
+	0x0e: "COM_PING",
+	0x11: "COM_CHANGE_USER",
+	0x16: "COM_STMT_PREPARE",
+	0x17: "COM_STMT_EXECUTE",
+	0x19: "COM_STMT_CLOSE",
+	0x1a: "COM_STMT_RESET",
+	0x1f: "COM_RESET_CONNECTION",
+}
+
+type MySQLMetadata struct {
+	BasicMetadata
+	ServerVersion string         `json:"server_version" binding:"omitempty"`
+	Username      string         `json:"username" binding:"omitempty"`
+	Database      string         `json:"database" binding:"omitempty"`
+	Commands      []MySQLCommand `json:"commands" binding:"omitempty"`
+	Results       []MySQLResult  `json:"results" binding:"omitempty"`
+}
+
+type MySQLCommand struct {
+	Command  string `json:"command"`
+	Argument string `json:"argument" binding:"omitempty"`
+}
+
+type MySQLResult struct {
+	Type         string          `json:"type"`
+	AffectedRows uint64          `json:"affected_rows" binding:"omitempty"`
+	LastInsertID uint64          `json:"last_insert_id" binding:"omitempty"`
+	ErrorCode    uint16          `json:"error_code" binding:"omitempty"`
+	SQLState     string          `json:"sql_state" binding:"omitempty"`
+	Message      string          `json:"message" binding:"omitempty"`
+	Columns      []string        `json:"columns" binding:"omitempty"`
+	Rows         [][]interface{} `json:"rows" binding:"omitempty"`
+}
+
+type MySQLParser struct {
+}
+
+type mysqlPacket struct {
+	sequence byte
+	payload  []byte
+}
+
+func (p MySQLParser) TryParse(content []byte) Metadata {
+	packets, ok := splitMySQLPackets(content)
+	if !ok {
+		return nil
+	}
+
+	metadata := MySQLMetadata{BasicMetadata: BasicMetadata{"mysql"}}
+	for i := 0; i < len(packets); {
+		packet := packets[i]
+		if packet.sequence == 0 {
+			if serverVersion, isGreeting := parseMySQLGreeting(packet.payload); isGreeting {
+				metadata.ServerVersion = serverVersion
+			} else if command, isCommand := parseMySQLCommand(packet.payload); isCommand {
+				metadata.Commands = append(metadata.Commands, command)
+			} else {
+				return nil
+			}
+			i++
+		} else if username, database, isLogin := parseMySQLHandshakeResponse(packet); isLogin {
+			metadata.Username = username
+			metadata.Database = database
+			i++
+		} else {
+			result, consumed := parseMySQLResult(packets[i:])
+			if consumed == 0 {
+				return nil
+			}
+			metadata.Results = append(metadata.Results, result)
+			i += consumed
+		}
+	}
+
+	return metadata
+}
+
+func splitMySQLPackets(content []byte) ([]mysqlPacket, bool) {
+	var packets []mysqlPacket
+	for len(content) > 0 {
+		if len(content) < mysqlHeaderSize {
+			return nil, false
+		}
+		length := int(content[0]) | int(content[1])<<8 | int(content[2])<<16
+		sequence := content[3]
+		if length == 0 || len(content) < mysqlHeaderSize+length {
+			return nil, false
+		}
+		// in a chunk the sequence ids are consecutive, except when a new command starts
+		if len(packets) > 0 && sequence != 0 && sequence != packets[len(packets)-1].sequence+1 {
+			return nil, false
+		}
+		packets = append(packets, mysqlPacket{sequence, content[mysqlHeaderSize : mysqlHeaderSize+length]})
+		content = content[mysqlHeaderSize+length:]
+	}
+
+	return packets, len(packets) > 0
+}
+
+func parseMySQLGreeting(payload []byte) (string, bool) {
+	if len(payload) < 2 || payload[0] != 0x0a || payload[1] < '0' || payload[1] > '9' {
+		return "", false
+	}
+	serverVersion, _, ok := readCString(payload[1:])
+	return serverVersion, ok
+}
+
+func parseMySQLCommand(payload []byte) (MySQLCommand, bool) {
+	command, isPresent := mysqlCommands[payload[0]]
+	if !isPresent {
+		return MySQLCommand{}, false
+	}
+
+	var argument string
+	switch payload[0] {
+	case 0x02, 0x03, 0x05, 0x06, 0x16:
+		argument = string(payload[1:])
+	case 0x04:
+		argument, _, _ = readCString(payload[1:])
+	}
+
+	return MySQLCommand{Command: command, Argument: argument}, true
+}
+
+func parseMySQLHandshakeResponse(packet mysqlPacket) (string, string, bool) {
+	payload := packet.payload
+	if packet.sequence != 1 || len(payload) < 33 {
+		return "", "", false
+	}
+	capabilities := binary.LittleEndian.Uint32(payload[0:4])
+	if capabilities&mysqlClientProtocol41 == 0 {
+		return "", "", false
+	}
+	for _, filler := range payload[9:32] {
+		if filler != 0 {
+			return "", "", false
+		}
+	}
+
+	username, rest, ok := readCString(payload[32:])
+	if !ok {
+		return "", "", false
+	}
+	var database string
+	if capabilities&mysqlClientConnectWithDB != 0 {
+		authLength := -1
+		if capabilities&mysqlClientPluginAuthLenencData != 0 {
+			// the length comes from the traffic, it must be checked before the conversion to int
+			if length, size := readMySQLLengthEncodedInteger(rest); size > 0 && length <= uint64(len(rest)-size) {
+				authLength, rest = int(length), rest[size:]
+			}
+		} else if capabilities&mysqlClientSecureConn != 0 && len(rest) > 0 {
+			authLength, rest = int(rest[0]), rest[1:]
+		} else {
+			authLength = 0
+			_, rest, _ = readCString(rest)
+		}
+		if authLength >= 0 && authLength <= len(rest) {
+			database, _, _ = readCString(rest[authLength:])
+		}
+	}
+
+	return username, database, true
+}
+
+func parseMySQLResult(packets []mysqlPacket) (MySQLResult, int) {
+	payload := packets[0].payload
+	switch {
+	case payload[0] == 0x00 && len(payload) >= 7:
+		affectedRows, size := readMySQLLengthEncodedInteger(payload[1:])
+		lastInsertID, _ := readMySQLLengthEncodedInteger(payload[1+size:])
+		return MySQLResult{Type: "ok", AffectedRows: affectedRows, LastInsertID: lastInsertID}, 1
+	case payload[0] == 0xff && len(payload) >= 3:
+		result := MySQLResult{Type: "error", ErrorCode: binary.LittleEndian.Uint16(payload[1:3])}
+		message := payload[3:]
+		if len(message) >= 6 && message[0] == '#' {
+			result.SQLState = string(message[1:6])
+			message = message[6:]
+		}
+		result.Message = string(message)
+		return result, 1
+	case isMySQLEOFPacket(payload):
+		return MySQLResult{Type: "eof"}, 1
+	case payload[0] == 0xfe:
+		pluginName, _, _ := readCString(payload[1:])
+		return MySQLResult{Type: "auth_switch", Message: pluginName}, 1
+	case payload[0] == 0x01 && len(payload) > 1:
+		return MySQLResult{Type: "auth_more_data"}, 1
+	}
+
+	columnsCount, size := readMySQLLengthEncodedInteger(payload)
+	if size != len(payload) || columnsCount == 0 || columnsCount >= uint64(len(packets)) {
+		return MySQLResult{}, 0
+	}
+
+	result := MySQLResult{Type: "result_set", Columns: make([]string, columnsCount), Rows: make([][]interface{}, 0)}
+	for i := range result.Columns {
+		// catalog, schema, table, org_table, name
+		fields, ok := readMySQLLengthEncodedStrings(packets[1+i].payload, 5)
+		if !ok {
+			return MySQLResult{}, 0
+		}
+		for _, field := range fields {
+			if field == nil { // the fields of a column definition are never NULL
+				return MySQLResult{}, 0
+			}
+		}
+		if *fields[0] != "def" {
+			return MySQLResult{}, 0
+		}
+		result.Columns[i] = *fields[4]
+	}
+
+	consumed := 1 + int(columnsCount)
+	if consumed < len(packets) && isMySQLEOFPacket(packets[consumed].payload) {
+		consumed++
+	}
+	for ; consumed < len(packets); consumed++ {
+		payload := packets[consumed].payload
+		if payload[0] == 0xfe && len(payload) < 0xffffff { // EOF or OK packet which terminates the result set
+			consumed++
+			break
+		} else if payload[0] == 0xff {
+			break
+		}
+
+		fields, ok := readMySQLLengthEncodedStrings(payload, int(columnsCount))
+		if !ok {
+			return MySQLResult{}, 0
+		}
+		row := make([]interface{}, len(fields))
+		for j, field := range fields {
+			if field != nil {
+				row[j] = *field
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+
+	return result, consumed
+}
+
+func isMySQLEOFPacket(payload []byte) bool {
+	return payload[0] == 0xfe && len(payload) < 9
+}
+
+func readMySQLLengthEncodedInteger(buffer []byte) (uint64, int) {
+	if len(buffer) == 0 {
+		return 0, 0
+	}
+
+	var size int
+	switch buffer[0] {
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	default:
+		return uint64(buffer[0]), 1
+	}
+	if len(buffer) < size+1 {
+		return 0, 0
+	}
+
+	var value uint64
+	for i := size; i > 0; i-- {
+		value = value<<8 | uint64(buffer[i])
+	}
+	return value, size + 1
+}
+
+func readMySQLLengthEncodedStrings(buffer []byte, count int) ([]*string, bool) {
+	fields := make([]*string, count)
+	for i := range fields {
+		if len(buffer) == 0 {
+			return nil, false
+		}
+		if buffer[0] == 0xfb { // NULL value
+			buffer = buffer[1:]
+			continue
+		}
+
+		length, size := readMySQLLengthEncodedInteger(buffer)
+		if size == 0 || uint64(len(buffer)-size) < length {
+			return nil, false
+		}
+		field := string(buffer[size : size+int(length)])
+		fields[i] = &field
+		buffer = buffer[size+int(length):]
+	}
+
+	return fields, true
+}
@@ -0,0 +1,111 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMySQLParser(t *testing.T) {
+	greeting := mysqlTestPacket(0, append([]byte("\x0a8.0.26\x00"), make([]byte, 20)...))
+	login := func(auth ...byte) []byte {
+		payload := append([]byte{0x08, 0x02, 0x20, 0x00}, make([]byte, 28)...) // connect with db, protocol 41, lenenc
+		payload = append(append(payload, "root\x00"...), auth...)
+		return mysqlTestPacket(1, append(payload, "ctf\x00"...))
+	}
+	resultSet := concat(
+		mysqlTestPacket(1, []byte{0x01}),
+		mysqlTestPacket(2, []byte("\x03def\x02db\x05flags\x05flags\x04flag\x04flag"+
+			"\x0c\x21\x00\x00\x01\x00\x00\xfd\x00\x00\x00\x00\x00")),
+		mysqlTestPacket(3, []byte{0xfe, 0x00, 0x00, 0x02, 0x00}),
+		mysqlTestPacket(4, []byte("\x07flag{x}")),
+		mysqlTestPacket(5, []byte{0xfe, 0x00, 0x00, 0x02, 0x00}),
+	)
+
+	tests := []struct {
+		name    string
+		content []byte
+		check   func(metadata MySQLMetadata)
+	}{
+		{"greeting", greeting, func(metadata MySQLMetadata) {
+			assert.Equal(t, "8.0.26", metadata.ServerVersion)
+		}},
+		{"login", login(0x02, 0xaa, 0xbb), func(metadata MySQLMetadata) {
+			assert.Equal(t, "root", metadata.Username)
+			assert.Equal(t, "ctf", metadata.Database)
+		}},
+		{"login with negative auth length", login(0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff),
+			func(metadata MySQLMetadata) {
+				assert.Equal(t, "root", metadata.Username)
+				assert.Empty(t, metadata.Database)
+			}},
+		{"login with auth longer than the packet", login(0xfc, 0xff, 0x7f), func(metadata MySQLMetadata) {
+			assert.Empty(t, metadata.Database)
+		}},
+		{"login with truncated auth length", login(0xfe, 0xff), func(metadata MySQLMetadata) {
+			assert.Empty(t, metadata.Database)
+		}},
+		{"query", mysqlTestPacket(0, []byte("\x03SELECT flag FROM flags")), func(metadata MySQLMetadata) {
+			assert.Equal(t, []MySQLCommand{{"COM_QUERY", "SELECT flag FROM flags"}}, metadata.Commands)
+		}},
+		{"result set", resultSet, func(metadata MySQLMetadata) {
+			assert.Len(t, metadata.Results, 1)
+			assert.Equal(t, []string{"flag"}, metadata.Results[0].Columns)
+			assert.Equal(t, [][]interface{}{{"flag{x}"}}, metadata.Results[0].Rows)
+		}},
+		{"error", mysqlTestPacket(1, []byte("\xff\x15\x04#28000Access denied")), func(metadata MySQLMetadata) {
+			assert.Equal(t, []MySQLResult{{Type: "error", ErrorCode: 1045, SQLState: "28000",
+				Message: "Access denied"}}, metadata.Results)
+		}},
+		{"truncated header", []byte{0x05, 0x00}, nil},
+		{"truncated packet", greeting[:len(greeting)-1], nil},
+		{"empty packet", mysqlTestPacket(0, nil), nil},
+		{"huge columns count", mysqlTestPacket(1, []byte{0xfd, 0xff, 0xff, 0xff}), nil},
+		{"result set without rows", resultSet[:len(resultSet)-20], nil},
+		{"truncated column definition", mysqlTestPacket(1, []byte{0x01}), nil},
+		{"column definition with null name", concat(
+			mysqlTestPacket(1, []byte{0x01}),
+			mysqlTestPacket(2, []byte{0x03, 'd', 'e', 'f', 0xfb, 0xfb, 0xfb, 0xfb}),
+			mysqlTestPacket(3, []byte{0xfe, 0x00, 0x00, 0x00, 0x00}),
+		), nil},
+		{"text", []byte("GET / HTTP/1.1\r\n\r\n"), nil},
+	}
+
+	for _, test := range tests {
+		metadata := MySQLParser{}.TryParse(test.content)
+		if test.check == nil {
+			assert.Nil(t, metadata, test.name)
+		} else if assert.IsType(t, MySQLMetadata{}, metadata, test.name) {
+			test.check(metadata.(MySQLMetadata))
+		}
+	}
+}
+
+func mysqlTestPacket(sequence byte, payload []byte) []byte {
+	length := len(payload)
+	return append([]byte{byte(length), byte(length >> 8), byte(length >> 16), sequence}, payload...)
+}
+
+func concat(buffers ...[]byte) []byte {
+	var result []byte
+	for _, buffer := range buffers {
+		result = append(result, buffer...)
+	}
+	return result
+}
@@ -32,6 +32,17 @@ type BasicMetadata struct {
 var parsers = []Parser{	// order matter
 	HTTPRequestParser{},
 	HTTPResponseParser{},
+	TLSParser{},
+	MySQLParser{},
+	MongoDBParser{},
+	PostgreSQLParser{},
+	DNSParser{},
+	SMTPParser{},
+	FTPParser{},
+	POP3Parser{},
+	IRCParser{},
+	RedisParser{},
+	LineMenuParser{}, // must be the last one, it matches every printable text
 }
 
 func Parse(content []byte) Metadata {
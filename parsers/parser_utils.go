@@ -18,6 +18,7 @@
 package parsers
 
 import (
+	"bytes"
 	"net/http"
 	"strings"
 )
@@ -39,3 +40,12 @@ func CookiesMap(cookiesArray []*http.Cookie) map[string]string {
 
 	return cookies
 }
+
+func readCString(buffer []byte) (string, []byte, bool) {
+	end := bytes.IndexByte(buffer, 0)
+	if end < 0 {
+		return "", nil, false
+	}
+
+	return string(buffer[:end]), buffer[end+1:], true
+}
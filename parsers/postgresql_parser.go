@@ -0,0 +1,326 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	postgreSQLProtocolVersion = 196608
+	postgreSQLSSLRequestCode  = 80877103
+	postgreSQLCancelCode      = 80877102
+	postgreSQLMaxMessageSize  = 1 << 30
+)
+
+var postgreSQLFrontendMessages = map[byte]string{
+	'B': "Bind",
+	'C': "Close",
+	'd': "CopyData",
+	'c': "CopyDone",
+	'f': "CopyFail",
+	'D': "Describe",
+	'E': "Execute",
+	'H': "Flush",
+	'F': "FunctionCall",
+	'P': "Parse",
+	'p': "PasswordMessage",
+	'Q': "Query",
+	'S': "Sync",
+	'X': "Terminate",
+}
+
+var postgreSQLBackendMessages = map[byte]string{
+	'R': "Authentication",
+	'K': "BackendKeyData",
+	'2': "BindComplete",
+	'3': "CloseComplete",
+	'C': "CommandComplete",
+	'd': "CopyData",
+	'c': "CopyDone",
+	'G': "CopyInResponse",
+	'H': "CopyOutResponse",
+	'D': "DataRow",
+	'I': "EmptyQueryResponse",
+	'E': "ErrorResponse",
+	'V': "FunctionCallResponse",
+	'n': "NoData",
+	'N': "NoticeResponse",
+	'A': "NotificationResponse",
+	't': "ParameterDescription",
+	'S': "ParameterStatus",
+	'1': "ParseComplete",
+	's': "PortalSuspended",
+	'Z': "ReadyForQuery",
+	'T': "RowDescription",
+}
+
+type PostgreSQLMetadata struct {
+	BasicMetadata
+	Side              string             `json:"side"`
+	Messages          []string           `json:"messages"`
+	StartupParameters map[string]string  `json:"startup_parameters" binding:"omitempty"`
+	Queries           []string           `json:"queries" binding:"omitempty"`
+	Parameters        map[string]string  `json:"parameters" binding:"omitempty"`
+	Results           []PostgreSQLResult `json:"results" binding:"omitempty"`
+	Errors            []string           `json:"errors" binding:"omitempty"`
+}
+
+type PostgreSQLResult struct {
+	Columns    []string        `json:"columns"`
+	Rows       [][]interface{} `json:"rows"`
+	CommandTag string          `json:"command_tag" binding:"omitempty"`
+}
+
+type PostgreSQLParser struct {
+}
+
+type postgreSQLMessage struct {
+	messageType byte
+	payload     []byte
+}
+
+func (p PostgreSQLParser) TryParse(content []byte) Metadata {
+	metadata := PostgreSQLMetadata{BasicMetadata: BasicMetadata{"postgresql"}}
+
+	if len(content) < 5 {
+		return nil
+	}
+	if length := int(binary.BigEndian.Uint32(content[0:4])); length >= 8 && length <= len(content) {
+		switch binary.BigEndian.Uint32(content[4:8]) {
+		case postgreSQLProtocolVersion:
+			parameters, ok := parsePostgreSQLStartupParameters(content[8:length])
+			if !ok {
+				return nil
+			}
+			metadata.Side = "frontend"
+			metadata.Messages = append(metadata.Messages, "StartupMessage")
+			metadata.StartupParameters = parameters
+			content = content[length:]
+		case postgreSQLSSLRequestCode:
+			if length != 8 {
+				return nil
+			}
+			metadata.Side = "frontend"
+			metadata.Messages = append(metadata.Messages, "SSLRequest")
+			content = content[length:]
+		case postgreSQLCancelCode:
+			if length != 16 {
+				return nil
+			}
+			metadata.Side = "frontend"
+			metadata.Messages = append(metadata.Messages, "CancelRequest")
+			content = content[length:]
+		}
+	}
+
+	messages, ok := splitPostgreSQLMessages(content)
+	if !ok || len(messages)+len(metadata.Messages) == 0 {
+		return nil
+	}
+
+	if metadata.Side == "" {
+		metadata.Side = postgreSQLSide(messages)
+	}
+	var knownMessages map[byte]string
+	switch metadata.Side {
+	case "frontend":
+		knownMessages = postgreSQLFrontendMessages
+	case "backend":
+		knownMessages = postgreSQLBackendMessages
+	default:
+		return nil
+	}
+
+	var result *PostgreSQLResult
+	for _, message := range messages {
+		name, isPresent := knownMessages[message.messageType]
+		if !isPresent {
+			return nil
+		}
+		metadata.Messages = append(metadata.Messages, name)
+
+		switch name {
+		case "Query":
+			query, _, _ := readCString(message.payload)
+			metadata.Queries = append(metadata.Queries, query)
+		case "Parse":
+			if _, rest, ok := readCString(message.payload); ok {
+				query, _, _ := readCString(rest)
+				metadata.Queries = append(metadata.Queries, query)
+			}
+		case "ParameterStatus":
+			if name, rest, ok := readCString(message.payload); ok {
+				if metadata.Parameters == nil {
+					metadata.Parameters = make(map[string]string)
+				}
+				metadata.Parameters[name], _, _ = readCString(rest)
+			}
+		case "RowDescription":
+			metadata.Results = append(metadata.Results, PostgreSQLResult{
+				Columns: parsePostgreSQLRowDescription(message.payload),
+				Rows:    make([][]interface{}, 0),
+			})
+			result = &metadata.Results[len(metadata.Results)-1]
+		case "DataRow":
+			if result == nil {
+				metadata.Results = append(metadata.Results, PostgreSQLResult{Rows: make([][]interface{}, 0)})
+				result = &metadata.Results[len(metadata.Results)-1]
+			}
+			row, ok := parsePostgreSQLDataRow(message.payload)
+			if !ok {
+				return nil
+			}
+			result.Rows = append(result.Rows, row)
+		case "CommandComplete":
+			commandTag, _, _ := readCString(message.payload)
+			if result != nil {
+				result.CommandTag = commandTag
+				result = nil
+			} else {
+				metadata.Results = append(metadata.Results, PostgreSQLResult{CommandTag: commandTag})
+			}
+		case "ErrorResponse":
+			metadata.Errors = append(metadata.Errors, parsePostgreSQLErrorFields(message.payload))
+		}
+	}
+
+	return metadata
+}
+
+func splitPostgreSQLMessages(content []byte) ([]postgreSQLMessage, bool) {
+	var messages []postgreSQLMessage
+	for len(content) > 0 {
+		if len(content) < 5 {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint32(content[1:5]))
+		if length < 4 || length > postgreSQLMaxMessageSize || length+1 > len(content) {
+			return nil, false
+		}
+		messages = append(messages, postgreSQLMessage{content[0], content[5 : length+1]})
+		content = content[length+1:]
+	}
+
+	return messages, true
+}
+
+func postgreSQLSide(messages []postgreSQLMessage) string {
+	var isFrontend, isBackend = true, true
+	var hasFrontendOnly, hasBackendOnly bool
+	for _, message := range messages {
+		_, frontendMessage := postgreSQLFrontendMessages[message.messageType]
+		_, backendMessage := postgreSQLBackendMessages[message.messageType]
+		isFrontend = isFrontend && frontendMessage
+		isBackend = isBackend && backendMessage
+		hasFrontendOnly = hasFrontendOnly || frontendMessage && !backendMessage
+		hasBackendOnly = hasBackendOnly || backendMessage && !frontendMessage
+	}
+
+	// messages like Sync, DataRow, Execute are ambiguous: require at least one message typical of each side
+	if isFrontend && hasFrontendOnly {
+		return "frontend"
+	} else if isBackend && hasBackendOnly {
+		return "backend"
+	}
+	return ""
+}
+
+func parsePostgreSQLStartupParameters(buffer []byte) (map[string]string, bool) {
+	parameters := make(map[string]string)
+	for len(buffer) > 1 {
+		name, rest, ok := readCString(buffer)
+		if !ok {
+			return nil, false
+		}
+		value, rest, ok := readCString(rest)
+		if !ok {
+			return nil, false
+		}
+		parameters[name] = value
+		buffer = rest
+	}
+
+	return parameters, len(buffer) == 1 && buffer[0] == 0
+}
+
+func parsePostgreSQLRowDescription(payload []byte) []string {
+	if len(payload) < 2 {
+		return nil
+	}
+	columns := make([]string, 0, binary.BigEndian.Uint16(payload[0:2]))
+	payload = payload[2:]
+	for i := 0; i < cap(columns); i++ {
+		name, rest, ok := readCString(payload)
+		if !ok || len(rest) < 18 { // table oid, column index, type oid, type size, type modifier, format code
+			break
+		}
+		columns = append(columns, name)
+		payload = rest[18:]
+	}
+
+	return columns
+}
+
+func parsePostgreSQLDataRow(payload []byte) ([]interface{}, bool) {
+	if len(payload) < 2 {
+		return nil, false
+	}
+	row := make([]interface{}, binary.BigEndian.Uint16(payload[0:2]))
+	payload = payload[2:]
+	for i := range row {
+		if len(payload) < 4 {
+			return nil, false
+		}
+		length := int32(binary.BigEndian.Uint32(payload[0:4]))
+		payload = payload[4:]
+		if length < 0 { // NULL value
+			continue
+		}
+		if int(length) > len(payload) {
+			return nil, false
+		}
+		row[i] = string(payload[:length])
+		payload = payload[length:]
+	}
+
+	return row, true
+}
+
+func parsePostgreSQLErrorFields(payload []byte) string {
+	var severity, code, message string
+	for len(payload) > 1 {
+		fieldType := payload[0]
+		value, rest, ok := readCString(payload[1:])
+		if !ok {
+			break
+		}
+		switch fieldType {
+		case 'S':
+			severity = value
+		case 'C':
+			code = value
+		case 'M':
+			message = value
+		}
+		payload = rest
+	}
+
+	return strings.TrimSpace(severity + " " + code + ": " + message)
+}
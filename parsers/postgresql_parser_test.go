@@ -0,0 +1,88 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPostgreSQLParser(t *testing.T) {
+	startup := make([]byte, 8)
+	binary.BigEndian.PutUint32(startup[4:], postgreSQLProtocolVersion)
+	startup = append(startup, "user\x00ctf\x00database\x00flags\x00\x00"...)
+	binary.BigEndian.PutUint32(startup, uint32(len(startup)))
+
+	rowDescription := append([]byte{0, 1}, "flag\x00"...)
+	rowDescription = append(rowDescription, make([]byte, 18)...)
+	authenticationFailed := postgreSQLTestMessage('E',
+		[]byte("SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"))
+	backend := concat(
+		postgreSQLTestMessage('T', rowDescription),
+		postgreSQLTestMessage('D', []byte("\x00\x02\x00\x00\x00\x07flag{x}\xff\xff\xff\xff")),
+		postgreSQLTestMessage('C', []byte("SELECT 1\x00")),
+		postgreSQLTestMessage('Z', []byte("I")),
+	)
+
+	tests := []struct {
+		name    string
+		content []byte
+		check   func(metadata PostgreSQLMetadata)
+	}{
+		{"startup and query", append(startup, postgreSQLTestMessage('Q', []byte("SELECT flag FROM flags\x00"))...),
+			func(metadata PostgreSQLMetadata) {
+				assert.Equal(t, "frontend", metadata.Side)
+				assert.Equal(t, map[string]string{"user": "ctf", "database": "flags"}, metadata.StartupParameters)
+				assert.Equal(t, []string{"SELECT flag FROM flags"}, metadata.Queries)
+			}},
+		{"result", backend, func(metadata PostgreSQLMetadata) {
+			assert.Equal(t, "backend", metadata.Side)
+			assert.Equal(t, []PostgreSQLResult{{Columns: []string{"flag"}, Rows: [][]interface{}{{"flag{x}", nil}},
+				CommandTag: "SELECT 1"}}, metadata.Results)
+		}},
+		{"error", concat(authenticationFailed, postgreSQLTestMessage('Z', []byte("I"))),
+			func(metadata PostgreSQLMetadata) {
+				assert.Equal(t, []string{"FATAL 28P01: password authentication failed"}, metadata.Errors)
+			}},
+		{"truncated startup", startup[:len(startup)-1], nil},
+		{"truncated message", backend[:len(backend)-1], nil},
+		{"message shorter than its length", []byte{'Q', 0, 0, 0, 3}, nil},
+		{"huge message length", []byte{'Q', 0xff, 0xff, 0xff, 0xff, 0}, nil},
+		{"data row longer than the message", postgreSQLTestMessage('D', []byte("\x00\x01\x7f\xff\xff\xffabc")), nil},
+		{"data row with missing columns", concat(postgreSQLTestMessage('D', []byte("\x00\xff")),
+			postgreSQLTestMessage('Z', []byte("I"))), nil},
+		{"unknown message", postgreSQLTestMessage('!', nil), nil},
+		{"text", []byte("GET / HTTP/1.1\r\n\r\n"), nil},
+	}
+
+	for _, test := range tests {
+		metadata := PostgreSQLParser{}.TryParse(test.content)
+		if test.check == nil {
+			assert.Nil(t, metadata, test.name)
+		} else if assert.IsType(t, PostgreSQLMetadata{}, metadata, test.name) {
+			test.check(metadata.(PostgreSQLMetadata))
+		}
+	}
+}
+
+func postgreSQLTestMessage(messageType byte, payload []byte) []byte {
+	message := []byte{messageType, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(message[1:], uint32(4+len(payload)))
+	return append(message, payload...)
+}
@@ -0,0 +1,153 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+const redisMaxNestingLevel = 16
+
+type RedisMetadata struct {
+	BasicMetadata
+	Commands []RedisCommand `json:"commands" binding:"omitempty"`
+	Replies  []interface{}  `json:"replies" binding:"omitempty"`
+}
+
+type RedisCommand struct {
+	Command   string   `json:"command"`
+	Arguments []string `json:"arguments"`
+}
+
+type RedisError struct {
+	Error string `json:"error"`
+}
+
+type RedisParser struct {
+}
+
+func (p RedisParser) TryParse(content []byte) Metadata {
+	var values []interface{}
+	for len(content) > 0 {
+		value, rest, ok := parseRESPValue(content, 0)
+		if !ok {
+			return nil
+		}
+		values = append(values, value)
+		content = rest
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	// the client sends only arrays of bulk strings, everything else is sent by the server
+	commands := make([]RedisCommand, 0, len(values))
+	for _, value := range values {
+		if command, isCommand := redisCommand(value); isCommand {
+			commands = append(commands, command)
+		} else {
+			return RedisMetadata{
+				BasicMetadata: BasicMetadata{"redis"},
+				Replies:       values,
+			}
+		}
+	}
+
+	return RedisMetadata{
+		BasicMetadata: BasicMetadata{"redis"},
+		Commands:      commands,
+	}
+}
+
+func parseRESPValue(buffer []byte, level int) (interface{}, []byte, bool) {
+	if len(buffer) == 0 || level > redisMaxNestingLevel {
+		return nil, nil, false
+	}
+	end := bytes.Index(buffer, []byte("\r\n"))
+	if end < 1 {
+		return nil, nil, false
+	}
+	line, rest := string(buffer[1:end]), buffer[end+2:]
+
+	switch buffer[0] {
+	case '+':
+		return line, rest, true
+	case '-':
+		return RedisError{line}, rest, true
+	case ':':
+		integer, err := strconv.ParseInt(line, 10, 64)
+		return integer, rest, err == nil
+	case '$':
+		length, err := strconv.Atoi(line)
+		if err != nil || length < -1 {
+			return nil, nil, false
+		}
+		if length == -1 {
+			return nil, rest, true
+		}
+		if length > len(rest)-2 || rest[length] != '\r' || rest[length+1] != '\n' {
+			return nil, nil, false
+		}
+		return string(rest[:length]), rest[length+2:], true
+	case '*':
+		count, err := strconv.Atoi(line)
+		if err != nil || count < -1 || count > len(rest) {
+			return nil, nil, false
+		}
+		if count == -1 {
+			return nil, rest, true
+		}
+		elements := make([]interface{}, count)
+		for i := range elements {
+			var ok bool
+			if elements[i], rest, ok = parseRESPValue(rest, level+1); !ok {
+				return nil, nil, false
+			}
+		}
+		return elements, rest, true
+	default:
+		return nil, nil, false
+	}
+}
+
+func redisCommand(value interface{}) (RedisCommand, bool) {
+	elements, isArray := value.([]interface{})
+	if !isArray || len(elements) == 0 {
+		return RedisCommand{}, false
+	}
+	arguments := make([]string, len(elements))
+	for i, element := range elements {
+		if argument, isString := element.(string); isString {
+			arguments[i] = argument
+		} else {
+			return RedisCommand{}, false
+		}
+	}
+	if arguments[0] == "" || strings.IndexFunc(arguments[0], func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || r == '.' || r == '|' || r == '-')
+	}) >= 0 {
+		return RedisCommand{}, false
+	}
+
+	return RedisCommand{
+		Command:   strings.ToUpper(arguments[0]),
+		Arguments: arguments[1:],
+	}, true
+}
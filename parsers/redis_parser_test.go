@@ -0,0 +1,55 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestRedisParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Metadata
+	}{
+		{"commands", "*2\r\n$3\r\nget\r\n$4\r\nflag\r\n*1\r\n$4\r\nPING\r\n", RedisMetadata{
+			BasicMetadata: BasicMetadata{"redis"},
+			Commands:      []RedisCommand{{"GET", []string{"flag"}}, {"PING", []string{}}},
+		}},
+		{"replies", "+OK\r\n-ERR unknown\r\n:42\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n", RedisMetadata{
+			BasicMetadata: BasicMetadata{"redis"},
+			Replies:       []interface{}{"OK", RedisError{"ERR unknown"}, int64(42), nil, []interface{}{"a", int64(1)}},
+		}},
+		{"truncated bulk string", "*1\r\n$10\r\nget\r\n", nil},
+		{"bulk string without terminator", "$3\r\ngetxx", nil},
+		{"huge bulk string", "$9223372036854775807\r\nget\r\n", nil},
+		{"negative bulk string", "$-2\r\n", nil},
+		{"huge array", "*9223372036854775807\r\n", nil},
+		{"array longer than the content", "*3\r\n:1\r\n", nil},
+		{"invalid integer", ":abc\r\n", nil},
+		{"too nested", strings.Repeat("*1\r\n", redisMaxNestingLevel+2) + ":1\r\n", nil},
+		{"missing line end", "+OK", nil},
+		{"unknown type", "GET / HTTP/1.1\r\n", nil},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, RedisParser{}.TryParse([]byte(test.content)), test.name)
+	}
+}
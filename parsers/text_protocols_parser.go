@@ -0,0 +1,290 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+var smtpCommands = stringSet("HELO", "EHLO", "MAIL", "RCPT", "DATA", "BDAT", "RSET", "VRFY", "EXPN", "HELP",
+	"NOOP", "QUIT", "AUTH", "STARTTLS")
+
+var ftpCommands = stringSet("USER", "PASS", "ACCT", "CWD", "CDUP", "SMNT", "QUIT", "REIN", "PORT", "PASV", "TYPE",
+	"STRU", "MODE", "RETR", "STOR", "STOU", "APPE", "ALLO", "REST", "RNFR", "RNTO", "ABOR", "DELE", "RMD", "MKD", "PWD",
+	"LIST", "NLST", "SITE", "SYST", "STAT", "HELP", "NOOP", "FEAT", "OPTS", "EPRT", "EPSV", "AUTH", "PBSZ", "PROT",
+	"MDTM", "SIZE", "MLSD", "MLST", "XPWD", "XCWD", "XMKD", "XRMD")
+
+var pop3Commands = stringSet("USER", "PASS", "APOP", "STAT", "LIST", "RETR", "DELE", "NOOP", "RSET", "QUIT", "TOP",
+	"UIDL", "CAPA", "STLS", "AUTH")
+
+var ircCommands = stringSet("PASS", "NICK", "USER", "OPER", "MODE", "SERVICE", "QUIT", "SQUIT", "JOIN", "PART",
+	"TOPIC", "NAMES", "LIST", "INVITE", "KICK", "PRIVMSG", "NOTICE", "MOTD", "LUSERS", "VERSION", "STATS", "LINKS",
+	"TIME", "CONNECT", "TRACE", "ADMIN", "INFO", "WHO", "WHOIS", "WHOWAS", "KILL", "PING", "PONG", "ERROR", "AWAY",
+	"ISON", "CAP", "AUTHENTICATE")
+
+var ftpOnlyReplyCodes = stringSet("110", "120", "125", "150", "202", "212", "213", "215", "225", "226", "227", "228",
+	"229", "230", "232", "257", "331", "332", "350", "425", "426", "430", "434", "532")
+
+var smtpOnlyReplyCodes = stringSet("235", "251", "252", "334", "354", "455", "555")
+
+type TextProtocolMetadata struct {
+	BasicMetadata
+	Commands []TextCommand `json:"commands" binding:"omitempty"`
+	Replies  []TextReply   `json:"replies" binding:"omitempty"`
+	Data     string        `json:"data" binding:"omitempty"`
+}
+
+type TextCommand struct {
+	Prefix    string `json:"prefix" binding:"omitempty"`
+	Command   string `json:"command"`
+	Arguments string `json:"arguments" binding:"omitempty"`
+}
+
+type TextReply struct {
+	Code  string   `json:"code"`
+	Text  string   `json:"text"`
+	Lines []string `json:"lines" binding:"omitempty"`
+}
+
+type SMTPParser struct {
+}
+
+type FTPParser struct {
+}
+
+type POP3Parser struct {
+}
+
+type IRCParser struct {
+}
+
+func (p SMTPParser) TryParse(content []byte) Metadata {
+	lines, ok := splitTextLines(content, true)
+	if !ok {
+		return nil
+	}
+
+	if commands, ok := parseTextCommands(lines, smtpCommands); ok {
+		for _, command := range commands {
+			if command.Command == "MAIL" && !strings.HasPrefix(strings.ToUpper(command.Arguments), "FROM:") ||
+				command.Command == "RCPT" && !strings.HasPrefix(strings.ToUpper(command.Arguments), "TO:") {
+				return nil
+			}
+		}
+		return TextProtocolMetadata{BasicMetadata: BasicMetadata{"smtp"}, Commands: commands}
+	}
+	if replies, ok := parseNumericReplies(lines); ok && numericRepliesProtocol(replies) != "ftp" {
+		return TextProtocolMetadata{BasicMetadata: BasicMetadata{"smtp"}, Replies: replies}
+	}
+	// mail content sent after the DATA command, not to be confused with POP3 multi-line responses
+	if len(lines) > 1 && lines[len(lines)-1] == "." && !strings.HasPrefix(lines[0], "+OK") {
+		return TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"smtp"},
+			Data:          strings.Join(lines[:len(lines)-1], "\r\n"),
+		}
+	}
+
+	return nil
+}
+
+func (p FTPParser) TryParse(content []byte) Metadata {
+	lines, ok := splitTextLines(content, true)
+	if !ok {
+		return nil
+	}
+
+	if commands, ok := parseTextCommands(lines, ftpCommands); ok {
+		return TextProtocolMetadata{BasicMetadata: BasicMetadata{"ftp"}, Commands: commands}
+	}
+	if replies, ok := parseNumericReplies(lines); ok && numericRepliesProtocol(replies) != "smtp" {
+		return TextProtocolMetadata{BasicMetadata: BasicMetadata{"ftp"}, Replies: replies}
+	}
+
+	return nil
+}
+
+func (p POP3Parser) TryParse(content []byte) Metadata {
+	lines, ok := splitTextLines(content, true)
+	if !ok {
+		return nil
+	}
+
+	if commands, ok := parseTextCommands(lines, pop3Commands); ok {
+		return TextProtocolMetadata{BasicMetadata: BasicMetadata{"pop3"}, Commands: commands}
+	}
+
+	var replies []TextReply
+	for i := 0; i < len(lines); i++ {
+		code, text := splitFirstWord(lines[i])
+		if code != "+OK" && code != "-ERR" {
+			return nil
+		}
+		reply := TextReply{Code: code, Text: text}
+		// multi-line responses are terminated by a single dot; a single chunk can't contain only the first line
+		if i+1 < len(lines) {
+			for i++; i < len(lines) && lines[i] != "."; i++ {
+				reply.Lines = append(reply.Lines, strings.TrimPrefix(lines[i], "."))
+			}
+			if i == len(lines) {
+				return nil
+			}
+		}
+		replies = append(replies, reply)
+	}
+
+	return TextProtocolMetadata{BasicMetadata: BasicMetadata{"pop3"}, Replies: replies}
+}
+
+func (p IRCParser) TryParse(content []byte) Metadata {
+	lines, ok := splitTextLines(content, false)
+	if !ok {
+		return nil
+	}
+
+	commands := make([]TextCommand, 0, len(lines))
+	for _, line := range lines {
+		var prefix string
+		if strings.HasPrefix(line, ":") {
+			prefix, line = splitFirstWord(line[1:])
+			if prefix == "" {
+				return nil
+			}
+		}
+		command, arguments := splitFirstWord(line)
+		isNumeric := len(command) == 3 && strings.Trim(command, "0123456789") == ""
+		if !(isNumeric && prefix != "") && !ircCommands[strings.ToUpper(command)] {
+			return nil
+		}
+		commands = append(commands, TextCommand{Prefix: prefix, Command: strings.ToUpper(command), Arguments: arguments})
+	}
+
+	return TextProtocolMetadata{BasicMetadata: BasicMetadata{"irc"}, Commands: commands}
+}
+
+func splitTextLines(content []byte, crlfRequired bool) ([]string, bool) {
+	text := string(content)
+	if !isPrintableText(text) {
+		return nil, false
+	}
+
+	separator := "\n"
+	if crlfRequired {
+		separator = "\r\n"
+	}
+	if !strings.HasSuffix(text, separator) {
+		return nil, false
+	}
+	lines := strings.Split(strings.TrimSuffix(text, separator), separator)
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	return lines, true
+}
+
+func parseTextCommands(lines []string, knownCommands map[string]bool) ([]TextCommand, bool) {
+	commands := make([]TextCommand, 0, len(lines))
+	for _, line := range lines {
+		command, arguments := splitFirstWord(line)
+		if command != strings.ToUpper(command) && command != strings.ToLower(command) ||
+			!knownCommands[strings.ToUpper(command)] {
+			return nil, false
+		}
+		commands = append(commands, TextCommand{Command: strings.ToUpper(command), Arguments: arguments})
+	}
+
+	return commands, true
+}
+
+func parseNumericReplies(lines []string) ([]TextReply, bool) {
+	isReplyLine := func(line string) bool {
+		return len(line) >= 3 && line[0] >= '1' && line[0] <= '5' && strings.Trim(line[:3], "0123456789") == "" &&
+			(len(line) == 3 || line[3] == ' ' || line[3] == '-')
+	}
+
+	var replies []TextReply
+	for i := 0; i < len(lines); i++ {
+		if !isReplyLine(lines[i]) {
+			return nil, false
+		}
+		code := lines[i][:3]
+		reply := TextReply{Code: code, Text: strings.TrimSpace(lines[i][3:])}
+		if len(lines[i]) > 3 && lines[i][3] == '-' {
+			reply.Text = lines[i][4:]
+			for i++; i < len(lines) && !(strings.HasPrefix(lines[i], code) && isReplyLine(lines[i]) &&
+				(len(lines[i]) == 3 || lines[i][3] == ' ')); i++ {
+				reply.Lines = append(reply.Lines, strings.TrimPrefix(lines[i], code+"-"))
+			}
+			if i == len(lines) {
+				return nil, false
+			}
+			reply.Lines = append(reply.Lines, strings.TrimSpace(lines[i][3:]))
+		}
+		replies = append(replies, reply)
+	}
+
+	return replies, len(replies) > 0
+}
+
+// numericRepliesProtocol distinguishes SMTP and FTP replies, which share the same format, by looking for
+// reply codes or greetings used only by one of the two protocols. Returns an empty string if it can't decide.
+func numericRepliesProtocol(replies []TextReply) string {
+	for _, reply := range replies {
+		if ftpOnlyReplyCodes[reply.Code] {
+			return "ftp"
+		} else if smtpOnlyReplyCodes[reply.Code] {
+			return "smtp"
+		}
+		text := strings.ToUpper(reply.Text)
+		if strings.Contains(text, "FTP") {
+			return "ftp"
+		} else if strings.Contains(text, "SMTP") {
+			return "smtp"
+		}
+	}
+
+	return ""
+}
+
+func splitFirstWord(line string) (string, string) {
+	if index := strings.IndexByte(line, ' '); index >= 0 {
+		return line[:index], line[index+1:]
+	}
+	return line, ""
+}
+
+func isPrintableText(text string) bool {
+	if text == "" || !utf8.ValidString(text) {
+		return false
+	}
+	for _, r := range text {
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func stringSet(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
@@ -0,0 +1,135 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSMTPParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Metadata
+	}{
+		{"commands", "EHLO client\r\nMAIL FROM:<a@ctf>\r\nrcpt to:<b@ctf>\r\nDATA\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"smtp"},
+			Commands: []TextCommand{{Command: "EHLO", Arguments: "client"}, {Command: "MAIL", Arguments: "FROM:<a@ctf>"},
+				{Command: "RCPT", Arguments: "to:<b@ctf>"}, {Command: "DATA"}},
+		}},
+		{"replies", "250-mail.ctf\r\n250-SIZE 1000\r\n250 OK\r\n354 Start mail input\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"smtp"},
+			Replies: []TextReply{{Code: "250", Text: "mail.ctf", Lines: []string{"SIZE 1000", "OK"}},
+				{Code: "354", Text: "Start mail input"}},
+		}},
+		{"data", "Subject: flag\r\n\r\nflag{x}\r\n.\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"smtp"},
+			Data:          "Subject: flag\r\n\r\nflag{x}",
+		}},
+		{"mail without from", "MAIL <a@ctf>\r\n", nil},
+		{"mixed case command", "Helo client\r\n", nil},
+		{"ftp replies", "220 FTP server ready\r\n", nil},
+		{"pop3 response", "+OK\r\nflag{x}\r\n.\r\n", nil},
+		{"missing crlf", "HELO client\n", nil},
+		{"binary", "HELO \x00\r\n", nil},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, SMTPParser{}.TryParse([]byte(test.content)), test.name)
+	}
+}
+
+func TestFTPParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Metadata
+	}{
+		{"commands", "USER anonymous\r\nPASS flag\r\nRETR flag.txt\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"ftp"},
+			Commands: []TextCommand{{Command: "USER", Arguments: "anonymous"}, {Command: "PASS", Arguments: "flag"},
+				{Command: "RETR", Arguments: "flag.txt"}},
+		}},
+		{"replies", "220 ready\r\n331 Password required\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"ftp"},
+			Replies:       []TextReply{{Code: "220", Text: "ready"}, {Code: "331", Text: "Password required"}},
+		}},
+		{"smtp replies", "220 SMTP server ready\r\n", nil},
+		{"unterminated multi-line reply", "211-Features:\r\n MDTM\r\n", nil},
+		{"invalid reply code", "620 ready\r\n", nil},
+		{"unknown command", "GET / HTTP/1.1\r\n", nil},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, FTPParser{}.TryParse([]byte(test.content)), test.name)
+	}
+}
+
+func TestPOP3Parser(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Metadata
+	}{
+		{"commands", "USER ctf\r\nRETR 1\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"pop3"},
+			Commands:      []TextCommand{{Command: "USER", Arguments: "ctf"}, {Command: "RETR", Arguments: "1"}},
+		}},
+		{"single line response", "+OK ready\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"pop3"},
+			Replies:       []TextReply{{Code: "+OK", Text: "ready"}},
+		}},
+		{"multi-line response", "+OK message follows\r\nflag{x}\r\n..dot\r\n.\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"pop3"},
+			Replies:       []TextReply{{Code: "+OK", Text: "message follows", Lines: []string{"flag{x}", ".dot"}}},
+		}},
+		{"unterminated multi-line response", "+OK message follows\r\nflag{x}\r\n", nil},
+		{"unknown status", "OK ready\r\n", nil},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, POP3Parser{}.TryParse([]byte(test.content)), test.name)
+	}
+}
+
+func TestIRCParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Metadata
+	}{
+		{"commands", "NICK ctf\nPRIVMSG #ctf :flag{x}\r\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"irc"},
+			Commands: []TextCommand{{Command: "NICK", Arguments: "ctf"},
+				{Command: "PRIVMSG", Arguments: "#ctf :flag{x}"}},
+		}},
+		{"numeric reply", ":irc.ctf 001 ctf :Welcome\n", TextProtocolMetadata{
+			BasicMetadata: BasicMetadata{"irc"},
+			Commands:      []TextCommand{{Prefix: "irc.ctf", Command: "001", Arguments: "ctf :Welcome"}},
+		}},
+		{"numeric reply without prefix", "001 ctf :Welcome\n", nil},
+		{"empty prefix", ": PING\n", nil},
+		{"unknown command", "HELLO ctf\n", nil},
+		{"missing newline", "PING ctf", nil},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, IRCParser{}.TryParse([]byte(test.content)), test.name)
+	}
+}
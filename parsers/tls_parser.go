@@ -0,0 +1,395 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package parsers
+
+import (
+	"crypto/md5"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tlsRecordHeaderSize    = 5
+	tlsHandshakeHeaderSize = 4
+	tlsMaxRecordSize       = 1<<14 + 2048
+
+	tlsClientHello = 1
+	tlsServerHello = 2
+	tlsCertificate = 11
+
+	tlsExtensionServerName        = 0
+	tlsExtensionSupportedGroups   = 10
+	tlsExtensionPointFormats      = 11
+	tlsExtensionALPN              = 16
+	tlsExtensionSupportedVersions = 43
+)
+
+var tlsContentTypes = map[byte]string{
+	20: "change_cipher_spec",
+	21: "alert",
+	22: "handshake",
+	23: "application_data",
+	24: "heartbeat",
+}
+
+type TLSMetadata struct {
+	BasicMetadata
+	Records      map[string]int   `json:"records"`
+	ClientHello  *TLSClientHello  `json:"client_hello" binding:"omitempty"`
+	ServerHello  *TLSServerHello  `json:"server_hello" binding:"omitempty"`
+	Certificates []TLSCertificate `json:"certificates" binding:"omitempty"`
+}
+
+type TLSClientHello struct {
+	Version           uint16   `json:"version"`
+	Random            []byte   `json:"-"`
+	CipherSuites      []uint16 `json:"cipher_suites"`
+	Extensions        []uint16 `json:"extensions"`
+	SupportedGroups   []uint16 `json:"supported_groups"`
+	PointFormats      []uint8  `json:"point_formats"`
+	SupportedVersions []uint16 `json:"supported_versions"`
+	ServerName        string   `json:"server_name"`
+	ALPN              []string `json:"alpn"`
+}
+
+type TLSServerHello struct {
+	Version          uint16   `json:"version"`
+	Random           []byte   `json:"-"`
+	CipherSuite      uint16   `json:"cipher_suite"`
+	Extensions       []uint16 `json:"extensions"`
+	SupportedVersion uint16   `json:"supported_version"`
+	ALPN             string   `json:"alpn"`
+}
+
+type TLSCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+type TLSParser struct {
+}
+
+func (p TLSParser) TryParse(content []byte) Metadata {
+	if metadata, ok := parseTLSRecords(content, false); ok {
+		return metadata
+	}
+	return nil
+}
+
+// ParseTLSHandshake parses the first bytes of a stream, which can be truncated, looking for the handshake messages.
+func ParseTLSHandshake(content []byte) (TLSMetadata, bool) {
+	return parseTLSRecords(content, true)
+}
+
+func parseTLSRecords(content []byte, allowTruncated bool) (TLSMetadata, bool) {
+	metadata := TLSMetadata{
+		BasicMetadata: BasicMetadata{"tls"},
+		Records:       make(map[string]int),
+	}
+
+	var handshake []byte
+	for len(content) > 0 {
+		if len(content) < tlsRecordHeaderSize {
+			if allowTruncated && len(metadata.Records) > 0 {
+				break
+			}
+			return TLSMetadata{}, false
+		}
+		contentType, isPresent := tlsContentTypes[content[0]]
+		length := int(binary.BigEndian.Uint16(content[3:5]))
+		if !isPresent || content[1] != 3 || content[2] > 4 || length == 0 || length > tlsMaxRecordSize {
+			return TLSMetadata{}, false
+		}
+		if tlsRecordHeaderSize+length > len(content) {
+			if !allowTruncated {
+				return TLSMetadata{}, false
+			}
+			length = len(content) - tlsRecordHeaderSize
+		}
+
+		metadata.Records[contentType]++
+		// handshake messages after change_cipher_spec are encrypted
+		if contentType == "handshake" && metadata.Records["change_cipher_spec"] == 0 {
+			handshake = append(handshake, content[tlsRecordHeaderSize:tlsRecordHeaderSize+length]...)
+		}
+		content = content[tlsRecordHeaderSize+length:]
+	}
+
+	for len(handshake) >= tlsHandshakeHeaderSize {
+		length := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+		if tlsHandshakeHeaderSize+length > len(handshake) {
+			break
+		}
+		body := handshake[tlsHandshakeHeaderSize : tlsHandshakeHeaderSize+length]
+		switch handshake[0] {
+		case tlsClientHello:
+			if clientHello, ok := parseTLSClientHello(body); ok {
+				metadata.ClientHello = &clientHello
+			}
+		case tlsServerHello:
+			if serverHello, ok := parseTLSServerHello(body); ok {
+				metadata.ServerHello = &serverHello
+			}
+		case tlsCertificate:
+			metadata.Certificates = parseTLSCertificates(body)
+		}
+		handshake = handshake[tlsHandshakeHeaderSize+length:]
+	}
+
+	return metadata, len(metadata.Records) > 0
+}
+
+func parseTLSClientHello(body []byte) (TLSClientHello, bool) {
+	if len(body) < 35 {
+		return TLSClientHello{}, false
+	}
+	clientHello := TLSClientHello{Version: binary.BigEndian.Uint16(body[0:2]), Random: body[2:34]}
+	body = body[34:]
+
+	_, body, ok := readTLSVector(body, 1) // session id
+	if !ok {
+		return TLSClientHello{}, false
+	}
+	cipherSuites, body, ok := readTLSVector(body, 2)
+	if !ok {
+		return TLSClientHello{}, false
+	}
+	clientHello.CipherSuites = readUint16List(cipherSuites)
+	if _, body, ok = readTLSVector(body, 1); !ok { // compression methods
+		return TLSClientHello{}, false
+	}
+
+	clientHello.Extensions = make([]uint16, 0)
+	err := forEachTLSExtension(body, func(extensionType uint16, data []byte) {
+		clientHello.Extensions = append(clientHello.Extensions, extensionType)
+		switch extensionType {
+		case tlsExtensionServerName:
+			if list, _, ok := readTLSVector(data, 2); ok && len(list) > 3 && list[0] == 0 {
+				if name, _, ok := readTLSVector(list[1:], 2); ok {
+					clientHello.ServerName = string(name)
+				}
+			}
+		case tlsExtensionSupportedGroups:
+			if list, _, ok := readTLSVector(data, 2); ok {
+				clientHello.SupportedGroups = readUint16List(list)
+			}
+		case tlsExtensionPointFormats:
+			if list, _, ok := readTLSVector(data, 1); ok {
+				clientHello.PointFormats = list
+			}
+		case tlsExtensionALPN:
+			clientHello.ALPN = readALPNList(data)
+		case tlsExtensionSupportedVersions:
+			if list, _, ok := readTLSVector(data, 1); ok {
+				clientHello.SupportedVersions = readUint16List(list)
+			}
+		}
+	})
+
+	return clientHello, err == nil
+}
+
+func parseTLSServerHello(body []byte) (TLSServerHello, bool) {
+	if len(body) < 35 {
+		return TLSServerHello{}, false
+	}
+	serverHello := TLSServerHello{Version: binary.BigEndian.Uint16(body[0:2]), Random: body[2:34]}
+	body = body[34:]
+
+	_, body, ok := readTLSVector(body, 1) // session id
+	if !ok || len(body) < 3 {
+		return TLSServerHello{}, false
+	}
+	serverHello.CipherSuite = binary.BigEndian.Uint16(body[0:2])
+	body = body[3:]
+
+	serverHello.Extensions = make([]uint16, 0)
+	err := forEachTLSExtension(body, func(extensionType uint16, data []byte) {
+		serverHello.Extensions = append(serverHello.Extensions, extensionType)
+		switch extensionType {
+		case tlsExtensionALPN:
+			if protocols := readALPNList(data); len(protocols) > 0 {
+				serverHello.ALPN = protocols[0]
+			}
+		case tlsExtensionSupportedVersions:
+			if len(data) == 2 {
+				serverHello.SupportedVersion = binary.BigEndian.Uint16(data)
+			}
+		}
+	})
+
+	return serverHello, err == nil
+}
+
+func parseTLSCertificates(body []byte) []TLSCertificate {
+	list, _, ok := readTLSVector(body, 3)
+	if !ok {
+		return nil
+	}
+
+	var certificates []TLSCertificate
+	for len(list) > 0 {
+		var der []byte
+		if der, list, ok = readTLSVector(list, 3); !ok {
+			break
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		certificates = append(certificates, TLSCertificate{
+			Subject:   certificate.Subject.String(),
+			Issuer:    certificate.Issuer.String(),
+			DNSNames:  certificate.DNSNames,
+			NotBefore: certificate.NotBefore,
+			NotAfter:  certificate.NotAfter,
+		})
+	}
+
+	return certificates
+}
+
+// JA3 returns the fingerprint of the client as defined in https://github.com/salesforce/ja3
+func (h TLSClientHello) JA3() string {
+	var pointFormats []uint16
+	for _, pointFormat := range h.PointFormats {
+		pointFormats = append(pointFormats, uint16(pointFormat))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinTLSValues(h.CipherSuites),
+		joinTLSValues(h.Extensions),
+		joinTLSValues(h.SupportedGroups),
+		joinTLSValues(pointFormats),
+	}, ",")
+}
+
+// JA3S returns the fingerprint of the server as defined in https://github.com/salesforce/ja3
+func (h TLSServerHello) JA3S() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		strconv.Itoa(int(h.CipherSuite)),
+		joinTLSValues(h.Extensions),
+	}, ",")
+}
+
+// TLSFingerprintHash returns the md5 of a JA3 or JA3S fingerprint
+func TLSFingerprintHash(fingerprint string) string {
+	hash := md5.Sum([]byte(fingerprint))
+	return hex.EncodeToString(hash[:])
+}
+
+// TLSVersionName returns the name of a protocol version, like TLS 1.2
+func TLSVersionName(version uint16) string {
+	switch version {
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301:
+		return "TLS 1.0"
+	case 0x0302:
+		return "TLS 1.1"
+	case 0x0303:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+func forEachTLSExtension(buffer []byte, callback func(extensionType uint16, data []byte)) error {
+	if len(buffer) == 0 { // extensions are optional
+		return nil
+	}
+	extensions, _, ok := readTLSVector(buffer, 2)
+	if !ok {
+		return fmt.Errorf("invalid extensions length")
+	}
+	for len(extensions) >= 4 {
+		extensionType := binary.BigEndian.Uint16(extensions[0:2])
+		data, rest, ok := readTLSVector(extensions[2:], 2)
+		if !ok {
+			return fmt.Errorf("invalid extension length")
+		}
+		callback(extensionType, data)
+		extensions = rest
+	}
+
+	return nil
+}
+
+func readTLSVector(buffer []byte, lengthSize int) ([]byte, []byte, bool) {
+	if len(buffer) < lengthSize {
+		return nil, nil, false
+	}
+	var length int
+	for i := 0; i < lengthSize; i++ {
+		length = length<<8 | int(buffer[i])
+	}
+	if lengthSize+length > len(buffer) {
+		return nil, nil, false
+	}
+
+	return buffer[lengthSize : lengthSize+length], buffer[lengthSize+length:], true
+}
+
+func readUint16List(buffer []byte) []uint16 {
+	values := make([]uint16, 0, len(buffer)/2)
+	for i := 0; i+1 < len(buffer); i += 2 {
+		values = append(values, binary.BigEndian.Uint16(buffer[i:i+2]))
+	}
+	return values
+}
+
+func readALPNList(data []byte) []string {
+	list, _, ok := readTLSVector(data, 2)
+	if !ok {
+		return nil
+	}
+
+	var protocols []string
+	for len(list) > 0 {
+		var protocol []byte
+		if protocol, list, ok = readTLSVector(list, 1); !ok {
+			break
+		}
+		protocols = append(protocols, string(protocol))
+	}
+	return protocols
+}
+
+// joinTLSValues joins the values with dashes, excluding GREASE values (RFC 8701)
+func joinTLSValues(values []uint16) string {
+	var parts []string
+	for _, value := range values {
+		if value&0x0f0f == 0x0a0a && value>>8 == value&0xff {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(value)))
+	}
+	return strings.Join(parts, "-")
+}
@@ -0,0 +1,178 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// pcapExportTimeMargin extends the interval of the connections to include the last acknowledgments
+const pcapExportTimeMargin = time.Second
+
+// maxPcapFilterConnections is the maximum number of connections put in the bpf filter used to read the pcaps
+const maxPcapFilterConnections = 64
+
+const defaultPcapSnapLen = 262144
+
+type connectionInterval struct {
+	from time.Time
+	to   time.Time
+}
+
+// ExportConnectionsPcap writes a pcap with the packets of the connections, read from the pcaps of the sessions from
+// which the connections have been imported
+func ExportConnectionsPcap(connections []Connection, writer io.Writer) error {
+	sessionsConnections := make(map[string][]Connection)
+	var sessions []string
+	for _, connection := range connections {
+		if len(connection.ImportingSessions) == 0 {
+			return fmt.Errorf("the importing session of connection %s is unknown", connection.ID.Hex())
+		}
+		for _, sessionID := range connection.ImportingSessions {
+			if _, isPresent := sessionsConnections[sessionID]; !isPresent {
+				sessions = append(sessions, sessionID)
+			}
+			sessionsConnections[sessionID] = append(sessionsConnections[sessionID], connection)
+		}
+	}
+
+	pcapWriter := pcapgo.NewWriterNanos(writer)
+	var linkType layers.LinkType
+	var headerWritten bool
+	for _, sessionID := range sessions {
+		fileName, isPresent := sessionPcapFile(sessionID)
+		if !isPresent {
+			log.WithField("session", sessionID).Warn("the pcap of the session is not available")
+			continue
+		}
+		handle, err := pcap.OpenOffline(fileName)
+		if err != nil {
+			return err
+		}
+
+		if !headerWritten {
+			snapLen := uint32(handle.SnapLen())
+			if snapLen == 0 {
+				snapLen = defaultPcapSnapLen
+			}
+			linkType = handle.LinkType()
+			if err := pcapWriter.WriteFileHeader(snapLen, linkType); err != nil {
+				handle.Close()
+				return err
+			}
+			headerWritten = true
+		} else if handle.LinkType() != linkType {
+			log.WithField("session", sessionID).Warn("the pcap of the session has a different link type")
+			handle.Close()
+			continue
+		}
+
+		err = exportSessionPackets(handle, sessionsConnections[sessionID], pcapWriter)
+		handle.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !headerWritten {
+		return errors.New("the pcaps of the connections are not available")
+	}
+	return nil
+}
+
+func exportSessionPackets(handle *pcap.Handle, connections []Connection, pcapWriter *pcapgo.Writer) error {
+	intervals := make(map[StreamFlow][]connectionInterval, len(connections))
+	for _, connection := range connections {
+		flow := StreamFlow{
+			layers.NewIPEndpoint(net.ParseIP(connection.SourceIP)),
+			layers.NewIPEndpoint(net.ParseIP(connection.DestinationIP)),
+			layers.NewTCPPortEndpoint(layers.TCPPort(connection.SourcePort)),
+			layers.NewTCPPortEndpoint(layers.TCPPort(connection.DestinationPort)),
+		}
+		intervals[flow] = append(intervals[flow], connectionInterval{
+			from: connection.StartedAt.Add(-pcapExportTimeMargin),
+			to:   connection.ClosedAt.Add(pcapExportTimeMargin),
+		})
+	}
+	if err := handle.SetBPFFilter(connectionsBPFFilter(connections)); err != nil {
+		log.WithError(err).Warn("failed to set the bpf filter to export connections")
+	}
+
+	for {
+		data, captureInfo, err := handle.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		packet := gopacket.NewPacket(data, handle.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		if packet.NetworkLayer() == nil || packet.TransportLayer() == nil ||
+			packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
+			continue
+		}
+		netFlow, transportFlow := packet.NetworkLayer().NetworkFlow(), packet.TransportLayer().TransportFlow()
+		flowIntervals, isPresent := intervals[connectionFlow(netFlow, transportFlow, false)]
+		if !isPresent {
+			flowIntervals = intervals[connectionFlow(netFlow, transportFlow, true)]
+		}
+
+		for _, interval := range flowIntervals {
+			if !captureInfo.Timestamp.Before(interval.from) && !captureInfo.Timestamp.After(interval.to) {
+				if err := pcapWriter.WritePacket(captureInfo, data); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+}
+
+// connectionsBPFFilter returns a filter to read only the packets of the connections, which is faster than decoding
+// all the packets of the pcap
+func connectionsBPFFilter(connections []Connection) string {
+	if len(connections) > maxPcapFilterConnections {
+		return "tcp"
+	}
+
+	filters := make([]string, len(connections))
+	for i, connection := range connections {
+		filters[i] = fmt.Sprintf("(host %s and host %s and port %d and port %d)", connection.SourceIP,
+			connection.DestinationIP, connection.SourcePort, connection.DestinationPort)
+	}
+	return "tcp and (" + strings.Join(filters, " or ") + ")"
+}
+
+func sessionPcapFile(sessionID string) (string, bool) {
+	for _, extension := range []string{".pcap", ".pcapng"} {
+		if fileName := PcapsBasePath + sessionID + extension; FileExists(fileName) {
+			return fileName, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,117 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExportConnectionsPcap(t *testing.T) {
+	sessionID := "export_test_session"
+	require.NoError(t, CopyFile(PcapsBasePath+sessionID+".pcap", "test_data/ping_pong_10000.pcap"))
+
+	// the connections are the flows directed to the service port
+	var connections []Connection
+	var packetsCount []int
+	indexes := make(map[StreamFlow]int)
+	for _, packet := range readTestPcap(t, "test_data/ping_pong_10000.pcap") {
+		netFlow, transportFlow := packet.NetworkLayer().NetworkFlow(), packet.TransportLayer().TransportFlow()
+		flow := connectionFlow(netFlow, transportFlow, binary.BigEndian.Uint16(transportFlow.Src().Raw()) == 9999)
+		index, isPresent := indexes[flow]
+		if !isPresent {
+			index = len(connections)
+			indexes[flow] = index
+			connections = append(connections, Connection{
+				ID:                NewRowID(),
+				SourceIP:          flow[0].String(),
+				DestinationIP:     flow[1].String(),
+				SourcePort:        binary.BigEndian.Uint16(flow[2].Raw()),
+				DestinationPort:   binary.BigEndian.Uint16(flow[3].Raw()),
+				StartedAt:         packet.Metadata().Timestamp,
+				ImportingSessions: []string{sessionID},
+			})
+			packetsCount = append(packetsCount, 0)
+		}
+		connections[index].ClosedAt = packet.Metadata().Timestamp
+		packetsCount[index]++
+	}
+	require.NotEmpty(t, connections)
+
+	var buffer bytes.Buffer
+	require.NoError(t, ExportConnectionsPcap(connections[:1], &buffer))
+	exported := readTestPcapBytes(t, buffer.Bytes())
+	assert.Len(t, exported, packetsCount[0])
+	ports := []uint16{connections[0].SourcePort, connections[0].DestinationPort}
+	for _, packet := range exported {
+		transportFlow := packet.TransportLayer().TransportFlow()
+		assert.Contains(t, ports, binary.BigEndian.Uint16(transportFlow.Src().Raw()))
+		assert.Contains(t, ports, binary.BigEndian.Uint16(transportFlow.Dst().Raw()))
+	}
+
+	// only the packets in the interval of the connection are exported
+	connection := connections[0]
+	connection.StartedAt = connection.ClosedAt.Add(time.Hour)
+	connection.ClosedAt = connection.StartedAt
+	buffer.Reset()
+	require.NoError(t, ExportConnectionsPcap([]Connection{connection}, &buffer))
+	assert.Empty(t, readTestPcapBytes(t, buffer.Bytes()))
+
+	connection.ImportingSessions = nil
+	assert.Error(t, ExportConnectionsPcap([]Connection{connection}, &buffer))
+	connection.ImportingSessions = []string{"invalid_session"}
+	assert.Error(t, ExportConnectionsPcap([]Connection{connection}, &buffer))
+
+	assert.NoError(t, os.Remove(PcapsBasePath+sessionID+".pcap"))
+}
+
+func readTestPcap(t *testing.T, fileName string) []gopacket.Packet {
+	content, err := ioutil.ReadFile(fileName)
+	require.NoError(t, err)
+	return readTestPcapBytes(t, content)
+}
+
+func readTestPcapBytes(t *testing.T, content []byte) []gopacket.Packet {
+	reader, err := pcapgo.NewReader(bytes.NewReader(content))
+	require.NoError(t, err)
+
+	var packets []gopacket.Packet
+	for {
+		data, captureInfo, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return packets
+		}
+		require.NoError(t, err)
+
+		packet := gopacket.NewPacket(data, reader.LinkType(), gopacket.Default)
+		packet.Metadata().CaptureInfo = captureInfo
+		if packet.TransportLayer() != nil && packet.TransportLayer().LayerType() == layers.LayerTypeTCP {
+			packets = append(packets, packet)
+		}
+	}
+}
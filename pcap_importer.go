@@ -20,12 +20,12 @@ package main
 import (
 	"context"
 	"errors"
+	"github.com/eciavatta/caronte/parsers"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 	log "github.com/sirupsen/logrus"
-	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -39,14 +39,21 @@ const ProcessingPcapsBasePath = PcapsBasePath + "processing/"
 const initialAssemblerPoolSize = 16
 const importUpdateProgressInterval = 100 * time.Millisecond
 
+// the importing sessions of the connections without packets for trackedSessionsTimeout, relative to the last packet
+// of an import, are forgotten. Such connections are unlikely to be continued by another pcap
+const trackedSessionsTimeout = time.Hour
+
 type PcapImporter struct {
 	storage                Storage
 	streamPool             *tcpassembly.StreamPool
+	streamFactory          *BiDirectionalStreamFactory
 	assemblers             []*tcpassembly.Assembler
 	sessions               map[string]ImportingSession
 	mAssemblers            sync.Mutex
 	mSessions              sync.Mutex
-	serverNet              net.IPNet
+	serverNetworks         *ServerNetworks
+	mSettings              sync.Mutex
+	dnsController          *DNSController
 	notificationController *NotificationController
 }
 
@@ -65,9 +72,12 @@ type ImportingSession struct {
 
 type flowCount [2]int
 
-func NewPcapImporter(storage Storage, serverNet net.IPNet, rulesManager RulesManager,
+func NewPcapImporter(storage Storage, serverNetworks *ServerNetworks, rulesManager RulesManager, tlsKeys TLSKeyProvider,
+	teams TeamResolver, dnsController *DNSController, novelDetector NovelConnectionsDetector, gameClock GameClock,
 	notificationController *NotificationController) *PcapImporter {
-	streamPool := tcpassembly.NewStreamPool(NewBiDirectionalStreamFactory(storage, serverNet, rulesManager))
+	streamFactory := NewBiDirectionalStreamFactory(storage, serverNetworks, rulesManager, tlsKeys, teams, novelDetector,
+		gameClock)
+	streamPool := tcpassembly.NewStreamPool(streamFactory)
 
 	var result []ImportingSession
 	if err := storage.Find(ImportingSessions).All(&result); err != nil {
@@ -81,15 +91,28 @@ func NewPcapImporter(storage Storage, serverNet net.IPNet, rulesManager RulesMan
 	return &PcapImporter{
 		storage:                storage,
 		streamPool:             streamPool,
+		streamFactory:          streamFactory,
 		assemblers:             make([]*tcpassembly.Assembler, 0, initialAssemblerPoolSize),
 		sessions:               sessions,
 		mAssemblers:            sync.Mutex{},
 		mSessions:              sync.Mutex{},
-		serverNet:              serverNet,
+		serverNetworks:         serverNetworks,
+		dnsController:          dnsController,
 		notificationController: notificationController,
 	}
 }
 
+// UpdateSettings changes the server networks and the game clock used from now on. The pcaps being imported keep
+// using the previous server networks, to not change the sides of their connections
+func (pi *PcapImporter) UpdateSettings(serverNetworks *ServerNetworks, gameClock GameClock) {
+	pi.mSettings.Lock()
+	pi.serverNetworks = serverNetworks
+	pi.mSettings.Unlock()
+	if pi.streamFactory != nil {
+		pi.streamFactory.UpdateSettings(serverNetworks, gameClock)
+	}
+}
+
 // Import a pcap file to the database. The pcap file must be present at the fileName path. If the pcap is already
 // going to be imported or if it has been already imported in the past the function returns an error. Otherwise it
 // create a new session and starts to import the pcap, and returns immediately the session name (that is the sha256
@@ -171,6 +194,9 @@ func (pi *PcapImporter) FlushConnections(olderThen time.Time, closeAll bool) (fl
 		CloseAll: closeAll,
 	})
 	pi.releaseAssembler(assembler)
+	if pi.streamFactory != nil {
+		pi.streamFactory.ExpireSessions(olderThen)
+	}
 	return
 }
 
@@ -189,12 +215,21 @@ func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flu
 	assembler := pi.takeAssembler()
 	packets := packetSource.Packets()
 	updateProgressInterval := time.Tick(importUpdateProgressInterval)
+	// the client to server flows of the open connections where the server can't be told from the address
+	handshakes := make(map[StreamFlow]bool)
+	// a pcap is imported entirely with the settings it started with
+	pi.mSettings.Lock()
+	serverNetworks := pi.serverNetworks
+	pi.mSettings.Unlock()
+	// the time of the last packet read, to forget the connections idle for too long when the import finishes
+	var lastSeen time.Time
 
 	for {
 		select {
 		case <-ctx.Done():
 			handle.Close()
 			pi.releaseAssembler(assembler)
+			pi.releaseSessions(session, false, lastSeen)
 			pi.progressUpdate(session, fileName, false, "import process cancelled")
 			return
 		default:
@@ -209,6 +244,7 @@ func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flu
 				}
 				handle.Close()
 				pi.releaseAssembler(assembler)
+				pi.releaseSessions(session, flushAll, lastSeen)
 				pi.progressUpdate(session, fileName, true, "")
 				pi.notificationController.Notify("pcap.completed", session)
 
@@ -217,6 +253,10 @@ func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flu
 
 			session.ProcessedPackets++
 
+			if pi.processDNSPacket(packet) {
+				continue
+			}
+
 			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil ||
 				packet.TransportLayer().LayerType() != layers.LayerTypeTCP { // invalid packet
 				session.InvalidPackets++
@@ -227,18 +267,22 @@ func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flu
 			var servicePort uint16
 			var index int
 
-			isDstServer := pi.serverNet.Contains(packet.NetworkLayer().NetworkFlow().Dst().Raw())
-			isSrcServer := pi.serverNet.Contains(packet.NetworkLayer().NetworkFlow().Src().Raw())
-			if isDstServer && !isSrcServer {
+			netFlow, transportFlow := packet.NetworkLayer().NetworkFlow(), tcp.TransportFlow()
+			if serverNetworks.IsDstServer(connectionFlow(netFlow, transportFlow, false), tcp, handshakes) {
 				servicePort = uint16(tcp.DstPort)
 				index = 0
-			} else if isSrcServer && !isDstServer {
+			} else {
 				servicePort = uint16(tcp.SrcPort)
 				index = 1
-			} else {
-				session.InvalidPackets++
-				continue
 			}
+			if pi.streamFactory != nil {
+				pi.streamFactory.TrackSession(connectionFlow(netFlow, transportFlow, index == 1), session.ID,
+					packet.Metadata().Timestamp)
+			}
+			if packet.Metadata().Timestamp.After(lastSeen) {
+				lastSeen = packet.Metadata().Timestamp
+			}
+
 			fCount, isPresent := session.PacketsPerService[servicePort]
 			if !isPresent {
 				fCount = flowCount{0, 0}
@@ -253,6 +297,40 @@ func (pi *PcapImporter) parsePcap(session ImportingSession, fileName string, flu
 	}
 }
 
+// releaseSessions forgets the connections tracked by an import which can't be completed anymore. After a flush all
+// the connections of the import are completed, otherwise they can be continued by the next pcaps
+func (pi *PcapImporter) releaseSessions(session ImportingSession, flushed bool, lastSeen time.Time) {
+	if pi.streamFactory == nil {
+		return
+	}
+	if flushed {
+		pi.streamFactory.ReleaseSession(session.ID)
+	}
+	if !lastSeen.IsZero() {
+		pi.streamFactory.ExpireSessions(lastSeen.Add(-trackedSessionsTimeout))
+	}
+}
+
+// processDNSPacket saves the DNS message carried by an UDP packet, if any. DNS messages over TCP are instead
+// reassembled like any other connection.
+func (pi *PcapImporter) processDNSPacket(packet gopacket.Packet) bool {
+	if pi.dnsController == nil || packet.NetworkLayer() == nil {
+		return false
+	}
+	udp, isUDP := packet.TransportLayer().(*layers.UDP)
+	if !isUDP || (udp.SrcPort != 53 && udp.DstPort != 53) {
+		return false
+	}
+	message, ok := parsers.ParseDNSMessage(udp.Payload)
+	if !ok {
+		return false
+	}
+
+	flow := packet.NetworkLayer().NetworkFlow()
+	pi.dnsController.ProcessDNSMessage(message, flow.Src().String(), flow.Dst().String(), packet.Metadata().Timestamp)
+	return true
+}
+
 func (pi *PcapImporter) progressUpdate(session ImportingSession, fileName string, completed bool, err string) {
 	if completed {
 		session.CompletedAt = time.Now()
@@ -303,6 +381,14 @@ func (pi *PcapImporter) releaseAssembler(assembler *tcpassembly.Assembler) {
 	pi.mAssemblers.Unlock()
 }
 
+// connectionFlow returns the flow from the client to the server of the connection which the packet belongs to
+func connectionFlow(netFlow, transportFlow gopacket.Flow, fromServer bool) StreamFlow {
+	if fromServer {
+		return StreamFlow{netFlow.Dst(), netFlow.Src(), transportFlow.Dst(), transportFlow.Src()}
+	}
+	return StreamFlow{netFlow.Src(), netFlow.Dst(), transportFlow.Src(), transportFlow.Dst()}
+}
+
 func deleteProcessingFile(fileName string) {
 	if err := os.Remove(ProcessingPcapsBasePath + fileName); err != nil {
 		log.WithError(err).Error("failed to delete processing file")
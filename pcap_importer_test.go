@@ -126,7 +126,7 @@ func newTestPcapImporter(wrapper *TestStorageWrapper, serverAddress string) *Pca
 		sessions:    make(map[string]ImportingSession),
 		mAssemblers: sync.Mutex{},
 		mSessions:   sync.Mutex{},
-		serverNet:   *ParseIPNet(serverAddress),
+		serverNetworks: NewServerNetworks(Config{ServerAddress: serverAddress}),
 		notificationController: NewNotificationController(nil),
 	}
 }
@@ -0,0 +1,285 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replayDialTimeout        = 5 * time.Second
+	defaultReplayReadTimeout = 2 * time.Second
+	maxReplayResponseSize    = 16 * 1024 * 1024
+	replayReadBufferSize     = 32 * 1024
+)
+
+type ReplayOptions struct {
+	Host        string  `json:"host" binding:"required"`
+	Port        uint16  `json:"port" binding:"required,min=1"`
+	Speed       float64 `json:"speed" binding:"min=0"`        // 2 replays twice as fast, 1 if not set
+	ReadTimeout int     `json:"read_timeout" binding:"min=0"` // milliseconds to wait for the last responses
+}
+
+type ReplayResult struct {
+	Connection Connection      `json:"connection"`
+	Equal      bool            `json:"equal"` // the responses are equal to the original ones, ignoring flags and tokens
+	Diff       ConnectionsDiff `json:"diff"`
+}
+
+type replayBlock struct {
+	payload   []byte
+	timestamp time.Time
+}
+
+type ReplayController struct {
+	storage                     Storage
+	connectionStreamsController ConnectionStreamsController
+}
+
+func NewReplayController(storage Storage, connectionStreamsController ConnectionStreamsController) *ReplayController {
+	return &ReplayController{
+		storage:                     storage,
+		connectionStreamsController: connectionStreamsController,
+	}
+}
+
+// ReplayConnection sends the client messages of a connection to a target, respecting the recorded timing scaled by
+// the speed option. The replay is saved as a new connection and its responses are compared with the original ones.
+func (rc *ReplayController) ReplayConnection(c context.Context, connection Connection, options ReplayOptions,
+	ignorePatterns []*regexp.Regexp) (ReplayResult, error) {
+	if connection.TLS != nil && !connection.TLS.Decrypted {
+		return ReplayResult{}, errors.New("the connection is encrypted and must be decrypted before the replay")
+	}
+
+	var clientBlocks []replayBlock
+	cursor := rc.connectionStreamsController.newMessagesCursor(c, connection.ID, isDecrypted(connection), true)
+	var firstTimestamp time.Time
+	for side := cursor.nextSide(); side != nil; side = cursor.nextSide() {
+		timestamp := side.stream.BlocksTimestamps[side.blocksIndex]
+		if firstTimestamp.IsZero() {
+			firstTimestamp = timestamp
+		}
+		if side.fromClient {
+			clientBlocks = append(clientBlocks, replayBlock{
+				payload:   blockPayload(side.stream, side.blocksIndex),
+				timestamp: timestamp,
+			})
+		}
+		cursor.advance(side)
+	}
+	if len(clientBlocks) == 0 {
+		return ReplayResult{}, errors.New("the connection has no client messages to replay")
+	}
+
+	conn, err := rc.dial(connection, options)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	defer conn.Close()
+	startedAt := time.Now()
+
+	var serverBlocks []replayBlock
+	var mServerBlocks sync.Mutex
+	var sendingDone int32
+	readTimeout := defaultReplayReadTimeout
+	if options.ReadTimeout > 0 {
+		readTimeout = time.Duration(options.ReadTimeout) * time.Millisecond
+	}
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		var size int
+		for size < maxReplayResponseSize {
+			buffer := make([]byte, replayReadBufferSize)
+			n, err := conn.Read(buffer)
+			if n > 0 {
+				mServerBlocks.Lock()
+				serverBlocks = append(serverBlocks, replayBlock{payload: buffer[:n], timestamp: time.Now()})
+				mServerBlocks.Unlock()
+				size += n
+			}
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(&sendingDone) == 1 {
+				_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+			}
+		}
+	}()
+
+	speed := options.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	var sendErr error
+	var sent int
+	for i := 0; i < len(clientBlocks) && sendErr == nil; i++ {
+		delay := time.Duration(float64(clientBlocks[i].timestamp.Sub(firstTimestamp)) / speed)
+		select {
+		case <-time.After(time.Until(startedAt.Add(delay))):
+		case <-c.Done():
+			sendErr = c.Err()
+			continue
+		case <-readDone: // the target closed the connection
+			sendErr = errors.New("the target closed the connection")
+			continue
+		}
+		if _, err := conn.Write(clientBlocks[i].payload); err != nil {
+			sendErr = err
+			continue
+		}
+		clientBlocks[i].timestamp = time.Now()
+		sent++
+	}
+	if sendErr != nil {
+		log.WithError(sendErr).WithField("connection_id", connection.ID).Warn("replay interrupted")
+	}
+	clientBlocks = clientBlocks[:sent]
+
+	atomic.StoreInt32(&sendingDone, 1)
+	_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	select {
+	case <-readDone:
+	case <-c.Done():
+		_ = conn.Close()
+		<-readDone
+	}
+	closedAt := time.Now()
+
+	replay := Connection{
+		ID:           NewRowID(),
+		StartedAt:    startedAt,
+		ClosedAt:     closedAt,
+		ProcessedAt:  closedAt,
+		MatchedRules: []RowID{},
+		ReplayOf:     &connection.ID,
+	}
+	replay.SourceIP, replay.SourcePort = addressParts(conn.LocalAddr())
+	replay.DestinationIP, replay.DestinationPort = addressParts(conn.RemoteAddr())
+	for _, block := range clientBlocks {
+		replay.ClientBytes += len(block.payload)
+	}
+	mServerBlocks.Lock()
+	for _, block := range serverBlocks {
+		replay.ServerBytes += len(block.payload)
+	}
+	documents := append(rc.buildStreams(replay.ID, true, clientBlocks),
+		rc.buildStreams(replay.ID, false, serverBlocks)...)
+	mServerBlocks.Unlock()
+	for _, document := range documents {
+		if document.(ConnectionStream).FromClient {
+			replay.ClientDocuments++
+		} else {
+			replay.ServerDocuments++
+		}
+	}
+
+	if len(documents) > 0 {
+		if _, err := rc.storage.Insert(ConnectionStreams).Context(c).Many(documents); err != nil {
+			log.WithError(err).WithField("replay_id", replay.ID).Error("failed to insert the replay streams")
+			return ReplayResult{}, err
+		}
+	}
+	if _, err := rc.storage.Insert(Connections).Context(c).One(replay); err != nil {
+		log.WithError(err).WithField("replay_id", replay.ID).Error("failed to insert the replay connection")
+		return ReplayResult{}, err
+	}
+
+	diff, _ := rc.connectionStreamsController.DiffConnections(c, DiffOptions{
+		A: connection.ID.Hex(),
+		B: replay.ID.Hex(),
+	}, ignorePatterns)
+	result := ReplayResult{Connection: replay, Equal: true, Diff: diff}
+	for _, pair := range diff.Pairs {
+		if !pair.FromClient && !pair.Equal {
+			result.Equal = false
+		}
+	}
+
+	return result, nil
+}
+
+func (rc *ReplayController) dial(connection Connection, options ReplayOptions) (net.Conn, error) {
+	address := net.JoinHostPort(options.Host, strconv.Itoa(int(options.Port)))
+	dialer := &net.Dialer{Timeout: replayDialTimeout}
+	if connection.TLS == nil {
+		return dialer.Dial("tcp", address)
+	}
+
+	// the certificate of the target is not verified, it is usually a service of the local network
+	config := &tls.Config{InsecureSkipVerify: true, ServerName: connection.TLS.ServerName}
+	if connection.TLS.NegotiatedProtocol != "" {
+		config.NextProtos = []string{connection.TLS.NegotiatedProtocol}
+	}
+	return tls.DialWithDialer(dialer, "tcp", address, config)
+}
+
+// buildStreams splits the blocks in documents of at most MaxDocumentSize bytes
+func (rc *ReplayController) buildStreams(connectionID RowID, fromClient bool, blocks []replayBlock) []interface{} {
+	var documents []interface{}
+	var stream ConnectionStream
+	var payload []byte
+	flushStream := func() {
+		if len(stream.BlocksIndexes) == 0 {
+			return
+		}
+		stream.Payload = payload
+		stream.PayloadString = strings.ToValidUTF8(string(payload), "")
+		documents = append(documents, stream)
+	}
+
+	for _, block := range blocks {
+		if len(stream.BlocksIndexes) == 0 || len(payload)+len(block.payload) > MaxDocumentSize {
+			flushStream()
+			stream = ConnectionStream{
+				ID:             NewRowID(),
+				ConnectionID:   connectionID,
+				FromClient:     fromClient,
+				DocumentIndex:  len(documents),
+				PatternMatches: map[uint][]PatternSlice{},
+			}
+			payload = nil
+		}
+		stream.BlocksIndexes = append(stream.BlocksIndexes, len(payload))
+		stream.BlocksTimestamps = append(stream.BlocksTimestamps, block.timestamp)
+		stream.BlocksLoss = append(stream.BlocksLoss, false)
+		payload = append(payload, block.payload...)
+	}
+	flushStream()
+
+	return documents
+}
+
+func addressParts(address net.Addr) (string, uint16) {
+	if tcpAddress, ok := address.(*net.TCPAddr); ok {
+		return tcpAddress.IP.String(), uint16(tcpAddress.Port)
+	}
+	host, port, _ := net.SplitHostPort(address.String())
+	portNumber, _ := strconv.Atoi(port)
+	return host, uint16(portNumber)
+}
@@ -0,0 +1,95 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayConnection(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+
+	// the target answers each line with the line in upper case and a new flag
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for i := 0; ; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write([]byte(strings.ToUpper(line) + "FLAG{replay_" + string(rune('a'+i)) + "}\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	startedAt := time.Now().Add(-time.Minute)
+	original := Connection{ID: NewRowID(), StartedAt: startedAt, ClosedAt: startedAt.Add(time.Second)}
+	controller := NewReplayController(wrapper.Storage, NewConnectionStreamsController(wrapper.Storage))
+	clientStreams := controller.buildStreams(original.ID, true, []replayBlock{
+		{payload: []byte("hello\n"), timestamp: startedAt},
+		{payload: []byte("world\n"), timestamp: startedAt.Add(100 * time.Millisecond)},
+	})
+	serverStreams := controller.buildStreams(original.ID, false, []replayBlock{
+		{payload: []byte("HELLO\nFLAG{original_a}\n"), timestamp: startedAt.Add(50 * time.Millisecond)},
+		{payload: []byte("WORLD\nFLAG{original_b}\n"), timestamp: startedAt.Add(150 * time.Millisecond)},
+	})
+	_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).Many(append(clientStreams,
+		serverStreams...))
+	require.NoError(t, err)
+	_, err = wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(original)
+	require.NoError(t, err)
+
+	address := listener.Addr().(*net.TCPAddr)
+	flagRegex := regexp.MustCompile(`FLAG\{\w+\}`)
+	result, err := controller.ReplayConnection(wrapper.Context, original, ReplayOptions{
+		Host:        address.IP.String(),
+		Port:        uint16(address.Port),
+		Speed:       2,
+		ReadTimeout: 200,
+	}, []*regexp.Regexp{flagRegex})
+	require.NoError(t, err)
+	assert.True(t, result.Equal)
+	assert.Equal(t, original.ID, *result.Connection.ReplayOf)
+	assert.Equal(t, 12, result.Connection.ClientBytes)
+	assert.Equal(t, len("HELLO\nFLAG{replay_a}\nWORLD\nFLAG{replay_b}\n"), result.Connection.ServerBytes)
+
+	var replay Connection
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).
+		Filter(byID(result.Connection.ID)).First(&replay))
+	assert.Equal(t, original.ID, *replay.ReplayOf)
+
+	require.NoError(t, listener.Close())
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,383 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const retentionInterval = 10 * time.Minute
+const retentionBatchSize = 500
+const maxRetentionJobs = 100 // the oldest completed jobs are forgotten
+
+var errPayloadDropped = errors.New("the payload of the connection was dropped by the retention policy")
+
+const (
+	JobDeletion = "deletion"
+	JobPolicy   = "policy"
+)
+
+// RetentionPolicy limits the space used by the connections. The payloads of the connections imported more than
+// PayloadsMaxAge hours ago are dropped, and the payloads of the oldest connections are dropped while the data is
+// bigger than MaxStorageSize bytes. The metadata of the connections is always kept, and the marked or tagged
+// connections are never touched. A zero value disables the limit
+type RetentionPolicy struct {
+	PayloadsMaxAge uint  `json:"payloads_max_age" bson:"payloads_max_age,omitempty"`
+	MaxStorageSize int64 `json:"max_storage_size" binding:"min=0" bson:"max_storage_size,omitempty"`
+}
+
+// RetentionJob is a deletion of connections or an application of the retention policy, which runs in background
+type RetentionJob struct {
+	ID                 string    `json:"id"`
+	Type               string    `json:"type"`
+	StartedAt          time.Time `json:"started_at"`
+	CompletedAt        time.Time `json:"completed_at"`
+	Total              int64     `json:"total"`
+	DeletedConnections int64     `json:"deleted_connections"`
+	DroppedPayloads    int64     `json:"dropped_payloads"`
+	Error              string    `json:"error,omitempty"`
+	selection          OrderedDocument
+	scheduled          bool
+	completed          chan struct{}
+}
+
+type RetentionController struct {
+	storage                Storage
+	notificationController *NotificationController
+	policy                 RetentionPolicy
+	jobs                   map[string]RetentionJob
+	policyPending          bool
+	mJobs                  sync.Mutex
+	mRun                   sync.Mutex // the jobs run one at a time
+}
+
+func NewRetentionController(storage Storage, notificationController *NotificationController,
+	policy RetentionPolicy) *RetentionController {
+	retentionController := &RetentionController{
+		storage:                storage,
+		notificationController: notificationController,
+		policy:                 policy,
+		jobs:                   make(map[string]RetentionJob),
+	}
+
+	go retentionController.retentionService()
+
+	return retentionController
+}
+
+func (rc *RetentionController) SetPolicy(policy RetentionPolicy) {
+	rc.mJobs.Lock()
+	rc.policy = policy
+	rc.mJobs.Unlock()
+}
+
+// DeleteConnections starts a job which deletes the selected connections, with their streams, files and comments
+func (rc *RetentionController) DeleteConnections(c context.Context, selection OrderedDocument) (RetentionJob, error) {
+	// an empty selection would delete all the connections
+	if len(selection) == 0 {
+		return RetentionJob{}, errors.New("no connections selected")
+	}
+	total, err := rc.storage.Find(Connections).Context(c).Filter(selection).Count()
+	if err != nil {
+		log.WithError(err).WithField("selection", selection).Panic("failed to count the connections to delete")
+	}
+	if total == 0 {
+		return RetentionJob{}, errors.New("no connections to delete")
+	}
+
+	return rc.startJob(JobDeletion, selection, total, false), nil
+}
+
+// ApplyPolicy starts a job which drops the payloads exceeding the retention policy
+func (rc *RetentionController) ApplyPolicy() (RetentionJob, error) {
+	return rc.applyPolicy(false)
+}
+
+func (rc *RetentionController) GetJobs() []RetentionJob {
+	rc.mJobs.Lock()
+	jobs := make([]RetentionJob, 0, len(rc.jobs))
+	for _, job := range rc.jobs {
+		jobs = append(jobs, job)
+	}
+	rc.mJobs.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.After(jobs[j].StartedAt)
+	})
+	return jobs
+}
+
+func (rc *RetentionController) GetJob(id string) (RetentionJob, bool) {
+	rc.mJobs.Lock()
+	defer rc.mJobs.Unlock()
+	job, isPresent := rc.jobs[id]
+	return job, isPresent
+}
+
+func (rc *RetentionController) applyPolicy(scheduled bool) (RetentionJob, error) {
+	rc.mJobs.Lock()
+	if rc.policy.PayloadsMaxAge == 0 && rc.policy.MaxStorageSize == 0 {
+		rc.mJobs.Unlock()
+		return RetentionJob{}, errors.New("the retention policy is disabled")
+	}
+	if rc.policyPending {
+		rc.mJobs.Unlock()
+		return RetentionJob{}, errors.New("the retention policy is already being applied")
+	}
+	rc.policyPending = true
+	rc.mJobs.Unlock()
+
+	return rc.startJob(JobPolicy, nil, 0, scheduled), nil
+}
+
+func (rc *RetentionController) startJob(jobType string, selection OrderedDocument, total int64,
+	scheduled bool) RetentionJob {
+	job := RetentionJob{
+		ID:        NewRowID().Hex(),
+		Type:      jobType,
+		StartedAt: time.Now(),
+		Total:     total,
+		selection: selection,
+		scheduled: scheduled,
+		completed: make(chan struct{}),
+	}
+	// the scheduled jobs are shown only if they have something to do
+	if !scheduled {
+		rc.progressUpdate(job)
+	}
+
+	go func() {
+		rc.mRun.Lock()
+		defer rc.mRun.Unlock()
+
+		var err error
+		if job.Type == JobDeletion {
+			err = rc.deleteConnections(&job)
+		} else {
+			err = rc.dropPayloads(&job)
+		}
+		if err != nil {
+			log.WithError(err).WithField("job", job.ID).Error("failed to complete the retention job")
+			job.Error = err.Error()
+		}
+		job.CompletedAt = time.Now()
+		if !scheduled || job.DroppedPayloads > 0 || job.Error != "" {
+			rc.progressUpdate(job)
+		}
+		if job.Type == JobPolicy {
+			rc.mJobs.Lock()
+			rc.policyPending = false
+			rc.mJobs.Unlock()
+		}
+		close(job.completed)
+	}()
+
+	return job
+}
+
+func (rc *RetentionController) deleteConnections(job *RetentionJob) error {
+	c := context.Background()
+	for {
+		ids, err := rc.nextBatch(c, job.selection, false)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		byConnection := OrderedDocument{{"connection_id", UnorderedDocument{"$in": ids}}}
+		if err := rc.deletePayloads(c, byConnection); err != nil {
+			return err
+		}
+		if err := deleteAll(c, rc.storage, Comments, byConnection); err != nil {
+			return err
+		}
+		if err := deleteAll(c, rc.storage, Connections, OrderedDocument{{"_id",
+			UnorderedDocument{"$in": ids}}}); err != nil {
+			return err
+		}
+
+		job.DeletedConnections += int64(len(ids))
+		rc.progressUpdate(*job)
+	}
+}
+
+// dropPayloads deletes the streams and the files of the old connections, and then the ones of the oldest connections
+// until the data fits in the maximum size. To reach the size the connections imported in the last retentionInterval
+// are not dropped, since they are still being processed
+func (rc *RetentionController) dropPayloads(job *RetentionJob) error {
+	c := context.Background()
+	rc.mJobs.Lock()
+	policy := rc.policy
+	rc.mJobs.Unlock()
+
+	unprotected := OrderedDocument{
+		{"marked", UnorderedDocument{"$ne": true}},
+		{"tags.0", UnorderedDocument{"$exists": false}},
+		{"payload_dropped", UnorderedDocument{"$ne": true}},
+	}
+
+	if policy.PayloadsMaxAge > 0 {
+		maxAge := time.Duration(policy.PayloadsMaxAge) * time.Hour
+		expired := append(OrderedDocument{{"processed_at", UnorderedDocument{"$lt": time.Now().Add(-maxAge)}}},
+			unprotected...)
+		total, err := rc.storage.Find(Connections).Context(c).Filter(expired).Count()
+		if err != nil {
+			return err
+		}
+		job.Total = total
+		if err := rc.dropBatches(c, job, expired, func() (bool, error) { return true, nil }); err != nil {
+			return err
+		}
+	}
+
+	if policy.MaxStorageSize > 0 {
+		oversized := append(OrderedDocument{{"processed_at", UnorderedDocument{
+			"$lt": time.Now().Add(-retentionInterval)}}}, unprotected...)
+		return rc.dropBatches(c, job, oversized, func() (bool, error) {
+			size, err := rc.storage.DataSize(c)
+			return size > policy.MaxStorageSize, err
+		})
+	}
+
+	return nil
+}
+
+// dropBatches drops the payloads of the selected connections, from the oldest, while proceed returns true
+func (rc *RetentionController) dropBatches(c context.Context, job *RetentionJob, selection OrderedDocument,
+	proceed func() (bool, error)) error {
+	for {
+		if ok, err := proceed(); err != nil || !ok {
+			return err
+		}
+		ids, err := rc.nextBatch(c, selection, true)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		if err := rc.deletePayloads(c, OrderedDocument{{"connection_id", UnorderedDocument{"$in": ids}}}); err != nil {
+			return err
+		}
+		if _, err := rc.storage.Update(Connections).Context(c).Filter(OrderedDocument{{"_id",
+			UnorderedDocument{"$in": ids}}}).Many(UnorderedDocument{"payload_dropped": true}); err != nil {
+			return err
+		}
+
+		job.DroppedPayloads += int64(len(ids))
+		if job.Total < job.DroppedPayloads {
+			job.Total = job.DroppedPayloads
+		}
+		rc.progressUpdate(*job)
+	}
+}
+
+// nextBatch returns the ids of the next selected connections. The processed connections must not be selected anymore
+func (rc *RetentionController) nextBatch(c context.Context, selection OrderedDocument, oldest bool) ([]RowID, error) {
+	var connections []Connection
+	query := rc.storage.Find(Connections).Context(c).Filter(selection).Projection(OrderedDocument{{"_id", 1}}).
+		Limit(retentionBatchSize)
+	if oldest {
+		query = query.Sort("_id", true)
+	}
+	if err := query.All(&connections); err != nil {
+		return nil, err
+	}
+
+	ids := make([]RowID, len(connections))
+	for i, connection := range connections {
+		ids[i] = connection.ID
+	}
+	return ids, nil
+}
+
+// deletePayloads deletes the streams and the extracted files of the selected connections. The contents of the files
+// are deleted only when no other file has the same content
+func (rc *RetentionController) deletePayloads(c context.Context, byConnection OrderedDocument) error {
+	if err := deleteAll(c, rc.storage, ConnectionStreams, byConnection); err != nil {
+		return err
+	}
+
+	var files []ExtractedFile
+	if err := rc.storage.Find(Files).Context(c).Filter(byConnection).Projection(OrderedDocument{{"sha256", 1}}).
+		All(&files); err != nil {
+		return err
+	}
+	if err := deleteAll(c, rc.storage, Files, byConnection); err != nil {
+		return err
+	}
+	for _, file := range files {
+		count, err := rc.storage.Find(Files).Context(c).Filter(OrderedDocument{{"sha256", file.SHA256}}).Count()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			if err := deleteAll(c, rc.storage, FileContents, OrderedDocument{{"_id", file.SHA256}}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (rc *RetentionController) progressUpdate(job RetentionJob) {
+	rc.mJobs.Lock()
+	rc.jobs[job.ID] = job
+	if len(rc.jobs) > maxRetentionJobs {
+		rc.pruneJobs()
+	}
+	rc.mJobs.Unlock()
+
+	rc.notificationController.Notify("retention.progress", job)
+}
+
+// pruneJobs forgets the oldest completed jobs exceeding maxRetentionJobs. It must be called with mJobs locked
+func (rc *RetentionController) pruneJobs() {
+	completed := make([]RetentionJob, 0, len(rc.jobs))
+	for _, job := range rc.jobs {
+		if !job.CompletedAt.IsZero() {
+			completed = append(completed, job)
+		}
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].StartedAt.Before(completed[j].StartedAt)
+	})
+	for i := 0; i < len(completed) && len(rc.jobs) > maxRetentionJobs; i++ {
+		delete(rc.jobs, completed[i].ID)
+	}
+}
+
+func (rc *RetentionController) retentionService() {
+	ticker := time.NewTicker(retentionInterval)
+	for range ticker.C {
+		_, _ = rc.applyPolicy(true)
+	}
+}
+
+// deleteAll deletes the documents which match the filter, if there is any
+func deleteAll(c context.Context, storage Storage, collectionName string, filter OrderedDocument) error {
+	count, err := storage.Find(collectionName).Context(c).Filter(filter).Count()
+	if err != nil || count == 0 {
+		return err
+	}
+
+	return storage.Delete(collectionName).Context(c).Filter(filter).Many()
+}
@@ -0,0 +1,142 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRetentionJobs(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	wrapper.AddCollection(Comments)
+	wrapper.AddCollection(Files)
+	wrapper.AddCollection(FileContents)
+
+	old := time.Now().Add(-3 * time.Hour)
+	connections := []Connection{
+		{ID: NewRowID(), ProcessedAt: old},
+		{ID: NewRowID(), ProcessedAt: old, Marked: true},
+		{ID: NewRowID(), ProcessedAt: old, Tags: []string{"exploit"}},
+		{ID: NewRowID(), ProcessedAt: time.Now()},
+		{ID: NewRowID(), ProcessedAt: old, DestinationPort: 22},
+	}
+	for _, connection := range connections {
+		_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(connection)
+		require.NoError(t, err)
+		_, err = wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).One(ConnectionStream{
+			ID: NewRowID(), ConnectionID: connection.ID, Payload: []byte("payload")})
+		require.NoError(t, err)
+	}
+	storeExtractedFiles(wrapper.Storage, connections[0].ID, []ExtractedFile{{Content: []byte("shared")}})
+	storeExtractedFiles(wrapper.Storage, connections[1].ID, []ExtractedFile{{Content: []byte("shared")}})
+	storeExtractedFiles(wrapper.Storage, connections[4].ID, []ExtractedFile{{Content: []byte("dropped")}})
+
+	notificationController := NewNotificationController(nil)
+	go notificationController.Run()
+	controller := NewRetentionController(wrapper.Storage, notificationController, RetentionPolicy{})
+	_, err := controller.ApplyPolicy()
+	assert.Error(t, err)
+
+	// the payloads of the old connections which are not marked or tagged are dropped
+	controller.SetPolicy(RetentionPolicy{PayloadsMaxAge: 2})
+	job, err := controller.ApplyPolicy()
+	require.NoError(t, err)
+	<-job.completed
+	job, isPresent := controller.GetJob(job.ID)
+	require.True(t, isPresent)
+	assert.Empty(t, job.Error)
+	assert.Equal(t, int64(2), job.DroppedPayloads)
+	assert.Equal(t, int64(2), job.Total)
+	assert.False(t, job.CompletedAt.IsZero())
+
+	for i, connection := range connections {
+		var result Connection
+		require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Filter(byID(connection.ID)).
+			First(&result))
+		assert.Equal(t, i == 0 || i == 4, result.PayloadDropped)
+		count, err := wrapper.Storage.Find(ConnectionStreams).Context(wrapper.Context).
+			Filter(OrderedDocument{{"connection_id", connection.ID}}).Count()
+		require.NoError(t, err)
+		assert.Equal(t, i == 0 || i == 4, count == 0)
+	}
+	// the contents of the files are kept while other files have the same content
+	count, err := wrapper.Storage.Find(FileContents).Context(wrapper.Context).Count()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	// the deleted connections are removed with their streams
+	job, err = controller.DeleteConnections(wrapper.Context, OrderedDocument{{"port_dst", 22}})
+	require.NoError(t, err)
+	<-job.completed
+	job, _ = controller.GetJob(job.ID)
+	assert.Equal(t, int64(1), job.DeletedConnections)
+	_, err = controller.DeleteConnections(wrapper.Context, OrderedDocument{{"port_dst", 22}})
+	assert.Error(t, err)
+	_, err = controller.DeleteConnections(wrapper.Context, OrderedDocument{})
+	assert.Error(t, err)
+	job, err = controller.DeleteConnections(wrapper.Context, byID(connections[3].ID))
+	require.NoError(t, err)
+	<-job.completed
+
+	count, err = wrapper.Storage.Find(Connections).Context(wrapper.Context).Count()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	count, err = wrapper.Storage.Find(ConnectionStreams).Context(wrapper.Context).Count()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+
+	// the payloads are dropped from the oldest until the maximum size is reached, or nothing can be dropped
+	oversized := Connection{ID: NewRowID(), ProcessedAt: old}
+	_, err = wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(oversized)
+	require.NoError(t, err)
+	controller.SetPolicy(RetentionPolicy{MaxStorageSize: 1})
+	job, err = controller.ApplyPolicy()
+	require.NoError(t, err)
+	<-job.completed
+	job, _ = controller.GetJob(job.ID)
+	assert.Empty(t, job.Error)
+	assert.Equal(t, int64(1), job.DroppedPayloads)
+	assert.Len(t, controller.GetJobs(), 4)
+
+	wrapper.Destroy(t)
+}
+
+func TestPruneRetentionJobs(t *testing.T) {
+	controller := &RetentionController{jobs: make(map[string]RetentionJob)}
+	start := time.Now()
+	running := RetentionJob{ID: "running", StartedAt: start}
+	controller.jobs[running.ID] = running
+	for i := 0; i < maxRetentionJobs+10; i++ {
+		job := RetentionJob{ID: NewRowID().Hex(), StartedAt: start.Add(time.Duration(i) * time.Second)}
+		job.CompletedAt = job.StartedAt
+		controller.jobs[job.ID] = job
+	}
+
+	// the running jobs are kept, even if they are the oldest
+	controller.pruneJobs()
+	jobs := controller.GetJobs()
+	assert.Len(t, jobs, maxRetentionJobs)
+	assert.Equal(t, start.Add(time.Duration(maxRetentionJobs+9)*time.Second), jobs[0].StartedAt)
+	_, isPresent := controller.GetJob(running.ID)
+	assert.True(t, isPresent)
+}
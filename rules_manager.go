@@ -60,6 +60,11 @@ type Filter struct {
 	MaxDuration   uint   `json:"max_duration" binding:"omitempty,gtefield=MinDuration" bson:"max_duration,omitempty"`
 	MinBytes      uint   `json:"min_bytes" bson:"min_bytes,omitempty"`
 	MaxBytes      uint   `json:"max_bytes" binding:"omitempty,gtefield=MinBytes" bson:"max_bytes,omitempty"`
+	TLSServerName string `json:"tls_server_name" bson:"tls_server_name,omitempty"`
+	JA3Hash       string `json:"ja3_hash" binding:"omitempty,hexadecimal,len=32" bson:"ja3_hash,omitempty"`
+	JA3SHash      string `json:"ja3s_hash" binding:"omitempty,hexadecimal,len=32" bson:"ja3s_hash,omitempty"`
+	ClientTeam    uint16 `json:"client_team" bson:"client_team,omitempty"`
+	ServerTeam    uint16 `json:"server_team" bson:"server_team,omitempty"`
 }
 
 type Rule struct {
@@ -84,6 +89,7 @@ type RulesManager interface {
 	GetRule(id RowID) (Rule, bool)
 	UpdateRule(context context.Context, id RowID, rule Rule) (bool, error)
 	GetRules() []Rule
+	SetFlag(context context.Context, flagRegex string) error
 	FillWithMatchedRules(connection *Connection, clientMatches map[uint][]PatternSlice, serverMatches map[uint][]PatternSlice)
 	DatabaseUpdateChannel() chan RulesDatabase
 }
@@ -97,6 +103,7 @@ type rulesManagerImpl struct {
 	mutex           sync.Mutex
 	databaseUpdated chan RulesDatabase
 	validate        *validator.Validate
+	flagRegex       string
 }
 
 func LoadRulesManager(storage Storage, flagRegex string) (RulesManager, error) {
@@ -114,6 +121,7 @@ func LoadRulesManager(storage Storage, flagRegex string) (RulesManager, error) {
 		mutex:           sync.Mutex{},
 		databaseUpdated: make(chan RulesDatabase, 1),
 		validate:        validator.New(),
+		flagRegex:       flagRegex,
 	}
 
 	for _, rule := range rules {
@@ -223,6 +231,69 @@ func (rm *rulesManagerImpl) GetRules() []Rule {
 	return rules
 }
 
+// SetFlag replaces the flag regex in the patterns of the rules which use it, like the default flag_in and flag_out
+// rules, and updates the rules database
+func (rm *rulesManagerImpl) SetFlag(context context.Context, flagRegex string) error {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	oldRegex, newRegex := fmt.Sprintf("/%s/", rm.flagRegex), fmt.Sprintf("/%s/", flagRegex)
+	// the regex is compiled before changing the rules, so that an invalid regex doesn't leave them half updated
+	pattern := Pattern{Regex: newRegex, Flags: RegexFlags{Utf8Mode: true}}
+	compiledPattern, err := pattern.BuildPattern()
+	if err != nil {
+		return err
+	}
+	if _, err := hyperscan.NewStreamDatabase(compiledPattern); err != nil {
+		return err
+	}
+
+	var updatedRules []Rule
+	for _, rule := range rm.rules {
+		updatedRule := rule
+		updatedRule.Patterns = append([]Pattern{}, rule.Patterns...)
+		updated := false
+		for i, pattern := range updatedRule.Patterns {
+			if pattern.Regex == oldRegex {
+				updatedRule.Patterns[i].Regex = newRegex
+				updated = true
+			}
+		}
+		if updated {
+			updatedRules = append(updatedRules, updatedRule)
+		}
+	}
+	if len(updatedRules) == 0 {
+		rm.flagRegex = flagRegex
+		return nil
+	}
+
+	// all the rules are validated before changing any of them, so that an invalid rule doesn't leave them half updated
+	compiledPatterns := make([][]*hyperscan.Pattern, len(updatedRules))
+	for i := range updatedRules {
+		if compiledPatterns[i], err = rm.validateRulePatterns(&updatedRules[i]); err != nil {
+			return fmt.Errorf("rule %s: %w", updatedRules[i].Name, err)
+		}
+	}
+	// the old patterns are kept in the database, since they are not used by the rules they can't match
+	for i := range updatedRules {
+		rm.addRuleLocal(&updatedRules[i], compiledPatterns[i])
+	}
+	if err := rm.generateDatabase(NewRowID()); err != nil {
+		return err
+	}
+
+	for _, rule := range updatedRules {
+		if _, err := rm.storage.Update(Rules).Context(context).Filter(OrderedDocument{{"_id", rule.ID}}).
+			One(UnorderedDocument{"patterns": rule.Patterns}); err != nil {
+			log.WithError(err).WithField("rule", rule).Panic("failed to update rule on database")
+		}
+	}
+	rm.flagRegex = flagRegex
+
+	return nil
+}
+
 func (rm *rulesManagerImpl) FillWithMatchedRules(connection *Connection, clientMatches map[uint][]PatternSlice,
 	serverMatches map[uint][]PatternSlice) {
 	rm.mutex.Lock()
@@ -253,6 +324,24 @@ func (rm *rulesManagerImpl) FillWithMatchedRules(connection *Connection, clientM
 			return rule.Filter.MaxBytes == 0 || uint(connection.ClientBytes+connection.ServerBytes) <=
 				rule.Filter.MinBytes
 		},
+		func(rule Rule) bool {
+			return rule.Filter.TLSServerName == "" || connection.TLS != nil &&
+				connection.TLS.ServerName == rule.Filter.TLSServerName
+		},
+		func(rule Rule) bool {
+			return rule.Filter.JA3Hash == "" || connection.TLS != nil &&
+				strings.EqualFold(connection.TLS.JA3Hash, rule.Filter.JA3Hash)
+		},
+		func(rule Rule) bool {
+			return rule.Filter.JA3SHash == "" || connection.TLS != nil &&
+				strings.EqualFold(connection.TLS.JA3SHash, rule.Filter.JA3SHash)
+		},
+		func(rule Rule) bool {
+			return rule.Filter.ClientTeam == 0 || connection.SourceTeamID == rule.Filter.ClientTeam
+		},
+		func(rule Rule) bool {
+			return rule.Filter.ServerTeam == 0 || connection.DestinationTeamID == rule.Filter.ServerTeam
+		},
 	}
 
 	connection.MatchedRules = make([]RowID, 0)
@@ -308,11 +397,22 @@ func (rm *rulesManagerImpl) validateAndAddRuleLocal(rule *Rule) error {
 		return errors.New("rule name must be unique")
 	}
 
-	newPatterns := make([]*hyperscan.Pattern, 0, len(rule.Patterns))
+	compiledPatterns, err := rm.validateRulePatterns(rule)
+	if err != nil {
+		return err
+	}
+	rm.addRuleLocal(rule, compiledPatterns)
+
+	return nil
+}
+
+// validateRulePatterns normalizes and compiles the patterns of the rule, without changing the rules manager
+func (rm *rulesManagerImpl) validateRulePatterns(rule *Rule) ([]*hyperscan.Pattern, error) {
+	compiledPatterns := make([]*hyperscan.Pattern, 0, len(rule.Patterns))
 	duplicatePatterns := make(map[string]bool)
 	for i, pattern := range rule.Patterns {
 		if err := rm.validate.Struct(pattern); err != nil {
-			return err
+			return nil, err
 		}
 
 		regex := pattern.Regex
@@ -326,35 +426,41 @@ func (rm *rulesManagerImpl) validateAndAddRuleLocal(rule *Rule) error {
 
 		compiledPattern, err := pattern.BuildPattern()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		regex = compiledPattern.String()
 		if _, isPresent := duplicatePatterns[regex]; isPresent {
-			return errors.New("duplicate pattern")
+			return nil, errors.New("duplicate pattern")
 		}
+		duplicatePatterns[regex] = true
+		compiledPatterns = append(compiledPatterns, compiledPattern)
+	}
+
+	return compiledPatterns, nil
+}
+
+// addRuleLocal adds a validated rule, with its compiled patterns which are not already in the database
+func (rm *rulesManagerImpl) addRuleLocal(rule *Rule, compiledPatterns []*hyperscan.Pattern) {
+	for i, compiledPattern := range compiledPatterns {
+		regex := compiledPattern.String()
 		if existingPattern, isPresent := rm.patternsIds[regex]; isPresent {
 			rule.Patterns[i].internalID = existingPattern
 			continue
 		}
 
-		id := len(rm.patternsIds) + len(newPatterns)
+		id := len(rm.patterns)
 		rule.Patterns[i].internalID = uint(id)
 		compiledPattern.Id = id
-		newPatterns = append(newPatterns, compiledPattern)
-		duplicatePatterns[regex] = true
+		rm.patterns = append(rm.patterns, compiledPattern)
+		regex = compiledPattern.String()
+		rm.patternsIds[regex[strings.IndexByte(regex, ':')+1:]] = uint(id)
 	}
 
-	startID := len(rm.patterns)
-	for id, pattern := range newPatterns {
-		rm.patterns = append(rm.patterns, pattern)
-		regex := pattern.String()
-		rm.patternsIds[regex[strings.IndexByte(regex, ':')+1:]] = uint(startID + id)
+	if previousRule, isPresent := rm.rules[rule.ID]; isPresent {
+		delete(rm.rulesByName, previousRule.Name)
 	}
-
 	rm.rules[rule.ID] = *rule
 	rm.rulesByName[rule.Name] = *rule
-
-	return nil
 }
 
 func (rm *rulesManagerImpl) generateDatabase(version RowID) error {
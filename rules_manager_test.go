@@ -206,6 +206,40 @@ func TestLoadAndUpdateRules(t *testing.T) {
 	wrapper.Destroy(t)
 }
 
+func TestSetFlag(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Rules)
+
+	rulesManager, err := LoadRulesManager(wrapper.Storage, "FLAG{test}")
+	require.NoError(t, err)
+	impl := rulesManager.(*rulesManagerImpl)
+	checkVersion(t, rulesManager, impl.rulesByName["flag_out"].ID)
+	checkVersion(t, rulesManager, impl.rulesByName["flag_in"].ID)
+	// after the update the rule would have the same pattern twice
+	conflictID, err := rulesManager.AddRule(wrapper.Context, Rule{Name: "conflict", Color: "#fff", Patterns: []Pattern{
+		{Regex: "FLAG{test}", Flags: RegexFlags{Utf8Mode: true}},
+		{Regex: "FLAG{new}", Flags: RegexFlags{Utf8Mode: true}},
+	}})
+	require.NoError(t, err)
+	checkVersion(t, rulesManager, conflictID)
+	rules := rulesManager.GetRules()
+
+	// no rule is changed if one of them can't be updated
+	assert.Error(t, rulesManager.SetFlag(wrapper.Context, "FLAG{new}"))
+	assert.Equal(t, rules, rulesManager.GetRules())
+	assert.Len(t, impl.rulesByName, 3)
+	assert.Equal(t, "FLAG{test}", impl.flagRegex)
+
+	assert.NoError(t, rulesManager.SetFlag(wrapper.Context, "FLAG{other}"))
+	assert.Equal(t, "/FLAG{other}/", impl.rulesByName["flag_out"].Patterns[0].Regex)
+	assert.Equal(t, "/FLAG{other}/", impl.rulesByName["flag_in"].Patterns[0].Regex)
+	assert.Equal(t, "/FLAG{other}/", impl.rulesByName["conflict"].Patterns[0].Regex)
+	assert.Len(t, impl.rulesByName, 3)
+	assert.Equal(t, "FLAG{other}", impl.flagRegex)
+
+	wrapper.Destroy(t)
+}
+
 func TestFillWithMatchedRules(t *testing.T) {
 	wrapper := NewTestStorageWrapper(t)
 	wrapper.AddCollection(Rules)
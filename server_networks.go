@@ -0,0 +1,118 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// ServerNetwork is a network of vulnboxes. If Ports is not empty, only the connections directed to these ports
+// are considered directed to the server, so the connections started by the vulnboxes are not mistaken for attacks
+type ServerNetwork struct {
+	Name    string   `json:"name" bson:"name,omitempty"`
+	Address string   `json:"address" binding:"required,ip|cidr" bson:"address"`
+	Ports   []uint16 `json:"ports" bson:"ports,omitempty"`
+}
+
+type ServerNetworks struct {
+	networks     []*net.IPNet
+	ports        []map[uint16]bool // the service ports of each network, nil if all the ports are services
+	servicePorts map[uint16]bool
+}
+
+// NewServerNetworks returns the server networks of the config, which are the ServerAddress network and the
+// additional ServerNetworks. It returns nil if an address is not valid
+func NewServerNetworks(config Config) *ServerNetworks {
+	serverNetworks := &ServerNetworks{servicePorts: make(map[uint16]bool)}
+	for _, serverNetwork := range append([]ServerNetwork{{Address: config.ServerAddress}}, config.ServerNetworks...) {
+		network := ParseIPNet(serverNetwork.Address)
+		if network == nil {
+			return nil
+		}
+
+		var ports map[uint16]bool
+		if len(serverNetwork.Ports) > 0 {
+			ports = make(map[uint16]bool, len(serverNetwork.Ports))
+			for _, port := range serverNetwork.Ports {
+				ports[port] = true
+				serverNetworks.servicePorts[port] = true
+			}
+		}
+		serverNetworks.networks = append(serverNetworks.networks, network)
+		serverNetworks.ports = append(serverNetworks.ports, ports)
+	}
+
+	return serverNetworks
+}
+
+// IsServer returns true if the address is in a server network which exposes the port
+func (sn *ServerNetworks) IsServer(address net.IP, port uint16) bool {
+	for i, network := range sn.networks {
+		if network.Contains(address) && (sn.ports[i] == nil || sn.ports[i][port]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsDstServer returns true if the destination of a flow is the server. When both or none of the sides are in a
+// server network the direction of the handshake is used, which is saved in handshakes to decide the next packets of
+// the same connection until a FIN or a RST closes it. For the connections without a known handshake, the side with a
+// service port or with the lower port is the server. tcp and handshakes can be nil
+func (sn *ServerNetworks) IsDstServer(flow StreamFlow, tcp *layers.TCP, handshakes map[StreamFlow]bool) bool {
+	srcPort, dstPort := binary.BigEndian.Uint16(flow[2].Raw()), binary.BigEndian.Uint16(flow[3].Raw())
+	isSrcServer := sn.IsServer(flow[0].Raw(), srcPort)
+	isDstServer := sn.IsServer(flow[1].Raw(), dstPort)
+	if isSrcServer != isDstServer {
+		return isDstServer
+	}
+
+	invertedFlow := StreamFlow{flow[1], flow[0], flow[3], flow[2]}
+	if tcp != nil && handshakes != nil {
+		if tcp.SYN {
+			if tcp.ACK {
+				handshakes[invertedFlow] = true
+			} else {
+				handshakes[flow] = true
+			}
+		} else if tcp.FIN || tcp.RST {
+			// the connection is closing, the few packets left are decided by the ports
+			defer func() {
+				delete(handshakes, flow)
+				delete(handshakes, invertedFlow)
+			}()
+		}
+	}
+	if handshakes[flow] {
+		return true
+	}
+	if handshakes[invertedFlow] {
+		return false
+	}
+	if tcp != nil && tcp.SYN {
+		return !tcp.ACK
+	}
+
+	if sn.servicePorts[srcPort] != sn.servicePorts[dstPort] {
+		return sn.servicePorts[dstPort]
+	}
+	return dstPort <= srcPort
+}
@@ -0,0 +1,67 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestServerNetworksIsDstServer(t *testing.T) {
+	serverNetworks := NewServerNetworks(Config{
+		ServerAddress:  "10.60.1.1",
+		ServerNetworks: []ServerNetwork{{Name: "services", Address: "10.61.1.0/24", Ports: []uint16{8080, 1337}}},
+	})
+	require.NotNil(t, serverNetworks)
+	assert.Nil(t, NewServerNetworks(Config{ServerAddress: "10.60.1.1", ServerNetworks: []ServerNetwork{{
+		Address: "invalid"}}}))
+
+	flow := func(src string, srcPort uint16, dst string, dstPort uint16) StreamFlow {
+		return StreamFlow{layers.NewIPEndpoint(net.ParseIP(src).To4()), layers.NewIPEndpoint(net.ParseIP(dst).To4()),
+			layers.NewTCPPortEndpoint(layers.TCPPort(srcPort)), layers.NewTCPPortEndpoint(layers.TCPPort(dstPort))}
+	}
+
+	// the address test is enough
+	assert.True(t, serverNetworks.IsDstServer(flow("10.60.2.1", 41000, "10.60.1.1", 80), nil, nil))
+	assert.False(t, serverNetworks.IsDstServer(flow("10.60.1.1", 80, "10.60.2.1", 41000), nil, nil))
+	assert.True(t, serverNetworks.IsDstServer(flow("10.60.2.1", 41000, "10.61.1.5", 1337), nil, nil))
+
+	// an attack from a vulnbox of the services network to another team is not mistaken for an incoming connection
+	handshakes := make(map[StreamFlow]bool)
+	attack := flow("10.61.1.5", 1024, "10.60.2.1", 2000)
+	assert.True(t, serverNetworks.IsDstServer(attack, &layers.TCP{SYN: true}, handshakes))
+	assert.False(t, serverNetworks.IsDstServer(flow("10.60.2.1", 2000, "10.61.1.5", 1024),
+		&layers.TCP{SYN: true, ACK: true}, handshakes))
+	assert.True(t, serverNetworks.IsDstServer(attack, &layers.TCP{ACK: true}, handshakes))
+	// the handshake is forgotten when the connection is closed
+	assert.False(t, serverNetworks.IsDstServer(flow("10.60.2.1", 2000, "10.61.1.5", 1024),
+		&layers.TCP{FIN: true, ACK: true}, handshakes))
+	assert.Empty(t, handshakes)
+	assert.True(t, serverNetworks.IsDstServer(attack, &layers.TCP{SYN: true}, handshakes))
+	assert.True(t, serverNetworks.IsDstServer(attack, &layers.TCP{RST: true}, handshakes))
+	assert.Empty(t, handshakes)
+
+	// traffic between two server networks, without the handshake, is decided by the service ports
+	assert.True(t, serverNetworks.IsDstServer(flow("10.60.1.1", 80, "10.61.1.5", 8080), &layers.TCP{ACK: true},
+		handshakes))
+	// and when neither side is a server, by the lower port
+	assert.False(t, serverNetworks.IsDstServer(flow("192.168.1.1", 443, "192.168.1.2", 51000), nil, nil))
+}
@@ -25,14 +25,27 @@ import (
 )
 
 type StatisticRecord struct {
-	RangeStart            time.Time        `json:"range_start" bson:"_id"`
-	RangeEnd              time.Time        `json:"range_end"`
+	RangeStart       time.Time `json:"range_start" bson:"_id"`
+	RangeEnd         time.Time `json:"range_end"`
+	StatisticMetrics `bson:",inline"`
+}
+
+type RoundStatisticRecord struct {
+	Round            int       `json:"round" bson:"_id"`
+	RoundStart       time.Time `json:"round_start" bson:"-"`
+	RoundEnd         time.Time `json:"round_end" bson:"-"`
+	StatisticMetrics `bson:",inline"`
+}
+
+type StatisticMetrics struct {
 	ConnectionsPerService map[uint16]int64 `json:"connections_per_service" bson:"connections_per_service"`
 	ClientBytesPerService map[uint16]int64 `json:"client_bytes_per_service" bson:"client_bytes_per_service"`
 	ServerBytesPerService map[uint16]int64 `json:"server_bytes_per_service" bson:"server_bytes_per_service"`
 	TotalBytesPerService  map[uint16]int64 `json:"total_bytes_per_service" bson:"total_bytes_per_service"`
 	DurationPerService    map[uint16]int64 `json:"duration_per_service" bson:"duration_per_service"`
 	MatchedRules          map[string]int64 `json:"matched_rules" bson:"matched_rules"`
+	ConnectionsPerTeam    map[uint16]int64 `json:"connections_per_team" bson:"connections_per_team"`
+	MatchedRulesPerTeam   map[uint16]map[string]int64 `json:"matched_rules_per_team" bson:"matched_rules_per_team"`
 }
 
 type StatisticsFilter struct {
@@ -40,19 +53,26 @@ type StatisticsFilter struct {
 	RangeTo   time.Time `form:"range_to"`
 	Ports     []uint16  `form:"ports"`
 	RulesIDs  []string  `form:"rules_ids"`
+	Teams     []uint16  `form:"teams"`
 	Metric    string    `form:"metric"`
+	MinRound  int       `form:"min_round"`
+	MaxRound  int       `form:"max_round" binding:"omitempty,gtefield=MinRound"`
 }
 
 type StatisticsController struct {
 	storage         Storage
 	servicesMetrics []string
+	teamsMetrics    []string
+	gameClock       GameClock
 }
 
-func NewStatisticsController(storage Storage) StatisticsController {
+func NewStatisticsController(storage Storage, gameClock GameClock) StatisticsController {
 	return StatisticsController{
-		storage: storage,
+		storage:   storage,
+		gameClock: gameClock,
 		servicesMetrics: []string{"connections_per_service", "client_bytes_per_service",
 			"server_bytes_per_service", "total_bytes_per_service", "duration_per_service"},
+		teamsMetrics: []string{"connections_per_team", "matched_rules_per_team"},
 	}
 }
 
@@ -65,6 +85,51 @@ func (sc *StatisticsController) GetStatistics(context context.Context, filter St
 	if !filter.RangeTo.IsZero() {
 		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$gt": filter.RangeTo}}})
 	}
+	query = sc.metricsProjection(query, filter)
+
+	if err := query.All(&statisticRecords); err != nil {
+		log.WithError(err).WithField("filter", filter).Error("failed to retrieve statistics")
+		return []StatisticRecord{}
+	}
+	if statisticRecords == nil {
+		return []StatisticRecord{}
+	}
+
+	for i, _ := range statisticRecords {
+		statisticRecords[i].RangeEnd = statisticRecords[i].RangeStart.Add(time.Minute)
+	}
+
+	return statisticRecords
+}
+
+// GetRoundStatistics returns the same metrics of GetStatistics, grouped by the rounds of the game
+func (sc *StatisticsController) GetRoundStatistics(c context.Context, filter StatisticsFilter) []RoundStatisticRecord {
+	var roundStatisticRecords []RoundStatisticRecord
+	query := sc.storage.Find(RoundStatistics).Context(c).Sort("_id", true)
+	if filter.MinRound > 0 {
+		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$gte": filter.MinRound}}})
+	}
+	if filter.MaxRound > 0 {
+		query = query.Filter(OrderedDocument{{"_id", UnorderedDocument{"$lte": filter.MaxRound}}})
+	}
+	query = sc.metricsProjection(query, filter)
+
+	if err := query.All(&roundStatisticRecords); err != nil {
+		log.WithError(err).WithField("filter", filter).Error("failed to retrieve round statistics")
+		return []RoundStatisticRecord{}
+	}
+	if roundStatisticRecords == nil {
+		return []RoundStatisticRecord{}
+	}
+
+	for i, record := range roundStatisticRecords {
+		roundStatisticRecords[i].RoundStart, roundStatisticRecords[i].RoundEnd = sc.gameClock.RoundRange(record.Round)
+	}
+
+	return roundStatisticRecords
+}
+
+func (sc *StatisticsController) metricsProjection(query FindOperation, filter StatisticsFilter) FindOperation {
 	for _, port := range filter.Ports {
 		for _, metric := range sc.servicesMetrics {
 			if filter.Metric == "" || filter.Metric == metric {
@@ -91,20 +156,22 @@ func (sc *StatisticsController) GetStatistics(context context.Context, filter St
 			query = query.Projection(OrderedDocument{{"matched_rules", 1}})
 		}
 	}
-
-	if err := query.All(&statisticRecords); err != nil {
-		log.WithError(err).WithField("filter", filter).Error("failed to retrieve statistics")
-		return []StatisticRecord{}
-	}
-	if statisticRecords == nil {
-		return []StatisticRecord{}
+	for _, team := range filter.Teams {
+		for _, metric := range sc.teamsMetrics {
+			if filter.Metric == "" || filter.Metric == metric {
+				query = query.Projection(OrderedDocument{{fmt.Sprintf("%s.%d", metric, team), 1}})
+			}
+		}
 	}
-
-	for i, _ := range statisticRecords {
-		statisticRecords[i].RangeEnd = statisticRecords[i].RangeStart.Add(time.Minute)
+	if filter.Metric != "" && len(filter.Teams) == 0 {
+		for _, metric := range sc.teamsMetrics {
+			if filter.Metric == metric {
+				query = query.Projection(OrderedDocument{{metric, 1}})
+			}
+		}
 	}
 
-	return statisticRecords
+	return query
 }
 
 func (sc *StatisticsController) GetTotalStatistics(context context.Context, filter StatisticsFilter) StatisticRecord {
@@ -162,6 +229,20 @@ func (sc *StatisticsController) GetTotalStatistics(context context.Context, filt
 		aggregateServicesMap(totalStats.TotalBytesPerService, record.TotalBytesPerService)
 		aggregateServicesMap(totalStats.DurationPerService, record.DurationPerService)
 		aggregateMatchedRulesMap(totalStats.MatchedRules, record.MatchedRules)
+		// the minutes without connections of teams don't have the teams metrics
+		if record.ConnectionsPerTeam != nil && totalStats.ConnectionsPerTeam == nil {
+			totalStats.ConnectionsPerTeam = make(map[uint16]int64)
+		}
+		aggregateServicesMap(totalStats.ConnectionsPerTeam, record.ConnectionsPerTeam)
+		for team, matchedRules := range record.MatchedRulesPerTeam {
+			if totalStats.MatchedRulesPerTeam == nil {
+				totalStats.MatchedRulesPerTeam = make(map[uint16]map[string]int64)
+			}
+			if totalStats.MatchedRulesPerTeam[team] == nil {
+				totalStats.MatchedRulesPerTeam[team] = make(map[string]int64)
+			}
+			aggregateMatchedRulesMap(totalStats.MatchedRulesPerTeam[team], matchedRules)
+		}
 	}
 
 	return totalStats
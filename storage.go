@@ -31,14 +31,29 @@ import (
 
 // Collections names
 const (
+	APIKeys           = "api_keys"
+	AuditLog          = "audit_log"
+	AuthTokens        = "auth_tokens"
+	Clusters          = "clusters"
+	Comments          = "comments"
 	Connections       = "connections"
 	ConnectionStreams = "connection_streams"
+	DNSQueries        = "dns_queries"
+	FileContents      = "file_contents"
+	Files             = "files"
 	ImportingSessions = "importing_sessions"
+	PassiveDNS        = "passive_dns"
+	RoundStatistics   = "round_statistics"
 	Rules             = "rules"
 	Searches          = "searches"
 	Settings          = "settings"
 	Services          = "services"
 	Statistics        = "statistics"
+	Tags              = "tags"
+	Teams             = "teams"
+	TLSKeyLog         = "tls_key_log"
+	TLSServerKeys     = "tls_server_keys"
+	Users             = "users"
 )
 
 var ZeroRowID [12]byte
@@ -48,6 +63,7 @@ type Storage interface {
 	Update(collectionName string) UpdateOperation
 	Find(collectionName string) FindOperation
 	Delete(collectionName string) DeleteOperation
+	DataSize(c context.Context) (int64, error)
 }
 
 type MongoStorage struct {
@@ -75,14 +91,29 @@ func NewMongoStorage(uri string, port int, database string) (*MongoStorage, erro
 
 	db := client.Database(database)
 	collections := map[string]*mongo.Collection{
+		APIKeys:           db.Collection(APIKeys),
+		AuditLog:          db.Collection(AuditLog),
+		AuthTokens:        db.Collection(AuthTokens),
+		Clusters:          db.Collection(Clusters),
+		Comments:          db.Collection(Comments),
 		Connections:       db.Collection(Connections),
 		ConnectionStreams: db.Collection(ConnectionStreams),
+		DNSQueries:        db.Collection(DNSQueries),
+		FileContents:      db.Collection(FileContents),
+		Files:             db.Collection(Files),
 		ImportingSessions: db.Collection(ImportingSessions),
+		PassiveDNS:        db.Collection(PassiveDNS),
+		RoundStatistics:   db.Collection(RoundStatistics),
 		Rules:             db.Collection(Rules),
 		Searches:          db.Collection(Searches),
 		Settings:          db.Collection(Settings),
 		Services:          db.Collection(Services),
 		Statistics:        db.Collection(Statistics),
+		Tags:              db.Collection(Tags),
+		Teams:             db.Collection(Teams),
+		TLSKeyLog:         db.Collection(TLSKeyLog),
+		TLSServerKeys:     db.Collection(TLSServerKeys),
+		Users:             db.Collection(Users),
 	}
 
 	if _, err := collections[Services].Indexes().CreateOne(ctx, mongo.IndexModel{
@@ -92,6 +123,20 @@ func NewMongoStorage(uri string, port int, database string) (*MongoStorage, erro
 		return nil, err
 	}
 
+	if _, err := collections[APIKeys].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"key_hash", 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Teams].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{"name", 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, err
+	}
+
 	if _, err := collections[ConnectionStreams].Indexes().CreateMany(ctx, []mongo.IndexModel{
 		{
 			Keys: bson.D{{"connection_id", -1}}, // descending
@@ -103,6 +148,23 @@ func NewMongoStorage(uri string, port int, database string) (*MongoStorage, erro
 		return nil, err
 	}
 
+	if _, err := collections[Comments].Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{"connection_id", -1}},
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := collections[Files].Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{"connection_id", -1}},
+		},
+		{
+			Keys: bson.D{{"sha256", 1}},
+		},
+	}); err != nil {
+		return nil, err
+	}
+
 	return &MongoStorage{
 		client:      client,
 		collections: collections,
@@ -182,6 +244,7 @@ type UpdateOperation interface {
 	One(update interface{}) (bool, error)
 	OneComplex(update interface{}) (bool, error)
 	Many(update interface{}) (int64, error)
+	ManyComplex(update interface{}) (int64, error)
 }
 
 type MongoUpdateOperation struct {
@@ -266,6 +329,19 @@ func (fo MongoUpdateOperation) Many(update interface{}) (int64, error) {
 	return result.ModifiedCount, nil
 }
 
+func (fo MongoUpdateOperation) ManyComplex(update interface{}) (int64, error) {
+	if fo.err != nil {
+		return 0, fo.err
+	}
+
+	result, err := fo.collection.UpdateMany(fo.ctx, fo.filter, update, fo.opt)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
+
 func (storage *MongoStorage) Update(collectionName string) UpdateOperation {
 	collection, ok := storage.collections[collectionName]
 	op := MongoUpdateOperation{
@@ -292,6 +368,7 @@ type FindOperation interface {
 	MaxTime(duration time.Duration) FindOperation
 	First(result interface{}) error
 	All(results interface{}) error
+	Count() (int64, error)
 }
 
 type MongoFindOperation struct {
@@ -386,6 +463,14 @@ func (fo MongoFindOperation) All(results interface{}) error {
 	return nil
 }
 
+func (fo MongoFindOperation) Count() (int64, error) {
+	if fo.err != nil {
+		return 0, fo.err
+	}
+
+	return fo.collection.CountDocuments(fo.ctx, fo.filter)
+}
+
 func (storage *MongoStorage) Find(collectionName string) FindOperation {
 	collection, ok := storage.collections[collectionName]
 	op := MongoFindOperation{
@@ -477,3 +562,16 @@ func (do MongoDeleteOperation) Many() error {
 
 	return nil
 }
+
+// DataSize returns the size in bytes of all the documents of the database, uncompressed and without the indexes
+func (storage *MongoStorage) DataSize(c context.Context) (int64, error) {
+	var stats struct {
+		DataSize float64 `bson:"dataSize"`
+	}
+	if err := storage.collections[Settings].Database().RunCommand(c, bson.D{{"dbStats", 1}}).
+		Decode(&stats); err != nil {
+		return 0, err
+	}
+
+	return int64(stats.DataSize), nil
+}
@@ -60,6 +60,10 @@ func TestOperationOnInvalidCollection(t *testing.T) {
 	assert.Zero(t, updated)
 	assert.Error(t, err)
 
+	updated, err = updateOp.ManyComplex(UnorderedDocument{"$set": simpleDoc})
+	assert.Zero(t, updated)
+	assert.Error(t, err)
+
 	findOp := wrapper.Storage.Find("invalid_collection").Context(wrapper.Context)
 	var result interface{}
 	err = findOp.First(&result)
@@ -71,6 +75,10 @@ func TestOperationOnInvalidCollection(t *testing.T) {
 	assert.Nil(t, results)
 	assert.Error(t, err)
 
+	count, err := findOp.Count()
+	assert.Zero(t, count)
+	assert.Error(t, err)
+
 	wrapper.Destroy(t)
 }
 
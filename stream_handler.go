@@ -29,6 +29,7 @@ import (
 const MaxDocumentSize = 1024 * 1024
 const InitialBlockCount = 1024
 const InitialPatternSliceSize = 8
+const HandshakeBufferSize = 16 * 1024
 
 // IMPORTANT:  If you use a StreamHandler, you MUST read ALL BYTES from it,
 // quickly.  Not reading available bytes will block TCP stream reassembly.  It's
@@ -50,6 +51,8 @@ type StreamHandler struct {
 	patternMatches  map[uint][]PatternSlice
 	scanner         Scanner
 	isClient        bool
+	firstBytes      []byte
+	documents       [][]byte // the payloads of the stored documents, kept to carve the files of the small streams
 }
 
 // NewReaderStream returns a new StreamHandler object.
@@ -112,6 +115,14 @@ func (sh *StreamHandler) Reassembled(reassembly []tcpassembly.Reassembly) {
 		sh.currentIndex += n
 		sh.streamLength += n
 
+		// keep the first bytes of the stream apart, they are used to parse handshakes (TLS)
+		if remaining := HandshakeBufferSize - len(sh.firstBytes); remaining > 0 {
+			if remaining > n {
+				remaining = n
+			}
+			sh.firstBytes = append(sh.firstBytes, r.Bytes[skip:skip+remaining]...)
+		}
+
 		if sh.patternStream != nil {
 			err = sh.patternStream.Scan(r.Bytes)
 			if err != nil {
@@ -137,7 +148,11 @@ func (sh *StreamHandler) ReassemblyComplete() {
 }
 
 func (sh *StreamHandler) resetCurrentDocument() {
-	sh.buffer.Reset()
+	if len(sh.documents) > 0 { // the payload of the stored document is still used
+		sh.buffer = new(bytes.Buffer)
+	} else {
+		sh.buffer.Reset()
+	}
 	sh.indexes = sh.indexes[:0]
 	sh.timestamps = sh.timestamps[:0]
 	sh.lossBlocks = sh.lossBlocks[:0]
@@ -149,24 +164,27 @@ func (sh *StreamHandler) resetCurrentDocument() {
 }
 
 func (sh *StreamHandler) onMatch(id uint, from uint64, to uint64, _ uint, _ interface{}) error {
-	patternSlices, isPresent := sh.patternMatches[id]
+	addPatternMatch(sh.patternMatches, id, from, to)
+	return nil
+}
+
+func addPatternMatch(patternMatches map[uint][]PatternSlice, id uint, from uint64, to uint64) {
+	patternSlices, isPresent := patternMatches[id]
 	if isPresent {
 		if len(patternSlices) > 0 {
 			lastElement := &patternSlices[len(patternSlices)-1]
 			if lastElement[0] == from { // make the regex greedy to match the maximum number of chars
 				lastElement[1] = to
-				return nil
+				return
 			}
 		}
 		// new from == new match
-		sh.patternMatches[id] = append(patternSlices, PatternSlice{from, to})
+		patternMatches[id] = append(patternSlices, PatternSlice{from, to})
 	} else {
 		patternSlices = make([]PatternSlice, 1, InitialPatternSliceSize)
 		patternSlices[0] = PatternSlice{from, to}
-		sh.patternMatches[id] = patternSlices
+		patternMatches[id] = patternSlices
 	}
-
-	return nil
 }
 
 func (sh *StreamHandler) storageCurrentDocument() {
@@ -189,5 +207,21 @@ func (sh *StreamHandler) storageCurrentDocument() {
 		log.WithError(err).Error("failed to insert connection stream")
 	} else {
 		sh.documentsIDs = append(sh.documentsIDs, streamID)
+		if sh.streamLength <= maxCarvedStreamSize {
+			sh.documents = append(sh.documents, sh.buffer.Bytes())
+		} else {
+			sh.documents = nil
+		}
+	}
+}
+
+// payload returns the whole payload of the stream, or nil if it is too big to be carved
+func (sh *StreamHandler) payload() []byte {
+	if sh.streamLength == 0 || sh.streamLength > maxCarvedStreamSize {
+		return nil
+	}
+	if len(sh.documents) == 1 {
+		return sh.documents[0]
 	}
+	return bytes.Join(sh.documents, nil)
 }
@@ -144,6 +144,7 @@ func TestReassemblingSingleDocument(t *testing.T) {
 	assert.Equal(t, lastTime, streamHandler.lastPacketSeen)
 	assert.Len(t, streamHandler.documentsIDs, 1)
 	assert.Equal(t, len(data), streamHandler.streamLength)
+	assert.Equal(t, data, streamHandler.payload())
 	assert.Len(t, streamHandler.patternMatches, 0)
 
 	assert.Equal(t, true, completed, "completed")
@@ -229,6 +230,8 @@ func TestReassemblingMultipleDocuments(t *testing.T) {
 	assert.Equal(t, lastTime, streamHandler.lastPacketSeen)
 	assert.Len(t, streamHandler.documentsIDs, 2)
 	assert.Equal(t, len(data), streamHandler.streamLength)
+	// the payloads of the stored documents are kept to carve the files
+	assert.Equal(t, data, streamHandler.payload())
 	assert.Len(t, streamHandler.patternMatches, 0)
 
 	assert.Equal(t, true, completed, "completed")
@@ -0,0 +1,146 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tag is a label defined by the users to triage the connections, like exploit, checker or todo
+type Tag struct {
+	Name  string `json:"name" binding:"required,max=32" bson:"_id"`
+	Color string `json:"color" binding:"hexcolor" bson:"color"`
+	Notes string `json:"notes" bson:"notes"`
+}
+
+type TagsController struct {
+	storage Storage
+	tags    map[string]Tag
+	mutex   sync.Mutex
+}
+
+func NewTagsController(storage Storage) *TagsController {
+	var result []Tag
+	if err := storage.Find(Tags).All(&result); err != nil {
+		log.WithError(err).Panic("failed to retrieve tags")
+		return nil
+	}
+
+	tags := make(map[string]Tag, len(result))
+	for _, tag := range result {
+		tags[tag.Name] = tag
+	}
+
+	return &TagsController{
+		storage: storage,
+		tags:    tags,
+	}
+}
+
+func (tc *TagsController) SetTag(c context.Context, tag Tag) error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	var upsert interface{}
+	if _, err := tc.storage.Update(Tags).Context(c).Filter(OrderedDocument{{"_id", tag.Name}}).
+		Upsert(&upsert).One(tag); err != nil {
+		return err
+	}
+	tc.tags[tag.Name] = tag
+	return nil
+}
+
+func (tc *TagsController) GetTags() map[string]Tag {
+	tc.mutex.Lock()
+	tags := make(map[string]Tag, len(tc.tags))
+	for _, tag := range tc.tags {
+		tags[tag.Name] = tag
+	}
+	tc.mutex.Unlock()
+	return tags
+}
+
+// DeleteTag removes a tag and removes it from all the connections
+func (tc *TagsController) DeleteTag(c context.Context, tag Tag) error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	if err := tc.storage.Delete(Tags).Context(c).Filter(OrderedDocument{{"_id", tag.Name}}).One(); err != nil {
+		return err
+	}
+	delete(tc.tags, tag.Name)
+
+	if _, err := tc.storage.Update(Connections).Context(c).Filter(OrderedDocument{{"tags", tag.Name}}).
+		ManyComplex(UnorderedDocument{"$pull": UnorderedDocument{"tags": tag.Name}}); err != nil {
+		log.WithError(err).WithField("tag", tag.Name).Error("failed to remove tag from connections")
+		return err
+	}
+	return nil
+}
+
+// CountConnections returns the number of connections with each tag
+func (tc *TagsController) CountConnections(c context.Context) map[string]int64 {
+	counts := make(map[string]int64)
+	for name := range tc.GetTags() {
+		count, err := tc.storage.Find(Connections).Context(c).Filter(OrderedDocument{{"tags", name}}).Count()
+		if err != nil {
+			log.WithError(err).WithField("tag", name).Panic("failed to count tagged connections")
+		}
+		counts[name] = count
+	}
+
+	return counts
+}
+
+// AddTags adds the tags to the connections, and returns the number of connections modified
+func (tc *TagsController) AddTags(c context.Context, ids []RowID, tags []string) (int64, error) {
+	return tc.addTags(c, OrderedDocument{{"_id", UnorderedDocument{"$in": ids}}}, tags)
+}
+
+// RemoveTags removes the tags from the connections, and returns the number of connections modified
+func (tc *TagsController) RemoveTags(c context.Context, ids []RowID, tags []string) (int64, error) {
+	return tc.removeTags(c, OrderedDocument{{"_id", UnorderedDocument{"$in": ids}}}, tags)
+}
+
+func (tc *TagsController) addTags(c context.Context, selection OrderedDocument, tags []string) (int64, error) {
+	if err := tc.checkTags(tags); err != nil {
+		return 0, err
+	}
+
+	return tc.storage.Update(Connections).Context(c).Filter(selection).
+		ManyComplex(UnorderedDocument{"$addToSet": UnorderedDocument{"tags": UnorderedDocument{"$each": tags}}})
+}
+
+func (tc *TagsController) removeTags(c context.Context, selection OrderedDocument, tags []string) (int64, error) {
+	return tc.storage.Update(Connections).Context(c).Filter(selection).
+		ManyComplex(UnorderedDocument{"$pull": UnorderedDocument{"tags": UnorderedDocument{"$in": tags}}})
+}
+
+func (tc *TagsController) checkTags(tags []string) error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	for _, name := range tags {
+		if _, isPresent := tc.tags[name]; !isPresent {
+			return fmt.Errorf("tag %s not exists", name)
+		}
+	}
+	return nil
+}
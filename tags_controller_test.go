@@ -0,0 +1,63 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestTagConnections(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(Tags)
+
+	ids := []RowID{NewRowID(), NewRowID(), NewRowID()}
+	for _, id := range ids {
+		_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(Connection{ID: id})
+		require.NoError(t, err)
+	}
+
+	controller := NewTagsController(wrapper.Storage)
+	require.NoError(t, controller.SetTag(wrapper.Context, Tag{Name: "exploit", Color: "#f00"}))
+	require.NoError(t, controller.SetTag(wrapper.Context, Tag{Name: "checker", Color: "#0f0"}))
+
+	_, err := controller.AddTags(wrapper.Context, ids, []string{"unknown"})
+	assert.Error(t, err)
+	modified, err := controller.AddTags(wrapper.Context, ids[:2], []string{"exploit", "checker"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), modified)
+	modified, err = controller.AddTags(wrapper.Context, ids[:1], []string{"exploit"})
+	require.NoError(t, err)
+	assert.Zero(t, modified)
+	modified, err = controller.RemoveTags(wrapper.Context, ids[1:], []string{"checker"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), modified)
+	assert.Equal(t, map[string]int64{"exploit": 2, "checker": 1}, controller.CountConnections(wrapper.Context))
+
+	// the deleted tags are removed from the connections
+	require.NoError(t, controller.DeleteTag(wrapper.Context, Tag{Name: "exploit"}))
+	var connection Connection
+	require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).Filter(byID(ids[0])).
+		First(&connection))
+	assert.Equal(t, []string{"checker"}, connection.Tags)
+	assert.Equal(t, map[string]int64{"checker": 1}, controller.CountConnections(wrapper.Context))
+
+	wrapper.Destroy(t)
+}
@@ -0,0 +1,182 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const teamIDPlaceholder = "{id}"
+
+// Team is a participant of an attack-defense competition. The addresses can be ips, cidrs or templates where
+// {id} is replaced with the team id, like 10.60.{id}.1 or 10.60.{id}.0/24. Teams are assigned to the connections
+// when they are imported
+type Team struct {
+	ID        uint16   `json:"id" binding:"required" bson:"_id"`
+	Name      string   `json:"name" binding:"min=3" bson:"name"`
+	Addresses []string `json:"addresses" binding:"required,min=1" bson:"addresses"`
+	Color     string   `json:"color" binding:"omitempty,hexcolor" bson:"color,omitempty"`
+	Notes     string   `json:"notes" bson:"notes"`
+}
+
+type TeamResolver interface {
+	ResolveTeam(address string) (Team, bool)
+}
+
+type TeamsController struct {
+	storage  Storage
+	teams    map[uint16]Team
+	networks map[uint16][]*net.IPNet
+	mutex    sync.Mutex
+}
+
+func NewTeamsController(storage Storage) *TeamsController {
+	var result []Team
+	if err := storage.Find(Teams).All(&result); err != nil {
+		log.WithError(err).Panic("failed to retrieve teams")
+		return nil
+	}
+
+	teamsController := &TeamsController{
+		storage:  storage,
+		teams:    make(map[uint16]Team, len(result)),
+		networks: make(map[uint16][]*net.IPNet, len(result)),
+	}
+	for _, team := range result {
+		networks, err := teamNetworks(team)
+		if err != nil {
+			log.WithError(err).WithField("team", team).Error("invalid team addresses")
+			continue
+		}
+		teamsController.teams[team.ID] = team
+		teamsController.networks[team.ID] = networks
+	}
+
+	return teamsController
+}
+
+func (tc *TeamsController) SetTeam(c context.Context, team Team) error {
+	networks, err := teamNetworks(team)
+	if err != nil {
+		return err
+	}
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	var upsert interface{}
+	updated, err := tc.storage.Update(Teams).Context(c).Filter(OrderedDocument{{"_id", team.ID}}).
+		Upsert(&upsert).One(team)
+	if err != nil {
+		return errors.New("duplicate name")
+	}
+	if updated || upsert != nil {
+		tc.teams[team.ID] = team
+		tc.networks[team.ID] = networks
+	}
+	return nil
+}
+
+func (tc *TeamsController) GetTeams() map[uint16]Team {
+	tc.mutex.Lock()
+	teams := make(map[uint16]Team, len(tc.teams))
+	for _, team := range tc.teams {
+		teams[team.ID] = team
+	}
+	tc.mutex.Unlock()
+	return teams
+}
+
+func (tc *TeamsController) DeleteTeam(c context.Context, team Team) error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	if err := tc.storage.Delete(Teams).Context(c).Filter(OrderedDocument{{"_id", team.ID}}).
+		One(); err != nil {
+		return err
+	}
+	delete(tc.teams, team.ID)
+	delete(tc.networks, team.ID)
+	return nil
+}
+
+// ResolveTeam returns the team which owns an address. If more teams match, the most specific network wins
+func (tc *TeamsController) ResolveTeam(address string) (Team, bool) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return Team{}, false
+	}
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	var bestTeam Team
+	bestPrefix := -1
+	for id, networks := range tc.networks {
+		for _, network := range networks {
+			if prefix, _ := network.Mask.Size(); network.Contains(ip) && prefix > bestPrefix {
+				bestTeam, bestPrefix = tc.teams[id], prefix
+			}
+		}
+	}
+
+	return bestTeam, bestPrefix >= 0
+}
+
+// assignTeams sets the teams of the client and of the server of a connection
+func assignTeams(resolver TeamResolver, connection *Connection) {
+	if team, found := resolver.ResolveTeam(connection.SourceIP); found {
+		connection.SourceTeamID = team.ID
+	}
+	if team, found := resolver.ResolveTeam(connection.DestinationIP); found {
+		connection.DestinationTeamID = team.ID
+	}
+}
+
+func teamNetworks(team Team) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(team.Addresses))
+	for _, address := range team.Addresses {
+		address = strings.ReplaceAll(address, teamIDPlaceholder, strconv.Itoa(int(team.ID)))
+		if strings.Contains(address, "/") {
+			_, network, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %s", address)
+			}
+			networks = append(networks, network)
+			continue
+		}
+
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", address)
+		}
+		bits := 8 * net.IPv6len
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip, bits = ipv4, 8*net.IPv4len
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return networks, nil
+}
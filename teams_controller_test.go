@@ -0,0 +1,60 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestResolveTeam(t *testing.T) {
+	teamsController := &TeamsController{teams: make(map[uint16]Team), networks: make(map[uint16][]*net.IPNet)}
+	for _, team := range []Team{
+		{ID: 1, Name: "team1", Addresses: []string{"10.60.{id}.0/24"}},
+		{ID: 2, Name: "team2", Addresses: []string{"10.60.{id}.1", "fd00::{id}"}},
+		{ID: 3, Name: "vulnbox", Addresses: []string{"10.60.1.1"}},
+	} {
+		networks, err := teamNetworks(team)
+		require.NoError(t, err)
+		teamsController.teams[team.ID] = team
+		teamsController.networks[team.ID] = networks
+	}
+
+	resolve := func(address string) uint16 {
+		team, _ := teamsController.ResolveTeam(address)
+		return team.ID
+	}
+	assert.Equal(t, uint16(1), resolve("10.60.1.42"))
+	assert.Equal(t, uint16(3), resolve("10.60.1.1")) // the most specific network wins
+	assert.Equal(t, uint16(2), resolve("10.60.2.1"))
+	assert.Equal(t, uint16(0), resolve("10.60.2.2"))
+	assert.Equal(t, uint16(2), resolve("fd00::2"))
+	assert.Equal(t, uint16(0), resolve("invalid"))
+
+	connection := Connection{SourceIP: "10.60.2.1", DestinationIP: "10.60.1.10"}
+	assignTeams(teamsController, &connection)
+	assert.Equal(t, uint16(2), connection.SourceTeamID)
+	assert.Equal(t, uint16(1), connection.DestinationTeamID)
+
+	_, err := teamNetworks(Team{ID: 4, Addresses: []string{"10.60.{id}.0/33"}})
+	assert.Error(t, err)
+	_, err = teamNetworks(Team{ID: 4, Addresses: []string{"10.60.{team}.1"}})
+	assert.Error(t, err)
+}
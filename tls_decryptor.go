@@ -0,0 +1,598 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	_ "crypto/sha512" // register SHA-384 for the TLS_AES_256_GCM_SHA384 cipher suites
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"github.com/eciavatta/caronte/parsers"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"sort"
+	"time"
+)
+
+const (
+	tlsRecordHeaderSize     = 5
+	tlsHandshakeHeaderSize  = 4
+	tlsMasterSecretSize     = 48
+	tlsChangeCipherSpec     = 20
+	tlsHandshake            = 22
+	tlsApplicationData      = 23
+	tlsClientKeyExchange    = 16
+	tlsExtendedMasterSecret = 23
+	tlsEncryptThenMAC       = 22
+)
+
+const (
+	tlsModeCBC = iota
+	tlsModeGCM
+	tlsModeChaCha20
+)
+
+type tlsCipherSuite struct {
+	mode   int
+	keyLen int
+	ivLen  int
+	macLen int
+	hash   crypto.Hash // the hash of the PRF (TLS 1.2) or of the HKDF (TLS 1.3)
+}
+
+var tlsCipherSuites = map[uint16]tlsCipherSuite{
+	tls.TLS_AES_128_GCM_SHA256:                        {tlsModeGCM, 16, 12, 0, crypto.SHA256},
+	tls.TLS_AES_256_GCM_SHA384:                        {tlsModeGCM, 32, 12, 0, crypto.SHA384},
+	tls.TLS_CHACHA20_POLY1305_SHA256:                  {tlsModeChaCha20, 32, 12, 0, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:               {tlsModeGCM, 16, 4, 0, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:               {tlsModeGCM, 32, 4, 0, crypto.SHA384},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:         {tlsModeGCM, 16, 4, 0, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:         {tlsModeGCM, 32, 4, 0, crypto.SHA384},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       {tlsModeGCM, 16, 4, 0, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       {tlsModeGCM, 32, 4, 0, crypto.SHA384},
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:   {tlsModeChaCha20, 32, 12, 0, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: {tlsModeChaCha20, 32, 12, 0, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:                  {tlsModeCBC, 16, 16, 20, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:                  {tlsModeCBC, 32, 16, 20, crypto.SHA256},
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:               {tlsModeCBC, 16, 16, 32, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:            {tlsModeCBC, 16, 16, 20, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:            {tlsModeCBC, 32, 16, 20, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          {tlsModeCBC, 16, 16, 20, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          {tlsModeCBC, 32, 16, 20, crypto.SHA256},
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:         {tlsModeCBC, 16, 16, 32, crypto.SHA256},
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       {tlsModeCBC, 16, 16, 32, crypto.SHA256},
+}
+
+// TLSKeyProvider gives access to the key material used to decrypt the TLS connections: the secrets of a key log
+// file (in the NSS format, as written by SSLKEYLOGFILE) and the private keys of the services.
+type TLSKeyProvider interface {
+	Secret(label string, clientRandom []byte) ([]byte, bool)
+	ServerKey(servicePort uint16) (*rsa.PrivateKey, bool)
+}
+
+// TLSStream is the ciphertext sent by one side of a connection, divided in blocks as in ConnectionStream
+type TLSStream struct {
+	Payload          []byte
+	BlocksIndexes    []int
+	BlocksTimestamps []time.Time
+}
+
+// TLSPlaintextBlock is the decrypted application data of the records ended in the same ciphertext block
+type TLSPlaintextBlock struct {
+	Payload   []byte
+	Timestamp time.Time
+}
+
+type tlsRecord struct {
+	header   []byte
+	fragment []byte
+	end      int
+}
+
+type tlsRecordDecrypter struct {
+	suite          tlsCipherSuite
+	version        uint16
+	aead           cipher.AEAD
+	block          cipher.Block
+	iv             []byte
+	sequence       uint64
+	encryptThenMAC bool
+}
+
+// DecryptTLSConnection decrypts the application data exchanged in a TLS 1.0-1.3 connection. The keys are taken from
+// the key log secrets or, for TLS 1.2 and older connections which use the RSA key exchange, derived from the
+// premaster secret decrypted with the private key of the service. Connections which use an (EC)DHE key exchange
+// can be decrypted only with a key log. Returns an error if the connection can't be decrypted.
+func DecryptTLSConnection(keys TLSKeyProvider, servicePort uint16, client, server TLSStream) (
+	[]TLSPlaintextBlock, []TLSPlaintextBlock, error) {
+	clientRecords, serverRecords := splitTLSRecords(client.Payload), splitTLSRecords(server.Payload)
+	clientHandshake, ok := parsers.ParseTLSHandshake(client.Payload)
+	if !ok || clientHandshake.ClientHello == nil {
+		return nil, nil, errors.New("client hello not found")
+	}
+	serverHandshake, ok := parsers.ParseTLSHandshake(server.Payload)
+	if !ok || serverHandshake.ServerHello == nil {
+		return nil, nil, errors.New("server hello not found")
+	}
+	clientHello, serverHello := clientHandshake.ClientHello, serverHandshake.ServerHello
+
+	suite, isPresent := tlsCipherSuites[serverHello.CipherSuite]
+	if !isPresent {
+		return nil, nil, errors.New("unsupported cipher suite " + tls.CipherSuiteName(serverHello.CipherSuite))
+	}
+	version := serverHello.Version
+	if serverHello.SupportedVersion != 0 {
+		version = serverHello.SupportedVersion
+	}
+
+	if version == tls.VersionTLS13 {
+		return decryptTLS13Connection(keys, suite, clientHello.Random, client, clientRecords, server, serverRecords)
+	}
+
+	masterSecret, isPresent := keys.Secret("CLIENT_RANDOM", clientHello.Random)
+	if !isPresent {
+		privateKey, isPresent := keys.ServerKey(servicePort)
+		if !isPresent {
+			return nil, nil, errors.New("master secret not found")
+		}
+		var err error
+		if masterSecret, err = tlsMasterSecretFromRSA(privateKey, version, suite, clientHello.Random,
+			serverHello, handshakeMessages(clientRecords), handshakeMessages(serverRecords)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var macLen, ivLen = suite.macLen, suite.ivLen
+	keyBlock := tlsPRF(version, suite.hash, masterSecret, "key expansion",
+		append(append([]byte{}, serverHello.Random...), clientHello.Random...), 2*macLen+2*suite.keyLen+2*ivLen)
+	clientKey := keyBlock[2*macLen : 2*macLen+suite.keyLen]
+	serverKey := keyBlock[2*macLen+suite.keyLen : 2*macLen+2*suite.keyLen]
+	clientIV := keyBlock[2*macLen+2*suite.keyLen : 2*macLen+2*suite.keyLen+ivLen]
+	serverIV := keyBlock[2*macLen+2*suite.keyLen+ivLen:]
+
+	encryptThenMAC := suite.mode == tlsModeCBC && containsUint16(serverHello.Extensions, tlsEncryptThenMAC)
+	clientDecrypter, err := newTLSRecordDecrypter(suite, version, clientKey, clientIV, encryptThenMAC)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverDecrypter, err := newTLSRecordDecrypter(suite, version, serverKey, serverIV, encryptThenMAC)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return decryptTLS12Records(clientDecrypter, client, clientRecords),
+		decryptTLS12Records(serverDecrypter, server, serverRecords), nil
+}
+
+// hasTLSKeys checks if there are secrets or a private key to decrypt a connection, before loading the streams
+func hasTLSKeys(keys TLSKeyProvider, servicePort uint16, clientBytes []byte) bool {
+	if _, isPresent := keys.ServerKey(servicePort); isPresent {
+		return true
+	}
+	handshake, ok := parsers.ParseTLSHandshake(clientBytes)
+	if !ok || handshake.ClientHello == nil {
+		return false
+	}
+	for label := range tlsKeyLogLabels {
+		if _, isPresent := keys.Secret(label, handshake.ClientHello.Random); isPresent {
+			return true
+		}
+	}
+	return false
+}
+
+func decryptTLS12Records(decrypter *tlsRecordDecrypter, stream TLSStream, records []tlsRecord) []TLSPlaintextBlock {
+	var blocks []TLSPlaintextBlock
+	var isEncrypted bool
+	for _, record := range records {
+		if !isEncrypted {
+			isEncrypted = record.header[0] == tlsChangeCipherSpec
+			continue
+		}
+
+		contentType, plaintext, err := decrypter.decrypt(record)
+		if err != nil {
+			break
+		}
+		if contentType == tlsApplicationData {
+			blocks = appendPlaintextBlock(blocks, stream, record, plaintext)
+		}
+	}
+
+	return blocks
+}
+
+func decryptTLS13Connection(keys TLSKeyProvider, suite tlsCipherSuite, clientRandom []byte,
+	client TLSStream, clientRecords []tlsRecord, server TLSStream, serverRecords []tlsRecord) (
+	[]TLSPlaintextBlock, []TLSPlaintextBlock, error) {
+	decryptSide := func(side string, stream TLSStream, records []tlsRecord) ([]TLSPlaintextBlock, error) {
+		var secrets [][]byte
+		for _, label := range []string{side + "_HANDSHAKE_TRAFFIC_SECRET", side + "_TRAFFIC_SECRET_0"} {
+			if secret, isPresent := keys.Secret(label, clientRandom); isPresent {
+				secrets = append(secrets, secret)
+			}
+		}
+		if len(secrets) == 0 {
+			return nil, errors.New("traffic secrets not found")
+		}
+
+		var decrypters []*tlsRecordDecrypter
+		for _, secret := range secrets {
+			key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+			iv := hkdfExpandLabel(suite.hash, secret, "iv", suite.ivLen)
+			decrypter, err := newTLSRecordDecrypter(suite, tls.VersionTLS13, key, iv, false)
+			if err != nil {
+				return nil, err
+			}
+			decrypters = append(decrypters, decrypter)
+		}
+
+		var blocks []TLSPlaintextBlock
+		for _, record := range records {
+			if record.header[0] != tlsApplicationData {
+				continue
+			}
+			contentType, plaintext, err := decrypters[0].decrypt(record)
+			// the handshake keys are replaced by the application keys after the finished message
+			for err != nil && len(decrypters) > 1 {
+				decrypters = decrypters[1:]
+				contentType, plaintext, err = decrypters[0].decrypt(record)
+			}
+			if err != nil {
+				break
+			}
+			if contentType == tlsApplicationData {
+				blocks = appendPlaintextBlock(blocks, stream, record, plaintext)
+			}
+		}
+
+		return blocks, nil
+	}
+
+	clientBlocks, err := decryptSide("CLIENT", client, clientRecords)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverBlocks, err := decryptSide("SERVER", server, serverRecords)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return clientBlocks, serverBlocks, nil
+}
+
+func tlsMasterSecretFromRSA(privateKey *rsa.PrivateKey, version uint16, suite tlsCipherSuite,
+	clientRandom []byte, serverHello *parsers.TLSServerHello, clientMessages, serverMessages [][]byte) ([]byte, error) {
+	var transcript []byte
+	var encryptedPremaster []byte
+	for i, message := range clientMessages {
+		transcript = append(transcript, message...)
+		if i == 0 { // the server flight follows the client hello
+			for _, serverMessage := range serverMessages {
+				transcript = append(transcript, serverMessage...)
+			}
+		}
+		if message[0] == tlsClientKeyExchange {
+			encryptedPremaster = message[tlsHandshakeHeaderSize:]
+			break
+		}
+	}
+	if encryptedPremaster == nil {
+		return nil, errors.New("client key exchange not found")
+	}
+	if version > tls.VersionSSL30 {
+		if len(encryptedPremaster) < 2 {
+			return nil, errors.New("invalid client key exchange")
+		}
+		encryptedPremaster = encryptedPremaster[2:]
+	}
+
+	premasterSecret, err := rsa.DecryptPKCS1v15(nil, privateKey, encryptedPremaster)
+	if err != nil {
+		return nil, err
+	}
+
+	if containsUint16(serverHello.Extensions, tlsExtendedMasterSecret) {
+		var sessionHash []byte
+		if version == tls.VersionTLS12 {
+			h := suite.hash.New()
+			h.Write(transcript)
+			sessionHash = h.Sum(nil)
+		} else {
+			md5Hash, sha1Hash := md5.Sum(transcript), sha1.Sum(transcript)
+			sessionHash = append(md5Hash[:], sha1Hash[:]...)
+		}
+		return tlsPRF(version, suite.hash, premasterSecret, "extended master secret", sessionHash,
+			tlsMasterSecretSize), nil
+	}
+
+	return tlsPRF(version, suite.hash, premasterSecret, "master secret",
+		append(append([]byte{}, clientRandom...), serverHello.Random...), tlsMasterSecretSize), nil
+}
+
+func newTLSRecordDecrypter(suite tlsCipherSuite, version uint16, key, iv []byte,
+	encryptThenMAC bool) (*tlsRecordDecrypter, error) {
+	decrypter := &tlsRecordDecrypter{
+		suite:          suite,
+		version:        version,
+		iv:             append([]byte{}, iv...),
+		encryptThenMAC: encryptThenMAC,
+	}
+
+	var err error
+	switch suite.mode {
+	case tlsModeGCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err == nil {
+			decrypter.aead, err = cipher.NewGCM(block)
+		}
+	case tlsModeChaCha20:
+		decrypter.aead, err = chacha20poly1305.New(key)
+	case tlsModeCBC:
+		decrypter.block, err = aes.NewCipher(key)
+	}
+
+	return decrypter, err
+}
+
+func (d *tlsRecordDecrypter) decrypt(record tlsRecord) (byte, []byte, error) {
+	var sequence [8]byte
+	binary.BigEndian.PutUint64(sequence[:], d.sequence)
+	contentType, fragment := record.header[0], record.fragment
+
+	var plaintext []byte
+	var err error
+	switch {
+	case d.version == tls.VersionTLS13:
+		plaintext, err = d.aead.Open(nil, d.xorNonce(sequence), fragment, record.header)
+		if err != nil {
+			return 0, nil, err
+		}
+		// the real content type is the last byte which is not padding
+		i := len(plaintext) - 1
+		for i >= 0 && plaintext[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return 0, nil, errors.New("missing inner content type")
+		}
+		contentType, plaintext = plaintext[i], plaintext[:i]
+	case d.suite.mode == tlsModeGCM || d.suite.mode == tlsModeChaCha20:
+		var nonce []byte
+		if d.suite.mode == tlsModeGCM {
+			if len(fragment) < 8 {
+				return 0, nil, errors.New("invalid record length")
+			}
+			nonce = append(append([]byte{}, d.iv...), fragment[:8]...)
+			fragment = fragment[8:]
+		} else {
+			nonce = d.xorNonce(sequence)
+		}
+		if len(fragment) < d.aead.Overhead() {
+			return 0, nil, errors.New("invalid record length")
+		}
+		plaintext, err = d.aead.Open(nil, nonce, fragment,
+			additionalData(sequence, record.header, len(fragment)-d.aead.Overhead()))
+		if err != nil {
+			return 0, nil, err
+		}
+	default:
+		if plaintext, err = d.decryptCBC(fragment); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	d.sequence++
+	return contentType, plaintext, nil
+}
+
+// decryptCBC decrypts the record and removes padding and mac, which is not verified: a wrong key produces a
+// wrong padding most of the time
+func (d *tlsRecordDecrypter) decryptCBC(fragment []byte) ([]byte, error) {
+	blockSize := d.block.BlockSize()
+	if d.encryptThenMAC {
+		if len(fragment) < d.suite.macLen {
+			return nil, errors.New("invalid record length")
+		}
+		fragment = fragment[:len(fragment)-d.suite.macLen]
+	}
+	iv := d.iv
+	if d.version >= tls.VersionTLS11 {
+		if len(fragment) < blockSize {
+			return nil, errors.New("invalid record length")
+		}
+		iv, fragment = fragment[:blockSize], fragment[blockSize:]
+	}
+	if len(fragment) == 0 || len(fragment)%blockSize != 0 {
+		return nil, errors.New("invalid record length")
+	}
+
+	plaintext := make([]byte, len(fragment))
+	cipher.NewCBCDecrypter(d.block, iv).CryptBlocks(plaintext, fragment)
+	if d.version < tls.VersionTLS11 { // TLS 1.0 uses the last ciphertext block as next iv
+		d.iv = append(d.iv[:0], fragment[len(fragment)-blockSize:]...)
+	}
+
+	paddingLen := int(plaintext[len(plaintext)-1]) + 1
+	macLen := d.suite.macLen
+	if d.encryptThenMAC {
+		macLen = 0
+	}
+	if paddingLen+macLen > len(plaintext) {
+		return nil, errors.New("invalid padding")
+	}
+	for _, b := range plaintext[len(plaintext)-paddingLen:] {
+		if int(b) != paddingLen-1 {
+			return nil, errors.New("invalid padding")
+		}
+	}
+
+	return plaintext[:len(plaintext)-paddingLen-macLen], nil
+}
+
+func (d *tlsRecordDecrypter) xorNonce(sequence [8]byte) []byte {
+	nonce := append([]byte{}, d.iv...)
+	for i, b := range sequence {
+		nonce[len(nonce)-8+i] ^= b
+	}
+	return nonce
+}
+
+func additionalData(sequence [8]byte, header []byte, plaintextLen int) []byte {
+	data := append(append([]byte{}, sequence[:]...), header[:3]...)
+	return append(data, byte(plaintextLen>>8), byte(plaintextLen))
+}
+
+func splitTLSRecords(payload []byte) []tlsRecord {
+	var records []tlsRecord
+	offset := 0
+	for len(payload)-offset >= tlsRecordHeaderSize {
+		length := int(binary.BigEndian.Uint16(payload[offset+3 : offset+5]))
+		end := offset + tlsRecordHeaderSize + length
+		if payload[offset+1] != 3 || end > len(payload) {
+			break
+		}
+		records = append(records, tlsRecord{
+			header:   payload[offset : offset+tlsRecordHeaderSize],
+			fragment: payload[offset+tlsRecordHeaderSize : end],
+			end:      end,
+		})
+		offset = end
+	}
+
+	return records
+}
+
+// handshakeMessages returns the plaintext handshake messages, headers included, sent before change_cipher_spec
+func handshakeMessages(records []tlsRecord) [][]byte {
+	var buffer []byte
+	for _, record := range records {
+		if record.header[0] == tlsChangeCipherSpec {
+			break
+		} else if record.header[0] == tlsHandshake {
+			buffer = append(buffer, record.fragment...)
+		}
+	}
+
+	var messages [][]byte
+	for len(buffer) >= tlsHandshakeHeaderSize {
+		length := tlsHandshakeHeaderSize + (int(buffer[1])<<16 | int(buffer[2])<<8 | int(buffer[3]))
+		if length > len(buffer) {
+			break
+		}
+		messages = append(messages, buffer[:length])
+		buffer = buffer[length:]
+	}
+
+	return messages
+}
+
+// appendPlaintextBlock groups the plaintext of the records ended in the same block of the ciphertext stream
+func appendPlaintextBlock(blocks []TLSPlaintextBlock, stream TLSStream, record tlsRecord,
+	plaintext []byte) []TLSPlaintextBlock {
+	if len(plaintext) == 0 {
+		return blocks
+	}
+	blockIndex := sort.SearchInts(stream.BlocksIndexes, record.end) - 1
+	if blockIndex < 0 {
+		blockIndex = 0
+	}
+	timestamp := stream.BlocksTimestamps[blockIndex]
+
+	if len(blocks) > 0 && blocks[len(blocks)-1].Timestamp.Equal(timestamp) {
+		blocks[len(blocks)-1].Payload = append(blocks[len(blocks)-1].Payload, plaintext...)
+		return blocks
+	}
+	return append(blocks, TLSPlaintextBlock{Payload: plaintext, Timestamp: timestamp})
+}
+
+// tlsPRF is the pseudorandom function defined in RFC 5246 (TLS 1.2) and RFC 2246 (TLS 1.0 and 1.1)
+func tlsPRF(version uint16, hashFunction crypto.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelAndSeed := append([]byte(label), seed...)
+	result := make([]byte, length)
+	if version >= tls.VersionTLS12 {
+		pHash(result, secret, labelAndSeed, hashFunction.New)
+		return result
+	}
+
+	half := (len(secret) + 1) / 2
+	pHash(result, secret[:half], labelAndSeed, md5.New)
+	sha1Result := make([]byte, length)
+	pHash(sha1Result, secret[len(secret)-half:], labelAndSeed, sha1.New)
+	for i := range result {
+		result[i] ^= sha1Result[i]
+	}
+	return result
+}
+
+func pHash(result, secret, seed []byte, hashFunction func() hash.Hash) {
+	h := hmac.New(hashFunction, secret)
+	h.Write(seed)
+	a := h.Sum(nil)
+
+	for j := 0; j < len(result); {
+		h.Reset()
+		h.Write(a)
+		h.Write(seed)
+		j += copy(result[j:], h.Sum(nil))
+
+		h.Reset()
+		h.Write(a)
+		a = h.Sum(nil)
+	}
+}
+
+// hkdfExpandLabel is the HKDF-Expand-Label function defined in RFC 8446 (TLS 1.3), with an empty context
+func hkdfExpandLabel(hashFunction crypto.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := append([]byte{byte(length >> 8), byte(length), byte(len(label))}, label...)
+	info = append(info, 0)
+
+	result := make([]byte, length)
+	if _, err := hkdf.Expand(hashFunction.New, secret, info).Read(result); err != nil {
+		log.WithError(err).WithField("label", label).Panic("failed to expand the tls secret")
+	}
+	return result
+}
+
+// plaintextLength returns the size of the decrypted stream
+func plaintextLength(blocks []TLSPlaintextBlock) int {
+	var length int
+	for _, block := range blocks {
+		length += len(block.Payload)
+	}
+	return length
+}
+
+func containsUint16(values []uint16, value uint16) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
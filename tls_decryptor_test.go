@@ -0,0 +1,172 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecryptTLSConnection(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "caronte.test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	require.NoError(t, err)
+	certificate := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privateKey}
+
+	testCases := []struct {
+		name        string
+		version     uint16
+		cipherSuite uint16
+		useKeyLog   bool
+	}{
+		{"tls13_keylog", tls.VersionTLS13, 0, true},
+		{"tls12_ecdhe_gcm_keylog", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, true},
+		{"tls12_ecdhe_chacha20_keylog", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, true},
+		{"tls12_ecdhe_cbc_keylog", tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, true},
+		{"tls12_rsa_gcm_server_key", tls.VersionTLS12, tls.TLS_RSA_WITH_AES_256_GCM_SHA384, false},
+		{"tls11_rsa_cbc_server_key", tls.VersionTLS11, tls.TLS_RSA_WITH_AES_128_CBC_SHA, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var keyLog bytes.Buffer
+			var cipherSuites []uint16
+			if tc.cipherSuite != 0 {
+				cipherSuites = []uint16{tc.cipherSuite}
+			}
+
+			clientConn, serverConn := net.Pipe()
+			client := &recordingConn{Conn: clientConn}
+			server := &recordingConn{Conn: serverConn}
+			serverDone := make(chan error)
+			go func() {
+				tlsServer := tls.Server(server, &tls.Config{
+					Certificates: []tls.Certificate{certificate},
+					MinVersion:   tls.VersionTLS10,
+					CipherSuites: cipherSuites,
+				})
+				buffer := make([]byte, 64)
+				n, err := tlsServer.Read(buffer)
+				if err == nil {
+					_, err = tlsServer.Write([]byte("response to " + string(buffer[:n])))
+				}
+				serverDone <- err
+			}()
+
+			tlsClient := tls.Client(client, &tls.Config{
+				InsecureSkipVerify: true,
+				MinVersion:         tc.version,
+				MaxVersion:         tc.version,
+				CipherSuites:       cipherSuites,
+				KeyLogWriter:       &keyLog,
+			})
+			_, err := tlsClient.Write([]byte("request"))
+			require.NoError(t, err)
+			response, err := ioutil.ReadAll(io.LimitReader(tlsClient, int64(len("response to request"))))
+			require.NoError(t, err)
+			require.NoError(t, <-serverDone)
+			_ = clientConn.Close()
+
+			keys := testTLSKeys{secrets: make(map[string][]byte), serverKeys: make(map[uint16]*rsa.PrivateKey)}
+			if tc.useKeyLog {
+				for _, line := range strings.Split(strings.TrimSpace(keyLog.String()), "\n") {
+					fields := strings.Fields(line)
+					clientRandom, _ := hex.DecodeString(fields[1])
+					keys.secrets[tlsSecretID(fields[0], clientRandom)], _ = hex.DecodeString(fields[2])
+				}
+			} else {
+				keys.serverKeys[443] = privateKey
+			}
+
+			clientBlocks, serverBlocks, err := DecryptTLSConnection(keys, 443,
+				testTLSStream(client), testTLSStream(server))
+			require.NoError(t, err)
+			assert.Equal(t, "request", string(joinPlaintextBlocks(clientBlocks)))
+			assert.Equal(t, "response to request", string(response))
+			assert.Equal(t, "response to request", string(joinPlaintextBlocks(serverBlocks)))
+
+			_, _, err = DecryptTLSConnection(testTLSKeys{}, 443, testTLSStream(client), testTLSStream(server))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDocumentPatternMatches(t *testing.T) {
+	patternMatches := map[uint][]PatternSlice{
+		0: {{2, 5}, {8, 14}, {25, 30}},
+		1: {{10, 20}},
+	}
+
+	assert.Equal(t, map[uint][]PatternSlice{0: {{2, 5}, {8, 10}}}, documentPatternMatches(patternMatches, 0, 10))
+	assert.Equal(t, map[uint][]PatternSlice{0: {{0, 4}}, 1: {{0, 10}}}, documentPatternMatches(patternMatches, 10, 10))
+	assert.Equal(t, map[uint][]PatternSlice{0: {{5, 10}}}, documentPatternMatches(patternMatches, 20, 10))
+	assert.Empty(t, documentPatternMatches(patternMatches, 30, 10))
+	assert.Empty(t, documentPatternMatches(nil, 0, 10))
+}
+
+type testTLSKeys struct {
+	secrets    map[string][]byte
+	serverKeys map[uint16]*rsa.PrivateKey
+}
+
+func (k testTLSKeys) Secret(label string, clientRandom []byte) ([]byte, bool) {
+	secret, isPresent := k.secrets[tlsSecretID(label, clientRandom)]
+	return secret, isPresent
+}
+
+func (k testTLSKeys) ServerKey(servicePort uint16) (*rsa.PrivateKey, bool) {
+	privateKey, isPresent := k.serverKeys[servicePort]
+	return privateKey, isPresent
+}
+
+func testTLSStream(conn *recordingConn) TLSStream {
+	timestamps := make([]time.Time, len(conn.indexes))
+	for i := range timestamps {
+		timestamps[i] = time.Unix(int64(i), 0)
+	}
+	return TLSStream{Payload: conn.written.Bytes(), BlocksIndexes: conn.indexes, BlocksTimestamps: timestamps}
+}
+
+func joinPlaintextBlocks(blocks []TLSPlaintextBlock) []byte {
+	var payload []byte
+	for _, block := range blocks {
+		payload = append(payload, block.Payload...)
+	}
+	return payload
+}
@@ -0,0 +1,361 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsKeyLogLabels = map[string]bool{
+	"CLIENT_RANDOM":                   true,
+	"CLIENT_HANDSHAKE_TRAFFIC_SECRET": true,
+	"SERVER_HANDSHAKE_TRAFFIC_SECRET": true,
+	"CLIENT_TRAFFIC_SECRET_0":         true,
+	"SERVER_TRAFFIC_SECRET_0":         true,
+}
+
+type TLSKeyLogEntry struct {
+	ID           string `bson:"_id"`
+	Label        string `bson:"label"`
+	ClientRandom string `bson:"client_random"`
+	Secret       string `bson:"secret"`
+}
+
+type TLSServerKey struct {
+	ServicePort uint16    `json:"service_port" binding:"required" bson:"_id"`
+	Key         string    `json:"key,omitempty" binding:"required" bson:"key"`
+	AddedAt     time.Time `json:"added_at" bson:"added_at"`
+}
+
+type TLSKeysController struct {
+	storage    Storage
+	secrets    map[string][]byte
+	serverKeys map[uint16]*rsa.PrivateKey
+	addedAt    map[uint16]time.Time
+	mutex      sync.Mutex
+}
+
+func NewTLSKeysController(storage Storage) *TLSKeysController {
+	var entries []TLSKeyLogEntry
+	if err := storage.Find(TLSKeyLog).All(&entries); err != nil {
+		log.WithError(err).Panic("failed to retrieve tls key log")
+	}
+	var serverKeys []TLSServerKey
+	if err := storage.Find(TLSServerKeys).All(&serverKeys); err != nil {
+		log.WithError(err).Panic("failed to retrieve tls server keys")
+	}
+
+	controller := &TLSKeysController{
+		storage:    storage,
+		secrets:    make(map[string][]byte, len(entries)),
+		serverKeys: make(map[uint16]*rsa.PrivateKey, len(serverKeys)),
+		addedAt:    make(map[uint16]time.Time, len(serverKeys)),
+	}
+	for _, entry := range entries {
+		if secret, err := hex.DecodeString(entry.Secret); err == nil {
+			controller.secrets[entry.ID] = secret
+		}
+	}
+	for _, serverKey := range serverKeys {
+		if privateKey, err := parseRSAPrivateKey([]byte(serverKey.Key)); err != nil {
+			log.WithError(err).WithField("service_port", serverKey.ServicePort).Error("invalid tls server key")
+		} else {
+			controller.serverKeys[serverKey.ServicePort] = privateKey
+			controller.addedAt[serverKey.ServicePort] = serverKey.AddedAt
+		}
+	}
+
+	return controller
+}
+
+// AddKeyLog adds the secrets of a key log file in the NSS format, the one written by browsers and by most TLS
+// libraries when the SSLKEYLOGFILE environment variable is set. Returns the number of new secrets.
+func (tkc *TLSKeysController) AddKeyLog(c context.Context, content []byte) (int, error) {
+	var entries []interface{}
+	var validLines int
+
+	tkc.mutex.Lock()
+	defer tkc.mutex.Unlock()
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || !tlsKeyLogLabels[fields[0]] {
+			continue // comments and unsupported secrets, like early traffic secrets
+		}
+		clientRandom, err := hex.DecodeString(fields[1])
+		if err != nil || len(clientRandom) != 32 {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil || len(secret) == 0 {
+			continue
+		}
+
+		validLines++
+		id := tlsSecretID(fields[0], clientRandom)
+		if _, isPresent := tkc.secrets[id]; isPresent {
+			continue
+		}
+		tkc.secrets[id] = secret
+		entries = append(entries, TLSKeyLogEntry{
+			ID:           id,
+			Label:        fields[0],
+			ClientRandom: hex.EncodeToString(clientRandom),
+			Secret:       hex.EncodeToString(secret),
+		})
+	}
+	if validLines == 0 {
+		return 0, errors.New("no valid secrets in key log")
+	}
+
+	if len(entries) > 0 {
+		if _, err := tkc.storage.Insert(TLSKeyLog).Context(c).StopOnFail(false).Many(entries); err != nil {
+			log.WithError(err).Error("failed to insert tls key log entries")
+		}
+	}
+
+	return len(entries), nil
+}
+
+func (tkc *TLSKeysController) SetServerKey(c context.Context, serverKey TLSServerKey) error {
+	privateKey, err := parseRSAPrivateKey([]byte(serverKey.Key))
+	if err != nil {
+		return err
+	}
+	serverKey.AddedAt = time.Now()
+
+	tkc.mutex.Lock()
+	defer tkc.mutex.Unlock()
+	var upsert interface{}
+	if _, err := tkc.storage.Update(TLSServerKeys).Context(c).Filter(OrderedDocument{{"_id", serverKey.ServicePort}}).
+		Upsert(&upsert).One(serverKey); err != nil {
+		log.WithError(err).WithField("service_port", serverKey.ServicePort).Panic("failed to save tls server key")
+	}
+	tkc.serverKeys[serverKey.ServicePort] = privateKey
+	tkc.addedAt[serverKey.ServicePort] = serverKey.AddedAt
+
+	return nil
+}
+
+func (tkc *TLSKeysController) DeleteServerKey(c context.Context, servicePort uint16) bool {
+	tkc.mutex.Lock()
+	defer tkc.mutex.Unlock()
+	if _, isPresent := tkc.serverKeys[servicePort]; !isPresent {
+		return false
+	}
+	if err := tkc.storage.Delete(TLSServerKeys).Context(c).Filter(OrderedDocument{{"_id", servicePort}}).
+		One(); err != nil {
+		log.WithError(err).WithField("service_port", servicePort).Panic("failed to delete tls server key")
+	}
+	delete(tkc.serverKeys, servicePort)
+	delete(tkc.addedAt, servicePort)
+
+	return true
+}
+
+// GetServerKeys returns the services with a private key, without the keys
+func (tkc *TLSKeysController) GetServerKeys() []TLSServerKey {
+	tkc.mutex.Lock()
+	defer tkc.mutex.Unlock()
+	serverKeys := make([]TLSServerKey, 0, len(tkc.serverKeys))
+	for servicePort := range tkc.serverKeys {
+		serverKeys = append(serverKeys, TLSServerKey{ServicePort: servicePort, AddedAt: tkc.addedAt[servicePort]})
+	}
+	return serverKeys
+}
+
+func (tkc *TLSKeysController) KeyLogSize() int {
+	tkc.mutex.Lock()
+	defer tkc.mutex.Unlock()
+	return len(tkc.secrets)
+}
+
+func (tkc *TLSKeysController) Secret(label string, clientRandom []byte) ([]byte, bool) {
+	tkc.mutex.Lock()
+	defer tkc.mutex.Unlock()
+	secret, isPresent := tkc.secrets[tlsSecretID(label, clientRandom)]
+	return secret, isPresent
+}
+
+func (tkc *TLSKeysController) ServerKey(servicePort uint16) (*rsa.PrivateKey, bool) {
+	tkc.mutex.Lock()
+	defer tkc.mutex.Unlock()
+	privateKey, isPresent := tkc.serverKeys[servicePort]
+	return privateKey, isPresent
+}
+
+// DecryptConnection decrypts an already imported connection, replacing the previous plaintext documents.
+// Matching the rules on the plaintext is not supported here: it happens only on the connections decrypted while
+// importing, when the keys are already known. The connection keeps the rules matched on the ciphertext, and the
+// stored plaintext has no pattern matches
+func (tkc *TLSKeysController) DecryptConnection(c context.Context, connection Connection) error {
+	if connection.TLS == nil {
+		return errors.New("not a tls connection")
+	}
+	loadStream := func(fromClient bool) TLSStream {
+		return loadTLSStream(c, tkc.storage, OrderedDocument{
+			{"connection_id", connection.ID},
+			{"from_client", fromClient},
+			{"decrypted", decryptedFilter(false)},
+		})
+	}
+
+	clientBlocks, serverBlocks, err := DecryptTLSConnection(tkc, connection.DestinationPort,
+		loadStream(true), loadStream(false))
+	if err != nil {
+		return err
+	}
+
+	if err := deleteAll(c, tkc.storage, ConnectionStreams, OrderedDocument{
+		{"connection_id", connection.ID},
+		{"decrypted", true},
+	}); err != nil {
+		log.WithError(err).WithField("connection_id", connection.ID).Panic("failed to delete decrypted streams")
+	}
+	storeDecryptedStream(tkc.storage, connection.ID, true, clientBlocks, nil)
+	storeDecryptedStream(tkc.storage, connection.ID, false, serverBlocks, nil)
+
+	if _, err := tkc.storage.Update(Connections).Context(c).Filter(byID(connection.ID)).
+		One(UnorderedDocument{
+			"tls.decrypted":              true,
+			"tls.decrypted_client_bytes": plaintextLength(clientBlocks),
+			"tls.decrypted_server_bytes": plaintextLength(serverBlocks),
+		}); err != nil {
+		log.WithError(err).WithField("connection_id", connection.ID).Panic("failed to update connection")
+	}
+
+	return nil
+}
+
+// loadTLSStream joins the ciphertext documents of one side of a connection
+func loadTLSStream(c context.Context, storage Storage, filter OrderedDocument) TLSStream {
+	var documents []ConnectionStream
+	if err := storage.Find(ConnectionStreams).Context(c).Filter(filter).Sort("document_index", true).
+		All(&documents); err != nil {
+		log.WithError(err).Panic("failed to get connection streams")
+	}
+
+	var stream TLSStream
+	for _, document := range documents {
+		for i, index := range document.BlocksIndexes {
+			stream.BlocksIndexes = append(stream.BlocksIndexes, len(stream.Payload)+index)
+			stream.BlocksTimestamps = append(stream.BlocksTimestamps, document.BlocksTimestamps[i])
+		}
+		stream.Payload = append(stream.Payload, document.Payload...)
+	}
+
+	return stream
+}
+
+// storeDecryptedStream saves the plaintext blocks as ConnectionStream documents flagged as decrypted. The pattern
+// matches are relative to the whole stream, each document keeps the ones relative to its payload
+func storeDecryptedStream(storage Storage, connectionID RowID, fromClient bool, blocks []TLSPlaintextBlock,
+	patternMatches map[uint][]PatternSlice) {
+	var streams []ConnectionStream
+	var offsets []uint64
+	var streamLength uint64
+	for _, block := range blocks {
+		if len(streams) == 0 || len(streams[len(streams)-1].Payload)+len(block.Payload) > MaxDocumentSize {
+			streams = append(streams, ConnectionStream{
+				ID:            NewRowID(),
+				ConnectionID:  connectionID,
+				FromClient:    fromClient,
+				DocumentIndex: len(streams),
+				Decrypted:     true,
+			})
+			offsets = append(offsets, streamLength)
+		}
+		streamLength += uint64(len(block.Payload))
+		stream := &streams[len(streams)-1]
+		stream.BlocksIndexes = append(stream.BlocksIndexes, len(stream.Payload))
+		stream.BlocksTimestamps = append(stream.BlocksTimestamps, block.Timestamp)
+		stream.BlocksLoss = append(stream.BlocksLoss, false)
+		stream.Payload = append(stream.Payload, block.Payload...)
+	}
+
+	documents := make([]interface{}, len(streams))
+	for i := range streams {
+		streams[i].PayloadString = strings.ToValidUTF8(string(streams[i].Payload), "")
+		streams[i].PatternMatches = documentPatternMatches(patternMatches, offsets[i],
+			uint64(len(streams[i].Payload)))
+		documents[i] = streams[i]
+	}
+	if len(documents) == 0 {
+		return
+	}
+	if _, err := storage.Insert(ConnectionStreams).Many(documents); err != nil {
+		log.WithError(err).WithField("connection_id", connectionID).Error("failed to insert decrypted streams")
+	}
+}
+
+// documentPatternMatches returns the matches which overlap the document starting at offset, cut to the document
+// and shifted to be relative to its start
+func documentPatternMatches(patternMatches map[uint][]PatternSlice, offset, length uint64) map[uint][]PatternSlice {
+	documentMatches := make(map[uint][]PatternSlice, len(patternMatches))
+	for id, slices := range patternMatches {
+		for _, slice := range slices {
+			if slice[1] <= offset || slice[0] >= offset+length {
+				continue
+			}
+			from, to := uint64(0), length
+			if slice[0] > offset {
+				from = slice[0] - offset
+			}
+			if slice[1] < offset+length {
+				to = slice[1] - offset
+			}
+			documentMatches[id] = append(documentMatches[id], PatternSlice{from, to})
+		}
+	}
+	return documentMatches
+}
+
+func tlsSecretID(label string, clientRandom []byte) string {
+	return label + " " + hex.EncodeToString(clientRandom)
+}
+
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("invalid pem key")
+	}
+	if privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return privateKey, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("invalid private key")
+	}
+	// with (EC)DHE the server key is used only to sign, it's not possible to decrypt without a key log
+	privateKey, isRSA := key.(*rsa.PrivateKey)
+	if !isRSA {
+		return nil, errors.New("only rsa private keys can be used to decrypt connections")
+	}
+	return privateKey, nil
+}
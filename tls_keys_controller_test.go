@@ -0,0 +1,143 @@
+/*
+ * This file is part of caronte (https://github.com/eciavatta/caronte).
+ * Copyright (c) 2020 Emiliano Ciavatta.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, version 3.
+ *
+ * This program is distributed in the hope that it will be useful, but
+ * WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+ * General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecryptConnection(t *testing.T) {
+	wrapper := NewTestStorageWrapper(t)
+	wrapper.AddCollection(Connections)
+	wrapper.AddCollection(ConnectionStreams)
+	wrapper.AddCollection(TLSKeyLog)
+	wrapper.AddCollection(TLSServerKeys)
+
+	var keyLog bytes.Buffer
+	client, server := recordTLSSession(t, &keyLog)
+	controller := NewTLSKeysController(wrapper.Storage)
+	connection := Connection{ID: NewRowID(), DestinationPort: 443, TLS: &TLSInfo{Version: "TLS 1.3"}}
+	_, err := wrapper.Storage.Insert(Connections).Context(wrapper.Context).One(connection)
+	require.NoError(t, err)
+	for _, side := range []struct {
+		fromClient bool
+		conn       *recordingConn
+	}{{true, client}, {false, server}} {
+		stream := testTLSStream(side.conn)
+		_, err := wrapper.Storage.Insert(ConnectionStreams).Context(wrapper.Context).One(ConnectionStream{
+			ID:               NewRowID(),
+			ConnectionID:     connection.ID,
+			FromClient:       side.fromClient,
+			Payload:          stream.Payload,
+			BlocksIndexes:    stream.BlocksIndexes,
+			BlocksTimestamps: stream.BlocksTimestamps,
+			BlocksLoss:       make([]bool, len(stream.BlocksIndexes)),
+		})
+		require.NoError(t, err)
+	}
+
+	assert.Error(t, controller.DecryptConnection(wrapper.Context, Connection{ID: NewRowID()}))
+	// without the keys the connection can't be decrypted
+	assert.Error(t, controller.DecryptConnection(wrapper.Context, connection))
+
+	_, err = controller.AddKeyLog(wrapper.Context, keyLog.Bytes())
+	require.NoError(t, err)
+	// the first decryption has no previous plaintext to replace, the second one replaces it
+	for i := 0; i < 2; i++ {
+		require.NoError(t, controller.DecryptConnection(wrapper.Context, connection))
+
+		var streams []ConnectionStream
+		require.NoError(t, wrapper.Storage.Find(ConnectionStreams).Context(wrapper.Context).Filter(OrderedDocument{
+			{"connection_id", connection.ID},
+			{"decrypted", true},
+		}).Sort("from_client", false).All(&streams))
+		require.Len(t, streams, 2)
+		assert.True(t, streams[0].FromClient)
+		assert.Equal(t, "request", string(streams[0].Payload))
+		assert.Equal(t, "response to request", string(streams[1].Payload))
+
+		var result Connection
+		require.NoError(t, wrapper.Storage.Find(Connections).Context(wrapper.Context).
+			Filter(byID(connection.ID)).First(&result))
+		require.NotNil(t, result.TLS)
+		assert.True(t, result.TLS.Decrypted)
+		assert.Equal(t, len("request"), result.TLS.DecryptedClientBytes)
+		assert.Equal(t, len("response to request"), result.TLS.DecryptedServerBytes)
+	}
+
+	wrapper.Destroy(t)
+}
+
+// recordTLSSession records a TLS 1.3 request and its response, writing the secrets to keyLog
+func recordTLSSession(t *testing.T, keyLog io.Writer) (*recordingConn, *recordingConn) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "caronte.test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	client := &recordingConn{Conn: clientConn}
+	server := &recordingConn{Conn: serverConn}
+	serverDone := make(chan error)
+	go func() {
+		tlsServer := tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		})
+		buffer := make([]byte, 64)
+		n, err := tlsServer.Read(buffer)
+		if err == nil {
+			_, err = tlsServer.Write([]byte("response to " + string(buffer[:n])))
+		}
+		serverDone <- err
+	}()
+
+	tlsClient := tls.Client(client, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+		KeyLogWriter:       keyLog,
+	})
+	_, err = tlsClient.Write([]byte("request"))
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(io.LimitReader(tlsClient, int64(len("response to request"))))
+	require.NoError(t, err)
+	require.NoError(t, <-serverDone)
+	_ = clientConn.Close()
+
+	return client, server
+}